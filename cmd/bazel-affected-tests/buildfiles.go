@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"path"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+)
+
+// changedBzlFiles returns the .bzl files among the changed files.
+func changedBzlFiles(files []string) []string {
+	var bzl []string
+	for _, f := range files {
+		if path.Ext(f) == ".bzl" {
+			bzl = append(bzl, f)
+		}
+	}
+	return bzl
+}
+
+// packageLoader is the subset of *query.BazelQuerier that .bzl expansion
+// depends on.
+type packageLoader interface {
+	LoadingPackages(bzlFiles []string) ([]string, error)
+}
+
+// expandBzlChanges returns filesByPkg with every package whose BUILD file
+// loads one of bzlFiles, directly or through other .bzl files, marked as
+// changed. A .bzl file otherwise maps only to its own directory's package,
+// which misses every package using its macros and rules. The added packages
+// are keyed to the .bzl files, which belong to no rule or source-file target
+// there, so rule granularity and file precision query them whole.
+//
+// The lookup depends only on BUILD and .bzl files, so it is cached under a
+// whole-repository cacheKey. Incremental keys are skipped: a BUILD file
+// anywhere could start loading the file.
+func expandBzlChanges(filesByPkg map[string][]string, bzlFiles []string, loader packageLoader, c *cache.Cache, cacheKey string, noCache bool) (map[string][]string, error) {
+	if len(bzlFiles) == 0 {
+		return filesByPkg, nil
+	}
+
+	useCache := !noCache && cacheKey != "" && !cache.IsIncrementalKey(cacheKey)
+	storeKey := labelSetCacheKey("bzl", bzlFiles)
+	pkgs, found := []string(nil), false
+	if useCache {
+		var unlock func()
+		pkgs, found, unlock = c.GetOrLock(cacheKey, storeKey)
+		defer unlock()
+	}
+	if !found {
+		var err error
+		if pkgs, err = loader.LoadingPackages(bzlFiles); err != nil {
+			return nil, err
+		}
+		if useCache {
+			if err := c.Set(cacheKey, storeKey, pkgs); err != nil {
+				slog.Debug("Failed to cache results", "entry", storeKey, "error", err)
+			}
+		}
+	}
+	slog.Debug("Packages loading changed .bzl files", "bzl_files", bzlFiles, "packages", len(pkgs), "cached", found)
+
+	expanded := make(map[string][]string, len(filesByPkg)+len(pkgs))
+	for pkg, files := range filesByPkg {
+		expanded[pkg] = files
+	}
+	for _, pkg := range pkgs {
+		expanded[pkg] = appendMissing(expanded[pkg], bzlFiles)
+	}
+	return expanded, nil
+}
+
+// appendMissing appends the values not already in list.
+func appendMissing(list, values []string) []string {
+	seen := make(map[string]bool, len(list))
+	for _, v := range list {
+		seen[v] = true
+	}
+	out := append([]string(nil), list...)
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+)
+
+// fakePackageLoader serves the packages loading any .bzl file from loads.
+type fakePackageLoader struct {
+	loads map[string][]string
+	calls int
+}
+
+func (f *fakePackageLoader) LoadingPackages(bzlFiles []string) ([]string, error) {
+	f.calls++
+	set := make(map[string]bool)
+	for _, b := range bzlFiles {
+		for _, pkg := range f.loads[b] {
+			set[pkg] = true
+		}
+	}
+	return sortedKeys(set), nil
+}
+
+func TestChangedBzlFiles(t *testing.T) {
+	got := changedBzlFiles([]string{"a/BUILD", "tools/defs.bzl", "a/x.go", "b/rules.bzl"})
+	if want := []string{"tools/defs.bzl", "b/rules.bzl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changedBzlFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestExpandBzlChanges(t *testing.T) {
+	loader := &fakePackageLoader{loads: map[string][]string{
+		"tools/defs.bzl": {"//app", "//lib", "//tools"},
+	}}
+	filesByPkg := map[string][]string{
+		"//tools": {"tools/defs.bzl"},
+		"//lib":   {"lib/x.go"},
+	}
+	c := cache.NewCache(t.TempDir())
+
+	got, err := expandBzlChanges(filesByPkg, []string{"tools/defs.bzl"}, loader, c, "k1", false)
+	if err != nil {
+		t.Fatalf("expandBzlChanges() error = %v", err)
+	}
+	want := map[string][]string{
+		"//app":   {"tools/defs.bzl"},
+		"//lib":   {"lib/x.go", "tools/defs.bzl"},
+		"//tools": {"tools/defs.bzl"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandBzlChanges() = %v, want %v", got, want)
+	}
+	if len(filesByPkg["//lib"]) != 1 {
+		t.Errorf("input map was modified: %v", filesByPkg)
+	}
+
+	// The second lookup is served from the cache.
+	if _, err := expandBzlChanges(filesByPkg, []string{"tools/defs.bzl"}, loader, c, "k1", false); err != nil {
+		t.Fatalf("expandBzlChanges() error = %v", err)
+	}
+	if loader.calls != 1 {
+		t.Errorf("LoadingPackages called %d times, want 1", loader.calls)
+	}
+}
+
+func TestExpandBzlChanges_NoBzlFiles(t *testing.T) {
+	loader := &fakePackageLoader{}
+	filesByPkg := map[string][]string{"//lib": {"lib/x.go"}}
+	got, err := expandBzlChanges(filesByPkg, nil, loader, cache.NewCache(t.TempDir()), "", true)
+	if err != nil {
+		t.Fatalf("expandBzlChanges() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, filesByPkg) || loader.calls != 0 {
+		t.Errorf("expandBzlChanges() = %v with %d lookups, want input unchanged", got, loader.calls)
+	}
+}
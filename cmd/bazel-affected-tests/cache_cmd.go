@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+const (
+	cacheActionGC    = "gc"
+	cacheActionStats = "stats"
+)
+
+type cacheCmdConfig struct {
+	action   string
+	debug    bool
+	cacheDir string
+	maxBytes int64
+	maxAge   time.Duration
+	maxKeys  int
+}
+
+func parseCacheFlags(args []string) (cacheCmdConfig, error) {
+	var cfg cacheCmdConfig
+	if len(args) == 0 || (args[0] != cacheActionGC && args[0] != cacheActionStats) {
+		return cfg, fmt.Errorf("cache requires a subcommand: %s or %s", cacheActionGC, cacheActionStats)
+	}
+	cfg.action = args[0]
+	fs := flag.NewFlagSet("cache "+cfg.action, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.BoolVar(&cfg.debug, "debug", false, "Enable debug output")
+	fs.StringVar(&cfg.cacheDir, "cache-dir", "", "Cache directory (default: $HOME/.cache/bazel-affected-tests)")
+	if cfg.action == cacheActionGC {
+		fs.Int64Var(&cfg.maxBytes, "max-bytes", 0, "Evict least recently used keys until the cache is at most this many bytes; overrides config")
+		fs.DurationVar(&cfg.maxAge, "max-age", 0, "Evict keys unused for longer than this (e.g. 168h); overrides config")
+		fs.IntVar(&cfg.maxKeys, "max-keys", 0, "Evict least recently used keys until at most this many remain; overrides config")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return cfg, fmt.Errorf("parsing cache flags: %w", err)
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if cfg.maxBytes < 0 || cfg.maxAge < 0 || cfg.maxKeys < 0 {
+		return cfg, errors.New("--max-bytes, --max-age and --max-keys must not be negative")
+	}
+	return cfg, nil
+}
+
+func runCache(args []string) int {
+	cfg, err := parseCacheFlags(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if cfg.debug {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	c := cache.NewCache(cfg.cacheDir)
+	if cfg.action == cacheActionStats {
+		stats, err := c.Stats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		writeCacheStats(os.Stdout, c.Dir(), stats)
+		return 0
+	}
+
+	limits := resolveGCLimits(cfg, loadRepoConfigIfAny())
+	if limits.Unlimited() {
+		fmt.Fprintln(os.Stderr, "Error: no cache limits set; pass --max-bytes, --max-age or --max-keys, "+
+			"or set max_cache_bytes, max_cache_age or max_cache_keys in the config file")
+		return 2
+	}
+	result, err := c.GC(limits, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "Removed %d keys (%s); kept %d keys (%s)\n",
+		result.RemovedKeys, formatBytes(result.RemovedBytes), result.KeptKeys, formatBytes(result.KeptBytes))
+	return 0
+}
+
+// loadRepoConfigIfAny loads the config of the enclosing repository, with the
+// profile selected by the environment. Cache maintenance also works outside a
+// repository, so failures yield nil.
+func loadRepoConfigIfAny() *config.Config {
+	repoRoot, err := git.RepoRoot(context.Background(), executor.NewBasicExecutor())
+	if err != nil {
+		slog.Debug("Not in a git repository; using cache limits from flags only", "error", err)
+		return nil
+	}
+	repoCfg, err := config.LoadConfigProfile(repoRoot, resolveProfile(cliConfig{}))
+	if err != nil {
+		slog.Warn("Ignoring unreadable config", "error", err)
+		return nil
+	}
+	return repoCfg
+}
+
+// cacheLimits returns the cache limits configured in repoCfg.
+func cacheLimits(repoCfg *config.Config) cache.Limits {
+	if repoCfg == nil {
+		return cache.Limits{}
+	}
+	return cache.Limits{
+		MaxBytes: repoCfg.MaxCacheBytes,
+		MaxAge:   repoCfg.ResolvedMaxCacheAge(),
+		MaxKeys:  repoCfg.MaxCacheKeys,
+	}
+}
+
+// resolveGCLimits returns the limits for cache gc, honoring precedence
+// CLI flag > config > unlimited for each limit.
+func resolveGCLimits(cfg cacheCmdConfig, repoCfg *config.Config) cache.Limits {
+	limits := cacheLimits(repoCfg)
+	if cfg.maxBytes > 0 {
+		limits.MaxBytes = cfg.maxBytes
+	}
+	if cfg.maxAge > 0 {
+		limits.MaxAge = cfg.maxAge
+	}
+	if cfg.maxKeys > 0 {
+		limits.MaxKeys = cfg.maxKeys
+	}
+	return limits
+}
+
+func writeCacheStats(w io.Writer, dir string, stats cache.Stats) {
+	var entries int
+	var bytes int64
+	for _, k := range stats.Keys {
+		entries += k.Entries
+		bytes += k.Bytes
+	}
+	fmt.Fprintf(w, "Cache directory: %s\n", dir)
+	fmt.Fprintf(w, "Keys:            %d\n", len(stats.Keys))
+	fmt.Fprintf(w, "Entries:         %d\n", entries)
+	fmt.Fprintf(w, "Disk usage:      %s\n", formatBytes(bytes))
+	lookups := stats.Hits + stats.Misses
+	if lookups == 0 {
+		fmt.Fprintln(w, "Hit rate:        n/a (no lookups recorded)")
+	} else {
+		fmt.Fprintf(w, "Hit rate:        %.1f%% (%d hits, %d misses)\n",
+			100*float64(stats.Hits)/float64(lookups), stats.Hits, stats.Misses)
+	}
+	if len(stats.Keys) > 0 {
+		newest, oldest := stats.Keys[0], stats.Keys[len(stats.Keys)-1]
+		fmt.Fprintf(w, "Last used:       %s (%s)\n", newest.LastUsed.Format(time.RFC3339), newest.Key)
+		fmt.Fprintf(w, "Least recent:    %s (%s)\n", oldest.LastUsed.Format(time.RFC3339), oldest.Key)
+	}
+}
+
+// formatBytes renders n in binary units, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
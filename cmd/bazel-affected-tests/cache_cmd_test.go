@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+)
+
+func TestParseCacheFlags(t *testing.T) {
+	cfg, err := parseCacheFlags([]string{"gc", "--max-age", "72h", "--max-keys", "5"})
+	if err != nil {
+		t.Fatalf("parseCacheFlags() error = %v", err)
+	}
+	if cfg.action != cacheActionGC || cfg.maxAge != 72*time.Hour || cfg.maxKeys != 5 {
+		t.Errorf("parseCacheFlags() = %+v", cfg)
+	}
+
+	for _, args := range [][]string{nil, {"prune"}, {"stats", "extra"}, {"stats", "--max-keys", "1"}, {"gc", "--max-keys", "-1"}} {
+		if _, err := parseCacheFlags(args); err == nil {
+			t.Errorf("parseCacheFlags(%v) error = nil, want error", args)
+		}
+	}
+}
+
+func TestResolveGCLimits(t *testing.T) {
+	repoCfg := &config.Config{MaxCacheBytes: 1000, MaxCacheAge: "24h", MaxCacheKeys: 10}
+	got := resolveGCLimits(cacheCmdConfig{maxKeys: 3}, repoCfg)
+	want := cache.Limits{MaxBytes: 1000, MaxAge: 24 * time.Hour, MaxKeys: 3}
+	if got != want {
+		t.Errorf("resolveGCLimits() = %+v, want %+v", got, want)
+	}
+	if !resolveGCLimits(cacheCmdConfig{}, nil).Unlimited() {
+		t.Error("resolveGCLimits() without flags or config should be unlimited")
+	}
+}
+
+func TestWriteCacheStats(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	stats := cache.Stats{
+		Keys: []cache.KeyUsage{
+			{Key: "aaa", Entries: 3, Bytes: 2048, LastUsed: now},
+			{Key: "bbb", Entries: 1, Bytes: 1024, LastUsed: now.Add(-time.Hour)},
+		},
+		Hits:   3,
+		Misses: 1,
+	}
+	var buf bytes.Buffer
+	writeCacheStats(&buf, "/cache", stats)
+	out := buf.String()
+	for _, want := range []string{"Keys:            2", "Entries:         4", "Disk usage:      3.0 KiB", "75.0% (3 hits, 1 misses)", "(bbb)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stats output missing %q:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	writeCacheStats(&buf, "/cache", cache.Stats{})
+	if !strings.Contains(buf.String(), "no lookups recorded") {
+		t.Errorf("empty stats output = %q", buf.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 20: "5.0 MiB"} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
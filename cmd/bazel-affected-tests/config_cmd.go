@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+	executor "github.com/jaeyeom/go-cmdexec"
+	"gopkg.in/yaml.v3"
+)
+
+const configActionDump = "dump"
+
+type configCmdConfig struct {
+	action  string
+	debug   bool
+	profile string
+	file    string
+}
+
+func parseConfigFlags(args []string) (configCmdConfig, error) {
+	var cfg configCmdConfig
+	if len(args) == 0 || args[0] != configActionDump {
+		return cfg, fmt.Errorf("config requires a subcommand: %s", configActionDump)
+	}
+	cfg.action = args[0]
+	fs := flag.NewFlagSet("config "+cfg.action, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.BoolVar(&cfg.debug, "debug", false, "Enable debug output")
+	fs.StringVar(&cfg.profile, "profile", "",
+		"Config profile to overlay on the top-level settings (default $"+profileEnvVar+")")
+	fs.StringVar(&cfg.file, "file", "",
+		"Show the config that applies to this file, including nested config files above it")
+	if err := fs.Parse(args[1:]); err != nil {
+		return cfg, fmt.Errorf("parsing config flags: %w", err)
+	}
+	if err := checkProfileFlag(cfg.profile); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	return cfg, nil
+}
+
+func runConfig(args []string) int {
+	cfg, err := parseConfigFlags(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if cfg.debug {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	if err := dumpConfig(os.Stdout, cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// dumpConfig prints the effective config of the enclosing repository, with
+// the selected profile applied and, given a file, the nested config files
+// above it merged in.
+func dumpConfig(w io.Writer, cfg configCmdConfig) error {
+	repoRoot, err := git.RepoRoot(context.Background(), executor.NewBasicExecutor())
+	if err != nil {
+		return fmt.Errorf("not a git repository (or any parent): %w", err)
+	}
+	profile := resolveProfile(cliConfig{profile: cfg.profile})
+	repoCfg, err := config.LoadConfigProfile(repoRoot, profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if repoCfg == nil {
+		return fmt.Errorf("no %s in %s", config.ConfigFileName, repoRoot)
+	}
+	file, err := repoRelativeFile(repoRoot, cfg.file)
+	if err != nil {
+		return err
+	}
+	return writeConfigDump(w, repoCfg, repoRoot, file, profile)
+}
+
+// repoRelativeFile returns file as a slash-separated path relative to
+// repoRoot. Relative paths are taken to be relative to repoRoot already.
+func repoRelativeFile(repoRoot, file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	if filepath.IsAbs(file) {
+		rel, err := filepath.Rel(repoRoot, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("--file %s is outside the repository %s", file, repoRoot)
+		}
+		file = rel
+	}
+	return path.Clean(filepath.ToSlash(file)), nil
+}
+
+// writeConfigDump writes the effective config for file (or the root config if
+// file is empty) as YAML, headed by comments naming the profile, the config
+// files it was merged from and, if it applies, the ignore_paths pattern that
+// skips file.
+func writeConfigDump(w io.Writer, repoCfg *config.Config, repoRoot, file, profile string) error {
+	// The root config alone is what applies to a file at the top level.
+	target := file
+	if target == "" {
+		target = config.ConfigFileName
+	}
+	effective, err := repoCfg.ForFile(repoRoot, target)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	sources := []string{config.ConfigFileName}
+	if file != "" {
+		fmt.Fprintf(w, "# Effective config for %s\n", file)
+		sources = append(sources, repoCfg.NestedFiles(path.Dir(file))...)
+	}
+	if profile != "" {
+		fmt.Fprintf(w, "# profile: %s\n", profile)
+	} else if names := repoCfg.ProfileNames(); len(names) > 0 {
+		fmt.Fprintf(w, "# profiles (none selected): %s\n", strings.Join(names, ", "))
+	}
+	fmt.Fprintf(w, "# sources: %s\n", strings.Join(sources, ", "))
+	if file != "" {
+		if pattern := effective.IgnorePattern(file); pattern != "" {
+			fmt.Fprintf(w, "# ignored by ignore_paths pattern %q\n", pattern)
+		}
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(effective); err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+	return enc.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+)
+
+func TestParseConfigFlags(t *testing.T) {
+	cfg, err := parseConfigFlags([]string{"dump", "--file", "services/payment/x.go", "--profile", "ci"})
+	if err != nil {
+		t.Fatalf("parseConfigFlags() error = %v", err)
+	}
+	if cfg.action != configActionDump || cfg.file != "services/payment/x.go" || cfg.profile != "ci" {
+		t.Errorf("parseConfigFlags() = %+v", cfg)
+	}
+
+	for _, args := range [][]string{nil, {"show"}, {"dump", "extra"}, {"dump", "--profile", "--debug"}} {
+		if _, err := parseConfigFlags(args); err == nil {
+			t.Errorf("parseConfigFlags(%v) error = nil, want error", args)
+		}
+	}
+}
+
+func TestRepoRelativeFile(t *testing.T) {
+	root := filepath.FromSlash("/repo")
+	tests := []struct {
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"services/payment/x.go", "services/payment/x.go", false},
+		{"./services//x.go", "services/x.go", false},
+		{filepath.Join(root, "services", "x.go"), "services/x.go", false},
+		{filepath.FromSlash("/elsewhere/x.go"), "", true},
+	}
+	for _, tt := range tests {
+		got, err := repoRelativeFile(root, tt.file)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("repoRelativeFile(%q) = %q, %v; want %q, error %v", tt.file, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestWriteConfigDump(t *testing.T) {
+	root := t.TempDir()
+	write := func(dir, content string) {
+		full := filepath.Join(root, dir)
+		if err := os.MkdirAll(full, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(full, config.ConfigFileName), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(".", "version: 1\nstrict: true\nprofiles:\n  ci:\n    query_timeout: 2m\n")
+	write("services/payment", "ignore_paths: [\"*.md\"]\nrules:\n  - patterns: [\"*.go\"]\n    targets: [\":lint_test\"]\n")
+
+	repoCfg, err := config.LoadConfigProfile(root, "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := writeConfigDump(&b, repoCfg, root, "services/payment/README.md", "ci"); err != nil {
+		t.Fatalf("writeConfigDump() error = %v", err)
+	}
+	want := `# Effective config for services/payment/README.md
+# profile: ci
+# sources: .bazel-affected-tests.yaml, services/payment/.bazel-affected-tests.yaml
+# ignored by ignore_paths pattern "services/payment/*.md"
+version: 1
+ignore_paths:
+  - services/payment/*.md
+strict: true
+query_timeout: 2m
+rules:
+  - patterns:
+      - services/payment/*.go
+    targets:
+      - //services/payment:lint_test
+`
+	if got := b.String(); got != want {
+		t.Errorf("writeConfigDump() =\n%s\nwant:\n%s", got, want)
+	}
+
+	repoCfg, err = config.LoadConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err := writeConfigDump(&b, repoCfg, root, "", ""); err != nil {
+		t.Fatalf("writeConfigDump() error = %v", err)
+	}
+	want = `# profiles (none selected): ci
+# sources: .bazel-affected-tests.yaml
+version: 1
+strict: true
+`
+	if got := b.String(); got != want {
+		t.Errorf("writeConfigDump() =\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+type explainConfig struct {
+	// cli holds the change-source and resolution flags shared with the main
+	// command, so the same resolve* helpers and getChangedFiles apply.
+	cli  cliConfig
+	test string
+}
+
+func parseExplainFlags(args []string) (explainConfig, error) {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bazel-affected-tests explain [flags] //test:target")
+		fs.PrintDefaults()
+	}
+	var cfg explainConfig
+	fs.BoolVar(&cfg.cli.debug, "debug", false, "Enable debug output")
+	fs.StringVar(&cfg.cli.filesFrom, "files-from", "", "Read changed file list from a file (use - for stdin)")
+	fs.BoolVar(&cfg.cli.staged, "staged", false, "Use staged files only (git diff --cached)")
+	fs.BoolVar(&cfg.cli.head, "head", false, "Use staged + unstaged files (git diff HEAD)")
+	fs.StringVar(&cfg.cli.base, "base", "", "Use all changes vs a ref (git diff <ref>)")
+	fs.IntVar(&cfg.cli.maxParentDepth, "max-parent-depth", maxParentDepthUnset,
+		"Max parent directories to walk looking for a BUILD file (default 1; -1 for unlimited)")
+	fs.DurationVar(&cfg.cli.queryTimeout, "query-timeout", 0,
+		"Per-Bazel-query wall-clock limit (e.g. 60s, 2m); overrides config (default 30s)")
+	fs.StringVar(&cfg.cli.profile, "profile", "",
+		"Config profile to overlay on the top-level settings (default $"+profileEnvVar+")")
+	fs.StringVar(&cfg.cli.testSizes, "test-size", "",
+		"Comma-separated test sizes to keep (small, medium, large, enormous); overrides config")
+	fs.StringVar(&cfg.cli.maxTimeout, "max-timeout", "",
+		"Longest test timeout to keep (short, moderate, long, eternal); overrides config")
+	fs.StringVar(&cfg.cli.granularity, "granularity", "",
+		"Affected-test selection granularity; explain only replays package; overrides config")
+	fs.StringVar(&cfg.cli.precision, "precision", "",
+		"Start rdeps from each changed file's package or source-file target; explain only replays package; overrides config")
+	fs.BoolVar(&cfg.cli.resolveRemoved, "resolve-removed", false,
+		"Resolve removed packages at the base revision and explain tests that depended on them")
+	if err := fs.Parse(args); err != nil {
+		return cfg, fmt.Errorf("parsing explain flags: %w", err)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "resolve-removed" {
+			cfg.cli.removedSet = true
+		}
+	})
+	if !validGranularity(cfg.cli.granularity) {
+		return cfg, fmt.Errorf("--granularity must be %q or %q, got %q",
+			config.GranularityPackage, config.GranularityRule, cfg.cli.granularity)
+	}
+	if !validPrecision(cfg.cli.precision) {
+		return cfg, fmt.Errorf("--precision must be %q or %q, got %q",
+			config.PrecisionPackage, config.PrecisionFile, cfg.cli.precision)
+	}
+	if err := checkProfileFlag(cfg.cli.profile); err != nil {
+		return cfg, err
+	}
+	for _, size := range splitList(cfg.cli.testSizes) {
+		if query.SizeRank(size) < 0 {
+			return cfg, fmt.Errorf("--test-size entries must be small, medium, large or enormous, got %q", size)
+		}
+	}
+	if cfg.cli.maxTimeout != "" && query.TimeoutRank(cfg.cli.maxTimeout) < 0 {
+		return cfg, fmt.Errorf("--max-timeout must be short, moderate, long or eternal, got %q", cfg.cli.maxTimeout)
+	}
+	if fs.NArg() != 1 {
+		return cfg, fmt.Errorf("explain takes exactly one test label, got %d arguments", fs.NArg())
+	}
+	cfg.test = fs.Arg(0)
+	if countSourceFlags(cfg.cli) > 1 {
+		return cfg, errors.New("--staged, --head, --base, and --files-from are mutually exclusive")
+	}
+	return cfg, nil
+}
+
+func runExplain(args []string) int {
+	cfg, err := parseExplainFlags(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if cfg.cli.debug {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	ex, err := executeExplain(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	writeExplanation(os.Stdout, ex)
+	return 0
+}
+
+func executeExplain(cfg explainConfig) (*explanation, error) {
+	repoRoot, err := git.RepoRoot(context.Background(), executor.NewBasicExecutor())
+	if err != nil {
+		return nil, fmt.Errorf("not a git repository (or any parent): %w", err)
+	}
+	changes, err := getChangedFiles(cfg.cli, isPipe())
+	if err != nil {
+		return nil, err
+	}
+	repoCfg, err := config.LoadConfigProfile(repoRoot, resolveProfile(cfg.cli))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if err := checkExplainable(cfg.cli, repoCfg); err != nil {
+		return nil, err
+	}
+
+	q := newQuerier(repoCfg)
+	q.SetQueryTimeout(resolveQueryTimeout(cfg.cli, repoCfg))
+	q.SetUniverse(resolveUniverse(cfg.cli, repoCfg))
+	_, files := partitionAbsolutePaths(git.AffectedPaths(changes))
+	if repoCfg != nil {
+		dirs := append(config.FileDirs(files), config.LabelDirs([]string{cfg.test})...)
+		if err := repoCfg.LoadNested(repoRoot, dirs); err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+	maxDepth := resolveMaxParentDepth(cfg.cli, repoCfg)
+	base, err := explainBaseRevision(cfg, repoCfg, repoRoot, changes, files, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	return explainTest(cfg.test, files, base, repoRoot, repoCfg, maxDepth, resolveTestSizeFilter(cfg.cli, repoCfg), q)
+}
+
+// checkExplainable rejects the selection modes explain does not replay: it
+// mirrors the package-level queries only, so under rule granularity or file
+// precision its answer would not be the one the main command gives.
+func checkExplainable(cfg cliConfig, repoCfg *config.Config) error {
+	if g := resolveGranularity(cfg, repoCfg); g != config.GranularityPackage {
+		return fmt.Errorf("explain only replays package granularity, not %q; pass --granularity=%s to explain the package-level selection",
+			g, config.GranularityPackage)
+	}
+	if p := resolvePrecision(cfg, repoCfg); p != config.PrecisionPackage {
+		return fmt.Errorf("explain only replays package precision, not %q; pass --precision=%s to explain the package-level selection",
+			p, config.PrecisionPackage)
+	}
+	return nil
+}
+
+// explainBase is what the main command learns from the base revision: its
+// BUILD layout, against which gone files are resolved, and, with
+// --resolve-removed, the reasons the test was selected as a dependent of a
+// removed package along with the files those packages account for.
+type explainBase struct {
+	buildDirs map[string]bool
+	gone      map[string]bool
+	removed   []explainReason
+	// resolved holds the files of removed packages, which the main command
+	// does not resolve in the working tree.
+	resolved map[string]bool
+}
+
+// explainBaseRevision resolves the change against the base revision the way
+// resolveTargets does, recording the removed-package selections of test
+// through a provenance recorder.
+func explainBaseRevision(cfg explainConfig, repoCfg *config.Config, repoRoot string, changes []git.FileChange, files []string, maxDepth int) (explainBase, error) {
+	var base explainBase
+	resolveRemoved := resolveRemovedPackages(cfg.cli, repoCfg)
+	if !needsBaseLayout(changes, resolveRemoved) {
+		return base, nil
+	}
+	buildDirs, err := baseBuildDirs(cfg.cli, repoRoot)
+	if err != nil {
+		if resolveRemoved {
+			return base, err
+		}
+		slog.Warn("Resolving deleted files against the working tree instead", "error", err)
+		return base, nil
+	}
+	base.buildDirs, base.gone = buildDirs, goneFiles(changes)
+	if !resolveRemoved {
+		return base, nil
+	}
+
+	live := files
+	if repoCfg != nil {
+		live = repoCfg.FilterIgnoredFiles(files)
+	}
+	prov := newProvenance(true)
+	_, remaining, err := resolveRemovedPackageTests(cfg.cli, repoCfg, repoRoot, buildDirs, changes, live, maxDepth, prov)
+	if err != nil {
+		return base, err
+	}
+	base.resolved = make(map[string]bool)
+	for _, f := range live {
+		if !slices.Contains(remaining, f) {
+			base.resolved[f] = true
+		}
+	}
+	for _, r := range prov.reasons[cfg.test] {
+		base.removed = append(base.removed, explainReason{
+			source: sourceRemovedPackage,
+			pkg:    strings.Join(r.Packages, ", "),
+			files:  r.Files,
+		})
+	}
+	return base, nil
+}
+
+// explainQuerier finds a dependency path from a test to a package, applies
+// the configured test kind and tag filters to a test, reads its size and
+// finds the packages loading changed .bzl files. It is satisfied by
+// *query.BazelQuerier.
+type explainQuerier interface {
+	sizeQuerier
+	packageLoader
+	DependencyPath(test, pkg string) ([]string, error)
+	PassesTestFilter(test string) (bool, error)
+}
+
+// explanation is the answer to "why is (or isn't) this test selected?".
+// reasons lists every way the changed files select the test; blockers lists
+// what stops it from being selected.
+type explanation struct {
+	test     string
+	reasons  []explainReason
+	blockers []string
+}
+
+func (e *explanation) selected() bool {
+	return len(e.reasons) > 0 && len(e.blockers) == 0
+}
+
+// explainReason is one way the test is selected. source is one of the
+// --output=json sources. path is the dependency chain for rdeps reasons and
+// patterns the matching config rule's patterns for config_rule reasons.
+type explainReason struct {
+	source   string
+	pkg      string
+	files    []string
+	path     []string
+	patterns []string
+}
+
+// explainTest replays the package-granularity selection pipeline of the main
+// command for a single test: ignore_paths, package resolution within the
+// depth cap (gone files against the base revision's layout in base), the
+// packages loading changed .bzl files, removed-package dependents recorded in
+// base, the same-package, sub-package and rdeps queries, the test kind and tag filter,
+// exclude patterns, the size and timeout filter, and config rules, whose
+// targets are not subject to those filters. When nothing selects the test, files dropped by ignore_paths or
+// the depth cap are checked too, so the answer names the filter that removed
+// them.
+func explainTest(test string, files []string, base explainBase, repoRoot string, repoCfg *config.Config, maxDepth int, sizeFilter testSizeFilter, q explainQuerier) (*explanation, error) {
+	ex := &explanation{test: test}
+	subpackages := repoCfg == nil || repoCfg.SubpackageQueryEnabled()
+
+	var live, ignored []string
+	for _, f := range files {
+		if repoCfg != nil && repoCfg.IgnorePattern(f) != "" {
+			ignored = append(ignored, f)
+			continue
+		}
+		live = append(live, f)
+	}
+	ex.reasons = append(ex.reasons, base.removed...)
+
+	var queried []string
+	for _, f := range live {
+		if !base.resolved[f] {
+			queried = append(queried, f)
+		}
+	}
+	filesByPkg, unmapped := groupChangedFiles(repoRoot, base.buildDirs, base.gone, queried, maxDepth)
+	filesByPkg, err := expandBzlChanges(filesByPkg, changedBzlFiles(queried), q, nil, "", true)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range sortedKeys(filesByPkg) {
+		r, err := explainPackage(q, test, pkg, subpackages)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			r.files = filesByPkg[pkg]
+			ex.reasons = append(ex.reasons, *r)
+		}
+	}
+
+	// Config rule targets are merged after the query results are filtered, so
+	// the test filter and exclude patterns only remove tests the queries
+	// selected.
+	if repoCfg == nil || !explainConfigRules(ex, repoCfg, live) {
+		if err := explainQueryFilters(ex, q, repoCfg, sizeFilter); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ex.reasons) == 0 {
+		blockers, err := explainFiltered(q, test, repoRoot, repoCfg, maxDepth, ignored, unmapped, subpackages)
+		if err != nil {
+			return nil, err
+		}
+		ex.blockers = append(ex.blockers, blockers...)
+		if len(ex.blockers) == 0 {
+			blocker := "no changed file's package contains the test or is one of its dependencies"
+			if repoCfg != nil && len(repoCfg.Universe) > 0 {
+				blocker += fmt.Sprintf(" (dependents are only found within universe %s)", strings.Join(repoCfg.Universe, " "))
+			}
+			ex.blockers = append(ex.blockers, blocker)
+		}
+	}
+	return ex, nil
+}
+
+// explainConfigRules adds the config rules that select ex.test and reports
+// whether there were any.
+func explainConfigRules(ex *explanation, repoCfg *config.Config, files []string) bool {
+	matched := false
+	for _, m := range repoCfg.MatchRules(files) {
+		if slices.Contains(m.Rule.Targets, ex.test) {
+			ex.reasons = append(ex.reasons, explainReason{source: sourceConfigRule, files: m.Files, patterns: m.Rule.Patterns})
+			matched = true
+		}
+	}
+	return matched
+}
+
+// explainQueryFilters adds a blocker for each filter of the main command that
+// removes ex.test from the query results: the test kind and tag filter,
+// exclude patterns, and the size and timeout filter. The filters that need a
+// query are only checked if a query selects the test.
+func explainQueryFilters(ex *explanation, q explainQuerier, repoCfg *config.Config, sizeFilter testSizeFilter) error {
+	if len(ex.reasons) > 0 {
+		ok, err := q.PassesTestFilter(ex.test)
+		if err != nil {
+			return fmt.Errorf("explaining %s: %w", ex.test, err)
+		}
+		if !ok {
+			ex.blockers = append(ex.blockers, "filtered out by "+describeTestFilter(repoCfg))
+		}
+	}
+	if repoCfg != nil {
+		if p := repoCfg.ExcludePattern(ex.test); p != "" {
+			ex.blockers = append(ex.blockers, fmt.Sprintf("excluded by exclude pattern %q", p))
+		}
+	}
+	if len(ex.reasons) > 0 && sizeFilter.enabled() {
+		blocker, err := explainSizeFilter(q, ex.test, sizeFilter)
+		if err != nil {
+			return err
+		}
+		if blocker != "" {
+			ex.blockers = append(ex.blockers, blocker)
+		}
+	}
+	return nil
+}
+
+// explainSizeFilter returns the blocker for test if the size and timeout
+// filter defers it, or "" if it is kept.
+func explainSizeFilter(q sizeQuerier, test string, f testSizeFilter) (string, error) {
+	attrs, err := q.QueryTestSizes([]string{test})
+	if err != nil {
+		return "", fmt.Errorf("explaining %s: querying test size: %w", test, err)
+	}
+	a, ok := attrs[test]
+	if !ok {
+		return "", nil
+	}
+	switch testDeferral(a, f.sizes, f.maxTimeout) {
+	case deferBySize:
+		return fmt.Sprintf("deferred by size: %s is not %s", a.Size, strings.Join(f.sizes, "/")), nil
+	case deferByTimeout:
+		return fmt.Sprintf("deferred by timeout: %s is longer than %s", a.Timeout, f.maxTimeout), nil
+	}
+	return "", nil
+}
+
+// describeTestFilter names the test kinds and tag filters of repoCfg.
+func describeTestFilter(repoCfg *config.Config) string {
+	kinds := []string{query.DefaultTestKind}
+	var desc []string
+	if repoCfg != nil {
+		if len(repoCfg.TestKinds) > 0 {
+			kinds = repoCfg.TestKinds
+		}
+		if len(repoCfg.IncludeTags) > 0 {
+			desc = append(desc, "include_tags "+strings.Join(repoCfg.IncludeTags, ", "))
+		}
+		if len(repoCfg.ExcludeTags) > 0 {
+			desc = append(desc, "exclude_tags "+strings.Join(repoCfg.ExcludeTags, ", "))
+		}
+	}
+	desc = append([]string{"test_kinds " + strings.Join(kinds, ", ")}, desc...)
+	return strings.Join(desc, "; ")
+}
+
+// explainPackage reports how pkg selects test, mirroring the three package
+// queries: the test lives in pkg, lives below pkg, or depends on a target in
+// pkg. It returns nil if pkg does not select the test.
+func explainPackage(q explainQuerier, test, pkg string, subpackages bool) (*explainReason, error) {
+	testPkg, _, _ := strings.Cut(test, ":")
+	if testPkg == pkg {
+		return &explainReason{source: sourceSamePackage, pkg: pkg}, nil
+	}
+	if subpackages && pkg != "//" && strings.HasPrefix(testPkg, pkg+"/") {
+		return &explainReason{source: sourceSubpackage, pkg: pkg}, nil
+	}
+	path, err := q.DependencyPath(test, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("explaining %s via %s: %w", test, pkg, err)
+	}
+	if path == nil {
+		return nil, nil
+	}
+	return &explainReason{source: sourceRdeps, pkg: pkg, path: path}, nil
+}
+
+// explainFiltered checks whether files dropped before the queries would have
+// selected test, returning one blocker per such file.
+func explainFiltered(q explainQuerier, test, repoRoot string, repoCfg *config.Config, maxDepth int, ignored, unmapped []string, subpackages bool) ([]string, error) {
+	var blockers []string
+	for _, f := range ignored {
+		pkg, ok := query.FindBazelPackage(repoRoot, f, maxDepth)
+		if !ok {
+			continue
+		}
+		r, err := explainPackage(q, test, pkg, subpackages)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			blockers = append(blockers, fmt.Sprintf("%s would select it via %s (%s) but matches ignore_paths pattern %q",
+				f, pkg, r.source, repoCfg.IgnorePattern(f)))
+		}
+	}
+	for _, f := range unmapped {
+		pkg, ok := query.FindBazelPackage(repoRoot, f, query.UnlimitedParentDepth)
+		if !ok {
+			continue
+		}
+		r, err := explainPackage(q, test, pkg, subpackages)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			blockers = append(blockers, fmt.Sprintf("%s would select it via %s (%s) but that BUILD file is beyond max-parent-depth=%d",
+				f, pkg, r.source, maxDepth))
+		}
+	}
+	return blockers, nil
+}
+
+func writeExplanation(w io.Writer, ex *explanation) {
+	if ex.selected() {
+		fmt.Fprintf(w, "%s is selected\n", ex.test)
+	} else {
+		fmt.Fprintf(w, "%s is not selected\n", ex.test)
+	}
+	for _, r := range ex.reasons {
+		switch r.source {
+		case sourceConfigRule:
+			fmt.Fprintf(w, "  config rule %s matched %s\n", strings.Join(r.patterns, ", "), strings.Join(r.files, ", "))
+		case sourceRdeps:
+			fmt.Fprintf(w, "  depends on %s (changed: %s)\n", r.pkg, strings.Join(r.files, ", "))
+			for i, node := range r.path {
+				if i == 0 {
+					fmt.Fprintf(w, "    %s\n", node)
+				} else {
+					fmt.Fprintf(w, "    -> %s\n", node)
+				}
+			}
+		case sourceSamePackage:
+			fmt.Fprintf(w, "  in changed package %s (changed: %s)\n", r.pkg, strings.Join(r.files, ", "))
+		case sourceSubpackage:
+			fmt.Fprintf(w, "  below changed package %s (changed: %s)\n", r.pkg, strings.Join(r.files, ", "))
+		case sourceRemovedPackage:
+			fmt.Fprintf(w, "  depended on %s at the base revision (changed: %s)\n", r.pkg, strings.Join(r.files, ", "))
+		}
+	}
+	for _, b := range ex.blockers {
+		fmt.Fprintf(w, "  not selected: %s\n", b)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+)
+
+// fakeExplainQuerier answers DependencyPath from a fixed table keyed by
+// "test pkg" and records the packages it was asked about. Tests listed in
+// filtered fail the test filter, sizes answers QueryTestSizes and loading
+// LoadingPackages.
+type fakeExplainQuerier struct {
+	paths    map[string][]string
+	filtered []string
+	sizes    map[string]query.TestSize
+	loading  []string
+	asked    []string
+}
+
+func (f *fakeExplainQuerier) LoadingPackages(bzlFiles []string) ([]string, error) {
+	return f.loading, nil
+}
+
+func (f *fakeExplainQuerier) DependencyPath(test, pkg string) ([]string, error) {
+	f.asked = append(f.asked, pkg)
+	return f.paths[test+" "+pkg], nil
+}
+
+func (f *fakeExplainQuerier) PassesTestFilter(test string) (bool, error) {
+	return !slices.Contains(f.filtered, test), nil
+}
+
+func (f *fakeExplainQuerier) QueryTestSizes(tests []string) (map[string]query.TestSize, error) {
+	return f.sizes, nil
+}
+
+func explainRepo(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, f := range []string{"lib/BUILD", "app/BUILD", "app/sub/BUILD", "docs/BUILD"} {
+		writeFile(t, filepath.Join(root, f), "", 0o600)
+	}
+	return root
+}
+
+func TestParseExplainFlags(t *testing.T) {
+	cfg, err := parseExplainFlags([]string{"--base", "main", "//app:app_test"})
+	if err != nil {
+		t.Fatalf("parseExplainFlags failed: %v", err)
+	}
+	if cfg.test != "//app:app_test" || cfg.cli.base != "main" {
+		t.Errorf("got test=%q base=%q", cfg.test, cfg.cli.base)
+	}
+	if cfg.cli.maxParentDepth != maxParentDepthUnset {
+		t.Errorf("maxParentDepth = %d, want unset", cfg.cli.maxParentDepth)
+	}
+
+	if _, err := parseExplainFlags(nil); err == nil {
+		t.Error("expected error without a test label")
+	}
+	if _, err := parseExplainFlags([]string{"--staged", "--head", "//app:app_test"}); err == nil {
+		t.Error("expected error for mutually exclusive source flags")
+	}
+	if _, err := parseExplainFlags([]string{"--profile", "--staged", "//app:app_test"}); err == nil {
+		t.Error("expected error for a flag given as the --profile value")
+	}
+}
+
+func TestExplainTest_Rdeps(t *testing.T) {
+	root := explainRepo(t)
+	q := &fakeExplainQuerier{paths: map[string][]string{
+		"//app:app_test //lib": {"//app:app_test", "//app:app", "//lib:lib"},
+	}}
+
+	ex, err := explainTest("//app:app_test", []string{"lib/a.go"}, explainBase{}, root, nil, 1, testSizeFilter{}, q)
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	if !ex.selected() {
+		t.Fatalf("expected test to be selected, blockers: %v", ex.blockers)
+	}
+	want := []explainReason{{
+		source: sourceRdeps,
+		pkg:    "//lib",
+		files:  []string{"lib/a.go"},
+		path:   []string{"//app:app_test", "//app:app", "//lib:lib"},
+	}}
+	if !reflect.DeepEqual(ex.reasons, want) {
+		t.Errorf("reasons = %+v, want %+v", ex.reasons, want)
+	}
+
+	var buf bytes.Buffer
+	writeExplanation(&buf, ex)
+	for _, s := range []string{"//app:app_test is selected", "depends on //lib", "-> //lib:lib"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("output missing %q:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestExplainTest_SameAndSubpackageSkipQuery(t *testing.T) {
+	root := explainRepo(t)
+	q := &fakeExplainQuerier{}
+
+	ex, err := explainTest("//app/sub:sub_test", []string{"app/sub/x.go", "app/y.go"}, explainBase{}, root, nil, 1, testSizeFilter{}, q)
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	var sources []string
+	for _, r := range ex.reasons {
+		sources = append(sources, r.source)
+	}
+	if want := []string{sourceSubpackage, sourceSamePackage}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("sources = %v, want %v", sources, want)
+	}
+	if len(q.asked) != 0 {
+		t.Errorf("expected no path queries, got %v", q.asked)
+	}
+}
+
+func TestExplainTest_Excluded(t *testing.T) {
+	root := explainRepo(t)
+	repoCfg := &config.Config{Version: 1, Exclude: []string{"//app:*"}}
+
+	ex, err := explainTest("//app:app_test", []string{"app/y.go"}, explainBase{}, root, repoCfg, 1, testSizeFilter{}, &fakeExplainQuerier{})
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	if ex.selected() {
+		t.Fatal("expected excluded test not to be selected")
+	}
+	if len(ex.blockers) != 1 || !strings.Contains(ex.blockers[0], `exclude pattern "//app:*"`) {
+		t.Errorf("blockers = %v, want exclude pattern blocker", ex.blockers)
+	}
+}
+
+func TestExplainTest_ConfigRuleNotExcluded(t *testing.T) {
+	root := explainRepo(t)
+	repoCfg := &config.Config{
+		Version: 1,
+		Exclude: []string{"//app:*"},
+		Rules:   []config.Rule{{Patterns: []string{"app/*.go"}, Targets: []string{"//app:app_test"}}},
+	}
+
+	ex, err := explainTest("//app:app_test", []string{"app/y.go"}, explainBase{}, root, repoCfg, 1, testSizeFilter{}, &fakeExplainQuerier{})
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	if !ex.selected() {
+		t.Fatalf("expected config rule target to be selected despite exclude, blockers: %v", ex.blockers)
+	}
+	if n := len(ex.reasons); n != 2 || ex.reasons[1].source != sourceConfigRule {
+		t.Errorf("reasons = %+v, want same_package and config_rule", ex.reasons)
+	}
+}
+
+func TestExplainTest_TestFilter(t *testing.T) {
+	root := explainRepo(t)
+	repoCfg := &config.Config{Version: 1, ExcludeTags: []string{"manual"}}
+	q := &fakeExplainQuerier{filtered: []string{"//app:manual_test"}}
+
+	ex, err := explainTest("//app:manual_test", []string{"app/y.go"}, explainBase{}, root, repoCfg, 1, testSizeFilter{}, q)
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	if ex.selected() {
+		t.Fatal("expected test removed by the tag filter not to be selected")
+	}
+	if want := "filtered out by test_kinds .*_test rule; exclude_tags manual"; !reflect.DeepEqual(ex.blockers, []string{want}) {
+		t.Errorf("blockers = %v, want [%s]", ex.blockers, want)
+	}
+}
+
+func TestExplainTest_SizeFilter(t *testing.T) {
+	root := explainRepo(t)
+	q := &fakeExplainQuerier{sizes: map[string]query.TestSize{
+		"//app:app_test": {Size: "large", Timeout: "long"},
+	}}
+
+	tests := []struct {
+		name   string
+		filter testSizeFilter
+		want   []string
+	}{
+		{"size", testSizeFilter{sizes: []string{"small", "medium"}}, []string{"deferred by size: large is not small/medium"}},
+		{"timeout", testSizeFilter{maxTimeout: "moderate"}, []string{"deferred by timeout: long is longer than moderate"}},
+		{"kept", testSizeFilter{sizes: []string{"large"}, maxTimeout: "long"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ex, err := explainTest("//app:app_test", []string{"app/y.go"}, explainBase{}, root, nil, 1, tt.filter, q)
+			if err != nil {
+				t.Fatalf("explainTest failed: %v", err)
+			}
+			if !reflect.DeepEqual(ex.blockers, tt.want) {
+				t.Errorf("blockers = %v, want %v", ex.blockers, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplainTest_IgnoredAndDepthCapped(t *testing.T) {
+	root := explainRepo(t)
+	repoCfg := &config.Config{Version: 1, IgnorePaths: []string{"docs/**"}}
+	q := &fakeExplainQuerier{paths: map[string][]string{
+		"//app:app_test //docs": {"//app:app_test", "//docs:docs"},
+		"//app:app_test //lib":  {"//app:app_test", "//lib:lib"},
+	}}
+
+	files := []string{"docs/guide.md", "lib/deep/er/x.go"}
+	ex, err := explainTest("//app:app_test", files, explainBase{}, root, repoCfg, 1, testSizeFilter{}, q)
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	if ex.selected() {
+		t.Fatal("expected test not to be selected")
+	}
+	if len(ex.blockers) != 2 {
+		t.Fatalf("blockers = %v, want 2", ex.blockers)
+	}
+	if !strings.Contains(ex.blockers[0], `ignore_paths pattern "docs/**"`) {
+		t.Errorf("blockers[0] = %q, want ignore_paths blocker", ex.blockers[0])
+	}
+	if !strings.Contains(ex.blockers[1], "max-parent-depth=1") {
+		t.Errorf("blockers[1] = %q, want depth cap blocker", ex.blockers[1])
+	}
+}
+
+func TestExplainTest_Unrelated(t *testing.T) {
+	root := explainRepo(t)
+	ex, err := explainTest("//app:app_test", []string{"lib/a.go"}, explainBase{}, root, nil, 1, testSizeFilter{}, &fakeExplainQuerier{})
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	if ex.selected() || len(ex.blockers) != 1 {
+		t.Errorf("got selected=%v blockers=%v, want one generic blocker", ex.selected(), ex.blockers)
+	}
+}
+
+func TestExplainTest_BzlLoadingPackage(t *testing.T) {
+	root := explainRepo(t)
+	writeFile(t, filepath.Join(root, "tools", "BUILD"), "", 0o600)
+	q := &fakeExplainQuerier{loading: []string{"//app"}}
+
+	ex, err := explainTest("//app:app_test", []string{"tools/defs.bzl"}, explainBase{}, root, nil, 1, testSizeFilter{}, q)
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	want := []explainReason{{source: sourceSamePackage, pkg: "//app", files: []string{"tools/defs.bzl"}}}
+	if !ex.selected() || !reflect.DeepEqual(ex.reasons, want) {
+		t.Errorf("reasons = %+v, blockers = %v; want %+v", ex.reasons, ex.blockers, want)
+	}
+}
+
+func TestExplainTest_GoneFileResolvedAtBase(t *testing.T) {
+	root := explainRepo(t)
+	// app/sub/old.go was deleted from //app; app/sub has since gained a BUILD
+	// file, so the working tree alone would blame //app/sub.
+	base := explainBase{
+		buildDirs: map[string]bool{"app": true, "lib": true},
+		gone:      map[string]bool{"app/sub/old.go": true},
+	}
+	ex, err := explainTest("//app:app_test", []string{"app/sub/old.go"}, base, root, nil, 1, testSizeFilter{}, &fakeExplainQuerier{})
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	want := []explainReason{{source: sourceSamePackage, pkg: "//app", files: []string{"app/sub/old.go"}}}
+	if !reflect.DeepEqual(ex.reasons, want) {
+		t.Errorf("reasons = %+v, want %+v", ex.reasons, want)
+	}
+}
+
+func TestExplainTest_RemovedPackage(t *testing.T) {
+	root := explainRepo(t)
+	base := explainBase{
+		removed:  []explainReason{{source: sourceRemovedPackage, pkg: "//gone", files: []string{"gone/a.go"}}},
+		resolved: map[string]bool{"gone/a.go": true},
+	}
+	q := &fakeExplainQuerier{}
+	ex, err := explainTest("//app:app_test", []string{"gone/a.go"}, base, root, nil, 1, testSizeFilter{}, q)
+	if err != nil {
+		t.Fatalf("explainTest failed: %v", err)
+	}
+	if !ex.selected() || !reflect.DeepEqual(ex.reasons, base.removed) {
+		t.Errorf("reasons = %+v, blockers = %v; want %+v", ex.reasons, ex.blockers, base.removed)
+	}
+	if len(q.asked) != 0 {
+		t.Errorf("files of removed packages should not be resolved in the working tree, asked %v", q.asked)
+	}
+
+	var buf bytes.Buffer
+	writeExplanation(&buf, ex)
+	if want := "depended on //gone at the base revision"; !strings.Contains(buf.String(), want) {
+		t.Errorf("output missing %q:\n%s", want, buf.String())
+	}
+}
+
+func TestCheckExplainable(t *testing.T) {
+	ruleCfg := &config.Config{Granularity: config.GranularityRule}
+	fileCfg := &config.Config{Precision: config.PrecisionFile}
+	tests := []struct {
+		name    string
+		cli     cliConfig
+		repoCfg *config.Config
+		wantErr bool
+	}{
+		{"defaults", cliConfig{}, nil, false},
+		{"rule granularity from config", cliConfig{}, ruleCfg, true},
+		{"overridden by flag", cliConfig{granularity: config.GranularityPackage}, ruleCfg, false},
+		{"file precision from config", cliConfig{}, fileCfg, true},
+		{"file precision overridden", cliConfig{precision: config.PrecisionPackage}, fileCfg, false},
+	}
+	for _, tt := range tests {
+		if err := checkExplainable(tt.cli, tt.repoCfg); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkExplainable() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
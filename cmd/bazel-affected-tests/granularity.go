@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/audit"
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+)
+
+// collectRuleTests resolves affected tests at rule granularity. Each changed
+// file is mapped to the rules that list it in a source-like attribute, and the
+// union of those owner rules is queried with a single rdeps. A package with
+// any changed file that no rule owns (a BUILD edit, unlisted data, a rule
+// query failure) falls back to the package-level queries, so the selection is
+// never narrower than what Bazel could actually depend on. The changed files
+// that Bazel knows as source-file targets start the rdeps query too, so rules
+// in other packages that reference them directly are reached as they are by
+// //pkg:*. With actionInputs,
+// a file is also owned by every rule that consumes it as an input; see
+// resolveOwnerRules.
+func collectRuleTests(filesByPkg map[string][]string, queriers []*query.BazelQuerier, c *cache.Cache, cacheKey string, noCache, batch, actionInputs bool, prov *provenance) ([]string, error) {
+	querier := queriers[0]
+	owners, fallback := resolveOwnerRules(querier, filesByPkg, actionInputs)
+	slog.Debug("Rule granularity resolved", "owner_rules", len(owners), "fallback_packages", len(fallback))
+
+	testsSet := make(map[string]bool)
+	if len(owners) > 0 {
+		tests, err := getRuleTests(owners, querier, c, cacheKey, noCache, prov)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tests {
+			testsSet[t] = true
+		}
+	}
+	if len(fallback) > 0 {
+		tests, err := collectPackageTests(fallback, queriers, c, cacheKey, noCache, batch, prov)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tests {
+			testsSet[t] = true
+		}
+	}
+
+	allTests := make([]string, 0, len(testsSet))
+	for t := range testsSet {
+		allTests = append(allTests, t)
+	}
+	return allTests, nil
+}
+
+// ownerQuerier is the subset of *query.BazelQuerier that owner resolution
+// depends on.
+type ownerQuerier interface {
+	QueryRules(pattern string) ([]query.Rule, error)
+	ConsumingRules(fileLabel string) ([]string, error)
+	SourceFileTargets(fileLabels []string) ([]string, error)
+}
+
+// resolveOwnerRules maps the changed files of each package to their owner
+// rules using the same ownership analysis as audit-packages. It returns the
+// sorted, deduplicated owner rules across all packages and the packages that
+// must fall back to package granularity.
+//
+// The owner rules are joined by the source-file labels of the changed files
+// themselves, since a rule in another package can reference a file directly
+// (exported with exports_files) without any rule in its own package owning
+// it. Those labels are checked with one SourceFileTargets query; if it fails,
+// every package falls back, as the rule set alone could under-select.
+//
+// With actionInputs, ownership also covers every input of a rule (templates,
+// codegen inputs, custom rule attributes), and a file no rule in its own
+// package consumes is resolved to the rules anywhere in the repository that
+// take it as a direct input. Generated code is then traced back to its
+// generator's inputs, and the rdeps of the generator select the tests of the
+// generated code's consumers.
+func resolveOwnerRules(querier ownerQuerier, filesByPkg map[string][]string, actionInputs bool) (owners, fallback []string) {
+	ownerSet := make(map[string]bool)
+	var fileLabels []string
+	for _, pkg := range sortedKeys(filesByPkg) {
+		rules, err := querier.QueryRules(pkg + ":*")
+		if err != nil {
+			slog.Warn("Failed to list rules, falling back to package granularity", "package", pkg, "error", err)
+			fallback = append(fallback, pkg)
+			continue
+		}
+		fileOwners := audit.FileOwners(rules, pkg)
+		if actionInputs {
+			for path, o := range audit.InputOwners(rules, pkg) {
+				fileOwners[path] = append(fileOwners[path], o...)
+			}
+		}
+		var lookup func(file string) []string
+		if actionInputs {
+			lookup = func(f string) []string { return consumingRules(querier, pkg, f) }
+		}
+		pkgOwners, ok := ownersForFiles(fileOwners, filesByPkg[pkg], lookup)
+		if !ok {
+			fallback = append(fallback, pkg)
+			continue
+		}
+		for _, o := range pkgOwners {
+			ownerSet[o] = true
+		}
+		for _, f := range filesByPkg[pkg] {
+			if label := query.SourceFileLabel(pkg, f); label != "" && !git.IsBuildFile(f) {
+				fileLabels = append(fileLabels, label)
+			}
+		}
+	}
+	if len(fileLabels) > 0 {
+		known, err := querier.SourceFileTargets(fileLabels)
+		if err != nil {
+			slog.Warn("Failed to list changed source files, falling back to package granularity", "error", err)
+			return nil, sortedKeys(filesByPkg)
+		}
+		for _, l := range known {
+			ownerSet[l] = true
+		}
+	}
+	return sortedKeys(ownerSet), fallback
+}
+
+// consumingRules returns the rules anywhere in the repository that take file
+// as a direct input. BUILD and .bzl edits change rule definitions rather than
+// inputs, so they have none. Errors, including Bazel not knowing the file as a
+// target, yield none too, leaving the file's owners in its own package, or
+// the package fallback if it has none.
+func consumingRules(querier ownerQuerier, pkg, file string) []string {
+	label := query.SourceFileLabel(pkg, file)
+	if label == "" || git.IsBuildFile(file) {
+		return nil
+	}
+	rules, err := querier.ConsumingRules(label)
+	if err != nil {
+		slog.Debug("Failed to find consuming rules", "file", label, "error", err)
+		return nil
+	}
+	return rules
+}
+
+// ownersForFiles collects the owner rules for files from fileOwners plus,
+// if lookup is non-nil, the rules it reports for each file, so a file owned
+// in its own package still reaches consumers in other packages. It reports
+// false as soon as one file has no owner or an owner label the querier would
+// skip (see query.ValidLabel), since the package surface is then the only
+// safe starting point.
+func ownersForFiles(fileOwners map[string][]string, files []string, lookup func(file string) []string) ([]string, bool) {
+	var owners []string
+	for _, f := range files {
+		o := fileOwners[f]
+		if lookup != nil {
+			o = append(slices.Clone(o), lookup(f)...)
+		}
+		if len(o) == 0 {
+			slog.Debug("No owner rule for file, falling back to package granularity", "file", f)
+			return nil, false
+		}
+		if i := slices.IndexFunc(o, func(l string) bool { return !query.ValidLabel(l) }); i >= 0 {
+			slog.Warn("Owner rule label cannot be queried, falling back to package granularity", "file", f, "rule", o[i])
+			return nil, false
+		}
+		owners = append(owners, o...)
+	}
+	return owners, true
+}
+
+// getRuleTests returns the tests affected by the given owner rules, reading
+// from and writing to the cache under a key derived from the rule set.
+func getRuleTests(owners []string, querier *query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool, prov *provenance) ([]string, error) {
+	storeKey := rulesCacheKey(owners)
+	if !noCache && cacheKey != "" {
+		cachedTests, found, unlock := c.GetOrLock(cacheKey, storeKey)
+		defer unlock()
+		if found {
+			prov.addOwnerRuleTests(owners, cachedTests, true)
+			return cachedTests, nil
+		}
+	}
+
+	tests, err := querier.FindAffectedTestsForRules(owners)
+	if err != nil {
+		return nil, fmt.Errorf("querying tests for owner rules: %w", err)
+	}
+
+	if !noCache && cacheKey != "" {
+		storeTests(c, cacheKey, storeKey, tests, func() ([]string, error) { return querier.RuleBuildInputs(owners) })
+	}
+	prov.addOwnerRuleTests(owners, tests, false)
+	return tests, nil
+}
+
+// rulesCacheKey hashes the owner rule set (order-independent) into a short,
+// filesystem-safe cache entry name, mirroring depsCacheKey for audit closures.
+func rulesCacheKey(rules []string) string {
+	return labelSetCacheKey("rules", rules)
+}
+
+// labelSetCacheKey hashes labels (order-independent) into a cache entry name
+// starting with prefix.
+func labelSetCacheKey(prefix string, labels []string) string {
+	sorted := append([]string(nil), labels...)
+	sort.Strings(sorted)
+	h := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return fmt.Sprintf("%s-%x", prefix, h[:8])
+}
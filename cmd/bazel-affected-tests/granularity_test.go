@@ -0,0 +1,287 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+const granularityXML = `<?xml version="1.1" encoding="UTF-8" standalone="no"?>
+<query version="2">
+    <rule class="go_library" name="//pkg/foo:lib_a">
+        <list name="srcs"><label value="//pkg/foo:a.go"/></list>
+    </rule>
+    <rule class="go_library" name="//pkg/foo:lib_b">
+        <list name="srcs"><label value="//pkg/foo:b.go"/></list>
+    </rule>
+</query>
+`
+
+// expectRules answers a rule query as a Bazel without streamed_proto output
+// would, so the fixture can stay readable XML.
+func expectRules(m *executor.MockExecutor, pattern, xml string) {
+	m.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto", pattern).
+		WillFail("ERROR: Invalid output format 'streamed_proto'.", 2).
+		Once().
+		Build()
+	m.ExpectCommandWithArgs("bazel", "query", "--output=xml", pattern).
+		WillSucceed(xml, 0).
+		Once().
+		Build()
+}
+
+func expectPackageQueries(m *executor.MockExecutor, pkg, rdepsResult string) {
+	m.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', "+pkg+":*)").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	m.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', "+pkg+"/...)").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	m.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., "+pkg+":*) intersect kind('.*_test rule', //...)").
+		WillSucceed(rdepsResult, 0).
+		Once().
+		Build()
+}
+
+// expectSourceFiles answers the check of changed files against the source-file
+// targets of pkgs.
+func expectSourceFiles(m *executor.MockExecutor, pkgs, result string) {
+	m.ExpectCommandWithArgs("bazel", "query", "kind('source file', set("+pkgs+"))").
+		WillSucceed(result, 0).
+		Once().
+		Build()
+}
+
+func TestCollectRuleTests_QueriesOnlyOwnerRules(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	expectRules(mockExec, "//pkg/foo:*", granularityXML)
+	expectSourceFiles(mockExec, "//pkg/foo:*", "//pkg/foo:a.go\n//pkg/foo:b.go\n//pkg/foo:BUILD.bazel")
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., set(//pkg/foo:a.go //pkg/foo:lib_a)) intersect kind('.*_test rule', //...)").
+		WillSucceed("//pkg/foo:a_test", 0).
+		Once().
+		Build()
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := collectRuleTests(map[string][]string{"//pkg/foo": {"pkg/foo/a.go"}}, []*query.BazelQuerier{q}, cache.NewCache(t.TempDir()), "", true, false, false, nil)
+	if err != nil {
+		t.Fatalf("collectRuleTests() error: %v", err)
+	}
+	if want := []string{"//pkg/foo:a_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("collectRuleTests() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestCollectRuleTests_SourceFileQueryErrorFallsBackToPackage(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	expectRules(mockExec, "//pkg/foo:*", granularityXML)
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('source file', set(//pkg/foo:*))").
+		WillFail("ERROR: query failure", 1).
+		Once().
+		Build()
+	expectPackageQueries(mockExec, "//pkg/foo", "//other:dep_test")
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := collectRuleTests(map[string][]string{"//pkg/foo": {"pkg/foo/a.go"}}, []*query.BazelQuerier{q}, cache.NewCache(t.TempDir()), "", true, false, false, nil)
+	if err != nil {
+		t.Fatalf("collectRuleTests() error: %v", err)
+	}
+	if want := []string{"//other:dep_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("collectRuleTests() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestCollectRuleTests_UnownedFileFallsBackToPackage(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	expectRules(mockExec, "//pkg/foo:*", granularityXML)
+	expectPackageQueries(mockExec, "//pkg/foo", "//other:dep_test")
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+
+	filesByPkg := map[string][]string{"//pkg/foo": {"pkg/foo/a.go", "pkg/foo/BUILD.bazel"}}
+	got, err := collectRuleTests(filesByPkg, []*query.BazelQuerier{q}, cache.NewCache(t.TempDir()), "", true, false, false, nil)
+	if err != nil {
+		t.Fatalf("collectRuleTests() error: %v", err)
+	}
+	if want := []string{"//other:dep_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("collectRuleTests() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestCollectRuleTests_RuleQueryErrorFallsBackToPackage(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto", "//pkg/foo:*").
+		WillFail("ERROR: query failure", 1).
+		Once().
+		Build()
+	expectPackageQueries(mockExec, "//pkg/foo", "//other:dep_test")
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := collectRuleTests(map[string][]string{"//pkg/foo": {"pkg/foo/a.go"}}, []*query.BazelQuerier{q}, cache.NewCache(t.TempDir()), "", true, false, false, nil)
+	if err != nil {
+		t.Fatalf("collectRuleTests() error: %v", err)
+	}
+	if want := []string{"//other:dep_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("collectRuleTests() = %v, want %v", got, want)
+	}
+}
+
+func TestGetRuleTests_UsesCache(t *testing.T) {
+	c := cache.NewCache(t.TempDir())
+	owners := []string{"//pkg/foo:lib_b", "//pkg/foo:lib_a"}
+	if err := c.Set("k1", rulesCacheKey(owners), []string{"//pkg/foo:cached_test"}); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+
+	mockExec := executor.NewMockExecutor()
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := getRuleTests([]string{"//pkg/foo:lib_a", "//pkg/foo:lib_b"}, q, c, "k1", false, nil)
+	if err != nil {
+		t.Fatalf("getRuleTests() error: %v", err)
+	}
+	if want := []string{"//pkg/foo:cached_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getRuleTests() = %v, want %v", got, want)
+	}
+	if n := len(mockExec.GetCallHistory()); n != 0 {
+		t.Errorf("expected no bazel calls on cache hit, got %d", n)
+	}
+}
+
+// fakeOwnerQuerier serves rule listings, consuming rules and known source
+// files from fixed data.
+type fakeOwnerQuerier struct {
+	rules       map[string][]query.Rule
+	consumers   map[string][]string
+	sourceFiles []string
+	consulted   []string
+}
+
+func (f *fakeOwnerQuerier) QueryRules(pattern string) ([]query.Rule, error) {
+	return f.rules[pattern], nil
+}
+
+func (f *fakeOwnerQuerier) SourceFileTargets(fileLabels []string) ([]string, error) {
+	var known []string
+	for _, l := range fileLabels {
+		if slices.Contains(f.sourceFiles, l) {
+			known = append(known, l)
+		}
+	}
+	return known, nil
+}
+
+func (f *fakeOwnerQuerier) ConsumingRules(fileLabel string) ([]string, error) {
+	f.consulted = append(f.consulted, fileLabel)
+	return f.consumers[fileLabel], nil
+}
+
+func TestResolveOwnerRules_ActionInputs(t *testing.T) {
+	fake := &fakeOwnerQuerier{
+		rules: map[string][]query.Rule{
+			"//pkg/foo:*": {
+				{Label: "//pkg/foo:lib", Sources: map[string][]string{"srcs": {"//pkg/foo:a.go"}}},
+				{Label: "//pkg/foo:gen", Inputs: []string{"//pkg/foo:api.tmpl", "//tools:codegen"}},
+			},
+		},
+		consumers: map[string][]string{"//pkg/foo:exported.tmpl": {"//other:gen"}},
+	}
+	filesByPkg := map[string][]string{"//pkg/foo": {"pkg/foo/a.go", "pkg/foo/api.tmpl", "pkg/foo/exported.tmpl"}}
+
+	owners, fallback := resolveOwnerRules(fake, filesByPkg, true)
+	if want := []string{"//other:gen", "//pkg/foo:gen", "//pkg/foo:lib"}; !reflect.DeepEqual(owners, want) {
+		t.Errorf("owners = %v, want %v", owners, want)
+	}
+	if len(fallback) != 0 {
+		t.Errorf("fallback = %v, want none", fallback)
+	}
+
+	// Without action inputs, codegen inputs have no owner.
+	owners, fallback = resolveOwnerRules(fake, filesByPkg, false)
+	if len(owners) != 0 || !reflect.DeepEqual(fallback, []string{"//pkg/foo"}) {
+		t.Errorf("without action inputs: owners = %v, fallback = %v", owners, fallback)
+	}
+}
+
+func TestResolveOwnerRules_ActionInputsKeepsCrossPackageConsumers(t *testing.T) {
+	fake := &fakeOwnerQuerier{
+		rules: map[string][]query.Rule{
+			"//pkg/foo:*": {{Label: "//pkg/foo:schema", Sources: map[string][]string{"srcs": {"//pkg/foo:api.proto"}}}},
+		},
+		consumers: map[string][]string{"//pkg/foo:api.proto": {"//other:gen", "//pkg/foo:schema"}},
+	}
+
+	owners, fallback := resolveOwnerRules(fake, map[string][]string{"//pkg/foo": {"pkg/foo/api.proto"}}, true)
+	if want := []string{"//other:gen", "//pkg/foo:schema"}; !reflect.DeepEqual(owners, want) {
+		t.Errorf("owners = %v, want %v", owners, want)
+	}
+	if len(fallback) != 0 {
+		t.Errorf("fallback = %v, want none", fallback)
+	}
+}
+
+func TestResolveOwnerRules_IncludesChangedSourceFiles(t *testing.T) {
+	// //other:gen references //pkg/foo:schema.json directly (exports_files);
+	// only the file's own label reaches it without --action-inputs.
+	fake := &fakeOwnerQuerier{
+		rules: map[string][]query.Rule{
+			"//pkg/foo:*": {{Label: "//pkg/foo:lib", Sources: map[string][]string{"srcs": {"//pkg/foo:a.go"}, "data": {"//pkg/foo:schema.json"}}}},
+		},
+		sourceFiles: []string{"//pkg/foo:a.go", "//pkg/foo:schema.json"},
+	}
+	filesByPkg := map[string][]string{"//pkg/foo": {"pkg/foo/a.go", "pkg/foo/schema.json"}}
+
+	owners, fallback := resolveOwnerRules(fake, filesByPkg, false)
+	if want := []string{"//pkg/foo:a.go", "//pkg/foo:lib", "//pkg/foo:schema.json"}; !reflect.DeepEqual(owners, want) {
+		t.Errorf("owners = %v, want %v", owners, want)
+	}
+	if len(fallback) != 0 {
+		t.Errorf("fallback = %v, want none", fallback)
+	}
+}
+
+func TestResolveOwnerRules_InvalidOwnerLabelFallsBack(t *testing.T) {
+	fake := &fakeOwnerQuerier{
+		rules: map[string][]query.Rule{
+			"//pkg/foo:*": {{Label: "//pkg/foo:odd name", Sources: map[string][]string{"srcs": {"//pkg/foo:a.go"}}}},
+			"//pkg/bar:*": {{Label: "//pkg/bar:lib", Sources: map[string][]string{"srcs": {"//pkg/bar:b.go"}}}},
+		},
+	}
+	filesByPkg := map[string][]string{"//pkg/foo": {"pkg/foo/a.go"}, "//pkg/bar": {"pkg/bar/b.go"}}
+
+	owners, fallback := resolveOwnerRules(fake, filesByPkg, false)
+	if want := []string{"//pkg/bar:lib"}; !reflect.DeepEqual(owners, want) {
+		t.Errorf("owners = %v, want %v", owners, want)
+	}
+	if want := []string{"//pkg/foo"}; !reflect.DeepEqual(fallback, want) {
+		t.Errorf("fallback = %v, want %v", fallback, want)
+	}
+}
+
+func TestResolveOwnerRules_ActionInputsBuildFileFallsBack(t *testing.T) {
+	fake := &fakeOwnerQuerier{
+		rules: map[string][]query.Rule{"//pkg/foo:*": {{Label: "//pkg/foo:gen", Inputs: []string{"//pkg/foo:api.tmpl"}}}},
+	}
+	_, fallback := resolveOwnerRules(fake, map[string][]string{"//pkg/foo": {"pkg/foo/BUILD.bazel", "pkg/foo/api.tmpl"}}, true)
+	if !reflect.DeepEqual(fallback, []string{"//pkg/foo"}) {
+		t.Errorf("fallback = %v, want [//pkg/foo]", fallback)
+	}
+	if len(fake.consulted) != 0 {
+		t.Errorf("BUILD files should not be looked up as inputs, consulted %v", fake.consulted)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+const indexActionBuild = "build"
+
+// defaultIndexQueryTimeout bounds the whole-repository graph query of
+// "index build", which takes far longer than a per-package query.
+const defaultIndexQueryTimeout = 10 * time.Minute
+
+type indexCmdConfig struct {
+	action       string
+	debug        bool
+	cacheDir     string
+	profile      string
+	queryTimeout time.Duration
+}
+
+func parseIndexFlags(args []string) (indexCmdConfig, error) {
+	var cfg indexCmdConfig
+	if len(args) == 0 || args[0] != indexActionBuild {
+		return cfg, fmt.Errorf("index requires a subcommand: %s", indexActionBuild)
+	}
+	cfg.action = args[0]
+	fs := flag.NewFlagSet("index "+cfg.action, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.BoolVar(&cfg.debug, "debug", false, "Enable debug output")
+	fs.StringVar(&cfg.cacheDir, "cache-dir", "", "Cache directory (default: $HOME/.cache/bazel-affected-tests)")
+	fs.StringVar(&cfg.profile, "profile", "",
+		"Config profile to overlay on the top-level settings (default $"+profileEnvVar+")")
+	fs.DurationVar(&cfg.queryTimeout, "query-timeout", defaultIndexQueryTimeout,
+		"Timeout for the dependency graph query (e.g. 30m)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return cfg, fmt.Errorf("parsing index flags: %w", err)
+	}
+	if err := checkProfileFlag(cfg.profile); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if cfg.queryTimeout <= 0 {
+		return cfg, errors.New("--query-timeout must be positive")
+	}
+	return cfg, nil
+}
+
+func runIndex(args []string) int {
+	cfg, err := parseIndexFlags(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if cfg.debug {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	if err := buildIndex(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// buildIndex queries the dependency graph of every test and stores the
+// resulting reverse-dependency index under the current cache key, where
+// later runs with the same BUILD files pick it up.
+func buildIndex(cfg indexCmdConfig) error {
+	repoRoot, err := git.RepoRoot(context.Background(), executor.NewBasicExecutor())
+	if err != nil {
+		return fmt.Errorf("not a git repository (or any parent): %w", err)
+	}
+	repoCfg, err := config.LoadConfigProfile(repoRoot, resolveProfile(cliConfig{profile: cfg.profile}))
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	c := cache.NewCache(cfg.cacheDir)
+	if remote := resolveRemoteCache(cliConfig{}, repoCfg); remote != "" {
+		c.SetRemote(cache.NewHTTPBackend(remote, cache.DefaultRemoteTimeout))
+	}
+	c.SetLimits(cacheLimits(repoCfg))
+	q := indexQuerier(cfg, repoCfg)
+
+	// The index replaces whole-repository answers, so it is always stored
+	// under a whole-repository key even if incremental_cache is enabled.
+	keyCfg := cliConfig{incrementalSet: true}
+	cacheKey := computeCacheKey(keyCfg, repoCfg, c, repoRoot, q.Fingerprint())
+	if cacheKey == "" {
+		return errors.New("failed to compute cache key")
+	}
+
+	idx, err := q.BuildTestIndex()
+	if err != nil {
+		return err
+	}
+	data, err := idx.Encode()
+	if err != nil {
+		return err
+	}
+	if err := c.SetIndex(cacheKey, data); err != nil {
+		return fmt.Errorf("failed to store test index: %w", err)
+	}
+	fmt.Fprintf(os.Stdout, "Indexed %d tests across %d packages (key %s)\n",
+		len(idx.Tests), len(idx.Packages), cacheKey)
+	return nil
+}
+
+// indexQuerier returns the querier "index build" uses: the one a run without
+// command line flags would use first, so the fingerprint, and with it the
+// cache key, matches what later runs compute from the same config.
+func indexQuerier(cfg indexCmdConfig, repoCfg *config.Config) *query.BazelQuerier {
+	q := newWorkerQuerier(cliConfig{}, repoCfg, 0)
+	q.SetQueryTimeout(cfg.queryTimeout)
+	return q
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+func TestParseIndexFlags(t *testing.T) {
+	cfg, err := parseIndexFlags([]string{"build"})
+	if err != nil {
+		t.Fatalf("parseIndexFlags() error = %v", err)
+	}
+	if cfg.action != indexActionBuild || cfg.queryTimeout != defaultIndexQueryTimeout {
+		t.Errorf("parseIndexFlags() = %+v", cfg)
+	}
+
+	cfg, err = parseIndexFlags([]string{"build", "--query-timeout", "30m", "--cache-dir", "/tmp/c"})
+	if err != nil {
+		t.Fatalf("parseIndexFlags() error = %v", err)
+	}
+	if cfg.queryTimeout != 30*time.Minute || cfg.cacheDir != "/tmp/c" {
+		t.Errorf("parseIndexFlags() = %+v", cfg)
+	}
+
+	for _, args := range [][]string{nil, {"rebuild"}, {"build", "extra"}, {"build", "--query-timeout", "0s"}} {
+		if _, err := parseIndexFlags(args); err == nil {
+			t.Errorf("parseIndexFlags(%v) error = nil, want error", args)
+		}
+	}
+}
+
+func TestIndexQuerier_KeyMatchesMainRun(t *testing.T) {
+	repo := t.TempDir()
+	writeFile(t, filepath.Join(repo, "BUILD"), "# root", 0o600)
+	bestEffort, cquery := true, true
+	for _, repoCfg := range []*config.Config{
+		nil,
+		{BestEffort: &bestEffort},
+		{Cquery: &cquery},
+	} {
+		mainKey := computeCacheKey(cliConfig{}, repoCfg, cache.NewCache(t.TempDir()), repo,
+			newWorkerQueriers(cliConfig{}, repoCfg)[0].Fingerprint())
+		q := indexQuerier(indexCmdConfig{queryTimeout: defaultIndexQueryTimeout}, repoCfg)
+		indexKey := computeCacheKey(cliConfig{incrementalSet: true}, repoCfg, cache.NewCache(t.TempDir()), repo,
+			q.Fingerprint())
+		if indexKey == "" || indexKey != mainKey {
+			t.Errorf("config %+v: index build key = %q, main run key = %q", repoCfg, indexKey, mainKey)
+		}
+	}
+}
+
+func TestLoadTestIndex(t *testing.T) {
+	c := cache.NewCache(t.TempDir())
+	idx := &query.TestIndex{Tests: []string{"//app:app_test"}, Packages: map[string][]int{"//lib": {0}}}
+	data, err := idx.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetIndex("key", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// No mock expectations: the querier must answer from the index.
+	q := query.NewBazelQuerierWithExecutor(executor.NewMockExecutor())
+	loadTestIndex(c, "key", []*query.BazelQuerier{q})
+	got, err := q.FindAffectedTests([]string{"//lib"})
+	if err != nil {
+		t.Fatalf("FindAffectedTests() error = %v", err)
+	}
+	if len(got) != 1 || got[0] != "//app:app_test" {
+		t.Errorf("FindAffectedTests() = %v, want [//app:app_test]", got)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+)
+
+// cacheKeyInputs collects the extra cache key inputs configured under
+// cache_key_inputs: a content digest per file matching each glob, a digest
+// of each environment variable's value, and each Bazel flag verbatim. Every
+// input is logged at debug level so --debug shows what contributed to the
+// key.
+func cacheKeyInputs(repoRoot string, inputs config.CacheKeyInputs) ([]cache.KeyInput, error) {
+	var keyInputs []cache.KeyInput
+	for _, pattern := range inputs.Files {
+		matches, err := filepath.Glob(filepath.Join(repoRoot, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache_key_inputs file pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			slog.Debug("Cache key input pattern matched no files", "pattern", pattern)
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || info.IsDir() {
+				continue
+			}
+			data, err := os.ReadFile(match)
+			if err != nil {
+				return nil, fmt.Errorf("reading cache key input: %w", err)
+			}
+			rel, err := filepath.Rel(repoRoot, match)
+			if err != nil {
+				return nil, fmt.Errorf("resolving cache key input %s: %w", match, err)
+			}
+			keyInputs = append(keyInputs, cache.KeyInput{Name: "file:" + filepath.ToSlash(rel), Value: fmt.Sprintf("%x", sha256.Sum256(data))})
+		}
+	}
+	// Environment values are hashed so secrets never reach the debug log.
+	for _, name := range inputs.Env {
+		value, ok := os.LookupEnv(name)
+		digest := "unset"
+		if ok {
+			digest = fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
+		}
+		keyInputs = append(keyInputs, cache.KeyInput{Name: "env:" + name, Value: digest})
+	}
+	for _, flag := range inputs.BazelFlags {
+		keyInputs = append(keyInputs, cache.KeyInput{Name: "flag", Value: flag})
+	}
+	for _, in := range keyInputs {
+		slog.Debug("Cache key input", "name", in.Name, "value", in.Value)
+	}
+	return keyInputs, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+)
+
+func TestCacheKeyInputs(t *testing.T) {
+	repo := t.TempDir()
+	writeFile(t, filepath.Join(repo, "MODULE.bazel"), "module(name = \"x\")", 0o600)
+	writeFile(t, filepath.Join(repo, "tools/ci.bazelrc"), "build --define=a=b", 0o600)
+	writeFile(t, filepath.Join(repo, "tools/dev.bazelrc"), "build --define=a=c", 0o600)
+	t.Setenv("BAT_TEST_CACHE_KEY_ENV", "secret")
+
+	got, err := cacheKeyInputs(repo, config.CacheKeyInputs{
+		Files:      []string{"MODULE.bazel", "tools/*.bazelrc", "missing.bazelrc"},
+		Env:        []string{"BAT_TEST_CACHE_KEY_ENV", "BAT_TEST_CACHE_KEY_UNSET"},
+		BazelFlags: []string{"--define=mode=opt"},
+	})
+	if err != nil {
+		t.Fatalf("cacheKeyInputs() error: %v", err)
+	}
+
+	var names []string
+	for _, in := range got {
+		names = append(names, in.Name)
+		if in.Value == "secret" {
+			t.Errorf("input %s exposes the raw environment value", in.Name)
+		}
+	}
+	wantNames := []string{"file:MODULE.bazel", "file:tools/ci.bazelrc", "file:tools/dev.bazelrc",
+		"env:BAT_TEST_CACHE_KEY_ENV", "env:BAT_TEST_CACHE_KEY_UNSET", "flag"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("input names = %v, want %v", names, wantNames)
+	}
+	if got[4].Value != "unset" {
+		t.Errorf("unset env value = %q, want %q", got[4].Value, "unset")
+	}
+	if got[5].Value != "--define=mode=opt" {
+		t.Errorf("flag value = %q, want %q", got[5].Value, "--define=mode=opt")
+	}
+}
+
+func TestComputeCacheKey_InputsChangeKey(t *testing.T) {
+	repo := t.TempDir()
+	writeFile(t, filepath.Join(repo, "BUILD"), "# root", 0o600)
+	writeFile(t, filepath.Join(repo, "MODULE.bazel"), "use_repo(a)", 0o600)
+	repoCfg := &config.Config{CacheKeyInputs: config.CacheKeyInputs{Files: []string{"MODULE.bazel"}}}
+	c := cache.NewCache(t.TempDir())
+
+	before := computeCacheKey(cliConfig{}, repoCfg, c, repo, "fp")
+	if err := os.WriteFile(filepath.Join(repo, "MODULE.bazel"), []byte("use_repo(a, b)"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	after := computeCacheKey(cliConfig{}, repoCfg, c, repo, "fp")
+	if before == "" || before == after {
+		t.Errorf("cache key should change with MODULE.bazel when listed in cache_key_inputs: before %q, after %q", before, after)
+	}
+
+	plain := computeCacheKey(cliConfig{}, nil, cache.NewCache(t.TempDir()), repo, "fp")
+	if err := os.WriteFile(filepath.Join(repo, "MODULE.bazel"), []byte("use_repo(c)"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if plain != computeCacheKey(cliConfig{}, nil, cache.NewCache(t.TempDir()), repo, "fp") {
+		t.Error("cache key should ignore MODULE.bazel by default")
+	}
+
+	if computeCacheKey(cliConfig{}, repoCfg, c, repo, "other") == computeCacheKey(cliConfig{}, repoCfg, c, repo, "fp") {
+		t.Error("cache key should change with the query fingerprint")
+	}
+
+	if got := computeCacheKey(cliConfig{noCache: true}, repoCfg, c, repo, "fp"); got != "" {
+		t.Errorf("computeCacheKey() with --no-cache = %q, want empty", got)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
@@ -20,9 +21,20 @@ import (
 
 func main() {
 	// Subcommand dispatch must happen before parseFlags, which uses the
-	// global flag.CommandLine and would reject audit-specific flags.
-	if len(os.Args) > 1 && os.Args[1] == "audit-packages" {
-		os.Exit(runAuditPackages(os.Args[2:]))
+	// global flag.CommandLine and would reject subcommand-specific flags.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "audit-packages":
+			os.Exit(runAuditPackages(os.Args[2:]))
+		case "explain":
+			os.Exit(runExplain(os.Args[2:]))
+		case "cache":
+			os.Exit(runCache(os.Args[2:]))
+		case "index":
+			os.Exit(runIndex(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		}
 	}
 
 	cfg := parseFlags()
@@ -31,10 +43,8 @@ func main() {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
 
-	c := cache.NewCache(cfg.cacheDir)
-
 	if cfg.clearCache {
-		if err := handleCacheClear(c); err != nil {
+		if err := handleCacheClear(cache.NewCache(cfg.cacheDir)); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
@@ -46,52 +56,127 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := checkProfileFlag(cfg.profile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !validGranularity(cfg.granularity) {
+		fmt.Fprintf(os.Stderr, "Error: --granularity must be %q or %q, got %q\n",
+			config.GranularityPackage, config.GranularityRule, cfg.granularity)
+		os.Exit(1)
+	}
+
+	for _, p := range strings.Fields(cfg.universe) {
+		if !query.ValidUniversePattern(p) {
+			fmt.Fprintf(os.Stderr, "Error: --universe entries must be target patterns such as //src/... or -//third_party/..., got %q\n", p)
+			os.Exit(1)
+		}
+	}
+
+	for _, size := range splitList(cfg.testSizes) {
+		if query.SizeRank(size) < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --test-size entries must be small, medium, large or enormous, got %q\n", size)
+			os.Exit(1)
+		}
+	}
+	if cfg.maxTimeout != "" && query.TimeoutRank(cfg.maxTimeout) < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-timeout must be short, moderate, long or eternal, got %q\n", cfg.maxTimeout)
+		os.Exit(1)
+	}
+
+	if !validPrecision(cfg.precision) {
+		fmt.Fprintf(os.Stderr, "Error: --precision must be %q or %q, got %q\n",
+			config.PrecisionPackage, config.PrecisionFile, cfg.precision)
+		os.Exit(1)
+	}
+
+	if cfg.remoteCache != "" && !config.ValidRemoteCache(cfg.remoteCache) {
+		fmt.Fprintf(os.Stderr, "Error: --remote-cache must be an http or https URL, got %q\n", cfg.remoteCache)
+		os.Exit(1)
+	}
+
+	if !validCacheKey(cfg.cacheKey) {
+		fmt.Fprintf(os.Stderr, "Error: --cache-key must be %q or %q, got %q\n",
+			config.CacheKeyWalk, config.CacheKeyGit, cfg.cacheKey)
+		os.Exit(1)
+	}
+
+	if cfg.output != outputFormatText && cfg.output != outputFormatJSON {
+		fmt.Fprintf(os.Stderr, "Error: --output must be %q or %q, got %q\n", outputFormatText, outputFormatJSON, cfg.output)
+		os.Exit(1)
+	}
+	if cfg.output == outputFormatJSON && cfg.run {
+		fmt.Fprintln(os.Stderr, "Error: --output=json cannot be combined with --run")
+		os.Exit(1)
+	}
+
 	timer := newStageTimer(cfg.timing)
-	targets, err := resolveTargets(cfg, c, timer)
+	prov := newProvenance(cfg.output == outputFormatJSON)
+	stop := timer.stage("repo-root")
+	repoRoot, err := git.RepoRoot(context.Background(), executor.NewBasicExecutor())
+	stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: not a git repository (or any parent): %v\n", err)
+		os.Exit(1)
+	}
+	c := cache.NewRepoCache(cfg.cacheDir, repoRoot)
+	targets, err := resolveTargets(cfg, repoRoot, c, timer, prov)
 	timer.report(os.Stderr)
+	if err := c.FlushStats(); err != nil {
+		slog.Debug("Failed to record cache stats", "error", err)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
+	if cfg.output == outputFormatJSON {
+		if err := writeTargetsJSON(os.Stdout, targets, prov); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	outputOrRun(cfg.run, targets)
 }
 
 // resolveTargets detects changed files, finds affected Bazel packages, queries
 // for affected test targets, and applies config-based filtering and additions.
-func resolveTargets(cfg cliConfig, c *cache.Cache, timer *stageTimer) ([]string, error) {
-	stop := timer.stage("repo-root")
-	repoRoot, err := git.RepoRoot(context.Background(), executor.NewBasicExecutor())
-	stop()
-	if err != nil {
-		return nil, fmt.Errorf("not a git repository (or any parent): %w", err)
-	}
-
+func resolveTargets(cfg cliConfig, repoRoot string, c *cache.Cache, timer *stageTimer, prov *provenance) ([]string, error) {
 	piped := isPipe()
 	if countSourceFlags(cfg) > 0 && piped {
 		fmt.Fprintln(os.Stderr, "Warning: stdin is a pipe but an explicit flag is set; ignoring pipe input")
 	}
 
-	stop = timer.stage("changed-files")
-	changedFiles, err := getChangedFiles(cfg, piped)
+	stop := timer.stage("changed-files")
+	changes, err := getChangedFiles(cfg, piped)
 	stop()
 	if err != nil {
 		return nil, err
 	}
 
+	// Deleted files and the old side of renames are kept: the packages they
+	// lived in lost a source and their dependents must be re-tested.
+	changedFiles := git.AffectedPaths(changes)
+
 	if len(changedFiles) == 0 {
 		return nil, nil
 	}
 
 	// Load config early so ignore_paths can filter files before package resolution
 	stop = timer.stage("load-config")
-	repoCfg, err := config.LoadConfig(repoRoot)
+	repoCfg, err := config.LoadConfigProfile(repoRoot, resolveProfile(cfg))
 	stop()
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
 
 	if repoCfg != nil {
+		prov.setSubpackageQuery(repoCfg.SubpackageQueryEnabled())
+		if err := repoCfg.LoadNested(repoRoot, config.FileDirs(changedFiles)); err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
 		changedFiles = repoCfg.FilterIgnoredFiles(changedFiles)
 		slog.Debug("Files after ignore_paths filtering", "count", len(changedFiles))
 		if len(changedFiles) == 0 {
@@ -110,10 +195,39 @@ func resolveTargets(cfg cliConfig, c *cache.Cache, timer *stageTimer) ([]string,
 		return nil, nil
 	}
 
+	resolveRemoved := resolveRemovedPackages(cfg, repoCfg)
+	var buildDirs map[string]bool
+	if needsBaseLayout(changes, resolveRemoved) {
+		stop = timer.stage("base-layout")
+		buildDirs, err = baseBuildDirs(cfg, repoRoot)
+		stop()
+		if err != nil {
+			if resolveRemoved {
+				return nil, err
+			}
+			slog.Warn("Resolving deleted files against the working tree instead", "error", err)
+		}
+	}
+
+	liveFiles := changedFiles
+	var removedTests []string
+	if resolveRemoved {
+		stop = timer.stage("removed-packages")
+		removedTests, liveFiles, err = resolveRemovedPackageTests(cfg, repoCfg, repoRoot, buildDirs, changes, changedFiles, maxDepth, prov)
+		stop()
+		if err != nil {
+			return nil, err
+		}
+	} else if edited := editedBuildFiles(changes); len(edited) > 0 {
+		slog.Debug("BUILD files edited; dependents of targets they removed are only selected with --resolve-removed",
+			"files", sortedKeys(edited))
+	}
+
 	stop = timer.stage("find-packages")
-	packages, unmapped := findPackages(repoRoot, changedFiles, maxDepth)
+	filesByPkg, unmapped := groupChangedFiles(repoRoot, buildDirs, goneFiles(changes), liveFiles, maxDepth)
 	stop()
-	slog.Debug("Bazel packages found", "count", len(packages))
+	prov.setPackageFiles(filesByPkg)
+	slog.Debug("Bazel packages found", "count", len(filesByPkg))
 	if len(unmapped) > 0 {
 		if strict {
 			return nil, fmt.Errorf("files not mapped to any Bazel package within max-parent-depth=%d: %v", maxDepth, unmapped)
@@ -122,15 +236,32 @@ func resolveTargets(cfg cliConfig, c *cache.Cache, timer *stageTimer) ([]string,
 			"max_parent_depth", maxDepth, "files", unmapped)
 	}
 
-	allTests, err := queryTestsForPackages(cfg, repoCfg, c, repoRoot, packages, timer)
+	allTests, err := queryTestsForPackages(cfg, repoCfg, c, repoRoot, filesByPkg, changedBzlFiles(liveFiles), timer, prov)
 	if err != nil {
 		return nil, err
 	}
 
-	var configTargets []string
+	allTests = append(allTests, removedTests...)
+
 	if repoCfg != nil {
+		if err := repoCfg.LoadNested(repoRoot, config.LabelDirs(allTests)); err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
 		allTests = repoCfg.FilterExcluded(allTests)
+	}
+	if sizeFilter := resolveTestSizeFilter(cfg, repoCfg); sizeFilter.enabled() {
+		stop = timer.stage("test-sizes")
+		allTests, err = applyTestSizeFilter(cfg, repoCfg, allTests, sizeFilter.sizes, sizeFilter.maxTimeout)
+		stop()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var configTargets []string
+	if repoCfg != nil {
 		configTargets = repoCfg.MatchTargets(changedFiles)
+		prov.addConfigRules(repoCfg.MatchRules(changedFiles))
 		slog.Debug("Config targets matched", "count", len(configTargets))
 	}
 
@@ -179,7 +310,29 @@ type cliConfig struct {
 	strict         bool
 	strictSet      bool
 	timing         bool
+	profile        string
 	queryTimeout   time.Duration
+	granularity    string
+	precision      string
+	batch          bool
+	batchSet       bool
+	jobs           int
+	outputBase     string
+	resolveRemoved bool
+	removedSet     bool
+	output         string
+	incremental    bool
+	incrementalSet bool
+	cacheKey       string
+	remoteCache    string
+	cquery         bool
+	cquerySet      bool
+	cqueryFlags    string
+	universe       string
+	testSizes      string
+	maxTimeout     string
+	actionInputs   bool
+	actionInputSet bool
 }
 
 func parseFlags() cliConfig {
@@ -199,11 +352,50 @@ func parseFlags() cliConfig {
 	flag.BoolVar(&cfg.strict, "strict", false,
 		"Fail if any changed file does not map to a Bazel package within max-parent-depth")
 	flag.BoolVar(&cfg.timing, "timing", false, "Print per-stage wall-clock durations to stderr")
-	flag.BoolVar(&cfg.timing, "profile", false, "Alias for --timing")
+	flag.StringVar(&cfg.profile, "profile", "",
+		"Config profile to overlay on the top-level settings (default $"+profileEnvVar+")")
 	flag.DurationVar(&cfg.queryTimeout, "query-timeout", 0,
 		"Per-Bazel-query wall-clock limit (e.g. 60s, 2m); overrides config (default 30s)")
+	flag.StringVar(&cfg.granularity, "granularity", "",
+		"Affected-test selection granularity: package or rule; overrides config (default package)")
+	flag.StringVar(&cfg.precision, "precision", "",
+		"Start rdeps from each changed file's package or its own source-file target: package or file; overrides config (default package)")
+	flag.BoolVar(&cfg.batch, "batch", false,
+		"Query all changed packages with one batched set of bazel queries instead of per package")
+	flag.IntVar(&cfg.jobs, "jobs", 0, "Number of packages to query concurrently; overrides config (default 1)")
+	flag.StringVar(&cfg.outputBase, "query-output-base", "",
+		"Run queries against an isolated Bazel --output_base rooted here (one subdirectory per job); overrides config")
+	flag.StringVar(&cfg.output, "output", outputFormatText,
+		"Output format: text (one label per line) or json (each target with the reasons it was selected)")
+	flag.BoolVar(&cfg.incremental, "incremental-cache", false,
+		"Validate each cache entry against the BUILD/.bzl files it depended on instead of a whole-repo hash; new dependents in other BUILD files go unnoticed")
+	flag.StringVar(&cfg.cacheKey, "cache-key", "",
+		"Cache key strategy: walk (hash BUILD/.bzl files found on disk) or git (index blob ids); overrides config (default walk)")
+	flag.StringVar(&cfg.remoteCache, "remote-cache", "",
+		"Share query results through an HTTP cache server speaking the Bazel remote cache protocol; overrides config")
+	flag.BoolVar(&cfg.actionInputs, "action-inputs", false,
+		"With --granularity=rule, also map changed files to the rules that consume them as inputs (templates, codegen inputs)")
+	flag.BoolVar(&cfg.cquery, "cquery", false,
+		"Run the rdeps step as bazel cquery so select() is resolved for one configuration")
+	flag.StringVar(&cfg.universe, "universe", "",
+		"Space-separated target patterns the rdeps queries range over, - to exclude (e.g. \"//... -//third_party/...\"); overrides config (default //...)")
+	flag.StringVar(&cfg.testSizes, "test-size", "",
+		"Comma-separated test sizes to keep (small, medium, large, enormous); other selected tests are deferred; overrides config")
+	flag.StringVar(&cfg.maxTimeout, "max-timeout", "",
+		"Defer selected tests with a longer timeout than this (short, moderate, long, eternal); overrides config")
+	flag.StringVar(&cfg.cqueryFlags, "cquery-flags", "",
+		"Space-separated build flags for --cquery (e.g. \"--config=linux\"); overrides config")
+	flag.BoolVar(&cfg.resolveRemoved, "resolve-removed", false,
+		"Resolve deleted files against the base revision's BUILD layout and query tests that depended on removed packages")
 	flag.Parse()
 
+	// Zero means unset and defers to query_jobs; a negative count is a
+	// mistake, rejected as it is in the config file.
+	if cfg.jobs < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --jobs must not be negative, got %d\n", cfg.jobs)
+		os.Exit(1)
+	}
+
 	// Record whether flags were explicitly set so config can override only when they weren't.
 	flag.Visit(func(f *flag.Flag) {
 		switch f.Name {
@@ -211,6 +403,16 @@ func parseFlags() cliConfig {
 			cfg.strictSet = true
 		case "best-effort":
 			cfg.bestEffortSet = true
+		case "batch":
+			cfg.batchSet = true
+		case "resolve-removed":
+			cfg.removedSet = true
+		case "incremental-cache":
+			cfg.incrementalSet = true
+		case "cquery":
+			cfg.cquerySet = true
+		case "action-inputs":
+			cfg.actionInputSet = true
 		}
 	})
 
@@ -249,10 +451,33 @@ func isPipe() bool {
 	return (stat.Mode() & os.ModeCharDevice) == 0
 }
 
+// resolveQueryJobs returns the effective query concurrency, honoring
+// precedence CLI flag > config > 1.
+func resolveQueryJobs(cfg cliConfig, repoCfg *config.Config) int {
+	if cfg.jobs > 0 {
+		return cfg.jobs
+	}
+	return repoCfg.ResolvedQueryJobs(1)
+}
+
+// resolveQueryOutputBase returns the effective isolated output base, honoring
+// precedence CLI flag > config > "" (the workspace's default server).
+func resolveQueryOutputBase(cfg cliConfig, repoCfg *config.Config) string {
+	if cfg.outputBase != "" {
+		return cfg.outputBase
+	}
+	if repoCfg != nil {
+		return repoCfg.QueryOutputBase
+	}
+	return ""
+}
+
 func newQuerier(repoCfg *config.Config) *query.BazelQuerier {
 	q := query.NewBazelQuerier()
 	if repoCfg != nil {
 		q.SetEnableSubpackageQuery(repoCfg.SubpackageQueryEnabled())
+		q.SetUniverse(repoCfg.Universe)
+		q.SetTestFilter(repoCfg.TestKinds, repoCfg.IncludeTags, repoCfg.ExcludeTags)
 	}
 	return q
 }
@@ -265,7 +490,10 @@ func handleCacheClear(c *cache.Cache) error {
 	return nil
 }
 
-func getChangedFiles(cfg cliConfig, piped bool) ([]string, error) {
+// getChangedFiles returns the change records for the selected source. Paths
+// read from --files-from or a pipe carry no status and are treated as
+// modifications.
+func getChangedFiles(cfg cliConfig, piped bool) ([]git.FileChange, error) {
 	ctx := context.Background()
 	exec := executor.NewBasicExecutor()
 
@@ -276,28 +504,28 @@ func getChangedFiles(cfg cliConfig, piped bool) ([]string, error) {
 			return nil, fmt.Errorf("reading files from %q: %w", cfg.filesFrom, err)
 		}
 		slog.Debug("Read files from input", "source", cfg.filesFrom, "count", len(files))
-		return files, nil
+		return modifiedChanges(files), nil
 	case cfg.staged:
-		files, err := git.GetStagedFiles(ctx, exec)
+		changes, err := git.GetStagedChanges(ctx, exec)
 		if err != nil {
 			return nil, fmt.Errorf("getting staged files: %w", err)
 		}
-		slog.Debug("Staged files found", "count", len(files))
-		return files, nil
+		slog.Debug("Staged files found", "count", len(changes))
+		return changes, nil
 	case cfg.head:
-		files, err := git.GetHeadFiles(ctx, exec)
+		changes, err := git.GetHeadChanges(ctx, exec)
 		if err != nil {
 			return nil, fmt.Errorf("getting HEAD diff files: %w", err)
 		}
-		slog.Debug("HEAD diff files found", "count", len(files))
-		return files, nil
+		slog.Debug("HEAD diff files found", "count", len(changes))
+		return changes, nil
 	case cfg.base != "":
-		files, err := git.GetDiffFiles(ctx, exec, cfg.base)
+		changes, err := git.GetDiffChanges(ctx, exec, cfg.base)
 		if err != nil {
 			return nil, fmt.Errorf("getting diff files vs %q: %w", cfg.base, err)
 		}
-		slog.Debug("Base diff files found", "base", cfg.base, "count", len(files))
-		return files, nil
+		slog.Debug("Base diff files found", "base", cfg.base, "count", len(changes))
+		return changes, nil
 	default:
 		// Auto mode: pipe → staged → HEAD
 		if piped {
@@ -306,40 +534,82 @@ func getChangedFiles(cfg cliConfig, piped bool) ([]string, error) {
 				return nil, fmt.Errorf("reading from stdin pipe: %w", err)
 			}
 			slog.Debug("Read files from pipe", "count", len(files))
-			return files, nil
+			return modifiedChanges(files), nil
 		}
-		files, err := git.GetStagedFiles(ctx, exec)
+		changes, err := git.GetStagedChanges(ctx, exec)
 		if err != nil {
 			return nil, fmt.Errorf("getting staged files: %w", err)
 		}
-		if len(files) > 0 {
-			slog.Debug("Auto: using staged files", "count", len(files))
-			return files, nil
+		if len(changes) > 0 {
+			slog.Debug("Auto: using staged files", "count", len(changes))
+			return changes, nil
 		}
-		files, err = git.GetHeadFiles(ctx, exec)
+		changes, err = git.GetHeadChanges(ctx, exec)
 		if err != nil {
 			return nil, fmt.Errorf("getting HEAD diff files: %w", err)
 		}
-		slog.Debug("Auto: using HEAD diff files", "count", len(files))
-		return files, nil
+		slog.Debug("Auto: using HEAD diff files", "count", len(changes))
+		return changes, nil
 	}
 }
 
-func getCacheKey(c *cache.Cache, noCache bool, repoRoot string) string {
+// modifiedChanges wraps plain paths as modification records.
+func modifiedChanges(files []string) []git.FileChange {
+	changes := make([]git.FileChange, len(files))
+	for i, f := range files {
+		changes[i] = git.FileChange{Status: git.StatusModified, Path: f}
+	}
+	return changes
+}
+
+func getCacheKey(c *cache.Cache, noCache bool, repoRoot, strategy string) string {
 	if noCache {
 		return ""
 	}
 
-	cacheKey, err := c.GetCacheKey(repoRoot)
+	var cacheKey string
+	var err error
+	if strategy == config.CacheKeyGit {
+		cacheKey, err = c.GetGitCacheKey(context.Background(), executor.NewBasicExecutor(), repoRoot)
+	} else {
+		cacheKey, err = c.GetCacheKey(repoRoot)
+	}
 	if err != nil {
 		slog.Debug("Failed to compute cache key", "error", err)
 		return ""
 	}
 
-	slog.Debug("Cache key computed", "key", cacheKey)
+	slog.Debug("Cache key computed", "key", cacheKey, "strategy", strategy)
 	return cacheKey
 }
 
+// computeCacheKey returns the cache key for this run, or "" when caching is
+// disabled or the configured cache_key_inputs cannot be read. fingerprint
+// describes the query parameters (see query.BazelQuerier.Fingerprint); it is
+// mixed into the key so entries computed under other parameters, or by a
+// tool version that queried differently, are never reused.
+func computeCacheKey(cfg cliConfig, repoCfg *config.Config, c *cache.Cache, repoRoot, fingerprint string) string {
+	if cfg.noCache {
+		return ""
+	}
+	slog.Debug("Query fingerprint", "fingerprint", fingerprint)
+	inputs := []cache.KeyInput{{Name: "query", Value: fingerprint}}
+	if repoCfg != nil {
+		extra, err := cacheKeyInputs(repoRoot, repoCfg.CacheKeyInputs)
+		if err != nil {
+			slog.Warn("Disabling cache: failed to read cache key inputs", "error", err)
+			return ""
+		}
+		inputs = append(inputs, extra...)
+	}
+	c.SetKeyInputs(inputs)
+	if resolveIncrementalCache(cfg, repoCfg) {
+		return c.IncrementalKey()
+	}
+	c.SetKeyExclude(repoCfg.CacheKeyExcluded)
+	return getCacheKey(c, cfg.noCache, repoRoot, resolveCacheKey(cfg, repoCfg))
+}
+
 // resolveMaxParentDepth returns the effective max-parent-depth, honoring
 // precedence CLI flag > config > DefaultMaxParentDepth.
 func resolveMaxParentDepth(cfg cliConfig, repoCfg *config.Config) int {
@@ -361,6 +631,31 @@ func resolveStrict(cfg cliConfig, repoCfg *config.Config) bool {
 	return false
 }
 
+// profileEnvVar names the environment variable that selects a config profile
+// when --profile is not given.
+const profileEnvVar = "BAZEL_AFFECTED_TESTS_PROFILE"
+
+// resolveProfile returns the config profile to apply, honoring precedence CLI
+// flag > environment variable > none. The profile's fields then take the
+// place of the top-level config in every other resolve* helper.
+func resolveProfile(cfg cliConfig) string {
+	if cfg.profile != "" {
+		return cfg.profile
+	}
+	return os.Getenv(profileEnvVar)
+}
+
+// checkProfileFlag rejects a --profile value that looks like a flag. Before
+// profiles existed, --profile was a boolean alias for --timing, so an old
+// "--profile --staged" would otherwise take "--staged" as the profile name
+// and silently drop the flag that follows.
+func checkProfileFlag(profile string) error {
+	if strings.HasPrefix(profile, "-") {
+		return fmt.Errorf("--profile takes a config profile name, got %q (use --timing for per-stage durations)", profile)
+	}
+	return nil
+}
+
 // bestEffortEnv reports whether the BAZEL_AFFECTED_TESTS_BEST_EFFORT
 // environment variable requests best-effort mode.
 func bestEffortEnv() bool {
@@ -389,6 +684,178 @@ func resolveQueryTimeout(cfg cliConfig, repoCfg *config.Config) time.Duration {
 	return repoCfg.ResolvedQueryTimeout(query.DefaultQueryTimeout)
 }
 
+// resolveBatch returns whether package queries are batched, honoring
+// precedence CLI flag > config > false.
+func resolveBatch(cfg cliConfig, repoCfg *config.Config) bool {
+	if cfg.batchSet {
+		return cfg.batch
+	}
+	if repoCfg != nil && repoCfg.BatchQueries != nil {
+		return *repoCfg.BatchQueries
+	}
+	return false
+}
+
+// resolveActionInputs returns whether rule granularity maps changed files to
+// the rules consuming them as inputs, honoring precedence CLI flag > config >
+// false.
+func resolveActionInputs(cfg cliConfig, repoCfg *config.Config) bool {
+	if cfg.actionInputSet {
+		return cfg.actionInputs
+	}
+	if repoCfg != nil && repoCfg.ActionInputs != nil {
+		return *repoCfg.ActionInputs
+	}
+	return false
+}
+
+// resolveIncrementalCache returns whether incremental cache validation is
+// used, honoring precedence CLI flag > config > false.
+func resolveIncrementalCache(cfg cliConfig, repoCfg *config.Config) bool {
+	if cfg.incrementalSet {
+		return cfg.incremental
+	}
+	if repoCfg != nil && repoCfg.IncrementalCache != nil {
+		return *repoCfg.IncrementalCache
+	}
+	return false
+}
+
+// resolveCquery returns whether the rdeps step runs as bazel cquery and the
+// build flags it runs with, honoring precedence CLI flag > config > plain
+// query with no flags for each.
+func resolveCquery(cfg cliConfig, repoCfg *config.Config) (bool, []string) {
+	enabled := false
+	var flags []string
+	if repoCfg != nil {
+		enabled = repoCfg.Cquery != nil && *repoCfg.Cquery
+		flags = repoCfg.CqueryFlags
+	}
+	if cfg.cquerySet {
+		enabled = cfg.cquery
+	}
+	if cfg.cqueryFlags != "" {
+		flags = strings.Fields(cfg.cqueryFlags)
+	}
+	return enabled, flags
+}
+
+// resolveUniverse returns the universe patterns, honoring precedence CLI
+// flag > config > the whole workspace (nil).
+func resolveUniverse(cfg cliConfig, repoCfg *config.Config) []string {
+	if cfg.universe != "" {
+		return strings.Fields(cfg.universe)
+	}
+	if repoCfg != nil {
+		return repoCfg.Universe
+	}
+	return nil
+}
+
+// resolveTestSizes returns the test sizes to keep, honoring precedence CLI
+// flag > config > all sizes (nil).
+func resolveTestSizes(cfg cliConfig, repoCfg *config.Config) []string {
+	if cfg.testSizes != "" {
+		return splitList(cfg.testSizes)
+	}
+	if repoCfg != nil {
+		return repoCfg.TestSizes
+	}
+	return nil
+}
+
+// resolveMaxTimeout returns the longest timeout to keep, honoring precedence
+// CLI flag > config > no limit ("").
+func resolveMaxTimeout(cfg cliConfig, repoCfg *config.Config) string {
+	if cfg.maxTimeout != "" {
+		return cfg.maxTimeout
+	}
+	if repoCfg != nil {
+		return repoCfg.MaxTimeout
+	}
+	return ""
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// resolveRemovedPackages returns whether removed packages are resolved via
+// the base revision, honoring precedence CLI flag > config > false.
+func resolveRemovedPackages(cfg cliConfig, repoCfg *config.Config) bool {
+	if cfg.removedSet {
+		return cfg.resolveRemoved
+	}
+	if repoCfg != nil {
+		return repoCfg.ResolveRemovedPackages
+	}
+	return false
+}
+
+// validGranularity reports whether g is an accepted --granularity value. The
+// empty string means the flag was not set.
+func validGranularity(g string) bool {
+	return g == "" || g == config.GranularityPackage || g == config.GranularityRule
+}
+
+// resolveGranularity returns the effective granularity, honoring precedence
+// CLI flag > config > config.GranularityPackage.
+func resolveGranularity(cfg cliConfig, repoCfg *config.Config) string {
+	if cfg.granularity != "" {
+		return cfg.granularity
+	}
+	return repoCfg.ResolvedGranularity(config.GranularityPackage)
+}
+
+// validPrecision reports whether p is an accepted --precision value. The
+// empty string means the flag was not set.
+func validPrecision(p string) bool {
+	return p == "" || p == config.PrecisionPackage || p == config.PrecisionFile
+}
+
+// resolvePrecision returns the effective precision, honoring precedence
+// CLI flag > config > config.PrecisionPackage.
+func resolvePrecision(cfg cliConfig, repoCfg *config.Config) string {
+	if cfg.precision != "" {
+		return cfg.precision
+	}
+	return repoCfg.ResolvedPrecision(config.PrecisionPackage)
+}
+
+// validCacheKey reports whether k is an accepted --cache-key value. The empty
+// string means the flag was not set.
+func validCacheKey(k string) bool {
+	return k == "" || k == config.CacheKeyWalk || k == config.CacheKeyGit
+}
+
+// resolveCacheKey returns the effective cache key strategy, honoring
+// precedence CLI flag > config > config.CacheKeyWalk.
+func resolveCacheKey(cfg cliConfig, repoCfg *config.Config) string {
+	if cfg.cacheKey != "" {
+		return cfg.cacheKey
+	}
+	return repoCfg.ResolvedCacheKey(config.CacheKeyWalk)
+}
+
+// resolveRemoteCache returns the effective remote cache URL, honoring
+// precedence CLI flag > config > none.
+func resolveRemoteCache(cfg cliConfig, repoCfg *config.Config) string {
+	if cfg.remoteCache != "" {
+		return cfg.remoteCache
+	}
+	if repoCfg != nil {
+		return repoCfg.RemoteCache
+	}
+	return ""
+}
+
 // partitionAbsolutePaths splits files into those that look like absolute
 // paths (leading "/") and the rest. Absolute paths are never legitimate
 // inputs because changed-file lists are always repo-relative; treating
@@ -406,25 +873,95 @@ func partitionAbsolutePaths(files []string) (absolute, relative []string) {
 }
 
 // queryTestsForPackages computes the cache key and resolves affected tests
-// for the given packages. Returns nil tests when packages is empty.
-func queryTestsForPackages(cfg cliConfig, repoCfg *config.Config, c *cache.Cache, repoRoot string, packages []string, timer *stageTimer) ([]string, error) {
-	if len(packages) == 0 {
+// for the given packages, keyed to the changed files that mapped to each.
+// Packages loading any of the changed bzlFiles are added first (see
+// expandBzlChanges). Returns nil tests when there is nothing to query.
+func queryTestsForPackages(cfg cliConfig, repoCfg *config.Config, c *cache.Cache, repoRoot string, filesByPkg map[string][]string, bzlFiles []string, timer *stageTimer, prov *provenance) ([]string, error) {
+	if len(filesByPkg) == 0 && len(bzlFiles) == 0 {
 		return nil, nil
 	}
 
+	if remote := resolveRemoteCache(cfg, repoCfg); remote != "" && !cfg.noCache {
+		c.SetRemote(cache.NewHTTPBackend(remote, cache.DefaultRemoteTimeout))
+	}
+	c.SetLimits(cacheLimits(repoCfg))
+	queriers := newWorkerQueriers(cfg, repoCfg)
 	stop := timer.stage("cache-key")
-	cacheKey := getCacheKey(c, cfg.noCache, repoRoot)
+	cacheKey := computeCacheKey(cfg, repoCfg, c, repoRoot, queriers[0].Fingerprint())
 	stop()
+	if cacheKey != "" {
+		loadTestIndex(c, cacheKey, queriers)
+	}
+
+	// Mark the key in use so a concurrent GC keeps it. Concurrent runs
+	// coordinate per entry instead (see cache.GetOrLock): a run waits only
+	// for an entry another run is computing, then finds it cached.
+	if cacheKey != "" {
+		if release, err := c.Use(cacheKey); err != nil {
+			slog.Warn("Failed to mark cache key in use", "error", err)
+		} else {
+			defer release()
+		}
+	}
+
+	if len(bzlFiles) > 0 {
+		stop = timer.stage("bzl-packages")
+		expanded, err := expandBzlChanges(filesByPkg, bzlFiles, queriers[0], c, cacheKey, cfg.noCache)
+		stop()
+		if err != nil {
+			return nil, err
+		}
+		filesByPkg = expanded
+		prov.setPackageFiles(filesByPkg)
+		if len(filesByPkg) == 0 {
+			return nil, nil
+		}
+	}
+
+	batch := resolveBatch(cfg, repoCfg)
+	if resolvePrecision(cfg, repoCfg) == config.PrecisionFile {
+		if resolveGranularity(cfg, repoCfg) == config.GranularityRule {
+			slog.Warn("File precision takes precedence over rule granularity")
+		}
+		stop = timer.stage("bazel-query")
+		tests, err := collectFileTests(filesByPkg, queriers, c, cacheKey, cfg.noCache, batch, prov)
+		stop()
+		return tests, err
+	}
+	if resolveGranularity(cfg, repoCfg) == config.GranularityRule {
+		stop = timer.stage("bazel-query")
+		tests, err := collectRuleTests(filesByPkg, queriers, c, cacheKey, cfg.noCache, batch, resolveActionInputs(cfg, repoCfg), prov)
+		stop()
+		return tests, err
+	}
 
-	querier := newQuerier(repoCfg)
-	querier.SetFailOnError(!resolveBestEffort(cfg, repoCfg))
-	querier.SetQueryTimeout(resolveQueryTimeout(cfg, repoCfg))
 	stop = timer.stage("bazel-query")
-	tests, err := collectAllTests(packages, querier, c, cacheKey, cfg.noCache)
+	tests, err := collectPackageTests(sortedKeys(filesByPkg), queriers, c, cacheKey, cfg.noCache, batch, prov)
 	stop()
 	return tests, err
 }
 
+// loadTestIndex makes queriers answer package queries from the
+// reverse-dependency index stored under cacheKey by "index build", if any.
+func loadTestIndex(c *cache.Cache, cacheKey string, queriers []*query.BazelQuerier) {
+	if cache.IsIncrementalKey(cacheKey) {
+		return
+	}
+	data, ok := c.GetIndex(cacheKey)
+	if !ok {
+		return
+	}
+	idx, err := query.DecodeTestIndex(data)
+	if err != nil {
+		slog.Warn("Ignoring unreadable test index", "error", err)
+		return
+	}
+	slog.Debug("Using reverse-dependency index", "tests", len(idx.Tests), "packages", len(idx.Packages))
+	for _, q := range queriers {
+		q.SetIndex(idx)
+	}
+}
+
 // rejectAbsolutePaths drops absolute paths from files. In strict mode any
 // absolute path is a fatal error; otherwise it logs a warning and continues
 // with the remaining repo-relative paths.
@@ -440,34 +977,54 @@ func rejectAbsolutePaths(files []string, strict bool) ([]string, error) {
 	return relative, nil
 }
 
-// findPackages resolves each changed file to its Bazel package, capped at
-// maxDepth parent hops. It returns the deduplicated list of packages found
-// and the files that did not resolve within the cap.
-func findPackages(repoRoot string, changedFiles []string, maxDepth int) (packages, unmapped []string) {
-	packageMap := make(map[string]bool)
+// groupFilesByPackage resolves each changed file to its Bazel package, capped
+// at maxDepth parent hops. It returns the changed files grouped by the package
+// they belong to and the files that did not resolve within the cap.
+func groupFilesByPackage(repoRoot string, changedFiles []string, maxDepth int) (filesByPkg map[string][]string, unmapped []string) {
+	filesByPkg = make(map[string][]string)
 	for _, file := range changedFiles {
 		slog.Debug("Processing file", "file", file)
 		if pkg, found := query.FindBazelPackage(repoRoot, file, maxDepth); found {
 			slog.Debug("Found package", "package", pkg)
-			packageMap[pkg] = true
+			filesByPkg[pkg] = append(filesByPkg[pkg], file)
 		} else {
 			slog.Debug("No Bazel package found for file", "file", file)
 			unmapped = append(unmapped, file)
 		}
 	}
+	return filesByPkg, unmapped
+}
 
-	for pkg := range packageMap {
-		packages = append(packages, pkg)
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	return packages, unmapped
+	sort.Strings(keys)
+	return keys
 }
 
-func collectAllTests(packages []string, querier *query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool) ([]string, error) {
+// collectPackageTests resolves package-level affected tests either with one
+// batched set of queries for all cache misses or with per-package queries,
+// spread across the worker queriers when there is more than one.
+func collectPackageTests(packages []string, queriers []*query.BazelQuerier, c *cache.Cache, cacheKey string, noCache, batch bool, prov *provenance) ([]string, error) {
+	switch {
+	case batch:
+		return collectAllTestsBatched(packages, queriers[0], c, cacheKey, noCache, prov)
+	case len(queriers) > 1:
+		return collectAllTestsParallel(packages, queriers, c, cacheKey, noCache, prov)
+	default:
+		return collectAllTests(packages, queriers[0], c, cacheKey, noCache, prov)
+	}
+}
+
+func collectAllTests(packages []string, querier *query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool, prov *provenance) ([]string, error) {
 	allTestsMap := make(map[string]bool)
 
 	// Process packages
 	for _, pkg := range packages {
-		tests, err := getPackageTests(pkg, querier, c, cacheKey, noCache)
+		tests, err := getPackageTests(pkg, querier, c, cacheKey, noCache, prov)
 		if err != nil {
 			return nil, err
 		}
@@ -483,25 +1040,104 @@ func collectAllTests(packages []string, querier *query.BazelQuerier, c *cache.Ca
 	return allTests, nil
 }
 
-func getPackageTests(pkg string, querier *query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool) ([]string, error) {
+// collectAllTestsBatched serves packages from the cache where possible and
+// resolves all misses with a single FindAffectedTestsBatched call, storing the
+// per-package attribution it returns so later runs hit the cache per package.
+func collectAllTestsBatched(packages []string, querier *query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool, prov *provenance) ([]string, error) {
+	useCache := !noCache && cacheKey != ""
+	allTestsMap := make(map[string]bool)
+
+	// The misses stay locked until the batched answer is stored. packages is
+	// sorted, so concurrent runs take the locks in the same order.
+	var misses []string
+	for _, pkg := range packages {
+		if useCache {
+			cachedTests, found, unlock := c.GetOrLock(cacheKey, pkg)
+			defer unlock()
+			if found {
+				prov.addPackageTests(pkg, cachedTests, true)
+				for _, test := range cachedTests {
+					allTestsMap[test] = true
+				}
+				continue
+			}
+		}
+		misses = append(misses, pkg)
+	}
+
+	if len(misses) > 0 {
+		slog.Debug("Batched query for cache misses", "count", len(misses))
+		byPkg, err := querier.FindAffectedTestsBatched(misses)
+		if err != nil {
+			return nil, fmt.Errorf("querying tests for %d packages: %w", len(misses), err)
+		}
+		// Incremental entries record the inputs of the whole batch, found
+		// with one query the first time they are needed.
+		inputs := sync.OnceValues(func() ([]string, error) { return querier.PackagesBuildInputs(misses) })
+		for pkg, tests := range byPkg {
+			prov.addPackageTests(pkg, tests, false)
+			for _, test := range tests {
+				allTestsMap[test] = true
+			}
+			if useCache {
+				storeTests(c, cacheKey, pkg, tests, inputs)
+			}
+		}
+	}
+
+	var allTests []string
+	for test := range allTestsMap {
+		allTests = append(allTests, test)
+	}
+	return allTests, nil
+}
+
+// storeTests caches tests under entry. Incremental cache keys also record the
+// build files the answer depended on, as reported by inputs; when those cannot
+// be determined the result is not cached, since an entry without inputs could
+// never be invalidated.
+func storeTests(c *cache.Cache, cacheKey, entry string, tests []string, inputs func() ([]string, error)) {
+	var err error
+	if cache.IsIncrementalKey(cacheKey) {
+		var files []string
+		if files, err = inputs(); err == nil {
+			err = c.SetWithInputs(cacheKey, entry, tests, files)
+		}
+	} else {
+		err = c.Set(cacheKey, entry, tests)
+	}
+	if err != nil {
+		slog.Debug("Failed to cache results", "entry", entry, "error", err)
+	}
+}
+
+func getPackageTests(pkg string, querier *query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool, prov *provenance) ([]string, error) {
+	return getPackageTestsContext(context.Background(), pkg, querier, c, cacheKey, noCache, prov)
+}
+
+// getPackageTestsContext is getPackageTests with a context that cancels the
+// package's Bazel queries.
+func getPackageTestsContext(ctx context.Context, pkg string, querier *query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool, prov *provenance) ([]string, error) {
 	if !noCache && cacheKey != "" {
-		if cachedTests, found := c.Get(cacheKey, pkg); found {
+		cachedTests, found, unlock := c.GetOrLock(cacheKey, pkg)
+		defer unlock()
+		if found {
+			prov.addPackageTests(pkg, cachedTests, true)
 			return cachedTests, nil
 		}
 	}
 
-	tests, err := querier.FindAffectedTests([]string{pkg})
+	tests, err := querier.FindAffectedTestsContext(ctx, []string{pkg})
 	if err != nil {
 		return nil, fmt.Errorf("querying tests for package %s: %w", pkg, err)
 	}
 
 	// Store in cache
 	if !noCache && cacheKey != "" {
-		if err := c.Set(cacheKey, pkg, tests); err != nil {
-			slog.Debug("Failed to cache results", "package", pkg, "error", err)
-		}
+		storeTests(c, cacheKey, pkg, tests, func() ([]string, error) { return querier.PackageBuildInputs(pkg) })
 	}
 
+	prov.addPackageTests(pkg, tests, false)
 	return tests, nil
 }
 
@@ -6,11 +6,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
 	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
 	"github.com/jaeyeom/bazel-affected-tests/internal/query"
 	executor "github.com/jaeyeom/go-cmdexec"
 )
@@ -130,7 +132,7 @@ func TestGetPackageTests_UsesCacheWhenAvailable(t *testing.T) {
 	mockExec := executor.NewMockExecutor()
 	q := query.NewBazelQuerierWithExecutor(mockExec)
 
-	got, err := getPackageTests(pkg, q, c, cacheKey, false)
+	got, err := getPackageTests(pkg, q, c, cacheKey, false, nil)
 	if err != nil {
 		t.Fatalf("getPackageTests() error: %v", err)
 	}
@@ -169,7 +171,7 @@ func TestGetPackageTests_CacheMissQueriesAndStores(t *testing.T) {
 		Build()
 	q := query.NewBazelQuerierWithExecutor(mockExec)
 
-	gotRaw, err := getPackageTests(pkg, q, c, cacheKey, false)
+	gotRaw, err := getPackageTests(pkg, q, c, cacheKey, false, nil)
 	if err != nil {
 		t.Fatalf("getPackageTests() error: %v", err)
 	}
@@ -191,6 +193,55 @@ func TestGetPackageTests_CacheMissQueriesAndStores(t *testing.T) {
 	}
 }
 
+func TestGetPackageTests_IncrementalCacheRecordsInputs(t *testing.T) {
+	repo := t.TempDir()
+	writeFile(t, filepath.Join(repo, "pkg/foo/BUILD"), "# foo", 0o600)
+	writeFile(t, filepath.Join(repo, "unrelated/BUILD"), "# unrelated", 0o600)
+	c := cache.NewRepoCache(t.TempDir(), repo)
+	cacheKey := c.IncrementalKey()
+	pkg := "//pkg/foo"
+
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', //pkg/foo:*)").
+		WillSucceed("//pkg/foo:unit_test", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', //pkg/foo/...)").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps", "rdeps(//..., //pkg/foo:*) intersect kind('.*_test rule', //...)").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--nohost_deps", "--noimplicit_deps", "buildfiles(rdeps(//..., //pkg/foo:*) union //pkg/foo/...)").
+		WillSucceed("//pkg/foo:BUILD", 0).
+		Once().
+		Build()
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+
+	want := []string{"//pkg/foo:unit_test"}
+	for i := 0; i < 2; i++ {
+		got, err := getPackageTests(pkg, q, c, cacheKey, false, nil)
+		if err != nil {
+			t.Fatalf("getPackageTests() error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("getPackageTests() = %v, want %v", got, want)
+		}
+		// An edit outside the recorded inputs must not invalidate the entry.
+		writeFile(t, filepath.Join(repo, "unrelated/BUILD"), "# unrelated changed", 0o600)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+
+	writeFile(t, filepath.Join(repo, "pkg/foo/BUILD"), "# foo changed", 0o600)
+	if _, found := c.Get(cacheKey, pkg); found {
+		t.Error("expected entry to be invalidated by a recorded input edit")
+	}
+}
+
 func TestGetPackageTests_NoCacheFlagBypassesReadAndWrite(t *testing.T) {
 	tmpDir := t.TempDir()
 	c := cache.NewCache(tmpDir)
@@ -215,7 +266,7 @@ func TestGetPackageTests_NoCacheFlagBypassesReadAndWrite(t *testing.T) {
 		Build()
 	q := query.NewBazelQuerierWithExecutor(mockExec)
 
-	got, err := getPackageTests(pkg, q, c, cacheKey, true)
+	got, err := getPackageTests(pkg, q, c, cacheKey, true, nil)
 	if err != nil {
 		t.Fatalf("getPackageTests() error: %v", err)
 	}
@@ -256,7 +307,7 @@ func TestGetPackageTests_EmptyKeyBypassesReadAndWrite(t *testing.T) {
 		Build()
 	q := query.NewBazelQuerierWithExecutor(mockExec)
 
-	got, err := getPackageTests(pkg, q, c, "", false)
+	got, err := getPackageTests(pkg, q, c, "", false, nil)
 	if err != nil {
 		t.Fatalf("getPackageTests() error: %v", err)
 	}
@@ -300,7 +351,7 @@ func TestCollectAllTests_DeduplicatesAcrossPackages(t *testing.T) {
 	mockExec := executor.NewMockExecutor()
 	q := query.NewBazelQuerierWithExecutor(mockExec)
 
-	gotRaw, err := collectAllTests([]string{"//pkg/foo", "//pkg/bar"}, q, c, cacheKey, false)
+	gotRaw, err := collectAllTests([]string{"//pkg/foo", "//pkg/bar"}, q, c, cacheKey, false, nil)
 	if err != nil {
 		t.Fatalf("collectAllTests() error: %v", err)
 	}
@@ -352,7 +403,7 @@ func TestReadFilesFrom_EmptyFile(t *testing.T) {
 	}
 }
 
-func TestFindPackages(t *testing.T) {
+func TestGroupFilesByPackage(t *testing.T) {
 	tests := []struct {
 		name         string
 		buildFiles   []string
@@ -457,8 +508,8 @@ func TestFindPackages(t *testing.T) {
 				}
 			}
 
-			packages, unmapped := findPackages(tmpDir, tt.files, tt.maxDepth)
-			slices.Sort(packages)
+			filesByPkg, unmapped := groupFilesByPackage(tmpDir, tt.files, tt.maxDepth)
+			packages := sortedKeys(filesByPkg)
 
 			if !slices.Equal(packages, tt.wantPackages) {
 				t.Errorf("packages = %v, want %v", packages, tt.wantPackages)
@@ -664,9 +715,118 @@ func TestResolveQueryTimeout(t *testing.T) {
 	}
 }
 
+func TestResolveGranularity(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     cliConfig
+		repoCfg *config.Config
+		want    string
+	}{
+		{"nothing set uses package", cliConfig{}, nil, config.GranularityPackage},
+		{"config overrides default", cliConfig{}, &config.Config{Granularity: config.GranularityRule}, config.GranularityRule},
+		{"flag overrides config", cliConfig{granularity: config.GranularityPackage}, &config.Config{Granularity: config.GranularityRule}, config.GranularityPackage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveGranularity(tt.cfg, tt.repoCfg); got != tt.want {
+				t.Errorf("resolveGranularity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvePrecision(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     cliConfig
+		repoCfg *config.Config
+		want    string
+	}{
+		{"nothing set uses package", cliConfig{}, nil, config.PrecisionPackage},
+		{"config overrides default", cliConfig{}, &config.Config{Precision: config.PrecisionFile}, config.PrecisionFile},
+		{"flag overrides config", cliConfig{precision: config.PrecisionPackage}, &config.Config{Precision: config.PrecisionFile}, config.PrecisionPackage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolvePrecision(tt.cfg, tt.repoCfg); got != tt.want {
+				t.Errorf("resolvePrecision() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCacheKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     cliConfig
+		repoCfg *config.Config
+		want    string
+	}{
+		{"default", cliConfig{}, nil, config.CacheKeyWalk},
+		{"config", cliConfig{}, &config.Config{CacheKey: config.CacheKeyGit}, config.CacheKeyGit},
+		{"flag overrides config", cliConfig{cacheKey: config.CacheKeyWalk}, &config.Config{CacheKey: config.CacheKeyGit}, config.CacheKeyWalk},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveCacheKey(tt.cfg, tt.repoCfg); got != tt.want {
+				t.Errorf("resolveCacheKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCquery(t *testing.T) {
+	enabled := true
+	repoCfg := &config.Config{Cquery: &enabled, CqueryFlags: []string{"--config=linux"}}
+	tests := []struct {
+		name      string
+		cfg       cliConfig
+		repoCfg   *config.Config
+		wantOn    bool
+		wantFlags []string
+	}{
+		{"default", cliConfig{}, nil, false, nil},
+		{"config", cliConfig{}, repoCfg, true, []string{"--config=linux"}},
+		{"flag disables", cliConfig{cquery: false, cquerySet: true}, repoCfg, false, []string{"--config=linux"}},
+		{"flags override config", cliConfig{cqueryFlags: "--config=macos  --cpu=arm64"}, repoCfg, true, []string{"--config=macos", "--cpu=arm64"}},
+		{"flag enables", cliConfig{cquery: true, cquerySet: true}, nil, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			on, flags := resolveCquery(tt.cfg, tt.repoCfg)
+			if on != tt.wantOn || !reflect.DeepEqual(flags, tt.wantFlags) {
+				t.Errorf("resolveCquery() = %v, %v, want %v, %v", on, flags, tt.wantOn, tt.wantFlags)
+			}
+		})
+	}
+}
+
+func TestResolveUniverse(t *testing.T) {
+	repoCfg := &config.Config{Universe: []string{"//...", "-//third_party/..."}}
+	tests := []struct {
+		name    string
+		cfg     cliConfig
+		repoCfg *config.Config
+		want    []string
+	}{
+		{"default", cliConfig{}, nil, nil},
+		{"config", cliConfig{}, repoCfg, []string{"//...", "-//third_party/..."}},
+		{"flag overrides config", cliConfig{universe: "//src/...  -//src/experimental/..."}, repoCfg, []string{"//src/...", "-//src/experimental/..."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveUniverse(tt.cfg, tt.repoCfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveUniverse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestGetCacheKey_NoCacheReturnsEmpty(t *testing.T) {
 	c := cache.NewCache(t.TempDir())
-	key := getCacheKey(c, true, "/some/repo")
+	key := getCacheKey(c, true, "/some/repo", config.CacheKeyWalk)
 	if key != "" {
 		t.Errorf("expected empty key with noCache=true, got %q", key)
 	}
@@ -763,7 +923,10 @@ func TestGetChangedFiles_FilesFrom(t *testing.T) {
 	if err != nil {
 		t.Fatalf("getChangedFiles() error: %v", err)
 	}
-	want := []string{"a.go", "b.go"}
+	want := []git.FileChange{
+		{Status: git.StatusModified, Path: "a.go"},
+		{Status: git.StatusModified, Path: "b.go"},
+	}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("getChangedFiles() = %v, want %v", got, want)
 	}
@@ -788,7 +951,7 @@ func TestCollectAllTests_ErrorPropagation(t *testing.T) {
 		Build()
 	q := query.NewBazelQuerierWithExecutor(mockExec)
 
-	_, err := collectAllTests([]string{"//pkg/foo"}, q, c, "", false)
+	_, err := collectAllTests([]string{"//pkg/foo"}, q, c, "", false, nil)
 	if err == nil {
 		t.Fatal("expected error from collectAllTests when query fails")
 	}
@@ -804,8 +967,141 @@ func TestGetPackageTests_QueryError(t *testing.T) {
 		Build()
 	q := query.NewBazelQuerierWithExecutor(mockExec)
 
-	_, err := getPackageTests("//pkg/foo", q, c, "", false)
+	_, err := getPackageTests("//pkg/foo", q, c, "", false, nil)
 	if err == nil {
 		t.Fatal("expected error from getPackageTests when query fails")
 	}
 }
+
+func TestResolveBatch(t *testing.T) {
+	boolPtr := func(b bool) *bool { return &b }
+
+	tests := []struct {
+		name    string
+		cfg     cliConfig
+		repoCfg *config.Config
+		want    bool
+	}{
+		{"nothing set is false", cliConfig{}, nil, false},
+		{"config true, flag not set", cliConfig{}, &config.Config{BatchQueries: boolPtr(true)}, true},
+		{"flag false overrides config true", cliConfig{batch: false, batchSet: true}, &config.Config{BatchQueries: boolPtr(true)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveBatch(tt.cfg, tt.repoCfg); got != tt.want {
+				t.Errorf("resolveBatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectAllTestsBatched_QueriesOnlyMissesAndCachesPerPackage(t *testing.T) {
+	c := cache.NewCache(t.TempDir())
+	cacheKey := "k1"
+	if err := c.Set(cacheKey, "//pkg/hit", []string{"//pkg/hit:cached_test"}); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', set(//pkg/miss:*))").
+		WillSucceed("//pkg/miss:unit_test", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., set(//pkg/miss:*)) intersect kind('.*_test rule', //...)").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+	q.SetEnableSubpackageQuery(false)
+
+	got, err := collectAllTestsBatched([]string{"//pkg/hit", "//pkg/miss"}, q, c, cacheKey, false, nil)
+	if err != nil {
+		t.Fatalf("collectAllTestsBatched() error: %v", err)
+	}
+	want := []string{"//pkg/hit:cached_test", "//pkg/miss:unit_test"}
+	if !reflect.DeepEqual(sorted(got), want) {
+		t.Errorf("collectAllTestsBatched() = %v, want %v", got, want)
+	}
+
+	cached, found := c.Get(cacheKey, "//pkg/miss")
+	if !found || !reflect.DeepEqual(cached, []string{"//pkg/miss:unit_test"}) {
+		t.Errorf("cached //pkg/miss = %v (found=%v), want [//pkg/miss:unit_test]", cached, found)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestCollectAllTestsBatched_IncrementalInputsQueriedOnce(t *testing.T) {
+	repo := t.TempDir()
+	writeFile(t, filepath.Join(repo, "pkg/a/BUILD"), "# a", 0o600)
+	writeFile(t, filepath.Join(repo, "pkg/b/BUILD"), "# b", 0o600)
+	c := cache.NewRepoCache(t.TempDir(), repo)
+	cacheKey := c.IncrementalKey()
+
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', set(//pkg/a:* //pkg/b:*))").
+		WillSucceed("//pkg/a:a_test\n//pkg/b:b_test", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., set(//pkg/a:* //pkg/b:*)) intersect kind('.*_test rule', //...)").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--nohost_deps", "--noimplicit_deps",
+		"buildfiles(rdeps(//..., set(//pkg/a:* //pkg/b:*)))").
+		WillSucceed("//pkg/a:BUILD\n//pkg/b:BUILD", 0).
+		Once().
+		Build()
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+	q.SetEnableSubpackageQuery(false)
+
+	if _, err := collectAllTestsBatched([]string{"//pkg/a", "//pkg/b"}, q, c, cacheKey, false, nil); err != nil {
+		t.Fatalf("collectAllTestsBatched() error: %v", err)
+	}
+	for _, pkg := range []string{"//pkg/a", "//pkg/b"} {
+		if _, found := c.Get(cacheKey, pkg); !found {
+			t.Errorf("expected incremental entry for %s", pkg)
+		}
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestCheckProfileFlag(t *testing.T) {
+	for _, profile := range []string{"", "ci", "pre-commit"} {
+		if err := checkProfileFlag(profile); err != nil {
+			t.Errorf("checkProfileFlag(%q) error = %v, want nil", profile, err)
+		}
+	}
+	// The old boolean --profile followed by another flag.
+	err := checkProfileFlag("--staged")
+	if err == nil || !strings.Contains(err.Error(), "--timing") {
+		t.Errorf("checkProfileFlag(--staged) error = %v, want one pointing at --timing", err)
+	}
+}
+
+func TestResolveProfile(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  cliConfig
+		env  string
+		want string
+	}{
+		{"nothing set", cliConfig{}, "", ""},
+		{"env used when flag unset", cliConfig{}, "precommit", "precommit"},
+		{"flag overrides env", cliConfig{profile: "ci"}, "precommit", "ci"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(profileEnvVar, tt.env)
+			if got := resolveProfile(tt.cfg); got != tt.want {
+				t.Errorf("resolveProfile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
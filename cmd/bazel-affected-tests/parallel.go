@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+)
+
+// newWorkerQueriers returns one configured querier per query job. With an
+// isolated output base and more than one job, each worker gets its own
+// subdirectory (and so its own Bazel server); otherwise all workers share the
+// same server and their queries serialize on its lock.
+func newWorkerQueriers(cfg cliConfig, repoCfg *config.Config) []*query.BazelQuerier {
+	jobs := resolveQueryJobs(cfg, repoCfg)
+	if jobs > 1 && resolveQueryOutputBase(cfg, repoCfg) == "" {
+		slog.Debug("Running concurrent queries against the default Bazel server; they will serialize on its lock",
+			"jobs", jobs)
+	}
+
+	queriers := make([]*query.BazelQuerier, jobs)
+	for i := range queriers {
+		queriers[i] = newWorkerQuerier(cfg, repoCfg, i)
+	}
+	return queriers
+}
+
+// newWorkerQuerier returns the querier newWorkerQueriers builds for worker i.
+// Queries outside the worker pool use worker 0's, so they reuse its Bazel
+// server.
+func newWorkerQuerier(cfg cliConfig, repoCfg *config.Config, i int) *query.BazelQuerier {
+	q := newQuerier(repoCfg)
+	q.SetFailOnError(!resolveBestEffort(cfg, repoCfg))
+	q.SetQueryTimeout(resolveQueryTimeout(cfg, repoCfg))
+	q.SetCquery(resolveCquery(cfg, repoCfg))
+	q.SetUniverse(resolveUniverse(cfg, repoCfg))
+	switch outputBase := resolveQueryOutputBase(cfg, repoCfg); {
+	case outputBase == "":
+	case resolveQueryJobs(cfg, repoCfg) == 1:
+		q.SetOutputBase(outputBase)
+	default:
+		q.SetOutputBase(filepath.Join(outputBase, fmt.Sprintf("worker-%d", i)))
+	}
+	return q
+}
+
+// collectAllTestsParallel is collectAllTests with one worker goroutine per
+// querier pulling packages from a shared queue. The first query error cancels
+// the remaining work and is returned; errors caused by that cancellation are
+// discarded. The merged result is sorted so output does not depend on
+// scheduling.
+func collectAllTestsParallel(packages []string, queriers []*query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool, prov *provenance) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	results := make([][]string, len(packages))
+	work := make(chan int)
+
+	for _, q := range queriers {
+		wg.Add(1)
+		go func(q *query.BazelQuerier) {
+			defer wg.Done()
+			for i := range work {
+				tests, err := getPackageTestsContext(ctx, packages[i], q, c, cacheKey, noCache, prov)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+					continue
+				}
+				results[i] = tests
+			}
+		}(q)
+	}
+
+feed:
+	for i := range packages {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	allTestsMap := make(map[string]bool)
+	for _, tests := range results {
+		for _, test := range tests {
+			allTestsMap[test] = true
+		}
+	}
+	allTests := make([]string, 0, len(allTestsMap))
+	for test := range allTestsMap {
+		allTests = append(allTests, test)
+	}
+	sort.Strings(allTests)
+	return allTests, nil
+}
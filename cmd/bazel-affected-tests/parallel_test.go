@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+func TestCollectAllTestsParallel_MergesDeterministically(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	for _, pkg := range []string{"//pkg/a", "//pkg/b", "//pkg/c"} {
+		name := strings.TrimPrefix(pkg, "//pkg/")
+		mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', "+pkg+":*)").
+			WillSucceed(pkg+":"+name+"_test", 0).
+			Once().
+			Build()
+		mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+			"rdeps(//..., "+pkg+":*) intersect kind('.*_test rule', //...)").
+			WillSucceed("//shared:test", 0).
+			Once().
+			Build()
+	}
+	queriers := make([]*query.BazelQuerier, 2)
+	for i := range queriers {
+		queriers[i] = query.NewBazelQuerierWithExecutor(mockExec)
+		queriers[i].SetEnableSubpackageQuery(false)
+	}
+
+	got, err := collectAllTestsParallel([]string{"//pkg/c", "//pkg/a", "//pkg/b"}, queriers, cache.NewCache(t.TempDir()), "", true, nil)
+	if err != nil {
+		t.Fatalf("collectAllTestsParallel() error: %v", err)
+	}
+	want := []string{"//pkg/a:a_test", "//pkg/b:b_test", "//pkg/c:c_test", "//shared:test"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collectAllTestsParallel() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestCollectAllTestsParallel_ReturnsFirstError(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', //pkg/bad:*)").
+		WillFail("ERROR: no such package", 1).
+		Build()
+	q := query.NewBazelQuerierWithExecutor(mockExec)
+	q.SetFailOnError(true)
+
+	_, err := collectAllTestsParallel([]string{"//pkg/bad"}, []*query.BazelQuerier{q, q}, cache.NewCache(t.TempDir()), "", true, nil)
+	if err == nil {
+		t.Fatal("expected error from collectAllTestsParallel when a query fails")
+	}
+	if !strings.Contains(err.Error(), "//pkg/bad") {
+		t.Errorf("error %q should name the failing package", err)
+	}
+}
+
+func TestNewWorkerQueriers(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     cliConfig
+		repoCfg *config.Config
+		want    int
+	}{
+		{"default is one worker", cliConfig{}, nil, 1},
+		{"config sets jobs", cliConfig{}, &config.Config{QueryJobs: 3}, 3},
+		{"flag overrides config", cliConfig{jobs: 2}, &config.Config{QueryJobs: 3}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := len(newWorkerQueriers(tt.cfg, tt.repoCfg)); got != tt.want {
+				t.Errorf("len(newWorkerQueriers()) = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
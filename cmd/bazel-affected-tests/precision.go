@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+)
+
+// collectFileTests resolves affected tests at file precision. Each changed
+// file is converted to its source-file label, and the labels Bazel knows are
+// queried with a single rdeps, so only targets that consume a changed file
+// are traversed. A package with any changed file Bazel does not know as a
+// target (a BUILD or .bzl edit, unlisted data, a deleted file) falls back to
+// the package-level queries, as does every package if the lookup fails.
+func collectFileTests(filesByPkg map[string][]string, queriers []*query.BazelQuerier, c *cache.Cache, cacheKey string, noCache, batch bool, prov *provenance) ([]string, error) {
+	querier := queriers[0]
+	labels, fallback := resolveSourceFiles(querier, filesByPkg)
+	slog.Debug("File precision resolved", "source_files", len(labels), "fallback_packages", len(fallback))
+
+	testsSet := make(map[string]bool)
+	if len(labels) > 0 {
+		tests, err := getSourceFileTests(labels, filesByPkg, fallback, querier, c, cacheKey, noCache, prov)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tests {
+			testsSet[t] = true
+		}
+	}
+	if len(fallback) > 0 {
+		tests, err := collectPackageTests(fallback, queriers, c, cacheKey, noCache, batch, prov)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tests {
+			testsSet[t] = true
+		}
+	}
+
+	allTests := make([]string, 0, len(testsSet))
+	for t := range testsSet {
+		allTests = append(allTests, t)
+	}
+	return allTests, nil
+}
+
+// sourceFileQuerier is the subset of *query.BazelQuerier that source-file
+// resolution depends on.
+type sourceFileQuerier interface {
+	SourceFileTargets(fileLabels []string) ([]string, error)
+}
+
+// resolveSourceFiles maps the changed files of each package to their
+// source-file labels, verifying with one query that Bazel knows them as
+// targets. It returns the sorted labels of the packages whose files all
+// resolved, and the packages that must fall back to package precision.
+func resolveSourceFiles(querier sourceFileQuerier, filesByPkg map[string][]string) (labels, fallback []string) {
+	pkgs := sortedKeys(filesByPkg)
+	pkgLabels := make(map[string][]string, len(pkgs))
+	var candidates []string
+	for _, pkg := range pkgs {
+		var ls []string
+		for _, f := range filesByPkg[pkg] {
+			l := query.SourceFileLabel(pkg, f)
+			// A BUILD or .bzl edit changes rule definitions, not an input
+			// file, so only the package surface covers it.
+			if l == "" || git.IsBuildFile(f) {
+				slog.Debug("No source-file target for file, falling back to package precision", "file", f)
+				ls = nil
+				break
+			}
+			ls = append(ls, l)
+		}
+		if ls == nil {
+			fallback = append(fallback, pkg)
+			continue
+		}
+		pkgLabels[pkg] = ls
+		candidates = append(candidates, ls...)
+	}
+	if len(candidates) == 0 {
+		return nil, fallback
+	}
+
+	known, err := querier.SourceFileTargets(candidates)
+	if err != nil {
+		slog.Warn("Failed to list source files, falling back to package precision", "error", err)
+		return nil, pkgs
+	}
+	knownSet := make(map[string]bool, len(known))
+	for _, l := range known {
+		knownSet[l] = true
+	}
+
+	labelSet := make(map[string]bool)
+	for _, pkg := range sortedKeys(pkgLabels) {
+		if !allKnown(pkgLabels[pkg], knownSet) {
+			fallback = append(fallback, pkg)
+			continue
+		}
+		for _, l := range pkgLabels[pkg] {
+			labelSet[l] = true
+		}
+	}
+	sort.Strings(fallback)
+	return sortedKeys(labelSet), fallback
+}
+
+// allKnown reports whether every label is in known, logging the first that
+// is not.
+func allKnown(labels []string, known map[string]bool) bool {
+	for _, l := range labels {
+		if !known[l] {
+			slog.Debug("File is not a Bazel target, falling back to package precision", "file", l)
+			return false
+		}
+	}
+	return true
+}
+
+// getSourceFileTests returns the tests affected by the given source-file
+// labels, reading from and writing to the cache under a key derived from the
+// label set.
+func getSourceFileTests(labels []string, filesByPkg map[string][]string, fallback []string, querier *query.BazelQuerier, c *cache.Cache, cacheKey string, noCache bool, prov *provenance) ([]string, error) {
+	pkgs, files := preciseFiles(filesByPkg, fallback)
+	storeKey := labelSetCacheKey("files", labels)
+	if !noCache && cacheKey != "" {
+		cachedTests, found, unlock := c.GetOrLock(cacheKey, storeKey)
+		defer unlock()
+		if found {
+			prov.addSourceFileTests(pkgs, files, cachedTests, true)
+			return cachedTests, nil
+		}
+	}
+
+	tests, err := querier.FindAffectedTestsForFiles(labels)
+	if err != nil {
+		return nil, fmt.Errorf("querying tests for source files: %w", err)
+	}
+
+	if !noCache && cacheKey != "" {
+		storeTests(c, cacheKey, storeKey, tests, func() ([]string, error) { return querier.RuleBuildInputs(labels) })
+	}
+	prov.addSourceFileTests(pkgs, files, tests, false)
+	return tests, nil
+}
+
+// preciseFiles returns the packages of filesByPkg outside fallback and their
+// changed files, in package order.
+func preciseFiles(filesByPkg map[string][]string, fallback []string) (pkgs, files []string) {
+	skip := make(map[string]bool, len(fallback))
+	for _, pkg := range fallback {
+		skip[pkg] = true
+	}
+	for _, pkg := range sortedKeys(filesByPkg) {
+		if skip[pkg] {
+			continue
+		}
+		pkgs = append(pkgs, pkg)
+		files = append(files, filesByPkg[pkg]...)
+	}
+	return pkgs, files
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakeSourceFileQuerier knows the source-file targets in known.
+type fakeSourceFileQuerier struct {
+	known []string
+	err   error
+	asked []string
+}
+
+func (f *fakeSourceFileQuerier) SourceFileTargets(fileLabels []string) ([]string, error) {
+	f.asked = append(f.asked, fileLabels...)
+	if f.err != nil {
+		return nil, f.err
+	}
+	knownSet := make(map[string]bool)
+	for _, l := range f.known {
+		knownSet[l] = true
+	}
+	var out []string
+	for _, l := range fileLabels {
+		if knownSet[l] {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+func TestResolveSourceFiles(t *testing.T) {
+	fake := &fakeSourceFileQuerier{known: []string{"//pkg/foo:a.go", "//pkg/foo:sub/b.go", "//pkg/data:c.go"}}
+	filesByPkg := map[string][]string{
+		"//pkg/foo":   {"pkg/foo/a.go", "pkg/foo/sub/b.go"},
+		"//pkg/data":  {"pkg/data/c.go", "pkg/data/unlisted.json"},
+		"//pkg/build": {"pkg/build/BUILD.bazel", "pkg/build/d.go"},
+	}
+
+	labels, fallback := resolveSourceFiles(fake, filesByPkg)
+	if want := []string{"//pkg/foo:a.go", "//pkg/foo:sub/b.go"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+	if want := []string{"//pkg/build", "//pkg/data"}; !reflect.DeepEqual(fallback, want) {
+		t.Errorf("fallback = %v, want %v", fallback, want)
+	}
+	// A package with a BUILD edit is not looked up at all.
+	for _, l := range fake.asked {
+		if l == "//pkg/build:d.go" {
+			t.Errorf("looked up %s of a package that already fell back", l)
+		}
+	}
+}
+
+func TestResolveSourceFiles_LookupError(t *testing.T) {
+	fake := &fakeSourceFileQuerier{err: errors.New("bazel failed")}
+	filesByPkg := map[string][]string{
+		"//pkg/foo": {"pkg/foo/a.go"},
+		"//pkg/bar": {"pkg/bar/BUILD"},
+	}
+
+	labels, fallback := resolveSourceFiles(fake, filesByPkg)
+	if len(labels) != 0 {
+		t.Errorf("labels = %v, want none", labels)
+	}
+	if want := []string{"//pkg/bar", "//pkg/foo"}; !reflect.DeepEqual(fallback, want) {
+		t.Errorf("fallback = %v, want %v", fallback, want)
+	}
+}
+
+func TestPreciseFiles(t *testing.T) {
+	filesByPkg := map[string][]string{
+		"//a": {"a/x.go"},
+		"//b": {"b/y.go", "b/z.go"},
+		"//c": {"c/BUILD"},
+	}
+	pkgs, files := preciseFiles(filesByPkg, []string{"//c"})
+	if want := []string{"//a", "//b"}; !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("pkgs = %v, want %v", pkgs, want)
+	}
+	if want := []string{"a/x.go", "b/y.go", "b/z.go"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+}
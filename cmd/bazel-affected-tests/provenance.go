@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+)
+
+const (
+	outputFormatText = "text"
+	outputFormatJSON = "json"
+)
+
+// Sources a selected target can come from, as reported by --output=json.
+const (
+	sourceSamePackage    = "same_package"
+	sourceSubpackage     = "subpackage"
+	sourceRdeps          = "rdeps"
+	sourceOwnerRules     = "owner_rules"
+	sourceSourceFiles    = "source_files"
+	sourceRemovedPackage = "removed_package"
+	sourceConfigRule     = "config_rule"
+)
+
+// provenance records why each target was selected, for --output=json. A nil
+// or disabled recorder is a no-op, so the query paths record unconditionally.
+// It is safe for concurrent use by the parallel query workers.
+type provenance struct {
+	enabled bool
+
+	// subpackages mirrors enable_subpackage_query: without the sub-package
+	// query, a test below the package can only have come from rdeps.
+	subpackages bool
+
+	mu         sync.Mutex
+	filesByPkg map[string][]string
+	reasons    map[string][]jsonTargetReason
+}
+
+func newProvenance(enabled bool) *provenance {
+	return &provenance{enabled: enabled, subpackages: true, reasons: make(map[string][]jsonTargetReason)}
+}
+
+// setSubpackageQuery records whether the sub-package test query ran, so
+// addPackageTests does not credit it with tests it could not have found.
+func (p *provenance) setSubpackageQuery(enabled bool) {
+	if p == nil || !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subpackages = enabled
+}
+
+// setPackageFiles records which changed files mapped to each package, so
+// later per-package records can name the files that led to a target.
+func (p *provenance) setPackageFiles(filesByPkg map[string][]string) {
+	if p == nil || !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filesByPkg = filesByPkg
+}
+
+// addPackageTests records the tests selected for pkg. The query that produced
+// each test is inferred from its label the same way batched attribution does:
+// a test in pkg itself came from the same-package query, one below pkg from
+// the sub-package query if it ran, and anything else from rdeps. This works equally
+// for cached results, which store only labels.
+func (p *provenance) addPackageTests(pkg string, tests []string, cached bool) {
+	if p == nil || !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	files := p.filesByPkg[pkg]
+	for _, test := range tests {
+		p.add(test, jsonTargetReason{
+			Source:   testSource(pkg, test, p.subpackages),
+			Packages: []string{pkg},
+			Files:    files,
+			Cached:   cached,
+		})
+	}
+}
+
+// addOwnerRuleTests records tests selected by a rule-granularity rdeps query
+// over owners. The files are those of the owners' packages.
+func (p *provenance) addOwnerRuleTests(owners, tests []string, cached bool) {
+	if p == nil || !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pkgSet := make(map[string]bool)
+	for _, o := range owners {
+		pkg, _, _ := strings.Cut(o, ":")
+		pkgSet[pkg] = true
+	}
+	pkgs := sortedKeys(pkgSet)
+	var files []string
+	for _, pkg := range pkgs {
+		files = append(files, p.filesByPkg[pkg]...)
+	}
+	for _, test := range tests {
+		p.add(test, jsonTargetReason{
+			Source:   sourceOwnerRules,
+			Packages: pkgs,
+			Rules:    owners,
+			Files:    files,
+			Cached:   cached,
+		})
+	}
+}
+
+// addSourceFileTests records tests selected by a file-precision rdeps query
+// over the source-file targets of files, which lie in pkgs.
+func (p *provenance) addSourceFileTests(pkgs, files, tests []string, cached bool) {
+	if p == nil || !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, test := range tests {
+		p.add(test, jsonTargetReason{
+			Source:   sourceSourceFiles,
+			Packages: pkgs,
+			Files:    files,
+			Cached:   cached,
+		})
+	}
+}
+
+// addRemovedPackageTests records tests that depended on packages removed
+// since the base revision.
+func (p *provenance) addRemovedPackageTests(removed map[string][]string, tests []string) {
+	if p == nil || !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pkgs := sortedKeys(removed)
+	var files []string
+	for _, pkg := range pkgs {
+		files = append(files, removed[pkg]...)
+	}
+	for _, test := range tests {
+		p.add(test, jsonTargetReason{Source: sourceRemovedPackage, Packages: pkgs, Files: files})
+	}
+}
+
+// addConfigRules records targets added by matching config rules.
+func (p *provenance) addConfigRules(matches []config.RuleMatch) {
+	if p == nil || !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range matches {
+		for _, target := range m.Rule.Targets {
+			p.add(target, jsonTargetReason{Source: sourceConfigRule, Patterns: m.Rule.Patterns, Files: m.Files})
+		}
+	}
+}
+
+func (p *provenance) add(target string, r jsonTargetReason) {
+	if r.Files == nil {
+		r.Files = []string{}
+	}
+	p.reasons[target] = append(p.reasons[target], r)
+}
+
+// testSource classifies test relative to the package it was selected for.
+// subpackages reports whether the sub-package test query ran; without it a
+// test below pkg was found by rdeps.
+func testSource(pkg, test string, subpackages bool) string {
+	testPkg, _, _ := strings.Cut(test, ":")
+	switch {
+	case testPkg == pkg:
+		return sourceSamePackage
+	case subpackages && pkg != "//" && strings.HasPrefix(testPkg, pkg+"/"):
+		return sourceSubpackage
+	default:
+		return sourceRdeps
+	}
+}
+
+// writeTargetsJSON encodes the final targets with the reasons recorded for
+// each. Targets are in the given order; reasons are ordered by source and
+// then by package so the output does not depend on query scheduling.
+func writeTargetsJSON(w io.Writer, targets []string, p *provenance) error {
+	report := jsonTargetsReport{Targets: make([]jsonTarget, 0, len(targets))}
+	for _, target := range targets {
+		reasons := []jsonTargetReason{}
+		if p != nil {
+			reasons = append(reasons, p.reasons[target]...)
+		}
+		sort.SliceStable(reasons, func(i, j int) bool {
+			if reasons[i].Source != reasons[j].Source {
+				return reasons[i].Source < reasons[j].Source
+			}
+			return strings.Join(reasons[i].Packages, ",") < strings.Join(reasons[j].Packages, ",")
+		})
+		report.Targets = append(report.Targets, jsonTarget{Label: target, Reasons: reasons})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return fmt.Errorf("encoding targets json: %w", err)
+	}
+	return nil
+}
+
+type jsonTargetsReport struct {
+	Targets []jsonTarget `json:"targets"`
+}
+
+type jsonTarget struct {
+	Label   string             `json:"label"`
+	Reasons []jsonTargetReason `json:"reasons"`
+}
+
+type jsonTargetReason struct {
+	Source   string   `json:"source"`
+	Packages []string `json:"packages,omitempty"`
+	Rules    []string `json:"rules,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+	Files    []string `json:"files"`
+	Cached   bool     `json:"cached"`
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/cache"
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+func TestTestSource(t *testing.T) {
+	tests := []struct {
+		pkg, test   string
+		subpackages bool
+		want        string
+	}{
+		{"//pkg/foo", "//pkg/foo:foo_test", true, sourceSamePackage},
+		{"//pkg/foo", "//pkg/foo/sub:sub_test", true, sourceSubpackage},
+		{"//pkg/foo", "//pkg/foobar:bar_test", true, sourceRdeps},
+		{"//pkg/foo", "//other:dep_test", true, sourceRdeps},
+		{"//", "//:root_test", true, sourceSamePackage},
+		{"//", "//other:dep_test", true, sourceRdeps},
+		// Without the sub-package query, only rdeps can find a test below pkg.
+		{"//pkg/foo", "//pkg/foo:foo_test", false, sourceSamePackage},
+		{"//pkg/foo", "//pkg/foo/sub:sub_test", false, sourceRdeps},
+	}
+	for _, tt := range tests {
+		if got := testSource(tt.pkg, tt.test, tt.subpackages); got != tt.want {
+			t.Errorf("testSource(%q, %q, %t) = %q, want %q", tt.pkg, tt.test, tt.subpackages, got, tt.want)
+		}
+	}
+}
+
+func TestProvenance_NilIsNoop(t *testing.T) {
+	var p *provenance
+	p.setPackageFiles(map[string][]string{"//a": {"a/x.go"}})
+	p.addPackageTests("//a", []string{"//a:t"}, false)
+	p.addOwnerRuleTests([]string{"//a:lib"}, []string{"//a:t"}, false)
+	p.addRemovedPackageTests(map[string][]string{"//gone": {"gone/x.go"}}, []string{"//a:t"})
+	p.addConfigRules([]config.RuleMatch{{Rule: config.Rule{Targets: []string{"//fmt:test"}}}})
+
+	var buf bytes.Buffer
+	if err := writeTargetsJSON(&buf, []string{"//a:t"}, p); err != nil {
+		t.Fatalf("writeTargetsJSON() error: %v", err)
+	}
+	var got jsonTargetsReport
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, buf.String())
+	}
+	if len(got.Targets) != 1 || len(got.Targets[0].Reasons) != 0 {
+		t.Errorf("got %+v, want one target without reasons", got)
+	}
+}
+
+func TestWriteTargetsJSON(t *testing.T) {
+	p := newProvenance(true)
+	p.setPackageFiles(map[string][]string{
+		"//pkg/a": {"pkg/a/a.go"},
+		"//pkg/b": {"pkg/b/b.go"},
+	})
+	p.addPackageTests("//pkg/b", []string{"//dep:dep_test"}, false)
+	p.addPackageTests("//pkg/a", []string{"//pkg/a:a_test", "//dep:dep_test"}, true)
+	p.addConfigRules([]config.RuleMatch{{
+		Rule:  config.Rule{Patterns: []string{"**/*.go"}, Targets: []string{"//tools:format_test"}},
+		Files: []string{"pkg/a/a.go", "pkg/b/b.go"},
+	}})
+
+	var buf bytes.Buffer
+	if err := writeTargetsJSON(&buf, []string{"//dep:dep_test", "//pkg/a:a_test", "//tools:format_test"}, p); err != nil {
+		t.Fatalf("writeTargetsJSON() error: %v", err)
+	}
+	var got jsonTargetsReport
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, buf.String())
+	}
+
+	want := jsonTargetsReport{Targets: []jsonTarget{
+		{Label: "//dep:dep_test", Reasons: []jsonTargetReason{
+			{Source: sourceRdeps, Packages: []string{"//pkg/a"}, Files: []string{"pkg/a/a.go"}, Cached: true},
+			{Source: sourceRdeps, Packages: []string{"//pkg/b"}, Files: []string{"pkg/b/b.go"}},
+		}},
+		{Label: "//pkg/a:a_test", Reasons: []jsonTargetReason{
+			{Source: sourceSamePackage, Packages: []string{"//pkg/a"}, Files: []string{"pkg/a/a.go"}, Cached: true},
+		}},
+		{Label: "//tools:format_test", Reasons: []jsonTargetReason{
+			{Source: sourceConfigRule, Patterns: []string{"**/*.go"}, Files: []string{"pkg/a/a.go", "pkg/b/b.go"}},
+		}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("writeTargetsJSON() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestGetPackageTests_RecordsProvenance(t *testing.T) {
+	c := cache.NewCache(t.TempDir())
+	if err := c.Set("k1", "//pkg/foo", []string{"//pkg/foo:foo_test"}); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	q := query.NewBazelQuerierWithExecutor(executor.NewMockExecutor())
+
+	p := newProvenance(true)
+	p.setPackageFiles(map[string][]string{"//pkg/foo": {"pkg/foo/a.go"}})
+	if _, err := getPackageTests("//pkg/foo", q, c, "k1", false, p); err != nil {
+		t.Fatalf("getPackageTests() error: %v", err)
+	}
+
+	want := []jsonTargetReason{{
+		Source:   sourceSamePackage,
+		Packages: []string{"//pkg/foo"},
+		Files:    []string{"pkg/foo/a.go"},
+		Cached:   true,
+	}}
+	if got := p.reasons["//pkg/foo:foo_test"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("reasons = %+v, want %+v", got, want)
+	}
+}
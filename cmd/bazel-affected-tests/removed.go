@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+// baseRevision returns the revision the working tree is compared against:
+// the --base ref if given, HEAD otherwise.
+func baseRevision(cfg cliConfig) string {
+	if cfg.base != "" {
+		return cfg.base
+	}
+	return "HEAD"
+}
+
+// goneFiles returns the paths that no longer exist after the change: deleted
+// files and the old side of renames.
+func goneFiles(changes []git.FileChange) map[string]bool {
+	gone := make(map[string]bool)
+	for _, c := range changes {
+		switch c.Status {
+		case git.StatusDeleted:
+			gone[c.Path] = true
+		case git.StatusRenamed:
+			gone[c.OldPath] = true
+		}
+	}
+	return gone
+}
+
+// needsBaseLayout reports whether the base revision's BUILD layout is needed:
+// the change removes files, which are always resolved against it since their
+// directory may have gained or lost a BUILD file in the working tree, or,
+// with resolveRemoved, it edits BUILD files.
+func needsBaseLayout(changes []git.FileChange, resolveRemoved bool) bool {
+	return len(goneFiles(changes)) > 0 || (resolveRemoved && len(editedBuildFiles(changes)) > 0)
+}
+
+// baseBuildDirs reads the base revision's BUILD layout (see git.BuildDirsAt).
+func baseBuildDirs(cfg cliConfig, repoRoot string) (map[string]bool, error) {
+	base := baseRevision(cfg)
+	buildDirs, err := git.BuildDirsAt(context.Background(), executor.NewBasicExecutor(), repoRoot, base)
+	if err != nil {
+		return nil, fmt.Errorf("reading BUILD layout at %s: %w", base, err)
+	}
+	return buildDirs, nil
+}
+
+// groupGoneFiles resolves each gone file among files to the package it lived
+// in at the base revision, as recorded in buildDirs, when that package still
+// exists in the working tree. The rest, including gone files of removed
+// packages (see splitRemovedPackages), are returned in remaining for the
+// usual working-tree resolution.
+func groupGoneFiles(repoRoot string, buildDirs, gone map[string]bool, files []string, maxDepth int) (filesByPkg map[string][]string, remaining []string) {
+	filesByPkg = make(map[string][]string)
+	for _, f := range files {
+		if !gone[f] || buildDirs == nil {
+			remaining = append(remaining, f)
+			continue
+		}
+		pkg, ok := query.FindBazelPackageAt(buildDirs, f, maxDepth)
+		if !ok || !query.PackageExists(repoRoot, pkg) {
+			remaining = append(remaining, f)
+			continue
+		}
+		filesByPkg[pkg] = append(filesByPkg[pkg], f)
+	}
+	return filesByPkg, remaining
+}
+
+// groupChangedFiles resolves changed files to packages: gone files against
+// the base revision's BUILD layout where their package still exists (see
+// groupGoneFiles), everything else against the working tree (see
+// groupFilesByPackage).
+func groupChangedFiles(repoRoot string, buildDirs, gone map[string]bool, files []string, maxDepth int) (filesByPkg map[string][]string, unmapped []string) {
+	goneByPkg, rest := groupGoneFiles(repoRoot, buildDirs, gone, files, maxDepth)
+	filesByPkg, unmapped = groupFilesByPackage(repoRoot, rest, maxDepth)
+	for pkg, files := range goneByPkg {
+		filesByPkg[pkg] = append(filesByPkg[pkg], files...)
+	}
+	return filesByPkg, unmapped
+}
+
+// editedBuildFiles returns the BUILD files modified in place by the change.
+// Their packages may have lost targets that other packages depended on.
+func editedBuildFiles(changes []git.FileChange) map[string]bool {
+	edited := make(map[string]bool)
+	for _, c := range changes {
+		if c.Status != git.StatusModified {
+			continue
+		}
+		if name := path.Base(c.Path); name == "BUILD" || name == "BUILD.bazel" {
+			edited[c.Path] = true
+		}
+	}
+	return edited
+}
+
+// editedBuildPackages returns the packages, as of the base revision's BUILD
+// layout, whose BUILD file among files was edited and still exists in the
+// working tree, keyed to that BUILD file.
+func editedBuildPackages(repoRoot string, buildDirs, edited map[string]bool, files []string) map[string][]string {
+	pkgs := make(map[string][]string)
+	for _, f := range files {
+		if !edited[f] {
+			continue
+		}
+		pkg, ok := query.FindBazelPackageAt(buildDirs, f, 0)
+		if !ok || !query.PackageExists(repoRoot, pkg) {
+			continue
+		}
+		pkgs[pkg] = append(pkgs[pkg], f)
+	}
+	return pkgs
+}
+
+// splitRemovedPackages resolves each gone file against the base revision's
+// BUILD layout. Files whose base package no longer has a BUILD file in the
+// working tree are returned grouped by that removed package; everything else
+// is returned in remaining for the usual working-tree resolution.
+func splitRemovedPackages(repoRoot string, buildDirs, gone map[string]bool, files []string, maxDepth int) (removed map[string][]string, remaining []string) {
+	removed = make(map[string][]string)
+	for _, f := range files {
+		if !gone[f] {
+			remaining = append(remaining, f)
+			continue
+		}
+		pkg, ok := query.FindBazelPackageAt(buildDirs, f, maxDepth)
+		if !ok || query.PackageExists(repoRoot, pkg) {
+			remaining = append(remaining, f)
+			continue
+		}
+		removed[pkg] = append(removed[pkg], f)
+	}
+	return removed, remaining
+}
+
+// resolveRemovedPackageTests finds files whose package was removed relative
+// to the base revision and returns the tests that depended on those packages,
+// along with the files left for working-tree resolution. The removed packages
+// cannot be queried in the working tree, so their dependents are computed in
+// a temporary worktree checked out at the base revision and then narrowed to
+// tests that still exist in the working tree. Results are not cached: they depend on
+// the base revision, not on the working tree's BUILD files.
+//
+// Packages with an edited BUILD file are queried at the base revision too,
+// since the edit may have removed targets whose dependents the working tree
+// no longer links to the package. Their files stay in the returned list, so
+// the package is still resolved in the working tree as well.
+//
+// buildDirs is the base revision's BUILD layout from baseBuildDirs, or nil if
+// needsBaseLayout reported it is not needed.
+func resolveRemovedPackageTests(cfg cliConfig, repoCfg *config.Config, repoRoot string, buildDirs map[string]bool, changes []git.FileChange, files []string, maxDepth int, prov *provenance) ([]string, []string, error) {
+	if buildDirs == nil {
+		return nil, files, nil
+	}
+	gone := goneFiles(changes)
+	edited := editedBuildFiles(changes)
+
+	removed, remaining := splitRemovedPackages(repoRoot, buildDirs, gone, files, maxDepth)
+	for pkg, buildFiles := range editedBuildPackages(repoRoot, buildDirs, edited, files) {
+		removed[pkg] = append(removed[pkg], buildFiles...)
+	}
+	if len(removed) == 0 {
+		return nil, files, nil
+	}
+	pkgs := sortedKeys(removed)
+	base := baseRevision(cfg)
+	slog.Debug("Removed and edited packages resolved at base revision", "base", base, "packages", pkgs)
+
+	tests, err := queryBaseDependents(context.Background(), executor.NewBasicExecutor(), cfg, repoCfg, base, pkgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var live []string
+	for _, t := range tests {
+		pkg, _, _ := strings.Cut(t, ":")
+		if query.PackageExists(repoRoot, pkg) {
+			live = append(live, t)
+		} else {
+			slog.Debug("Dropping dependent test whose package no longer exists", "test", t)
+		}
+	}
+	live, err = existingTests(cfg, repoCfg, newWorkerQuerier(cfg, repoCfg, 0), live)
+	if err != nil {
+		return nil, nil, err
+	}
+	prov.addRemovedPackageTests(removed, live)
+	return live, remaining, nil
+}
+
+// targetLister is the subset of *query.BazelQuerier that existingTests
+// depends on.
+type targetLister interface {
+	ExistingTargets(targets []string) ([]string, error)
+}
+
+// existingTests narrows tests found at the base revision to those still
+// defined in the working tree: a test deleted from a package that still
+// exists would otherwise make bazel test fail with "no such target". If the
+// working tree cannot be queried, all tests are kept under best-effort and an
+// error is returned otherwise.
+func existingTests(cfg cliConfig, repoCfg *config.Config, lister targetLister, tests []string) ([]string, error) {
+	if len(tests) == 0 {
+		return nil, nil
+	}
+	existing, err := lister.ExistingTargets(tests)
+	if err != nil {
+		if !resolveBestEffort(cfg, repoCfg) {
+			return nil, fmt.Errorf("checking dependent tests in the working tree: %w", err)
+		}
+		slog.Warn("Failed to check dependent tests in the working tree, keeping all", "error", err)
+		return tests, nil
+	}
+	for _, t := range tests {
+		if !slices.Contains(existing, t) {
+			slog.Debug("Dropping dependent test removed from the working tree", "test", t)
+		}
+	}
+	return existing, nil
+}
+
+// queryBaseDependents checks out base into a temporary worktree and queries
+// the tests that depend on pkgs there. Bazel would otherwise derive a new
+// output base under its cache from each random worktree path, so the server
+// runs with an explicit output base next to the worktree. The worktree, the
+// server and its output base are torn down before returning.
+func queryBaseDependents(ctx context.Context, exec executor.Executor, cfg cliConfig, repoCfg *config.Config, base string, pkgs []string) ([]string, error) {
+	tmp, err := os.MkdirTemp("", "bazel-affected-tests-base-")
+	if err != nil {
+		return nil, fmt.Errorf("creating worktree directory: %w", err)
+	}
+	defer func() {
+		if err := removeTree(tmp); err != nil {
+			slog.Warn("Failed to remove base worktree directory", "dir", tmp, "error", err)
+		}
+	}()
+	dir := filepath.Join(tmp, "worktree")
+
+	if err := git.AddWorktree(ctx, exec, dir, base); err != nil {
+		return nil, fmt.Errorf("checking out base revision: %w", err)
+	}
+	defer func() {
+		if err := git.RemoveWorktree(ctx, exec, dir); err != nil {
+			slog.Warn("Failed to remove base worktree", "dir", dir, "error", err)
+		}
+	}()
+
+	q := newQuerier(repoCfg)
+	q.SetFailOnError(!resolveBestEffort(cfg, repoCfg))
+	q.SetQueryTimeout(resolveQueryTimeout(cfg, repoCfg))
+	q.SetWorkspaceDir(dir)
+	q.SetOutputBase(filepath.Join(tmp, "output_base"))
+	q.SetUniverse(resolveUniverse(cfg, repoCfg))
+	defer func() {
+		if err := q.Shutdown(ctx); err != nil {
+			slog.Debug("Failed to shut down base worktree Bazel server", "error", err)
+		}
+	}()
+
+	tests, err := q.FindDependentTests(pkgs)
+	if err != nil {
+		return nil, fmt.Errorf("querying dependents of removed packages at %s: %w", base, err)
+	}
+	return tests, nil
+}
+
+// removeTree removes dir like os.RemoveAll, first making its directories
+// writable: Bazel leaves read-only directories in an output base, such as
+// extracted external repositories, whose entries could not be removed
+// otherwise.
+func removeTree(dir string) error {
+	// Errors are left for RemoveAll to report.
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(p, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
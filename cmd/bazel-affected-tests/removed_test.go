@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+)
+
+func TestGoneFiles(t *testing.T) {
+	changes := []git.FileChange{
+		{Status: git.StatusModified, Path: "a/x.go"},
+		{Status: git.StatusDeleted, Path: "b/BUILD"},
+		{Status: git.StatusRenamed, OldPath: "c/old.go", Path: "d/new.go"},
+		{Status: git.StatusCopied, OldPath: "a/x.go", Path: "e/x.go"},
+	}
+	want := map[string]bool{"b/BUILD": true, "c/old.go": true}
+	if got := goneFiles(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("goneFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestEditedBuildFiles(t *testing.T) {
+	changes := []git.FileChange{
+		{Status: git.StatusModified, Path: "a/BUILD"},
+		{Status: git.StatusModified, Path: "b/BUILD.bazel"},
+		{Status: git.StatusModified, Path: "c/defs.bzl"},
+		{Status: git.StatusAdded, Path: "d/BUILD"},
+		{Status: git.StatusDeleted, Path: "e/BUILD"},
+	}
+	want := map[string]bool{"a/BUILD": true, "b/BUILD.bazel": true}
+	if got := editedBuildFiles(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("editedBuildFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestEditedBuildPackages(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "BUILD"), "", 0o600)
+	writeFile(t, filepath.Join(root, "pkg", "kept", "BUILD.bazel"), "", 0o600)
+	buildDirs := map[string]bool{".": true, "pkg/kept": true}
+	edited := map[string]bool{"BUILD": true, "pkg/kept/BUILD.bazel": true, "pkg/new/BUILD": true}
+	files := []string{"BUILD", "pkg/kept/BUILD.bazel", "pkg/kept/a.go", "pkg/new/BUILD"}
+
+	got := editedBuildPackages(root, buildDirs, edited, files)
+	want := map[string][]string{
+		"//":         {"BUILD"},
+		"//pkg/kept": {"pkg/kept/BUILD.bazel"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("editedBuildPackages() = %v, want %v", got, want)
+	}
+}
+
+func TestNeedsBaseLayout(t *testing.T) {
+	deleted := []git.FileChange{{Status: git.StatusDeleted, Path: "a/x.go"}}
+	editedBuild := []git.FileChange{{Status: git.StatusModified, Path: "a/BUILD"}}
+	modified := []git.FileChange{{Status: git.StatusModified, Path: "a/x.go"}}
+	tests := []struct {
+		name           string
+		changes        []git.FileChange
+		resolveRemoved bool
+		want           bool
+	}{
+		{"deleted file", deleted, false, true},
+		{"edited BUILD without resolve-removed", editedBuild, false, false},
+		{"edited BUILD with resolve-removed", editedBuild, true, true},
+		{"modified file", modified, true, false},
+	}
+	for _, tt := range tests {
+		if got := needsBaseLayout(tt.changes, tt.resolveRemoved); got != tt.want {
+			t.Errorf("%s: needsBaseLayout() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGroupGoneFiles(t *testing.T) {
+	root := t.TempDir()
+	// //pkg existed at the base revision; pkg/sub gained its own BUILD file
+	// in the working tree, and //pkg/gone was removed.
+	writeFile(t, filepath.Join(root, "pkg", "BUILD"), "", 0o600)
+	writeFile(t, filepath.Join(root, "pkg", "sub", "BUILD"), "", 0o600)
+	buildDirs := map[string]bool{"pkg": true, "pkg/gone": true}
+	gone := map[string]bool{"pkg/sub/old.go": true, "pkg/gone/lib.go": true, "other/x.go": true}
+	files := []string{"pkg/sub/new.go", "pkg/sub/old.go", "pkg/gone/lib.go", "other/x.go"}
+
+	got, remaining := groupGoneFiles(root, buildDirs, gone, files, 1)
+	if want := map[string][]string{"//pkg": {"pkg/sub/old.go"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("groupGoneFiles() = %v, want %v", got, want)
+	}
+	if want := []string{"pkg/sub/new.go", "pkg/gone/lib.go", "other/x.go"}; !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining = %v, want %v", remaining, want)
+	}
+
+	// Without a base layout everything is left for the working tree.
+	got, remaining = groupGoneFiles(root, nil, gone, files, 1)
+	if len(got) != 0 || !reflect.DeepEqual(remaining, files) {
+		t.Errorf("without layout: groupGoneFiles() = %v, %v", got, remaining)
+	}
+}
+
+func TestSplitRemovedPackages(t *testing.T) {
+	root := t.TempDir()
+	// Working tree: //pkg/kept still exists; //pkg/gone and //pkg/moved were
+	// removed since the base revision.
+	writeFile(t, filepath.Join(root, "BUILD"), "", 0o600)
+	writeFile(t, filepath.Join(root, "pkg", "kept", "BUILD"), "", 0o600)
+	if err := os.MkdirAll(filepath.Join(root, "pkg", "moved"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	buildDirs := map[string]bool{
+		".":         true,
+		"pkg/kept":  true,
+		"pkg/gone":  true,
+		"pkg/moved": true,
+	}
+	gone := map[string]bool{
+		"pkg/kept/old.go":  true,
+		"pkg/gone/BUILD":   true,
+		"pkg/gone/lib.go":  true,
+		"pkg/moved/lib.go": true,
+		"untracked/x.go":   true,
+	}
+	files := []string{
+		"pkg/kept/a.go",
+		"pkg/kept/old.go",
+		"pkg/gone/BUILD",
+		"pkg/gone/lib.go",
+		"pkg/moved/lib.go",
+		"untracked/x.go",
+	}
+
+	removed, remaining := splitRemovedPackages(root, buildDirs, gone, files, 0)
+
+	wantRemoved := map[string][]string{
+		"//pkg/gone":  {"pkg/gone/BUILD", "pkg/gone/lib.go"},
+		"//pkg/moved": {"pkg/moved/lib.go"},
+	}
+	if !reflect.DeepEqual(removed, wantRemoved) {
+		t.Errorf("removed = %v, want %v", removed, wantRemoved)
+	}
+	wantRemaining := []string{"pkg/kept/a.go", "pkg/kept/old.go", "untracked/x.go"}
+	if !reflect.DeepEqual(remaining, wantRemaining) {
+		t.Errorf("remaining = %v, want %v", remaining, wantRemaining)
+	}
+}
+
+// fakeTargetLister reports the targets in exists, or fails with err.
+type fakeTargetLister struct {
+	exists []string
+	err    error
+}
+
+func (f fakeTargetLister) ExistingTargets(targets []string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var found []string
+	for _, t := range targets {
+		if slices.Contains(f.exists, t) {
+			found = append(found, t)
+		}
+	}
+	return found, nil
+}
+
+func TestExistingTests(t *testing.T) {
+	tests := []string{"//app:app_test", "//app:legacy_test"}
+	lister := fakeTargetLister{exists: []string{"//app:app_test"}}
+
+	got, err := existingTests(cliConfig{}, nil, lister, tests)
+	if err != nil {
+		t.Fatalf("existingTests() error = %v", err)
+	}
+	if want := []string{"//app:app_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("existingTests() = %v, want %v", got, want)
+	}
+
+	failing := fakeTargetLister{err: errors.New("bazel failed")}
+	if _, err := existingTests(cliConfig{bestEffortSet: true}, nil, failing, tests); err == nil {
+		t.Error("existingTests() should fail when the working tree cannot be queried")
+	}
+	got, err = existingTests(cliConfig{bestEffortSet: true, bestEffort: true}, nil, failing, tests)
+	if err != nil || !reflect.DeepEqual(got, tests) {
+		t.Errorf("existingTests() under best-effort = %v, %v; want all tests kept", got, err)
+	}
+}
+
+func TestRemoveTree_ReadOnlyDirectories(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "base")
+	ro := filepath.Join(dir, "output_base", "external", "repo")
+	writeFile(t, filepath.Join(ro, "BUILD"), "", 0o400)
+	if err := os.Chmod(ro, 0o500); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeTree(dir); err != nil {
+		t.Fatalf("removeTree() error = %v", err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat() after removeTree error = %v, want not exist", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+)
+
+// sizeQuerier is the subset of *query.BazelQuerier that size filtering
+// depends on.
+type sizeQuerier interface {
+	QueryTestSizes(tests []string) (map[string]query.TestSize, error)
+}
+
+// deferredTests counts the tests filterTestsBySize dropped, by reason.
+type deferredTests struct {
+	total     int
+	bySize    int
+	byTimeout int
+}
+
+// applyTestSizeFilter drops the tests whose size is not in sizes (if any) or
+// whose timeout is longer than maxTimeout (if set), and prints a summary of
+// the deferred tests to stderr. If the attributes cannot be queried, all
+// tests are kept under best-effort and an error is returned otherwise.
+func applyTestSizeFilter(cfg cliConfig, repoCfg *config.Config, tests, sizes []string, maxTimeout string) ([]string, error) {
+	if len(tests) == 0 {
+		return tests, nil
+	}
+	kept, deferred, err := filterTestsBySize(tests, newWorkerQuerier(cfg, repoCfg, 0), sizes, maxTimeout)
+	if err != nil {
+		if !resolveBestEffort(cfg, repoCfg) {
+			return nil, fmt.Errorf("querying test sizes: %w", err)
+		}
+		slog.Warn("Failed to query test sizes, keeping all tests", "error", err)
+		return tests, nil
+	}
+	writeDeferredSummary(os.Stderr, deferred, sizes, maxTimeout)
+	return kept, nil
+}
+
+// filterTestsBySize splits tests by their size and timeout. Tests whose
+// attributes are unknown, such as non-rule targets, are kept.
+func filterTestsBySize(tests []string, querier sizeQuerier, sizes []string, maxTimeout string) ([]string, deferredTests, error) {
+	attrs, err := querier.QueryTestSizes(tests)
+	if err != nil {
+		return nil, deferredTests{}, err
+	}
+	var kept []string
+	deferred := deferredTests{total: len(tests)}
+	for _, t := range tests {
+		a, ok := attrs[t]
+		if !ok {
+			kept = append(kept, t)
+			continue
+		}
+		switch testDeferral(a, sizes, maxTimeout) {
+		case deferBySize:
+			slog.Debug("Deferring test by size", "test", t, "size", a.Size)
+			deferred.bySize++
+		case deferByTimeout:
+			slog.Debug("Deferring test by timeout", "test", t, "timeout", a.Timeout)
+			deferred.byTimeout++
+		default:
+			kept = append(kept, t)
+		}
+	}
+	return kept, deferred, nil
+}
+
+// testSizeFilter is a resolved --test-size and --max-timeout setting.
+type testSizeFilter struct {
+	sizes      []string
+	maxTimeout string
+}
+
+func resolveTestSizeFilter(cfg cliConfig, repoCfg *config.Config) testSizeFilter {
+	return testSizeFilter{sizes: resolveTestSizes(cfg, repoCfg), maxTimeout: resolveMaxTimeout(cfg, repoCfg)}
+}
+
+func (f testSizeFilter) enabled() bool {
+	return len(f.sizes) > 0 || f.maxTimeout != ""
+}
+
+// deferral is why a test is deferred by the size filter, if it is.
+type deferral int
+
+const (
+	deferNone deferral = iota
+	deferBySize
+	deferByTimeout
+)
+
+// testDeferral returns whether a test with attributes a is deferred because
+// its size is not in sizes (if any) or its timeout is longer than maxTimeout
+// (if set). The size is checked first.
+func testDeferral(a query.TestSize, sizes []string, maxTimeout string) deferral {
+	if len(sizes) > 0 && !slices.Contains(sizes, a.Size) {
+		return deferBySize
+	}
+	if maxRank := query.TimeoutRank(maxTimeout); maxRank >= 0 && query.TimeoutRank(a.Timeout) > maxRank {
+		return deferByTimeout
+	}
+	return deferNone
+}
+
+// writeDeferredSummary reports how many tests were deferred and why. Nothing
+// is written when no test was deferred.
+func writeDeferredSummary(w io.Writer, d deferredTests, sizes []string, maxTimeout string) {
+	if d.bySize+d.byTimeout == 0 {
+		return
+	}
+	var reasons []string
+	if d.bySize > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d not %s", d.bySize, strings.Join(sizes, "/")))
+	}
+	if d.byTimeout > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d with a timeout longer than %s", d.byTimeout, maxTimeout))
+	}
+	fmt.Fprintf(w, "Deferred %d of %d tests: %s\n", d.bySize+d.byTimeout, d.total, strings.Join(reasons, ", "))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/config"
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
+)
+
+type fakeSizeQuerier map[string]query.TestSize
+
+func (f fakeSizeQuerier) QueryTestSizes(tests []string) (map[string]query.TestSize, error) {
+	return f, nil
+}
+
+var sampleSizes = fakeSizeQuerier{
+	"//a:small_test":      {Size: "small", Timeout: "short"},
+	"//a:small_long_test": {Size: "small", Timeout: "long"},
+	"//a:medium_test":     {Size: "medium", Timeout: "moderate"},
+	"//a:large_test":      {Size: "large", Timeout: "long"},
+}
+
+func TestFilterTestsBySize(t *testing.T) {
+	tests := []string{"//a:small_test", "//a:small_long_test", "//a:medium_test", "//a:large_test", "//a:unknown"}
+	cases := []struct {
+		name       string
+		sizes      []string
+		maxTimeout string
+		want       []string
+		deferred   deferredTests
+	}{
+		{"sizes", []string{"small", "medium"}, "",
+			[]string{"//a:small_test", "//a:small_long_test", "//a:medium_test", "//a:unknown"},
+			deferredTests{total: 5, bySize: 1}},
+		{"timeout", nil, "moderate",
+			[]string{"//a:small_test", "//a:medium_test", "//a:unknown"},
+			deferredTests{total: 5, byTimeout: 2}},
+		{"both", []string{"small"}, "short",
+			[]string{"//a:small_test", "//a:unknown"},
+			deferredTests{total: 5, bySize: 2, byTimeout: 1}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, deferred, err := filterTestsBySize(tests, sampleSizes, tt.sizes, tt.maxTimeout)
+			if err != nil {
+				t.Fatalf("filterTestsBySize() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || deferred != tt.deferred {
+				t.Errorf("filterTestsBySize() = %v, %+v, want %v, %+v", got, deferred, tt.want, tt.deferred)
+			}
+		})
+	}
+}
+
+func TestWriteDeferredSummary(t *testing.T) {
+	var buf bytes.Buffer
+	writeDeferredSummary(&buf, deferredTests{total: 5, bySize: 2, byTimeout: 1}, []string{"small"}, "short")
+	if want := "Deferred 3 of 5 tests: 2 not small, 1 with a timeout longer than short\n"; buf.String() != want {
+		t.Errorf("summary = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	writeDeferredSummary(&buf, deferredTests{total: 5}, nil, "")
+	if buf.Len() != 0 {
+		t.Errorf("summary = %q, want nothing when no test was deferred", buf.String())
+	}
+}
+
+func TestResolveTestSizes(t *testing.T) {
+	repoCfg := &config.Config{TestSizes: []string{"small"}, MaxTimeout: "short"}
+	if got := resolveTestSizes(cliConfig{}, nil); got != nil {
+		t.Errorf("resolveTestSizes() default = %v, want nil", got)
+	}
+	if got := resolveTestSizes(cliConfig{}, repoCfg); !reflect.DeepEqual(got, []string{"small"}) {
+		t.Errorf("resolveTestSizes() config = %v", got)
+	}
+	if got := resolveTestSizes(cliConfig{testSizes: "small, medium,"}, repoCfg); !reflect.DeepEqual(got, []string{"small", "medium"}) {
+		t.Errorf("resolveTestSizes() flag = %v", got)
+	}
+	if got := resolveMaxTimeout(cliConfig{}, repoCfg); got != "short" {
+		t.Errorf("resolveMaxTimeout() config = %q", got)
+	}
+	if got := resolveMaxTimeout(cliConfig{maxTimeout: "long"}, repoCfg); got != "long" {
+		t.Errorf("resolveMaxTimeout() flag = %q", got)
+	}
+}
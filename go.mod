@@ -4,7 +4,6 @@ go 1.24.4
 
 require (
 	github.com/jaeyeom/go-cmdexec v0.3.0
+	golang.org/x/sys v0.39.0
 	gopkg.in/yaml.v3 v3.0.1
 )
-
-require golang.org/x/sys v0.39.0 // indirect
@@ -105,7 +105,7 @@ func (a *Auditor) AuditPackage(pkg string) (*PackageAudit, error) {
 		return result.Rules[i].Label < result.Rules[j].Label
 	})
 
-	fileOwners := buildFileOwners(rules, pkg)
+	fileOwners := FileOwners(rules, pkg)
 	result.SourceFileCount = len(fileOwners)
 	if len(fileOwners) == 0 {
 		result.Metrics = PackageMetrics{PackageDepCount: len(pkgDeps)}
@@ -205,11 +205,12 @@ func aggregate(files []FileInfo, pkgDepCount int) PackageMetrics {
 	}
 }
 
-// buildFileOwners walks each rule's source-like attributes, mapping every
-// source label that belongs to pkg back to a workspace-relative path. Source
-// labels in other packages are skipped — they're owned by a different package
-// audit.
-func buildFileOwners(rules []query.Rule, pkg string) map[string][]string {
+// FileOwners walks each rule's source-like attributes, mapping every source
+// label that belongs to pkg back to a workspace-relative path. Source labels
+// in other packages are skipped — they're owned by a different package audit.
+// Owner lists may contain duplicates when a rule lists a file under more than
+// one attribute.
+func FileOwners(rules []query.Rule, pkg string) map[string][]string {
 	owners := make(map[string][]string)
 	for _, r := range rules {
 		for _, attr := range query.SourceAttrs {
@@ -225,6 +226,23 @@ func buildFileOwners(rules []query.Rule, pkg string) map[string][]string {
 	return owners
 }
 
+// InputOwners is FileOwners over every input of each rule instead of its
+// source-like attributes: templates, codegen inputs and files read by custom
+// rule attributes are owned by the rules that consume them as inputs.
+func InputOwners(rules []query.Rule, pkg string) map[string][]string {
+	owners := make(map[string][]string)
+	for _, r := range rules {
+		for _, lbl := range r.Inputs {
+			path := labelToPath(lbl, pkg)
+			if path == "" {
+				continue
+			}
+			owners[path] = append(owners[path], r.Label)
+		}
+	}
+	return owners
+}
+
 // labelToPath converts a Bazel label into a workspace-relative file path
 // when the label refers to a file in pkg. Returns "" otherwise.
 //
@@ -70,6 +70,44 @@ func TestLabelToPath(t *testing.T) {
 	}
 }
 
+func TestFileOwners(t *testing.T) {
+	rules := []query.Rule{
+		{Label: "//pkg/foo:lib", Sources: map[string][]string{
+			"srcs": {"//pkg/foo:a.go", "//pkg/foo:shared.go"},
+			"data": {"//pkg/foo:sub/testdata.txt", "//other:x.txt"},
+		}},
+		{Label: "//pkg/foo:lib_test", Sources: map[string][]string{
+			"srcs": {"//pkg/foo:a_test.go", "//pkg/foo:shared.go"},
+		}},
+	}
+	got := FileOwners(rules, "//pkg/foo")
+	want := map[string][]string{
+		"pkg/foo/a.go":             {"//pkg/foo:lib"},
+		"pkg/foo/shared.go":        {"//pkg/foo:lib", "//pkg/foo:lib_test"},
+		"pkg/foo/sub/testdata.txt": {"//pkg/foo:lib"},
+		"pkg/foo/a_test.go":        {"//pkg/foo:lib_test"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FileOwners() = %v, want %v", got, want)
+	}
+}
+
+func TestInputOwners(t *testing.T) {
+	rules := []query.Rule{
+		{Label: "//pkg/foo:gen", Inputs: []string{"//pkg/foo:api.tmpl", "//tools:codegen", "//pkg/foo:schema.json"}},
+		{Label: "//pkg/foo:lib", Inputs: []string{"//pkg/foo:gen", "//pkg/foo:schema.json"}},
+	}
+	got := InputOwners(rules, "//pkg/foo")
+	want := map[string][]string{
+		"pkg/foo/api.tmpl":    {"//pkg/foo:gen"},
+		"pkg/foo/schema.json": {"//pkg/foo:gen", "//pkg/foo:lib"},
+		"pkg/foo/gen":         {"//pkg/foo:lib"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("InputOwners() = %v, want %v", got, want)
+	}
+}
+
 func TestPercentileFloat(t *testing.T) {
 	cases := []struct {
 		name   string
@@ -5,6 +5,13 @@
 // When the build graph hasn't changed (same hash), cached results are returned
 // instead of re-running expensive `bazel query` operations.
 //
+// In incremental mode (see IncrementalKey) each entry instead records the
+// BUILD/.bzl files its answer depended on with their content hashes, so an
+// edit elsewhere in the repository does not invalidate it.
+//
+// An optional remote Backend (see SetRemote) shares entries between machines;
+// the local directory is always consulted first.
+//
 // Cache layout on disk:
 //
 //	<cacheDir>/<cacheKey>/<sanitizedPkg>.json
@@ -15,19 +22,41 @@ package cache
 import (
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Cache manages caching of Bazel query results.
 type Cache struct {
-	dir string
+	dir      string
+	repoRoot string // Root for the input paths of incremental entries; see NewRepoCache
+	// exclude reports whether a repo-relative, slash-separated directory is
+	// left out of the cache key together with everything below it.
+	exclude func(dir string) bool
+	inputs  []KeyInput // Extra inputs mixed into every key; see SetKeyInputs
+
+	// remote is an optional shared backend behind the local directory; see
+	// SetRemote. remoteFailed is set after its first error.
+	remote       Backend
+	remoteFailed atomic.Bool
+
+	// limits are enforced once per run after the first write; see SetLimits.
+	limits  Limits
+	gcOnce  sync.Once
+	touched sync.Map // Keys whose directory was marked used this run
+
+	hits   atomic.Int64
+	misses atomic.Int64
 }
 
 // NewCache creates a new cache instance.
@@ -43,7 +72,44 @@ func NewCache(dir string) *Cache {
 	return &Cache{dir: dir}
 }
 
-// GetCacheKey computes a cache key based on BUILD and .bzl files.
+// NewRepoCache creates a cache for the repository at repoRoot, which is where
+// the input files recorded by incremental entries (see IncrementalKey) are
+// read from.
+func NewRepoCache(dir, repoRoot string) *Cache {
+	c := NewCache(dir)
+	c.repoRoot = repoRoot
+	return c
+}
+
+// Dir returns the cache directory.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// SetKeyExclude sets the directories left out of cache key computation, such
+// as generated trees that are never part of the build graph. exclude is
+// called with repo-relative, slash-separated directory paths.
+func (c *Cache) SetKeyExclude(exclude func(dir string) bool) {
+	c.exclude = exclude
+}
+
+// excludedPath reports whether the repo-relative file p lies below an
+// excluded directory.
+func (c *Cache) excludedPath(p string) bool {
+	if c.exclude == nil {
+		return false
+	}
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if c.exclude(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCacheKey computes a cache key based on BUILD and .bzl files. Files are
+// identified by their repo-relative path, so checkouts of the same tree at
+// different locations share a key (and, with a remote cache, entries).
 func (c *Cache) GetCacheKey(repoRoot string) (string, error) {
 	// Find all BUILD and .bzl files
 	// WORKSPACE/MODULE are intentionally excluded as they don't affect internal dependency graph
@@ -54,7 +120,7 @@ func (c *Cache) GetCacheKey(repoRoot string) (string, error) {
 			return nil // Skip files we can't access
 		}
 		if d.IsDir() {
-			return nil
+			return c.walkDir(repoRoot, path, d)
 		}
 		name := d.Name()
 		if name == "BUILD" || name == "BUILD.bazel" || strings.HasSuffix(name, ".bzl") {
@@ -72,8 +138,12 @@ func (c *Cache) GetCacheKey(repoRoot string) (string, error) {
 	// Compute hash of all BUILD and .bzl files
 	h := sha256.New()
 	for _, file := range buildFiles {
-		// Include file path in hash
-		fmt.Fprintf(h, "%s\n", file)
+		// Include the repo-relative file path in hash
+		rel, err := filepath.Rel(repoRoot, file)
+		if err != nil {
+			return "", fmt.Errorf("failed to relativize %s: %w", file, err)
+		}
+		fmt.Fprintf(h, "%s\n", filepath.ToSlash(rel))
 
 		// Include file content in hash
 		f, err := os.Open(file)
@@ -85,14 +155,46 @@ func (c *Cache) GetCacheKey(repoRoot string) (string, error) {
 		_ = f.Close()
 	}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	return c.mixInputs(fmt.Sprintf("%x", h.Sum(nil))), nil
 }
 
-// Get retrieves cached results for a package.
+// walkDir decides whether GetCacheKey descends into dir. The .git directory
+// never holds packages; other directories are skipped if excluded.
+func (c *Cache) walkDir(repoRoot, dir string, d fs.DirEntry) error {
+	if d.Name() == ".git" {
+		return filepath.SkipDir
+	}
+	if c.exclude == nil || dir == repoRoot {
+		return nil
+	}
+	if rel, err := filepath.Rel(repoRoot, dir); err == nil && c.exclude(filepath.ToSlash(rel)) {
+		slog.Debug("Excluding directory from cache key", "dir", rel)
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// Get retrieves cached results for a package. For incremental keys the entry
+// is only returned if its recorded inputs are unchanged.
 func (c *Cache) Get(cacheKey, pkg string) ([]string, bool) {
-	cacheFile := c.getCacheFile(cacheKey, pkg)
-	data, err := os.ReadFile(cacheFile)
-	if err != nil {
+	var tests []string
+	var found bool
+	if IsIncrementalKey(cacheKey) {
+		tests, found = c.getIncremental(cacheKey, pkg)
+	} else {
+		tests, found = c.getWholeRepo(cacheKey, pkg)
+	}
+	c.recordLookup(found)
+	if found {
+		c.touchKey(cacheKey)
+	}
+	return tests, found
+}
+
+// getWholeRepo returns the entry for pkg under a whole-repo key.
+func (c *Cache) getWholeRepo(cacheKey, pkg string) ([]string, bool) {
+	data, ok := c.readEntry(cacheKey, pkg)
+	if !ok {
 		return nil, false
 	}
 
@@ -106,21 +208,68 @@ func (c *Cache) Get(cacheKey, pkg string) ([]string, bool) {
 	return tests, true
 }
 
-// Set stores results in cache for a package.
+// Set stores results in cache for a package. Incremental keys need the
+// entry's inputs and must use SetWithInputs instead.
 func (c *Cache) Set(cacheKey, pkg string, tests []string) error {
-	// Create cache directory if it doesn't exist
-	cacheDir := filepath.Join(c.dir, cacheKey)
-	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
-		return fmt.Errorf("failed to create cache directory: %w", err)
+	if IsIncrementalKey(cacheKey) {
+		return errNeedsInputs
 	}
-
-	cacheFile := c.getCacheFile(cacheKey, pkg)
 	data, err := json.Marshal(tests)
 	if err != nil {
 		return fmt.Errorf("failed to marshal tests: %w", err)
 	}
+	return c.writeEntry(cacheKey, pkg, data)
+}
+
+// indexEntry names the reverse-dependency index stored alongside the
+// per-package entries of a key. "@" cannot occur in a package label, so it
+// never collides with a package's file.
+const indexEntry = "@index"
+
+// GetIndex returns the serialized reverse-dependency index stored under
+// cacheKey, if any.
+func (c *Cache) GetIndex(cacheKey string) ([]byte, bool) {
+	data, found := c.readEntry(cacheKey, indexEntry)
+	if found {
+		c.touchKey(cacheKey)
+	}
+	return data, found
+}
+
+// SetIndex stores a serialized reverse-dependency index under cacheKey. The
+// index is only valid for the BUILD files the key was computed from.
+func (c *Cache) SetIndex(cacheKey string, data []byte) error {
+	if IsIncrementalKey(cacheKey) {
+		return errors.New("a reverse-dependency index needs a whole-repository cache key")
+	}
+	return c.writeEntry(cacheKey, indexEntry, data)
+}
+
+// writeEntry writes an encoded entry for pkg under cacheKey to the local
+// directory and the remote backend, behind the versioned, checksummed header.
+// Remote failures are not returned: the local write is what later runs on
+// this machine depend on.
+func (c *Cache) writeEntry(cacheKey, pkg string, payload []byte) error {
+	data := encodeEntry(payload)
+	if err := c.writeLocal(cacheKey, pkg, data); err != nil {
+		return err
+	}
+	c.storeRemote(cacheKey, pkg, data)
+	c.collectAfterWrite(cacheKey)
+	return nil
+}
+
+// writeLocal writes an encoded entry for pkg under cacheKey to the local
+// directory. The write is atomic, so concurrent runs never observe a partial
+// entry.
+func (c *Cache) writeLocal(cacheKey, pkg string, data []byte) error {
+	// Create cache directory if it doesn't exist
+	cacheDir := filepath.Join(c.dir, cacheKey)
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
 
-	if err := os.WriteFile(cacheFile, data, 0o600); err != nil {
+	if err := writeFileAtomic(c.getCacheFile(cacheKey, pkg), data); err != nil {
 		return fmt.Errorf("failed to write cache file: %w", err)
 	}
 	return nil
@@ -1,13 +1,20 @@
 package cache
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	executor "github.com/jaeyeom/go-cmdexec"
 )
 
 func TestNewCache(t *testing.T) {
@@ -455,3 +462,415 @@ func TestCache_DebugOutput(t *testing.T) {
 	c.Get(cacheKey, "//test")
 	c.Get(cacheKey, "//nonexistent")
 }
+
+func TestCache_Incremental(t *testing.T) {
+	repo := t.TempDir()
+	write := func(rel, content string) {
+		t.Helper()
+		p := filepath.Join(repo, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("services/payment/BUILD", "# payment")
+	write("tools/defs.bzl", "# defs")
+	write("unrelated/BUILD", "# unrelated")
+
+	c := NewRepoCache(t.TempDir(), repo)
+	key := c.IncrementalKey()
+	tests := []string{"//services/payment:payment_test"}
+
+	if err := c.Set(key, "//services/payment", tests); err == nil {
+		t.Error("Set() with an incremental key should require inputs")
+	}
+	if err := c.SetWithInputs(key, "//services/payment", tests, nil); err == nil {
+		t.Error("SetWithInputs() with no inputs should fail")
+	}
+	if err := NewCache(t.TempDir()).SetWithInputs(key, "//services/payment", tests, []string{"tools/defs.bzl"}); err == nil {
+		t.Error("SetWithInputs() without a repository root should fail")
+	}
+	if err := c.SetWithInputs(key, "//services/payment", tests, []string{"services/payment/BUILD", "tools/defs.bzl"}); err != nil {
+		t.Fatalf("SetWithInputs() error = %v", err)
+	}
+
+	if got, ok := c.Get(key, "//services/payment"); !ok || !reflect.DeepEqual(got, tests) {
+		t.Fatalf("Get() = %v, %v; want %v, true", got, ok, tests)
+	}
+
+	// An edit outside the recorded inputs keeps the entry valid.
+	write("unrelated/BUILD", "# unrelated changed")
+	if _, ok := c.Get(key, "//services/payment"); !ok {
+		t.Error("Get() after unrelated edit should hit")
+	}
+
+	// An edit to a recorded input invalidates it.
+	write("tools/defs.bzl", "# defs changed")
+	if _, ok := c.Get(key, "//services/payment"); ok {
+		t.Error("Get() after recorded input edit should miss")
+	}
+
+	// A deleted input invalidates it too.
+	if err := c.SetWithInputs(key, "//services/payment", tests, []string{"services/payment/BUILD"}); err != nil {
+		t.Fatalf("SetWithInputs() error = %v", err)
+	}
+	if err := os.Remove(filepath.Join(repo, "services", "payment", "BUILD")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(key, "//services/payment"); ok {
+		t.Error("Get() after recorded input deletion should miss")
+	}
+}
+
+func TestCache_IncrementalKeyIndependentOfLocation(t *testing.T) {
+	dir := t.TempDir()
+	a, b := NewRepoCache(dir, "/src/a").IncrementalKey(), NewRepoCache(dir, "/src/b").IncrementalKey()
+	if a != b {
+		t.Errorf("IncrementalKey() should not depend on the repo root, got %q and %q", a, b)
+	}
+	if !IsIncrementalKey(a) {
+		t.Errorf("IsIncrementalKey(%q) = false", a)
+	}
+}
+
+func TestCache_GetCacheKeyIndependentOfLocation(t *testing.T) {
+	c := NewCache("")
+	var keys []string
+	for i := 0; i < 2; i++ {
+		repo := filepath.Join(t.TempDir(), fmt.Sprintf("checkout%d", i))
+		if err := os.MkdirAll(filepath.Join(repo, "pkg"), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo, "pkg", "BUILD"), []byte("# same content"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := c.GetCacheKey(repo)
+		if err != nil {
+			t.Fatalf("GetCacheKey() error = %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if keys[0] != keys[1] {
+		t.Errorf("GetCacheKey() differs between checkouts of the same tree: %q vs %q", keys[0], keys[1])
+	}
+}
+
+func TestCache_GetCacheKeyExclude(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, dir := range []string{"src", "gen/out", ".git"} {
+		if err := os.MkdirAll(filepath.Join(tmpDir, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpDir, dir, "BUILD"), []byte("# "+dir), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewCache(t.TempDir())
+	c.SetKeyExclude(func(dir string) bool { return dir == "gen" })
+
+	before, err := c.GetCacheKey(tmpDir)
+	if err != nil {
+		t.Fatalf("GetCacheKey() error = %v", err)
+	}
+	for _, dir := range []string{"gen/out", ".git"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, dir, "BUILD"), []byte("# changed"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := c.GetCacheKey(tmpDir)
+	if err != nil {
+		t.Fatalf("GetCacheKey() error = %v", err)
+	}
+	if before != after {
+		t.Error("GetCacheKey() should ignore BUILD files under excluded directories and .git")
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "src", "BUILD"), []byte("# changed"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := c.GetCacheKey(tmpDir)
+	if err != nil {
+		t.Fatalf("GetCacheKey() error = %v", err)
+	}
+	if changed == after {
+		t.Error("GetCacheKey() should change after modifying a BUILD file outside excluded directories")
+	}
+}
+
+func TestCache_GetGitCacheKey(t *testing.T) {
+	repo := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repo, "b"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeBuild := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(repo, "b", "BUILD"), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitKey := func(c *Cache, index string) string {
+		t.Helper()
+		mockExec := executor.NewMockExecutor()
+		mockExec.ExpectCommandWithArgs("git", "-C", repo, "ls-files", "-s", "-z", "--", "*BUILD", "*BUILD.bazel", "*.bzl").
+			WillSucceed(index, 0).
+			Build()
+		mockExec.ExpectCommandWithArgs("git", "-C", repo, "ls-files", "-m", "-o", "--exclude-standard", "-z", "--", "*BUILD", "*BUILD.bazel", "*.bzl").
+			WillSucceed("b/BUILD\x00", 0).
+			Build()
+		key, err := c.GetGitCacheKey(context.Background(), mockExec, repo)
+		if err != nil {
+			t.Fatalf("GetGitCacheKey() error = %v", err)
+		}
+		return key
+	}
+	const index = "100644 aaaa 0\ta/BUILD\x00100644 bbbb 0\tgen/BUILD\x00"
+	c := NewCache(t.TempDir())
+
+	writeBuild("# one")
+	key1 := gitKey(c, index)
+	if key1 != gitKey(c, index) {
+		t.Error("GetGitCacheKey() should be stable for an unchanged tree")
+	}
+	writeBuild("# two")
+	key2 := gitKey(c, index)
+	if key1 == key2 {
+		t.Error("GetGitCacheKey() should change when a dirty file's content changes")
+	}
+	if key2 == gitKey(c, "100644 cccc 0\ta/BUILD\x00100644 bbbb 0\tgen/BUILD\x00") {
+		t.Error("GetGitCacheKey() should change when an indexed blob changes")
+	}
+
+	c.SetKeyExclude(func(dir string) bool { return dir == "gen" })
+	if gitKey(c, index) != gitKey(c, "100644 aaaa 0\ta/BUILD\x00100644 dddd 0\tgen/BUILD\x00") {
+		t.Error("GetGitCacheKey() should ignore files under excluded directories")
+	}
+}
+
+func TestCache_KeyInputs(t *testing.T) {
+	repo := t.TempDir()
+	c := NewCache(t.TempDir())
+	plain, err := c.GetCacheKey(repo)
+	if err != nil {
+		t.Fatalf("GetCacheKey() error = %v", err)
+	}
+	plainIncremental := c.IncrementalKey()
+
+	c.SetKeyInputs([]KeyInput{{Name: "flag", Value: "--define=mode=opt"}})
+	mixed, err := c.GetCacheKey(repo)
+	if err != nil {
+		t.Fatalf("GetCacheKey() error = %v", err)
+	}
+	if mixed == plain {
+		t.Error("GetCacheKey() should change when key inputs are set")
+	}
+	incremental := c.IncrementalKey()
+	if incremental == plainIncremental || !IsIncrementalKey(incremental) {
+		t.Errorf("IncrementalKey() = %q, want a different incremental key than %q", incremental, plainIncremental)
+	}
+
+	c.SetKeyInputs([]KeyInput{{Name: "flag", Value: "--define=mode=dbg"}})
+	other, err := c.GetCacheKey(repo)
+	if err != nil {
+		t.Fatalf("GetCacheKey() error = %v", err)
+	}
+	if other == mixed {
+		t.Error("GetCacheKey() should change when a key input's value changes")
+	}
+}
+
+func TestCache_EntryIntegrity(t *testing.T) {
+	c := NewCache(t.TempDir())
+	if err := c.Set("key", "//pkg", []string{"//pkg:test"}); err != nil {
+		t.Fatal(err)
+	}
+	file := c.getCacheFile("key", "//pkg")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated payload", data[:len(data)-3]},
+		{"legacy format without header", []byte(`["//pkg:test"]`)},
+		{"other version", append([]byte("bazel-affected-tests-cache 2 "), data[len("bazel-affected-tests-cache 1 "):]...)},
+		{"tampered payload", append(append([]byte{}, data[:len(data)-2]...), []byte("x]")...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(file, tt.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if got, found := c.Get("key", "//pkg"); found {
+				t.Errorf("Get() = %v, want miss for corrupt entry", got)
+			}
+			if _, err := os.Stat(file); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("corrupt entry should be removed, stat error = %v", err)
+			}
+		})
+	}
+}
+
+func TestCache_Index(t *testing.T) {
+	c := NewCache(t.TempDir())
+	if _, found := c.GetIndex("key"); found {
+		t.Error("GetIndex() on empty cache should miss")
+	}
+	data := []byte(`{"tests":["//pkg:test"],"packages":{"//pkg":[0]}}`)
+	if err := c.SetIndex("key", data); err != nil {
+		t.Fatalf("SetIndex() error = %v", err)
+	}
+	got, found := c.GetIndex("key")
+	if !found || string(got) != string(data) {
+		t.Errorf("GetIndex() = %q, %v, want %q, true", got, found, data)
+	}
+	// The index does not shadow a package entry under the same key.
+	if _, found := c.Get("key", "//pkg"); found {
+		t.Error("Get() should not return the index as a package entry")
+	}
+	if err := c.SetIndex(c.IncrementalKey(), data); err == nil {
+		t.Error("SetIndex() with an incremental key should fail")
+	}
+}
+
+func TestCache_ConcurrentSetIsAtomic(t *testing.T) {
+	c := NewCache(t.TempDir())
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tests := make([]string, i+1)
+			for j := range tests {
+				tests[j] = "//pkg:test"
+			}
+			if err := c.Set("key", "//pkg", tests); err != nil {
+				t.Errorf("Set() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, found := c.Get("key", "//pkg"); !found {
+		t.Error("Get() should find a complete entry after concurrent writes")
+	}
+	files, err := os.ReadDir(filepath.Join(c.dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("key directory holds %d files, want only the entry (no leftover temporary files)", len(files))
+	}
+}
+
+func TestCache_LockEntry(t *testing.T) {
+	c := NewCache(t.TempDir())
+	unlock, err := c.LockEntry("key", "//pkg", time.Second)
+	if err != nil {
+		t.Fatalf("LockEntry() error = %v", err)
+	}
+	if _, err := c.LockEntry("key", "//pkg", 100*time.Millisecond); err == nil {
+		t.Fatal("second LockEntry() should time out while the entry is held")
+	}
+	other, err := c.LockEntry("key", "//other", 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("LockEntry() of another entry should not wait: %v", err)
+	}
+	other()
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+		close(released)
+	}()
+	unlock2, err := c.LockEntry("key", "//pkg", 5*time.Second)
+	if err != nil {
+		t.Fatalf("LockEntry() should succeed once released: %v", err)
+	}
+	<-released
+	unlock2()
+}
+
+func TestCache_GetOrLock(t *testing.T) {
+	c := NewCache(t.TempDir())
+	_, found, unlock := c.GetOrLock("key", "//pkg")
+	if found {
+		t.Fatal("GetOrLock() found an entry in an empty cache")
+	}
+
+	// A concurrent run waiting for the entry finds it once stored.
+	got := make(chan []string)
+	go func() {
+		tests, _, unlock := c.GetOrLock("key", "//pkg")
+		unlock()
+		got <- tests
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Set("key", "//pkg", []string{"//pkg:test"}); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if tests := <-got; !reflect.DeepEqual(tests, []string{"//pkg:test"}) {
+		t.Errorf("waiting GetOrLock() = %v, want the stored entry", tests)
+	}
+}
+
+func TestCache_UseKeepsKeyFromGC(t *testing.T) {
+	c := NewCache(t.TempDir())
+	release, err := c.Use("key")
+	if err != nil {
+		t.Fatalf("Use() error = %v", err)
+	}
+	// Any number of runs may use a key at once.
+	release2, err := c.Use("key")
+	if err != nil {
+		t.Fatalf("second Use() error = %v", err)
+	}
+	release2()
+
+	if _, err := c.GC(Limits{MaxKeys: 1}, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "key")); err != nil {
+		t.Errorf("key in use was evicted: %v", err)
+	}
+
+	release()
+	claimed, ok := c.claimKey("key")
+	if !ok {
+		t.Fatal("claimKey() failed after the run released the key")
+	}
+	claimed()
+}
+
+func TestCache_UseWhileGCRemovesKey(t *testing.T) {
+	c := NewCache(t.TempDir())
+	if err := c.Set("key", "//pkg", []string{"//pkg:test"}); err != nil {
+		t.Fatal(err)
+	}
+	release, ok := c.claimKey("key")
+	if !ok {
+		t.Fatal("claimKey() failed on an unused key")
+	}
+	if _, err := c.Use("key"); err == nil || !strings.Contains(err.Error(), "being removed") {
+		t.Errorf("Use() during removal error = %v, want being removed", err)
+	}
+
+	// Once GC has removed the key, a new run recreates and protects it.
+	if err := os.RemoveAll(filepath.Join(c.dir, "key")); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	useRelease, err := c.Use("key")
+	if err != nil {
+		t.Fatalf("Use() after removal error = %v", err)
+	}
+	defer useRelease()
+	if _, ok := c.claimKey("key"); ok {
+		t.Error("claimKey() succeeded on a key in use")
+	}
+}
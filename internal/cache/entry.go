@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// entryMagic and entryVersion start the header line of every stored entry:
+// "<magic> <version> <sha256 of payload>\n". An entry whose header does not
+// parse, names another version, or whose checksum does not match is treated
+// as a miss, so a torn or partially written file is never decoded.
+const (
+	entryMagic   = "bazel-affected-tests-cache"
+	entryVersion = 1
+)
+
+var errCorruptEntry = errors.New("corrupt cache entry")
+
+// encodeEntry prefixes payload with the versioned, checksummed header.
+func encodeEntry(payload []byte) []byte {
+	header := fmt.Sprintf("%s %d %x\n", entryMagic, entryVersion, sha256.Sum256(payload))
+	return append([]byte(header), payload...)
+}
+
+// decodeEntry verifies the header written by encodeEntry and returns the
+// payload.
+func decodeEntry(data []byte) ([]byte, error) {
+	header, payload, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("%w: missing header", errCorruptEntry)
+	}
+	fields := strings.Fields(string(header))
+	if len(fields) != 3 || fields[0] != entryMagic {
+		return nil, fmt.Errorf("%w: malformed header", errCorruptEntry)
+	}
+	if v, err := strconv.Atoi(fields[1]); err != nil || v != entryVersion {
+		return nil, fmt.Errorf("%w: unsupported version %q", errCorruptEntry, fields[1])
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(payload)) != fields[2] {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptEntry)
+	}
+	return payload, nil
+}
+
+// writeFileAtomic writes data to a temporary file in path's directory and
+// renames it over path, so readers see either the old or the new content
+// and never a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed.
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("renaming temporary file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statsFileName holds the cumulative hit and miss counters in the cache
+// directory, next to the key directories.
+const statsFileName = "stats.json"
+
+// Limits bound the cache directory. Whole key directories are evicted, least
+// recently used first. Zero fields are unlimited.
+type Limits struct {
+	MaxBytes int64
+	MaxAge   time.Duration
+	MaxKeys  int
+}
+
+// Unlimited reports whether no limit is set.
+func (l Limits) Unlimited() bool {
+	return l.MaxBytes <= 0 && l.MaxAge <= 0 && l.MaxKeys <= 0
+}
+
+// KeyUsage describes one cache key directory. LastUsed is the directory's
+// modification time, which writes update and cache hits refresh.
+type KeyUsage struct {
+	Key      string
+	Entries  int
+	Bytes    int64
+	LastUsed time.Time
+}
+
+// GCResult reports what GC removed.
+type GCResult struct {
+	RemovedKeys  int
+	RemovedBytes int64
+	KeptKeys     int
+	KeptBytes    int64
+}
+
+// Stats summarizes the cache directory and its recorded lookups.
+type Stats struct {
+	Keys   []KeyUsage
+	Hits   int64
+	Misses int64
+}
+
+// statsFile is the on-disk form of the lookup counters.
+type statsFile struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// SetLimits sets the limits enforced after the first write of a run, so the
+// directory is trimmed opportunistically without a separate gc step.
+func (c *Cache) SetLimits(limits Limits) {
+	c.limits = limits
+}
+
+// Usage scans the cache directory and returns one KeyUsage per key, most
+// recently used first. A missing cache directory has no keys.
+func (c *Cache) Usage() ([]KeyUsage, error) {
+	dirEntries, err := os.ReadDir(c.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cache directory: %w", err)
+	}
+	var usage []KeyUsage
+	for _, d := range dirEntries {
+		if !d.IsDir() {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		u := KeyUsage{Key: d.Name(), LastUsed: info.ModTime()}
+		files, err := os.ReadDir(filepath.Join(c.dir, d.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !strings.HasSuffix(f.Name(), ".json") {
+				continue // Lock and in-flight temporary files
+			}
+			if fi, err := f.Info(); err == nil && fi.Mode().IsRegular() {
+				u.Entries++
+				u.Bytes += fi.Size()
+			}
+		}
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].LastUsed.After(usage[j].LastUsed) })
+	return usage, nil
+}
+
+// GC removes key directories that violate limits: first those unused for
+// longer than MaxAge, then the least recently used until at most MaxKeys
+// remain and they total at most MaxBytes. The key keep, if not empty, is never
+// removed.
+func (c *Cache) GC(limits Limits, keep string) (GCResult, error) {
+	var result GCResult
+	usage, err := c.Usage()
+	if err != nil {
+		return result, err
+	}
+	now := time.Now()
+	var kept []KeyUsage
+	for _, u := range usage {
+		if u.Key != keep && limits.MaxAge > 0 && now.Sub(u.LastUsed) > limits.MaxAge {
+			removed, err := c.removeKey(u, &result)
+			if err != nil {
+				return result, err
+			}
+			if removed {
+				continue
+			}
+		}
+		kept = append(kept, u)
+		result.KeptBytes += u.Bytes
+	}
+	// kept is most recently used first, so evict from the end.
+	for i := len(kept) - 1; i >= 0; i-- {
+		overKeys := limits.MaxKeys > 0 && len(kept) > limits.MaxKeys
+		overBytes := limits.MaxBytes > 0 && result.KeptBytes > limits.MaxBytes
+		if !overKeys && !overBytes {
+			break
+		}
+		if kept[i].Key == keep {
+			continue
+		}
+		removed, err := c.removeKey(kept[i], &result)
+		if err != nil {
+			return result, err
+		}
+		if !removed {
+			continue
+		}
+		result.KeptBytes -= kept[i].Bytes
+		kept = append(kept[:i], kept[i+1:]...)
+	}
+	result.KeptKeys = len(kept)
+	return result, nil
+}
+
+// removeKey removes u's key directory unless a concurrent run is using it,
+// in which case removed is false. The key's lock is held until the directory
+// is gone, so a run cannot start using it halfway through.
+func (c *Cache) removeKey(u KeyUsage, result *GCResult) (removed bool, err error) {
+	release, ok := c.claimKey(u.Key)
+	if !ok {
+		return false, nil
+	}
+	defer release()
+	if err := os.RemoveAll(filepath.Join(c.dir, u.Key)); err != nil {
+		return false, fmt.Errorf("removing cache key %s: %w", u.Key, err)
+	}
+	slog.Debug("Evicted cache key", "key", u.Key, "bytes", u.Bytes, "last_used", u.LastUsed)
+	result.RemovedKeys++
+	result.RemovedBytes += u.Bytes
+	return true, nil
+}
+
+// collectAfterWrite enforces the configured limits once per run, after the
+// first successful write. The key just written is kept.
+func (c *Cache) collectAfterWrite(cacheKey string) {
+	if c.limits.Unlimited() {
+		return
+	}
+	c.gcOnce.Do(func() {
+		result, err := c.GC(c.limits, cacheKey)
+		if err != nil {
+			slog.Debug("Cache garbage collection failed", "error", err)
+			return
+		}
+		if result.RemovedKeys > 0 {
+			slog.Debug("Cache garbage collected", "removed_keys", result.RemovedKeys, "removed_bytes", result.RemovedBytes)
+		}
+	})
+}
+
+// touchKey marks cacheKey as used by refreshing its directory's modification
+// time, once per run, so GC evicts in least-recently-used order.
+func (c *Cache) touchKey(cacheKey string) {
+	if _, done := c.touched.LoadOrStore(cacheKey, true); done {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(c.dir, cacheKey), now, now); err != nil {
+		slog.Debug("Failed to mark cache key as used", "key", cacheKey, "error", err)
+	}
+}
+
+// recordLookup counts a Get for the stats subcommand.
+func (c *Cache) recordLookup(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// FlushStats adds this run's hit and miss counts to the cumulative counters
+// in the cache directory. It does nothing if there were no lookups.
+func (c *Cache) FlushStats() error {
+	hits, misses := c.hits.Swap(0), c.misses.Swap(0)
+	if hits == 0 && misses == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	// Serialize the read-modify-write with concurrent runs.
+	unlock, err := acquireLockFile(filepath.Join(c.dir, "."+statsFileName+".lock"), time.Second)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	stats := c.readStatsFile()
+	stats.Hits += hits
+	stats.Misses += misses
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache stats: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(c.dir, statsFileName), data); err != nil {
+		return fmt.Errorf("failed to write cache stats: %w", err)
+	}
+	return nil
+}
+
+func (c *Cache) readStatsFile() statsFile {
+	var stats statsFile
+	data, err := os.ReadFile(filepath.Join(c.dir, statsFileName))
+	if err != nil {
+		return stats
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		slog.Debug("Ignoring unreadable cache stats", "error", err)
+		return statsFile{}
+	}
+	return stats
+}
+
+// Stats returns the per-key usage of the cache directory and the cumulative
+// lookup counters recorded by FlushStats.
+func (c *Cache) Stats() (Stats, error) {
+	usage, err := c.Usage()
+	if err != nil {
+		return Stats{}, err
+	}
+	recorded := c.readStatsFile()
+	return Stats{Keys: usage, Hits: recorded.Hits, Misses: recorded.Misses}, nil
+}
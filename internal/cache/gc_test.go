@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// seedKeys writes one entry per key and backdates each key directory by the
+// given age, so the keys are ordered for eviction.
+func seedKeys(t *testing.T, c *Cache, ages map[string]time.Duration) {
+	t.Helper()
+	for key, age := range ages {
+		if err := c.Set(key, "//pkg", []string{"//pkg:test"}); err != nil {
+			t.Fatal(err)
+		}
+		when := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(c.dir, key), when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func keyNames(t *testing.T, c *Cache) []string {
+	t.Helper()
+	usage, err := c.Usage()
+	if err != nil {
+		t.Fatalf("Usage() error = %v", err)
+	}
+	var names []string
+	for _, u := range usage {
+		names = append(names, u.Key)
+	}
+	return names
+}
+
+func TestCache_GC(t *testing.T) {
+	ages := map[string]time.Duration{"new": time.Hour, "mid": 2 * time.Hour, "old": 48 * time.Hour}
+	tests := []struct {
+		name   string
+		limits Limits
+		keep   string
+		want   []string
+	}{
+		{"max age", Limits{MaxAge: 24 * time.Hour}, "", []string{"new", "mid"}},
+		{"max keys evicts least recently used", Limits{MaxKeys: 1}, "", []string{"new"}},
+		{"max bytes", Limits{MaxBytes: 150}, "", []string{"new"}},
+		{"keep survives", Limits{MaxKeys: 1, MaxAge: 24 * time.Hour}, "old", []string{"old"}},
+		{"unlimited", Limits{}, "", []string{"new", "mid", "old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(t.TempDir())
+			seedKeys(t, c, ages)
+			result, err := c.GC(tt.limits, tt.keep)
+			if err != nil {
+				t.Fatalf("GC() error = %v", err)
+			}
+			if got := keyNames(t, c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keys after GC = %v, want %v", got, tt.want)
+			}
+			if result.RemovedKeys != len(ages)-len(tt.want) || result.KeptKeys != len(tt.want) {
+				t.Errorf("GC() = %+v, want %d removed and %d kept", result, len(ages)-len(tt.want), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestCache_GCAfterWrite(t *testing.T) {
+	c := NewCache(t.TempDir())
+	seedKeys(t, c, map[string]time.Duration{"old": 48 * time.Hour})
+	c.SetLimits(Limits{MaxKeys: 1})
+	if err := c.Set("current", "//pkg", []string{"//pkg:test"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := keyNames(t, c); !reflect.DeepEqual(got, []string{"current"}) {
+		t.Errorf("keys after write = %v, want [current]", got)
+	}
+}
+
+func TestCache_HitRefreshesLastUsed(t *testing.T) {
+	c := NewCache(t.TempDir())
+	seedKeys(t, c, map[string]time.Duration{"a": 2 * time.Hour, "b": time.Hour})
+	if _, found := c.Get("a", "//pkg"); !found {
+		t.Fatal("Get() missed a seeded entry")
+	}
+	if got := keyNames(t, c); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("keys by recency = %v, want [a b]", got)
+	}
+}
+
+func TestCache_Stats(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(dir)
+	seedKeys(t, c, map[string]time.Duration{"a": time.Hour})
+	c.Get("a", "//pkg")
+	c.Get("a", "//missing")
+	if err := c.FlushStats(); err != nil {
+		t.Fatalf("FlushStats() error = %v", err)
+	}
+
+	// A later run adds to the recorded counters.
+	c2 := NewCache(dir)
+	c2.Get("a", "//pkg")
+	if err := c2.FlushStats(); err != nil {
+		t.Fatalf("FlushStats() error = %v", err)
+	}
+
+	stats, err := c2.Stats()
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("Stats() hits/misses = %d/%d, want 2/1", stats.Hits, stats.Misses)
+	}
+	if len(stats.Keys) != 1 || stats.Keys[0].Entries != 1 || stats.Keys[0].Bytes == 0 {
+		t.Errorf("Stats() keys = %+v, want one key with one entry", stats.Keys)
+	}
+}
+
+func TestCache_UsageMissingDir(t *testing.T) {
+	c := NewCache(filepath.Join(t.TempDir(), "absent"))
+	usage, err := c.Usage()
+	if err != nil || len(usage) != 0 {
+		t.Errorf("Usage() = %v, %v; want no keys and no error", usage, err)
+	}
+}
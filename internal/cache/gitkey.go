@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	"github.com/jaeyeom/bazel-affected-tests/internal/git"
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+// GetGitCacheKey computes a cache key over the same BUILD, BUILD.bazel and
+// .bzl files as GetCacheKey, but from git's index instead of a directory
+// walk: tracked files contribute their blob ids (git ls-files -s) and only
+// dirty or untracked ones are read from disk. On a large repository this
+// takes milliseconds rather than seconds. Files ignored by git are not seen,
+// and the key differs from the GetCacheKey key for the same tree.
+func (c *Cache) GetGitCacheKey(ctx context.Context, exec executor.Executor, repoRoot string) (string, error) {
+	blobs, err := git.BuildFileBlobs(ctx, exec, repoRoot)
+	if err != nil {
+		return "", fmt.Errorf("computing git cache key: %w", err)
+	}
+	dirty, err := git.DirtyBuildFiles(ctx, exec, repoRoot)
+	if err != nil {
+		return "", fmt.Errorf("computing git cache key: %w", err)
+	}
+
+	// Dirty entries override the index: "" marks a path to hash from disk.
+	entries := make(map[string]string, len(blobs)+len(dirty))
+	for p, blob := range blobs {
+		entries[p] = blob
+	}
+	for _, p := range dirty {
+		entries[p] = ""
+	}
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		if !c.excludedPath(p) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, p := range paths {
+		id := entries[p]
+		if id == "" {
+			id, err = hashFile(filepath.Join(repoRoot, filepath.FromSlash(p)))
+			if errors.Is(err, fs.ErrNotExist) {
+				id = "deleted"
+			} else if err != nil {
+				return "", fmt.Errorf("computing git cache key: %w", err)
+			}
+		}
+		fmt.Fprintf(h, "%s %s\n", p, id)
+	}
+	return c.mixInputs(fmt.Sprintf("%x", h.Sum(nil))), nil
+}
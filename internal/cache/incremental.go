@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// incrementalKeyPrefix marks cache keys whose entries are validated per entry
+// against recorded input files instead of by a whole-repo hash. Whole-repo
+// keys are hex digests, so the prefix cannot collide with them.
+const incrementalKeyPrefix = "incremental-"
+
+// incrementalKeyVersion identifies the incremental entry format. Bump it when
+// incrementalEntry changes incompatibly.
+const incrementalKeyVersion = 1
+
+// errNeedsInputs is returned by Set for incremental keys, and by
+// SetWithInputs when there are no inputs: an entry without recorded inputs
+// could never be invalidated.
+var errNeedsInputs = errors.New("incremental cache entries require recorded inputs; use SetWithInputs")
+
+// errNeedsRepoRoot is returned by SetWithInputs for incremental keys on a
+// cache created without a repository root.
+var errNeedsRepoRoot = errors.New("incremental cache entries require a repository root; use NewRepoCache")
+
+// incrementalEntry is the on-disk form of an incremental cache entry. Inputs
+// maps each repo-relative BUILD/.bzl file the answer depended on to the
+// SHA-256 of its content when the entry was written.
+type incrementalEntry struct {
+	Tests  []string          `json:"tests"`
+	Inputs map[string]string `json:"inputs"`
+}
+
+// IncrementalKey returns the cache key that selects incremental validation,
+// to pass to Get and SetWithInputs on a cache created by NewRepoCache. Unlike GetCacheKey it does not walk the repository: each
+// entry records the files its answer depended on, and Get rehashes only
+// those. Since every entry carries its own validation, the key does not
+// depend on where the repository is checked out, so clones at different
+// paths (and machines sharing a remote cache) reuse each other's entries.
+func (c *Cache) IncrementalKey() string {
+	return c.mixInputs(fmt.Sprintf("%sv%d", incrementalKeyPrefix, incrementalKeyVersion))
+}
+
+// IsIncrementalKey reports whether cacheKey was returned by IncrementalKey.
+func IsIncrementalKey(cacheKey string) bool {
+	return strings.HasPrefix(cacheKey, incrementalKeyPrefix)
+}
+
+// SetWithInputs stores tests for pkg together with the content hashes of the
+// given repo-relative input files, read from the cache's repository root. For
+// whole-repo keys the inputs are not needed and it behaves like Set.
+func (c *Cache) SetWithInputs(cacheKey, pkg string, tests, inputs []string) error {
+	if !IsIncrementalKey(cacheKey) {
+		return c.Set(cacheKey, pkg, tests)
+	}
+	if c.repoRoot == "" {
+		return errNeedsRepoRoot
+	}
+	if len(inputs) == 0 {
+		return errNeedsInputs
+	}
+	entry := incrementalEntry{Tests: tests, Inputs: make(map[string]string, len(inputs))}
+	for _, input := range inputs {
+		sum, err := hashFile(filepath.Join(c.repoRoot, filepath.FromSlash(input)))
+		if err != nil {
+			return fmt.Errorf("failed to hash cache input %s: %w", input, err)
+		}
+		entry.Inputs[input] = sum
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache entry: %w", err)
+	}
+	return c.writeEntry(cacheKey, pkg, data)
+}
+
+// getIncremental returns the entry for pkg if every recorded input still has
+// the recorded content hash. Entries without inputs are never returned.
+func (c *Cache) getIncremental(cacheKey, pkg string) ([]string, bool) {
+	if c.repoRoot == "" {
+		return nil, false
+	}
+	data, ok := c.readEntry(cacheKey, pkg)
+	if !ok {
+		return nil, false
+	}
+	var entry incrementalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		slog.Debug("Failed to unmarshal cache", "package", pkg, "error", err)
+		return nil, false
+	}
+	if len(entry.Inputs) == 0 {
+		slog.Debug("Cache entry has no recorded inputs", "package", pkg)
+		return nil, false
+	}
+	for input, want := range entry.Inputs {
+		got, err := hashFile(filepath.Join(c.repoRoot, filepath.FromSlash(input)))
+		if err != nil || got != want {
+			slog.Debug("Cache entry invalidated", "package", pkg, "input", input)
+			return nil, false
+		}
+	}
+	slog.Debug("Cache hit", "package", pkg, "inputs", len(entry.Inputs))
+	return entry.Tests, true
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("reading %s: %w", path, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
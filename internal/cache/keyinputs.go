@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// KeyInput is an extra value mixed into the cache key: the content digest of
+// a configured file, the value of an environment variable, or a Bazel flag.
+// Name identifies the input (e.g. "file:MODULE.bazel") and Value is what is
+// hashed.
+type KeyInput struct {
+	Name  string
+	Value string
+}
+
+// SetKeyInputs sets the extra inputs mixed into every key returned by
+// GetCacheKey, GetGitCacheKey and IncrementalKey. Inputs are hashed in the
+// given order.
+func (c *Cache) SetKeyInputs(inputs []KeyInput) {
+	c.inputs = inputs
+}
+
+// mixInputs folds the extra inputs into key. Without inputs key is returned
+// unchanged, so configuring none keeps existing cache entries valid. The
+// incremental prefix is preserved so the mixed key is still recognized.
+func (c *Cache) mixInputs(key string) string {
+	if len(c.inputs) == 0 {
+		return key
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", key)
+	for _, in := range c.inputs {
+		fmt.Fprintf(h, "%s=%s\n", in.Name, in.Value)
+	}
+	if strings.HasPrefix(key, incrementalKeyPrefix) {
+		return fmt.Sprintf("%s%x", incrementalKeyPrefix, h.Sum(nil)[:8])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
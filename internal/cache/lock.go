@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lockFileName is held with a shared lock in a key directory by every run
+// using the key, so GC can tell it is in use.
+const lockFileName = ".lock"
+
+// DefaultLockTimeout bounds how long LockEntry waits for another run to
+// finish computing the same entry before proceeding without the lock.
+const DefaultLockTimeout = 2 * time.Minute
+
+// lockPollInterval is how often a waiting run retries the lock.
+const lockPollInterval = 50 * time.Millisecond
+
+// Use marks cacheKey's directory as in use for the rest of the run, so a
+// concurrent GC does not remove it. It never waits: any number of runs may
+// use a key at once. The mark is an advisory file lock that the operating
+// system drops when the process exits, so a killed run leaves nothing
+// behind. The returned function releases it.
+func (c *Cache) Use(cacheKey string) (func(), error) {
+	dir := filepath.Join(c.dir, cacheKey)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	release, ok, err := tryLockFile(filepath.Join(dir, lockFileName), false)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("cache key %s is being removed", cacheKey)
+	}
+	// GC may have removed the directory after MkdirAll, releasing its lock
+	// just before this one was taken.
+	if _, err := os.Stat(dir); err != nil {
+		release()
+		return nil, fmt.Errorf("cache key %s is being removed", cacheKey)
+	}
+	return release, nil
+}
+
+// LockEntry takes the lock on one entry of cacheKey so concurrent runs
+// sharing the cache coordinate: while one run queries and writes the entry,
+// the others wait and then find it cached instead of repeating the query.
+// Runs working on different entries never wait for each other. The lock is
+// an advisory file lock released by the operating system if the process dies.
+// If it is not acquired within timeout, an error is returned and the caller
+// may proceed unlocked; writes are atomic either way. The returned function
+// releases the lock.
+func (c *Cache) LockEntry(cacheKey, entry string, timeout time.Duration) (func(), error) {
+	if err := os.MkdirAll(filepath.Join(c.dir, cacheKey), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	path := strings.TrimSuffix(c.getCacheFile(cacheKey, entry), ".json") + lockFileName
+	return acquireLockFile(path, timeout)
+}
+
+// GetOrLock returns entry from the cache like Get. On a miss it takes the
+// entry's lock and looks again, since another run may have stored the entry
+// while this one waited. If the entry is still missing, the caller holds the
+// lock until it calls unlock, after storing its own answer. unlock is never
+// nil; if the lock cannot be taken the caller proceeds unlocked.
+func (c *Cache) GetOrLock(cacheKey, entry string) (tests []string, found bool, unlock func()) {
+	if tests, found := c.Get(cacheKey, entry); found {
+		return tests, true, func() {}
+	}
+	unlock, err := c.LockEntry(cacheKey, entry, DefaultLockTimeout)
+	if err != nil {
+		slog.Warn("Proceeding without cache lock", "entry", entry, "error", err)
+		return nil, false, func() {}
+	}
+	if tests, found := c.peek(cacheKey, entry); found {
+		unlock()
+		return tests, true, func() {}
+	}
+	return nil, false, unlock
+}
+
+// peek is Get without recording a lookup, for the second look of GetOrLock.
+func (c *Cache) peek(cacheKey, entry string) ([]string, bool) {
+	if IsIncrementalKey(cacheKey) {
+		return c.getIncremental(cacheKey, entry)
+	}
+	return c.getWholeRepo(cacheKey, entry)
+}
+
+// acquireLockFile takes an exclusive lock on path, retrying until timeout.
+func acquireLockFile(path string, timeout time.Duration) (func(), error) {
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		release, ok, err := tryLockFile(path, true)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return release, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("timed out after %v waiting for cache lock %s", timeout, path)
+		}
+		if !logged {
+			slog.Debug("Waiting for cache lock held by another run", "lock", path)
+			logged = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// claimKey takes the exclusive lock on cacheKey's directory for GC. ok is
+// false while a run is using the key. The caller removes the directory before
+// calling release, so no run can start using it in between.
+func (c *Cache) claimKey(cacheKey string) (release func(), ok bool) {
+	release, ok, err := tryLockFile(filepath.Join(c.dir, cacheKey, lockFileName), true)
+	if err != nil {
+		slog.Debug("Failed to lock cache key", "key", cacheKey, "error", err)
+		return nil, false
+	}
+	return release, ok
+}
@@ -0,0 +1,107 @@
+//go:build !unix
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tryLockFile takes a lock on path without waiting, exclusive or shared. ok
+// is false if a conflicting lock is held. An exclusive lock creates path
+// exclusively, recording this process's ID in it. A shared lock creates its
+// own marker file next to path instead. Each side creates its file before
+// checking for the other's, so an exclusive and a shared lock are never both
+// taken. A lock whose process no longer exists is broken.
+func tryLockFile(path string, exclusive bool) (release func(), ok bool, err error) {
+	if !exclusive {
+		return trySharedLock(path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err == nil {
+		_, _ = f.WriteString(strconv.Itoa(os.Getpid()))
+		_ = f.Close()
+		release := func() { removeLockFile(path) }
+		if sharedHeld(path) {
+			release()
+			return nil, false, nil
+		}
+		return release, true, nil
+	}
+	if !errors.Is(err, fs.ErrExist) {
+		return nil, false, fmt.Errorf("failed to create lock file: %w", err)
+	}
+	if lockOwnerGone(path) {
+		slog.Debug("Breaking cache lock of an exited process", "lock", path)
+		_ = os.Remove(path)
+	}
+	return nil, false, nil
+}
+
+// trySharedLock creates a marker file for path recording this process's ID.
+// It fails while a live process holds the exclusive lock on path.
+func trySharedLock(path string) (release func(), ok bool, err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+sharedSuffix)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create lock file: %w", err)
+	}
+	_, _ = f.WriteString(strconv.Itoa(os.Getpid()))
+	_ = f.Close()
+	release = func() { removeLockFile(f.Name()) }
+	if _, err := os.Stat(path); err == nil && !lockOwnerGone(path) {
+		release()
+		return nil, false, nil
+	}
+	return release, true, nil
+}
+
+// sharedSuffix starts the name of the shared lock markers of a lock file,
+// after its base name.
+const sharedSuffix = ".shared-*"
+
+// sharedHeld reports whether a live process holds a shared lock on path.
+// Markers left by exited processes are removed.
+func sharedHeld(path string) bool {
+	markers, _ := filepath.Glob(path + sharedSuffix)
+	held := false
+	for _, m := range markers {
+		if lockOwnerGone(m) {
+			_ = os.Remove(m)
+			continue
+		}
+		held = true
+	}
+	return held
+}
+
+func removeLockFile(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Debug("Failed to release cache lock", "lock", path, "error", err)
+	}
+}
+
+// lockOwnerGone reports whether the process recorded in the lock file at path
+// has exited. A lock without a readable process ID is assumed live, since
+// its owner may not have written it yet.
+func lockOwnerGone(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	}
+	_ = p.Release()
+	return false
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLockFile takes a flock(2) lock on path without waiting, exclusive or
+// shared. ok is false if a conflicting lock is held. The lock file itself is
+// left in place: removing it would race with a run that just opened it.
+func tryLockFile(path string, exclusive bool) (release func(), ok bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	release = func() {
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
+			slog.Debug("Failed to release cache lock", "lock", path, "error", err)
+		}
+		_ = f.Close()
+	}
+	// GC may have removed the file, with its key directory, between opening
+	// and locking it; a lock on a removed file protects nothing.
+	locked, err := f.Stat()
+	if err != nil {
+		release()
+		return nil, false, fmt.Errorf("failed to stat lock file: %w", err)
+	}
+	if current, err := os.Stat(path); err != nil || !os.SameFile(locked, current) {
+		release()
+		return nil, false, nil
+	}
+	return release, true, nil
+}
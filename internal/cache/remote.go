@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Backend is a shared store for encoded cache entries, consulted when the
+// local cache directory misses. Implementations must be safe for concurrent
+// use.
+type Backend interface {
+	// Load returns the entry stored for pkg under cacheKey. found is false,
+	// with a nil error, if there is no such entry.
+	Load(cacheKey, pkg string) (data []byte, found bool, err error)
+	// Store saves the entry for pkg under cacheKey.
+	Store(cacheKey, pkg string, data []byte) error
+}
+
+// DefaultRemoteTimeout bounds each request to a remote cache backend.
+const DefaultRemoteTimeout = 10 * time.Second
+
+// HTTPBackend stores entries on an HTTP server speaking the Bazel remote
+// cache's simple GET/PUT protocol. Each entry is stored under
+// <baseURL>/ac/<sha256 of cache key and package>, so a cache server that
+// already backs Bazel can share results between CI runners and developer
+// machines. Servers that validate /ac/ entries as ActionResult protos (such
+// as bazel-remote without --disable_http_ac_validation) must have that
+// validation disabled. Credentials in the URL's user info are sent as basic
+// auth.
+type HTTPBackend struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPBackend returns a backend for the cache server at baseURL whose
+// requests time out after timeout.
+func NewHTTPBackend(baseURL string, timeout time.Duration) *HTTPBackend {
+	return &HTTPBackend{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// entryURL returns the /ac/ URL of the entry for pkg under cacheKey.
+func (b *HTTPBackend) entryURL(cacheKey, pkg string) string {
+	return fmt.Sprintf("%s/ac/%x", b.baseURL, sha256.Sum256([]byte(cacheKey+"\n"+pkg)))
+}
+
+// Load implements Backend.
+func (b *HTTPBackend) Load(cacheKey, pkg string) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, b.entryURL(cacheKey, pkg), nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("creating remote cache request: %w", err)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("remote cache GET: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("remote cache GET: unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading remote cache entry: %w", err)
+	}
+	return data, true, nil
+}
+
+// Store implements Backend.
+func (b *HTTPBackend) Store(cacheKey, pkg string, data []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, b.entryURL(cacheKey, pkg), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("creating remote cache request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote cache PUT: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("remote cache PUT: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// SetRemote adds a shared backend behind the local cache directory. Local
+// misses are looked up remotely and remote hits are copied into the local
+// directory; every write goes to both. After the first remote error the
+// backend is skipped for the rest of the run, so an unreachable server costs
+// at most one timeout.
+func (c *Cache) SetRemote(remote Backend) {
+	c.remote = remote
+}
+
+// readEntry returns the payload of the entry for pkg under cacheKey from the
+// local directory or, failing that, the remote backend. Entries failing the
+// header check are misses; a corrupt local file is removed so the next write
+// replaces it.
+func (c *Cache) readEntry(cacheKey, pkg string) ([]byte, bool) {
+	cacheFile := c.getCacheFile(cacheKey, pkg)
+	if data, err := os.ReadFile(cacheFile); err == nil {
+		payload, err := decodeEntry(data)
+		if err == nil {
+			return payload, true
+		}
+		slog.Debug("Discarding cache entry", "package", pkg, "error", err)
+		_ = os.Remove(cacheFile)
+	}
+	if c.remote == nil || c.remoteFailed.Load() {
+		return nil, false
+	}
+	data, found, err := c.remote.Load(cacheKey, pkg)
+	if err != nil {
+		c.disableRemote(err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+	payload, err := decodeEntry(data)
+	if err != nil {
+		slog.Debug("Discarding remote cache entry", "package", pkg, "error", err)
+		return nil, false
+	}
+	slog.Debug("Remote cache hit", "package", pkg)
+	if err := c.writeLocal(cacheKey, pkg, data); err != nil {
+		slog.Debug("Failed to copy remote cache entry locally", "package", pkg, "error", err)
+	}
+	return payload, true
+}
+
+// storeRemote writes the entry to the remote backend, if any.
+func (c *Cache) storeRemote(cacheKey, pkg string, data []byte) {
+	if c.remote == nil || c.remoteFailed.Load() {
+		return
+	}
+	if err := c.remote.Store(cacheKey, pkg, data); err != nil {
+		c.disableRemote(err)
+	}
+}
+
+func (c *Cache) disableRemote(err error) {
+	if c.remoteFailed.CompareAndSwap(false, true) {
+		slog.Warn("Remote cache unavailable; continuing with the local cache only", "error", err)
+	}
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRemoteCache is an in-memory stand-in for a Bazel HTTP remote cache.
+type fakeRemoteCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	gets    int
+	puts    int
+}
+
+func newFakeRemoteCache(t *testing.T) (*fakeRemoteCache, *httptest.Server) {
+	t.Helper()
+	f := &fakeRemoteCache{entries: make(map[string][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !strings.HasPrefix(r.URL.Path, "/ac/") {
+			http.Error(w, "bad path", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			f.gets++
+			data, ok := f.entries[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(data)
+		case http.MethodPut:
+			f.puts++
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			f.entries[r.URL.Path] = data
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func TestCache_RemoteSharesEntries(t *testing.T) {
+	fake, srv := newFakeRemoteCache(t)
+	tests := []string{"//pkg:test1", "//pkg:test2"}
+
+	writer := NewCache(t.TempDir())
+	writer.SetRemote(NewHTTPBackend(srv.URL+"/", DefaultRemoteTimeout))
+	if err := writer.Set("key", "//pkg", tests); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if fake.puts != 1 {
+		t.Fatalf("remote PUTs = %d, want 1", fake.puts)
+	}
+
+	// A second machine with an empty local cache is served by the remote,
+	// and the hit is copied locally so the next lookup stays local.
+	reader := NewCache(t.TempDir())
+	reader.SetRemote(NewHTTPBackend(srv.URL, DefaultRemoteTimeout))
+	for i := 0; i < 2; i++ {
+		got, found := reader.Get("key", "//pkg")
+		if !found || !reflect.DeepEqual(got, tests) {
+			t.Fatalf("Get() = %v, %v; want %v, true", got, found, tests)
+		}
+	}
+	if fake.gets != 1 {
+		t.Errorf("remote GETs = %d, want 1", fake.gets)
+	}
+
+	if _, found := reader.Get("key", "//other"); found {
+		t.Error("Get() found an entry that was never stored")
+	}
+}
+
+func TestCache_RemoteErrorDisablesBackend(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	c := NewCache(t.TempDir())
+	c.SetRemote(NewHTTPBackend(srv.URL, time.Second))
+	if _, found := c.Get("key", "//pkg"); found {
+		t.Fatal("Get() should miss when the remote fails")
+	}
+	if err := c.Set("key", "//pkg", []string{"//pkg:test"}); err != nil {
+		t.Fatalf("Set() should succeed locally despite remote failure: %v", err)
+	}
+	if got, found := c.Get("key", "//pkg"); !found || len(got) != 1 {
+		t.Errorf("Get() = %v, %v; want the locally stored entry", got, found)
+	}
+	if requests != 1 {
+		t.Errorf("remote requests = %d, want 1 (backend disabled after the first error)", requests)
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/jaeyeom/bazel-affected-tests/internal/query"
 	"gopkg.in/yaml.v3"
 )
 
@@ -21,58 +24,206 @@ const ConfigFileName = ".bazel-affected-tests.yaml"
 // BUILD file. Use -1 (UnlimitedParentDepth in the query package) to disable.
 const DefaultMaxParentDepth = 1
 
+// Granularity values select how changed files are turned into the starting
+// set of the rdeps query. GranularityPackage starts from every target in the
+// changed file's package (//pkg:*); GranularityRule starts from only the rules
+// that list the file in a source-like attribute.
+const (
+	GranularityPackage = "package"
+	GranularityRule    = "rule"
+)
+
+// Precision values select what a changed file contributes to the rdeps query.
+// PrecisionPackage starts from the file's whole package (or its owner rules,
+// see Granularity); PrecisionFile starts from the file's own source-file
+// target, falling back to the package only for files Bazel does not know as
+// targets.
+const (
+	PrecisionPackage = "package"
+	PrecisionFile    = "file"
+)
+
+// Cache key strategies. CacheKeyWalk hashes every BUILD/.bzl file found by
+// walking the repository; CacheKeyGit reads tracked files' blob ids from the
+// git index and hashes only dirty or untracked ones.
+const (
+	CacheKeyWalk = "walk"
+	CacheKeyGit  = "git"
+)
+
 // Config represents the configuration file structure.
 type Config struct {
 	// Version is the configuration file format version. Currently only 1 is supported.
-	Version int `yaml:"version"`
+	Version int `yaml:"version,omitempty"`
 	// IgnorePaths is a list of glob patterns for file paths to skip before
 	// package resolution. Files matching these patterns are excluded from all
 	// processing — no package lookup and no test discovery.
-	IgnorePaths []string `yaml:"ignore_paths"`
+	IgnorePaths []string `yaml:"ignore_paths,omitempty"`
 	// EnableSubpackageQuery controls whether the sub-package test query
 	// (kind('.*_test rule', PKG/...)) is executed. When false, only
 	// same-package and rdeps queries run. Defaults to true if unset.
-	EnableSubpackageQuery *bool `yaml:"enable_subpackage_query"`
+	EnableSubpackageQuery *bool `yaml:"enable_subpackage_query,omitempty"`
 	// MaxParentDepth caps how many parent directories above a changed file's
 	// own directory may be walked looking for a BUILD file. Use -1 for
 	// unlimited. Unset (nil) means use DefaultMaxParentDepth.
-	MaxParentDepth *int `yaml:"max_parent_depth"`
+	MaxParentDepth *int `yaml:"max_parent_depth,omitempty"`
 	// Strict, when true, causes the tool to fail if any changed file does
 	// not map to a Bazel package within MaxParentDepth (after ignore_paths
 	// filtering).
-	Strict bool `yaml:"strict"`
+	Strict bool `yaml:"strict,omitempty"`
 	// BestEffort, when true, logs Bazel query failures as warnings and
 	// continues with partial results instead of failing. Unset (nil) means
 	// defer to the CLI flag / environment variable. This is safe to enable
 	// repo-wide only when an authoritative downstream gate (CI/CD) runs the
 	// full test suite; the pre-push run is then just a filter.
-	BestEffort *bool `yaml:"best_effort"`
+	BestEffort *bool `yaml:"best_effort,omitempty"`
 	// QueryTimeout is the per-query wall-clock limit as a Go duration string
 	// (e.g. "60s", "2m"). Empty means use the built-in default. Large
 	// monorepos whose rdeps queries traverse a big graph may need to raise it.
-	QueryTimeout string `yaml:"query_timeout"`
+	QueryTimeout string `yaml:"query_timeout,omitempty"`
+	// Granularity selects package-level ("package") or rule-level ("rule")
+	// affected-test selection. Empty means use GranularityPackage.
+	Granularity string `yaml:"granularity,omitempty"`
+	// Precision selects package-level ("package") or source-file-level
+	// ("file") rdeps starting points. Empty means use PrecisionPackage.
+	Precision string `yaml:"precision,omitempty"`
+	// ActionInputs, when true, makes rule granularity map a changed file to
+	// every rule that consumes it as an input (templates, codegen inputs,
+	// custom rule attributes), not only rules listing it in srcs, hdrs, data
+	// or resources. Unset (nil) means defer to the CLI flag, which defaults to
+	// false.
+	ActionInputs *bool `yaml:"action_inputs,omitempty"`
+	// BatchQueries, when true, resolves all changed packages with one batched
+	// set of Bazel queries instead of up to three queries per package. Unset
+	// (nil) means defer to the CLI flag, which defaults to false.
+	BatchQueries *bool `yaml:"batch_queries,omitempty"`
+	// QueryJobs is the number of packages queried concurrently. Zero (unset)
+	// means one package at a time.
+	QueryJobs int `yaml:"query_jobs,omitempty"`
+	// QueryOutputBase, when set, runs queries against an isolated Bazel
+	// --output_base rooted here instead of the workspace's default server.
+	// With QueryJobs > 1 each worker gets its own subdirectory so queries do
+	// not serialize on one server's lock.
+	QueryOutputBase string `yaml:"query_output_base,omitempty"`
+	// IncrementalCache, when true, validates each cache entry against the
+	// BUILD/.bzl files its answer depended on instead of a hash of every
+	// build file in the repository. Unset (nil) means defer to the CLI flag,
+	// which defaults to false.
+	IncrementalCache *bool `yaml:"incremental_cache,omitempty"`
+	// CacheKey selects how the whole-repository cache key is computed:
+	// CacheKeyWalk or CacheKeyGit. Empty means use CacheKeyWalk.
+	CacheKey string `yaml:"cache_key,omitempty"`
+	// CacheKeyExclude is a list of glob patterns for repo-relative
+	// directories, such as generated trees, whose BUILD/.bzl files are left
+	// out of the cache key. Patterns use the same syntax as ignore_paths.
+	CacheKeyExclude []string `yaml:"cache_key_exclude,omitempty"`
+	// CacheKeyInputs lists extra inputs mixed into the cache key, for
+	// repositories where files or settings outside BUILD/.bzl files change
+	// which targets exist.
+	CacheKeyInputs CacheKeyInputs `yaml:"cache_key_inputs,omitempty"`
+	// RemoteCache is the base URL of an HTTP cache server speaking the Bazel
+	// remote cache protocol (e.g. "https://cache.example.com"). Query results
+	// are shared through it, behind the local cache directory. Empty means
+	// local caching only.
+	RemoteCache string `yaml:"remote_cache,omitempty"`
+	// MaxCacheBytes caps the total size of the cache directory in bytes.
+	// Zero means unlimited.
+	MaxCacheBytes int64 `yaml:"max_cache_bytes,omitempty"`
+	// MaxCacheAge evicts cache keys unused for longer than this Go duration
+	// string (e.g. "168h"). Empty means no age limit.
+	MaxCacheAge string `yaml:"max_cache_age,omitempty"`
+	// MaxCacheKeys caps how many cache key directories are kept. Zero means
+	// unlimited.
+	MaxCacheKeys int `yaml:"max_cache_keys,omitempty"`
+	// Cquery, when true, runs the rdeps step as `bazel cquery` under
+	// CqueryFlags so select() is resolved for one configuration. Unset (nil)
+	// means defer to the CLI flag, which defaults to false.
+	Cquery *bool `yaml:"cquery,omitempty"`
+	// CqueryFlags are the build flags cquery runs with, e.g.
+	// ["--config=linux"]. They are part of the cache key.
+	CqueryFlags []string `yaml:"cquery_flags,omitempty"`
+	// Universe lists the target patterns rdeps queries and the test-kind
+	// filter range over, with - excluding a pattern, e.g.
+	// ["//...", "-//third_party/..."]. Empty means the whole workspace. It is
+	// part of the cache key.
+	Universe []string `yaml:"universe,omitempty"`
+	// TestKinds are the kind() regexes that select test targets, matched
+	// against strings like "go_test rule". Empty means [".*_test rule"].
+	TestKinds []string `yaml:"test_kinds,omitempty"`
+	// IncludeTags, if set, keeps only tests carrying at least one of these
+	// tags, like the positive entries of Bazel's --test_tag_filters.
+	IncludeTags []string `yaml:"include_tags,omitempty"`
+	// ExcludeTags drops tests carrying any of these tags, like the negative
+	// entries of Bazel's --test_tag_filters (e.g. ["manual", "flaky"]).
+	ExcludeTags []string `yaml:"exclude_tags,omitempty"`
+	// TestSizes, if set, keeps only selected tests of these sizes (small,
+	// medium, large, enormous); the rest are deferred.
+	TestSizes []string `yaml:"test_sizes,omitempty"`
+	// MaxTimeout, if set, defers selected tests whose timeout is longer than
+	// this (short, moderate, long, eternal).
+	MaxTimeout string `yaml:"max_timeout,omitempty"`
+	// ResolveRemovedPackages, when true, resolves deleted files against the
+	// base revision's BUILD layout (git ls-tree) and, for packages that no
+	// longer exist in the working tree, queries their dependent tests in a
+	// temporary checkout of the base revision.
+	ResolveRemovedPackages bool `yaml:"resolve_removed_packages,omitempty"`
 	// Exclude is a list of path.Match patterns for targets to exclude from query results.
-	Exclude []string `yaml:"exclude"`
+	Exclude []string `yaml:"exclude,omitempty"`
 	// Rules maps file glob patterns to Bazel targets to include when matched.
-	Rules []Rule `yaml:"rules"`
+	Rules []Rule `yaml:"rules,omitempty"`
+	// Profiles maps a profile name to a set of top-level fields (anything but
+	// version and profiles) that replace the base values when the profile is
+	// selected, e.g. a "ci" profile turning on strict mode.
+	Profiles map[string]yaml.Node `yaml:"profiles,omitempty"`
+
+	// nested holds the config files below the repository root read by
+	// LoadNested.
+	nested *nestedConfigs
 }
 
 // Rule maps glob patterns to Bazel targets. When any staged file matches one of
 // the Patterns, all corresponding Targets are included in the output.
 type Rule struct {
 	// Patterns is a list of glob patterns to match against staged file paths.
-	Patterns []string `yaml:"patterns"`
+	Patterns []string `yaml:"patterns,omitempty"`
 	// Targets is a list of Bazel target labels to include when a pattern matches.
-	Targets []string `yaml:"targets"`
+	Targets []string `yaml:"targets,omitempty"`
+}
+
+// CacheKeyInputs are extra inputs mixed into the cache key. WORKSPACE and
+// MODULE files are left out of the key by default because they usually only
+// define external dependencies; list them here when use_repo changes,
+// overrides or .bazelrc flags change targets through select() or macros.
+type CacheKeyInputs struct {
+	// Files is a list of filepath.Glob patterns, relative to the repository
+	// root, whose matching files' contents are hashed (e.g. "MODULE.bazel",
+	// ".bazelrc", "tools/*.bazelrc").
+	Files []string `yaml:"files,omitempty"`
+	// Env is a list of environment variable names whose values are hashed.
+	Env []string `yaml:"env,omitempty"`
+	// BazelFlags is a list of literal Bazel flags (e.g. "--define=mode=opt")
+	// hashed as given. Changing the list invalidates the cache.
+	BazelFlags []string `yaml:"bazel_flags,omitempty"`
 }
 
 // LoadConfig loads the configuration from .bazel-affected-tests.yaml in the given directory.
 // Returns nil, nil if the file does not exist.
 // Returns nil, error if the file exists but cannot be parsed.
 func LoadConfig(configDir string) (*Config, error) {
+	return LoadConfigProfile(configDir, "")
+}
+
+// LoadConfigProfile loads the configuration like LoadConfig and, if profile is
+// not empty, overlays the fields set in that entry of profiles. Selecting a
+// profile that is not defined, including when there is no config file, is an
+// error so a misspelled name does not silently run with the base settings.
+func LoadConfigProfile(configDir, profile string) (*Config, error) {
 	data, err := os.ReadFile(filepath.Join(configDir, ConfigFileName))
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
+			if profile != "" {
+				return nil, fmt.Errorf("profile %q selected but %s does not exist", profile, ConfigFileName)
+			}
 			return nil, nil
 		}
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -83,17 +234,113 @@ func LoadConfig(configDir string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
-	if config.Version != 0 && config.Version != 1 {
-		return nil, fmt.Errorf("unsupported config version %d (supported: 1)", config.Version)
+	if profile != "" {
+		if err := config.applyProfile(profile); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	for name, node := range config.Profiles {
+		var overlay Config
+		if err := decodeProfile(name, node, &overlay); err != nil {
+			return nil, err
+		}
+		if err := overlay.validate(); err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+	}
+	return &config, nil
+}
+
+// validate checks the values that cannot be expressed by the YAML types alone.
+func (c *Config) validate() error {
+	if c.Version != 0 && c.Version != 1 {
+		return fmt.Errorf("unsupported config version %d (supported: 1)", c.Version)
 	}
 
-	if config.QueryTimeout != "" {
-		if _, err := time.ParseDuration(config.QueryTimeout); err != nil {
-			return nil, fmt.Errorf("invalid query_timeout %q: %w", config.QueryTimeout, err)
+	if c.QueryTimeout != "" {
+		if _, err := time.ParseDuration(c.QueryTimeout); err != nil {
+			return fmt.Errorf("invalid query_timeout %q: %w", c.QueryTimeout, err)
 		}
 	}
 
-	return &config, nil
+	if c.MaxCacheAge != "" {
+		if _, err := time.ParseDuration(c.MaxCacheAge); err != nil {
+			return fmt.Errorf("invalid max_cache_age %q: %w", c.MaxCacheAge, err)
+		}
+	}
+
+	if c.MaxCacheBytes < 0 || c.MaxCacheKeys < 0 {
+		return errors.New("invalid cache limits: max_cache_bytes and max_cache_keys must not be negative")
+	}
+
+	if c.QueryJobs < 0 {
+		return fmt.Errorf("invalid query_jobs %d: must not be negative", c.QueryJobs)
+	}
+
+	switch c.Granularity {
+	case "", GranularityPackage, GranularityRule:
+	default:
+		return fmt.Errorf("invalid granularity %q (supported: %s, %s)", c.Granularity, GranularityPackage, GranularityRule)
+	}
+
+	switch c.Precision {
+	case "", PrecisionPackage, PrecisionFile:
+	default:
+		return fmt.Errorf("invalid precision %q (supported: %s, %s)", c.Precision, PrecisionPackage, PrecisionFile)
+	}
+
+	for _, pattern := range c.CacheKeyInputs.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid cache_key_inputs file pattern %q: %w", pattern, err)
+		}
+	}
+
+	if c.RemoteCache != "" && !ValidRemoteCache(c.RemoteCache) {
+		return fmt.Errorf("invalid remote_cache %q: must be an http or https URL", c.RemoteCache)
+	}
+
+	for _, f := range c.CqueryFlags {
+		if !strings.HasPrefix(f, "-") {
+			return fmt.Errorf("invalid cquery_flags entry %q: must be a flag starting with -", f)
+		}
+	}
+
+	for _, p := range c.Universe {
+		if !query.ValidUniversePattern(p) {
+			return fmt.Errorf("invalid universe entry %q: must be a target pattern such as //src/... or -//third_party/...", p)
+		}
+	}
+
+	for _, k := range c.TestKinds {
+		if !query.ValidTestKind(k) {
+			return fmt.Errorf("invalid test_kinds entry %q: must be a regular expression without quotes", k)
+		}
+	}
+	for _, t := range append(append([]string(nil), c.IncludeTags...), c.ExcludeTags...) {
+		if !query.ValidTag(t) {
+			return fmt.Errorf("invalid tag %q in include_tags or exclude_tags", t)
+		}
+	}
+
+	for _, size := range c.TestSizes {
+		if query.SizeRank(size) < 0 {
+			return fmt.Errorf("invalid test_sizes entry %q (supported: %s)", size, strings.Join(query.TestSizes(), ", "))
+		}
+	}
+	if c.MaxTimeout != "" && query.TimeoutRank(c.MaxTimeout) < 0 {
+		return fmt.Errorf("invalid max_timeout %q (supported: %s)", c.MaxTimeout, strings.Join(query.TestTimeouts(), ", "))
+	}
+
+	switch c.CacheKey {
+	case "", CacheKeyWalk, CacheKeyGit:
+	default:
+		return fmt.Errorf("invalid cache_key %q (supported: %s, %s)", c.CacheKey, CacheKeyWalk, CacheKeyGit)
+	}
+
+	return nil
 }
 
 // ResolvedQueryTimeout returns the effective per-query timeout. If the config's
@@ -110,10 +357,73 @@ func (c *Config) ResolvedQueryTimeout(fallback time.Duration) time.Duration {
 	return d
 }
 
+// ResolvedMaxCacheAge returns the configured cache age limit, or zero if
+// none is set. The value is validated at load time.
+func (c *Config) ResolvedMaxCacheAge() time.Duration {
+	if c == nil || c.MaxCacheAge == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(c.MaxCacheAge)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// ResolvedQueryJobs returns the effective query concurrency. If the config's
+// QueryJobs is set, that value is used; otherwise fallback is returned.
+func (c *Config) ResolvedQueryJobs(fallback int) int {
+	if c == nil || c.QueryJobs == 0 {
+		return fallback
+	}
+	return c.QueryJobs
+}
+
+// ResolvedGranularity returns the effective granularity. If the config's
+// Granularity is set, that value is used; otherwise fallback is returned.
+func (c *Config) ResolvedGranularity(fallback string) string {
+	if c == nil || c.Granularity == "" {
+		return fallback
+	}
+	return c.Granularity
+}
+
+// ResolvedPrecision returns the effective precision. If the config's
+// Precision is set, that value is used; otherwise fallback is returned.
+func (c *Config) ResolvedPrecision(fallback string) string {
+	if c == nil || c.Precision == "" {
+		return fallback
+	}
+	return c.Precision
+}
+
+// ResolvedCacheKey returns the effective cache key strategy. If the config's
+// CacheKey is set, that value is used; otherwise fallback is returned.
+func (c *Config) ResolvedCacheKey(fallback string) string {
+	if c == nil || c.CacheKey == "" {
+		return fallback
+	}
+	return c.CacheKey
+}
+
+// CacheKeyExcluded reports whether the repo-relative directory dir matches a
+// cache_key_exclude pattern.
+func (c *Config) CacheKeyExcluded(dir string) bool {
+	if c == nil {
+		return false
+	}
+	for _, pattern := range c.CacheKeyExclude {
+		if MatchPattern(pattern, dir) {
+			return true
+		}
+	}
+	return false
+}
+
 // FilterIgnoredFiles returns files that do not match any ignore_paths pattern.
 // Patterns use the same glob syntax as rule patterns (e.g., ".semgrep/**", "docs/**", "*.md").
 func (c *Config) FilterIgnoredFiles(files []string) []string {
-	if len(c.IgnorePaths) == 0 {
+	if len(c.IgnorePaths) == 0 && c.nested == nil {
 		return files
 	}
 	var filtered []string
@@ -127,12 +437,26 @@ func (c *Config) FilterIgnoredFiles(files []string) []string {
 
 // shouldIgnoreFile reports whether the given file matches any ignore_paths pattern.
 func (c *Config) shouldIgnoreFile(file string) bool {
+	return c.IgnorePattern(file) != ""
+}
+
+// IgnorePattern returns the first ignore_paths pattern matching file, or ""
+// if the file is not ignored. Patterns of nested config files above file are
+// tried after the root's and returned rebased onto the repository root.
+func (c *Config) IgnorePattern(file string) string {
 	for _, pattern := range c.IgnorePaths {
 		if MatchPattern(pattern, file) {
-			return true
+			return pattern
 		}
 	}
-	return false
+	for _, n := range c.scopes(path.Dir(file)) {
+		for _, pattern := range n.ignorePaths {
+			if MatchPattern(pattern, file) {
+				return pattern
+			}
+		}
+	}
+	return ""
 }
 
 // SubpackageQueryEnabled reports whether the sub-package test query is enabled.
@@ -152,10 +476,57 @@ func (c *Config) ResolvedMaxParentDepth(fallback int) int {
 }
 
 // ShouldExclude reports whether the given target matches any exclude pattern.
-// Patterns use path.Match syntax (e.g., "//tools/format:*").
+// Patterns use path.Match syntax (e.g., "//tools/format:*"); see
+// matchExclude for recursive /... patterns.
 func (c *Config) ShouldExclude(target string) bool {
+	return c.ExcludePattern(target) != ""
+}
+
+// ExcludePattern returns the first exclude pattern matching target, or "" if
+// the target is not excluded. Patterns of nested config files apply only to
+// targets in packages under their directory.
+func (c *Config) ExcludePattern(target string) string {
 	for _, pattern := range c.Exclude {
-		if matched, _ := path.Match(pattern, target); matched {
+		if matchExclude(pattern, target) {
+			return pattern
+		}
+	}
+	if dir := labelDir(target); dir != "" {
+		for _, n := range c.scopes(dir) {
+			for _, pattern := range n.exclude {
+				if matchExclude(pattern, target) {
+					return pattern
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// matchExclude reports whether target matches the exclude pattern. Patterns
+// use path.Match syntax, except that a package part ending in /... matches
+// that package and every package below it, as in Bazel target patterns:
+// "//legacy/..." matches every target under //legacy, and
+// "//legacy/...:*_test" only its tests.
+func matchExclude(pattern, target string) bool {
+	pkgPattern, namePattern, hasName := strings.Cut(pattern, ":")
+	base, recursive := strings.CutSuffix(pkgPattern, "/...")
+	if !recursive {
+		matched, _ := path.Match(pattern, target)
+		return matched
+	}
+	if !hasName {
+		namePattern = "*"
+	}
+	pkg, name, _ := strings.Cut(target, ":")
+	if matched, _ := path.Match(namePattern, name); !matched || !strings.HasPrefix(pkg, "//") {
+		return false
+	}
+	if base == "/" {
+		return true
+	}
+	for p := pkg; len(p) > len("//"); p = p[:strings.LastIndex(p, "/")] {
+		if matched, _ := path.Match(base, p); matched {
 			return true
 		}
 	}
@@ -164,7 +535,7 @@ func (c *Config) ShouldExclude(target string) bool {
 
 // FilterExcluded returns tests with excluded targets removed.
 func (c *Config) FilterExcluded(tests []string) []string {
-	if len(c.Exclude) == 0 {
+	if len(c.Exclude) == 0 && c.nested == nil {
 		return tests
 	}
 	var filtered []string
@@ -176,28 +547,57 @@ func (c *Config) FilterExcluded(tests []string) []string {
 	return filtered
 }
 
-// MatchTargets returns all targets whose patterns match any of the given files.
-func (c *Config) MatchTargets(files []string) []string {
-	targetSet := make(map[string]bool)
+// RuleMatch is a rule with at least one pattern matching a changed file, and
+// the files that matched.
+type RuleMatch struct {
+	Rule  Rule
+	Files []string
+}
 
-	for _, rule := range c.Rules {
-		matched := false
-		for _, pattern := range rule.Patterns {
-			for _, file := range files {
+// MatchRules returns the rules whose patterns match any of the given files,
+// in config order, each with the files that matched one of its patterns. It
+// is the explained form of MatchTargets. The rules of nested config files
+// follow the root's, ordered by directory, and only see files under their
+// directory.
+func (c *Config) MatchRules(files []string) []RuleMatch {
+	matches := matchRules(c.Rules, files)
+	for _, n := range c.scopesForFiles(files) {
+		var scoped []string
+		for _, f := range files {
+			if strings.HasPrefix(f, n.dir+"/") {
+				scoped = append(scoped, f)
+			}
+		}
+		matches = append(matches, matchRules(n.rules, scoped)...)
+	}
+	return matches
+}
+
+func matchRules(rules []Rule, files []string) []RuleMatch {
+	var matches []RuleMatch
+	for _, rule := range rules {
+		var matched []string
+		for _, file := range files {
+			for _, pattern := range rule.Patterns {
 				if MatchPattern(pattern, file) {
-					matched = true
+					matched = append(matched, file)
 					break
 				}
 			}
-			if matched {
-				break
-			}
 		}
+		if len(matched) > 0 {
+			matches = append(matches, RuleMatch{Rule: rule, Files: matched})
+		}
+	}
+	return matches
+}
 
-		if matched {
-			for _, target := range rule.Targets {
-				targetSet[target] = true
-			}
+// MatchTargets returns all targets whose patterns match any of the given files.
+func (c *Config) MatchTargets(files []string) []string {
+	targetSet := make(map[string]bool)
+	for _, m := range c.MatchRules(files) {
+		for _, target := range m.Rule.Targets {
+			targetSet[target] = true
 		}
 	}
 
@@ -209,3 +609,10 @@ func (c *Config) MatchTargets(files []string) []string {
 
 	return targets
 }
+
+// ValidRemoteCache reports whether raw is usable as a remote cache base URL:
+// an http or https URL with a host.
+func ValidRemoteCache(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -199,7 +199,7 @@ func TestLoadConfig_InvalidPath(t *testing.T) {
 func TestConfig_ShouldExclude(t *testing.T) {
 	config := &Config{
 		Version: 1,
-		Exclude: []string{"//tools/format:*"},
+		Exclude: []string{"//tools/format:*", "//third_party/...", "//legacy/...:*_integration_test"},
 	}
 
 	tests := []struct {
@@ -210,6 +210,12 @@ func TestConfig_ShouldExclude(t *testing.T) {
 		{"//tools/format:format_test_Python_with_ruff", true},
 		{"//pkg/foo:foo_test", false},
 		{"//tools/lint:lint_test", false},
+		{"//third_party:vendor_test", true},
+		{"//third_party/go/x:x_test", true},
+		{"//third_partyx:x_test", false},
+		{"//legacy/db:db_integration_test", true},
+		{"//legacy:legacy_integration_test", true},
+		{"//legacy/db:db_test", false},
 	}
 
 	for _, tt := range tests {
@@ -221,6 +227,18 @@ func TestConfig_ShouldExclude(t *testing.T) {
 	}
 }
 
+func TestConfig_ShouldExclude_RootRecursive(t *testing.T) {
+	config := &Config{Version: 1, Exclude: []string{"//...:*"}}
+	for _, target := range []string{"//:root_test", "//a:a_test", "//a/b:b_test"} {
+		if !config.ShouldExclude(target) {
+			t.Errorf("ShouldExclude(%q) = false, want true", target)
+		}
+	}
+	if config.ShouldExclude("@ext//a:a_test") {
+		t.Error("ShouldExclude(@ext//a:a_test) = true, want false")
+	}
+}
+
 func TestConfig_FilterExcluded(t *testing.T) {
 	config := &Config{
 		Version: 1,
@@ -644,3 +662,446 @@ func TestConfig_ResolvedQueryTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfig_WithGranularity(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\ngranularity: rule\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.Granularity != GranularityRule {
+		t.Errorf("Granularity = %q, want %q", cfg.Granularity, GranularityRule)
+	}
+}
+
+func TestLoadConfig_InvalidGranularity(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\ngranularity: file\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(tmpDir); err == nil {
+		t.Error("LoadConfig() error = nil, want error for invalid granularity")
+	}
+}
+
+func TestConfig_ResolvedGranularity(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		want   string
+	}{
+		{"nil config returns fallback", nil, GranularityPackage},
+		{"empty field returns fallback", &Config{Version: 1}, GranularityPackage},
+		{"explicit value overrides fallback", &Config{Version: 1, Granularity: GranularityRule}, GranularityRule},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.ResolvedGranularity(GranularityPackage); got != tt.want {
+				t.Errorf("ResolvedGranularity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Precision(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+		wantErr bool
+	}{
+		{"version: 1\n", "", false},
+		{"version: 1\nprecision: file\n", PrecisionFile, false},
+		{"version: 1\nprecision: package\n", PrecisionPackage, false},
+		{"version: 1\nprecision: rule\n", "", true},
+	}
+	for _, tt := range tests {
+		tmpDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(tmpDir)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("LoadConfig(%q) error = nil, want error", tt.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("LoadConfig(%q) error = %v", tt.content, err)
+		}
+		if cfg.Precision != tt.want {
+			t.Errorf("LoadConfig(%q).Precision = %q, want %q", tt.content, cfg.Precision, tt.want)
+		}
+		wantResolved := tt.want
+		if wantResolved == "" {
+			wantResolved = PrecisionPackage
+		}
+		if got := cfg.ResolvedPrecision(PrecisionPackage); got != wantResolved {
+			t.Errorf("ResolvedPrecision() = %q, want %q", got, wantResolved)
+		}
+	}
+}
+
+func TestLoadConfig_WithBatchQueries(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\nbatch_queries: true\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.BatchQueries == nil || !*cfg.BatchQueries {
+		t.Errorf("BatchQueries = %v, want true", cfg.BatchQueries)
+	}
+}
+
+func TestLoadConfig_WithQueryJobs(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\nquery_jobs: 4\nquery_output_base: /tmp/bat-ob\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.QueryJobs != 4 {
+		t.Errorf("QueryJobs = %d, want 4", cfg.QueryJobs)
+	}
+	if cfg.QueryOutputBase != "/tmp/bat-ob" {
+		t.Errorf("QueryOutputBase = %q, want /tmp/bat-ob", cfg.QueryOutputBase)
+	}
+}
+
+func TestLoadConfig_NegativeQueryJobs(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\nquery_jobs: -2\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(tmpDir); err == nil {
+		t.Error("LoadConfig() error = nil, want error for negative query_jobs")
+	}
+}
+
+func TestConfig_ResolvedQueryJobs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		want   int
+	}{
+		{"nil config returns fallback", nil, 1},
+		{"zero returns fallback", &Config{Version: 1}, 1},
+		{"explicit value overrides fallback", &Config{Version: 1, QueryJobs: 8}, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.ResolvedQueryJobs(1); got != tt.want {
+				t.Errorf("ResolvedQueryJobs(1) = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_WithResolveRemovedPackages(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\nresolve_removed_packages: true\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if !cfg.ResolveRemovedPackages {
+		t.Error("ResolveRemovedPackages = false, want true")
+	}
+}
+
+func TestConfig_MatchRules(t *testing.T) {
+	config := &Config{
+		Version: 1,
+		Rules: []Rule{
+			{Patterns: []string{"**/BUILD"}, Targets: []string{"//..."}},
+			{Patterns: []string{"**/*.go", "go.mod"}, Targets: []string{"//tools:format_test"}},
+			{Patterns: []string{"docs/**"}, Targets: []string{"//docs:lint"}},
+		},
+	}
+
+	got := config.MatchRules([]string{"a/BUILD", "a/x.go", "go.mod", "README.md"})
+	want := []RuleMatch{
+		{Rule: config.Rules[0], Files: []string{"a/BUILD"}},
+		{Rule: config.Rules[1], Files: []string{"a/x.go", "go.mod"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchRules() = %+v, want %+v", got, want)
+	}
+}
+
+func TestConfig_ExcludeAndIgnorePattern(t *testing.T) {
+	config := &Config{
+		Version:     1,
+		Exclude:     []string{"//tools/format:*", "//slow/*:*"},
+		IgnorePaths: []string{"docs/**", "*.md"},
+	}
+
+	if got := config.ExcludePattern("//slow/db:db_test"); got != "//slow/*:*" {
+		t.Errorf("ExcludePattern() = %q, want %q", got, "//slow/*:*")
+	}
+	if got := config.ExcludePattern("//pkg:test"); got != "" {
+		t.Errorf("ExcludePattern() = %q, want empty", got)
+	}
+	if got := config.IgnorePattern("docs/guide/intro.txt"); got != "docs/**" {
+		t.Errorf("IgnorePattern() = %q, want %q", got, "docs/**")
+	}
+	if got := config.IgnorePattern("pkg/a.go"); got != "" {
+		t.Errorf("IgnorePattern() = %q, want empty", got)
+	}
+}
+
+func TestLoadConfig_InvalidCacheKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\ncache_key: mtime\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(tmpDir); err == nil {
+		t.Error("LoadConfig() error = nil, want error for invalid cache_key")
+	}
+}
+
+func TestConfig_CacheKeyExcluded(t *testing.T) {
+	cfg := &Config{CacheKeyExclude: []string{"**/node_modules", "gen/**"}}
+	tests := []struct {
+		dir  string
+		want bool
+	}{
+		{"node_modules", true},
+		{"web/app/node_modules", true},
+		{"gen/proto", true},
+		{"src/gen", false},
+		{"src", false},
+	}
+	for _, tt := range tests {
+		if got := cfg.CacheKeyExcluded(tt.dir); got != tt.want {
+			t.Errorf("CacheKeyExcluded(%q) = %v, want %v", tt.dir, got, tt.want)
+		}
+	}
+	var nilCfg *Config
+	if nilCfg.CacheKeyExcluded("node_modules") {
+		t.Error("nil config should not exclude anything")
+	}
+}
+
+func TestLoadConfig_WithCacheKeyInputs(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := `version: 1
+cache_key_inputs:
+  files: ["MODULE.bazel", ".bazelrc"]
+  env: ["CC"]
+  bazel_flags: ["--define=mode=opt"]
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	want := CacheKeyInputs{
+		Files:      []string{"MODULE.bazel", ".bazelrc"},
+		Env:        []string{"CC"},
+		BazelFlags: []string{"--define=mode=opt"},
+	}
+	if !reflect.DeepEqual(cfg.CacheKeyInputs, want) {
+		t.Errorf("CacheKeyInputs = %+v, want %+v", cfg.CacheKeyInputs, want)
+	}
+}
+
+func TestLoadConfig_InvalidCacheKeyInputPattern(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\ncache_key_inputs:\n  files: [\"[\"]\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(tmpDir); err == nil {
+		t.Error("LoadConfig() error = nil, want error for invalid cache_key_inputs pattern")
+	}
+}
+
+func TestLoadConfig_RemoteCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"https", "https://cache.example.com", false},
+		{"http with port", "http://localhost:8080", false},
+		{"missing scheme", "cache.example.com", true},
+		{"grpc", "grpc://cache.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			content := "version: 1\nremote_cache: " + tt.value + "\n"
+			if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(tmpDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.RemoteCache != tt.value {
+				t.Errorf("RemoteCache = %q, want %q", cfg.RemoteCache, tt.value)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Cquery(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\ncquery: true\ncquery_flags: [\"--config=linux\", \"--cpu=k8\"]\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.Cquery == nil || !*cfg.Cquery || len(cfg.CqueryFlags) != 2 {
+		t.Errorf("Cquery = %v, CqueryFlags = %v", cfg.Cquery, cfg.CqueryFlags)
+	}
+
+	content = "version: 1\ncquery_flags: [\"config=linux\"]\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(tmpDir); err == nil {
+		t.Error("LoadConfig() should reject a cquery flag without a leading dash")
+	}
+}
+
+func TestLoadConfig_Universe(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "version: 1\nuniverse: [\"//...\", \"-//third_party/...\"]\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if want := []string{"//...", "-//third_party/..."}; !reflect.DeepEqual(cfg.Universe, want) {
+		t.Errorf("Universe = %v, want %v", cfg.Universe, want)
+	}
+
+	content = "version: 1\nuniverse: [\"third_party/...\"]\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(tmpDir); err == nil {
+		t.Error("LoadConfig() should reject a universe entry that is not a target pattern")
+	}
+}
+
+func TestLoadConfig_TestFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", "version: 1\ntest_kinds: [\".*_test rule\", \"sh_binary rule\"]\ninclude_tags: [unit]\nexclude_tags: [manual, flaky]\n", false},
+		{"quoted kind", "version: 1\ntest_kinds: [\"x' + //...\"]\n", true},
+		{"invalid regex", "version: 1\ntest_kinds: [\"(\"]\n", true},
+		{"invalid tag", "version: 1\nexclude_tags: [\"a b\"]\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(tmpDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(cfg.TestKinds) != 2 || len(cfg.IncludeTags) != 1 || len(cfg.ExcludeTags) != 2) {
+				t.Errorf("TestKinds = %v, IncludeTags = %v, ExcludeTags = %v", cfg.TestKinds, cfg.IncludeTags, cfg.ExcludeTags)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_TestSizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", "version: 1\ntest_sizes: [small, medium]\nmax_timeout: short\n", false},
+		{"invalid size", "version: 1\ntest_sizes: [tiny]\n", true},
+		{"invalid timeout", "version: 1\nmax_timeout: 60s\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(tmpDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(cfg.TestSizes) != 2 || cfg.MaxTimeout != "short") {
+				t.Errorf("TestSizes = %v, MaxTimeout = %q", cfg.TestSizes, cfg.MaxTimeout)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_CacheLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+		wantAge time.Duration
+	}{
+		{"valid", "version: 1\nmax_cache_bytes: 1048576\nmax_cache_age: 168h\nmax_cache_keys: 20\n", false, 168 * time.Hour},
+		{"invalid age", "version: 1\nmax_cache_age: 7d\n", true, 0},
+		{"negative keys", "version: 1\nmax_cache_keys: -1\n", true, 0},
+		{"negative bytes", "version: 1\nmax_cache_bytes: -1\n", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmpDir, ConfigFileName), []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(tmpDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.ResolvedMaxCacheAge() != tt.wantAge {
+				t.Errorf("ResolvedMaxCacheAge() = %v, want %v", cfg.ResolvedMaxCacheAge(), tt.wantAge)
+			}
+		})
+	}
+}
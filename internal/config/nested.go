@@ -0,0 +1,308 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// nestedKeys are the fields a config file below the repository root may set.
+// Everything else configures the run as a whole and belongs in the root file.
+var nestedKeys = []string{"version", "ignore_paths", "exclude", "rules"}
+
+// nestedConfig is a config file in a subdirectory of the repository. It
+// applies to changed files under dir and to targets in packages under dir.
+// Its patterns are stored rebased onto the repository root, so they match the
+// repo-relative paths the root config's patterns see.
+type nestedConfig struct {
+	// dir is the slash-separated directory holding the file, relative to
+	// the repository root.
+	dir         string
+	ignorePaths []string
+	exclude     []string
+	rules       []Rule
+}
+
+// nestedConfigs loads config files below the repository root on demand and
+// remembers them by directory, including directories without one.
+type nestedConfigs struct {
+	root  string
+	mu    sync.Mutex
+	byDir map[string]*nestedConfig
+	errs  map[string]error
+}
+
+// LoadNested reads the config files in the given repo-relative directories
+// and their ancestors below repoRoot. Their ignore_paths and rules then apply
+// to files under their directory and their exclude patterns to targets in
+// packages under it, on top of the root config. Files and targets in
+// directories that were never loaded see only the ancestors that were, so
+// callers load the directories of every file and target they filter.
+func (c *Config) LoadNested(repoRoot string, dirs []string) error {
+	if c.nested == nil {
+		c.nested = &nestedConfigs{root: repoRoot, byDir: make(map[string]*nestedConfig), errs: make(map[string]error)}
+	}
+	var errs []error
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		for _, d := range ancestorDirs(dir) {
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			if _, err := c.nested.load(d); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NestedFiles returns the repo-relative paths of the loaded config files that
+// apply to the repo-relative directory dir, outermost first.
+func (c *Config) NestedFiles(dir string) []string {
+	var files []string
+	for _, n := range c.scopes(dir) {
+		files = append(files, path.Join(n.dir, ConfigFileName))
+	}
+	return files
+}
+
+// ForFile returns the effective config for the repo-relative file: the root
+// config with the ignore_paths, exclude and rules of every nested config file
+// above file appended, their patterns rebased onto the repository root. The
+// nested files are loaded from repoRoot as needed.
+func (c *Config) ForFile(repoRoot, file string) (*Config, error) {
+	dir := path.Dir(file)
+	if err := c.LoadNested(repoRoot, []string{dir}); err != nil {
+		return nil, err
+	}
+	merged := *c
+	merged.Profiles = nil
+	merged.nested = nil
+	merged.IgnorePaths = slices.Clone(c.IgnorePaths)
+	merged.Exclude = slices.Clone(c.Exclude)
+	merged.Rules = slices.Clone(c.Rules)
+	for _, n := range c.scopes(dir) {
+		merged.IgnorePaths = append(merged.IgnorePaths, n.ignorePaths...)
+		merged.Exclude = append(merged.Exclude, n.exclude...)
+		merged.Rules = append(merged.Rules, n.rules...)
+	}
+	return &merged, nil
+}
+
+// scopes returns the nested configs that apply to the repo-relative directory
+// dir, outermost first. Without LoadNested there are none.
+func (c *Config) scopes(dir string) []*nestedConfig {
+	if c == nil || c.nested == nil {
+		return nil
+	}
+	var scopes []*nestedConfig
+	for _, d := range ancestorDirs(dir) {
+		// Load errors were reported by LoadNested; the file is skipped here.
+		if n, _ := c.nested.load(d); n != nil {
+			scopes = append(scopes, n)
+		}
+	}
+	return scopes
+}
+
+// scopesForFiles returns the nested configs that apply to any of files,
+// ordered by directory.
+func (c *Config) scopesForFiles(files []string) []*nestedConfig {
+	byDir := make(map[string]*nestedConfig)
+	for _, f := range files {
+		for _, n := range c.scopes(path.Dir(f)) {
+			byDir[n.dir] = n
+		}
+	}
+	dirs := make([]string, 0, len(byDir))
+	for d := range byDir {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	scopes := make([]*nestedConfig, len(dirs))
+	for i, d := range dirs {
+		scopes[i] = byDir[d]
+	}
+	return scopes
+}
+
+// load returns the config file in the repo-relative directory dir, or nil if
+// there is none.
+func (n *nestedConfigs) load(dir string) (*nestedConfig, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if cfg, ok := n.byDir[dir]; ok {
+		return cfg, n.errs[dir]
+	}
+	cfg, err := readNestedConfig(n.root, dir)
+	if err != nil {
+		n.errs[dir] = err
+		cfg = nil
+	}
+	n.byDir[dir] = cfg
+	return cfg, err
+}
+
+// readNestedConfig parses the config file in the repo-relative directory dir
+// below root.
+func readNestedConfig(root, dir string) (*nestedConfig, error) {
+	file := path.Join(dir, ConfigFileName)
+	data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(file)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read config file %s: %w", file, err)
+	}
+
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+	}
+	if len(node.Content) == 0 {
+		return nil, nil
+	}
+	doc := node.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("failed to parse config file %s: must be a mapping of config fields", file)
+	}
+	for i := 0; i < len(doc.Content); i += 2 {
+		if key := doc.Content[i].Value; !slices.Contains(nestedKeys, key) {
+			return nil, fmt.Errorf("invalid config file %s: %s can only be set in the root config (nested files support %s)",
+				file, key, strings.Join(nestedKeys[1:], ", "))
+		}
+	}
+	var raw Config
+	if err := doc.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+	}
+	if raw.Version != 0 && raw.Version != 1 {
+		return nil, fmt.Errorf("unsupported config version %d in %s (supported: 1)", raw.Version, file)
+	}
+
+	cfg := &nestedConfig{dir: dir}
+	for _, p := range raw.IgnorePaths {
+		cfg.ignorePaths = append(cfg.ignorePaths, rebasePattern(dir, p))
+	}
+	for _, p := range raw.Exclude {
+		pattern := resolveRelativeLabel(dir, p)
+		if err := validateNestedExclude(dir, pattern); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", file, err)
+		}
+		cfg.exclude = append(cfg.exclude, pattern)
+	}
+	for _, r := range raw.Rules {
+		var rule Rule
+		for _, p := range r.Patterns {
+			rule.Patterns = append(rule.Patterns, rebasePattern(dir, p))
+		}
+		for _, t := range r.Targets {
+			rule.Targets = append(rule.Targets, resolveRelativeLabel(dir, t))
+		}
+		cfg.rules = append(cfg.rules, rule)
+	}
+	return cfg, nil
+}
+
+// rebasePattern turns a glob pattern relative to dir into one relative to the
+// repository root.
+func rebasePattern(dir, pattern string) string {
+	return dir + "/" + strings.TrimPrefix(filepath.ToSlash(pattern), "/")
+}
+
+// resolveRelativeLabel turns a label or exclude pattern starting with : into
+// one in dir's package; other labels are returned unchanged.
+func resolveRelativeLabel(dir, label string) string {
+	if strings.HasPrefix(label, ":") {
+		return "//" + dir + label
+	}
+	return label
+}
+
+// validateNestedExclude checks that pattern, an exclude entry of the config
+// file in dir resolved by resolveRelativeLabel, can match a target the file
+// applies to: it must be a label pattern for dir's package or one below it.
+// Anything else, such as a bare name pattern or a label elsewhere, would
+// silently never match.
+func validateNestedExclude(dir, pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+	}
+	rest, ok := strings.CutPrefix(pattern, "//")
+	if !ok {
+		return fmt.Errorf("invalid exclude pattern %q: must be :name or a label pattern under //%s", pattern, dir)
+	}
+	pkg, _, _ := strings.Cut(rest, ":")
+	pkg = strings.TrimSuffix(pkg, "/...")
+	if pkg != dir && !strings.HasPrefix(pkg, dir+"/") {
+		return fmt.Errorf("invalid exclude pattern %q: nested exclude patterns only apply to targets under //%s", pattern, dir)
+	}
+	return nil
+}
+
+// ancestorDirs returns the repo-relative directory dir and its ancestors,
+// outermost first, excluding the repository root itself.
+func ancestorDirs(dir string) []string {
+	dir = strings.Trim(path.Clean(filepath.ToSlash(dir)), "/")
+	if dir == "." || dir == "" || dir == ".." || strings.HasPrefix(dir, "../") {
+		return nil
+	}
+	parts := strings.Split(dir, "/")
+	dirs := make([]string, len(parts))
+	for i := range parts {
+		dirs[i] = strings.Join(parts[:i+1], "/")
+	}
+	return dirs
+}
+
+// labelDir returns the repo-relative directory of a main-repository target's
+// package, or "" for external and malformed labels.
+func labelDir(label string) string {
+	pkg, ok := strings.CutPrefix(label, "//")
+	if !ok {
+		return ""
+	}
+	if i := strings.Index(pkg, ":"); i >= 0 {
+		pkg = pkg[:i]
+	}
+	return pkg
+}
+
+// LabelDirs returns the distinct repo-relative package directories of
+// labels, for LoadNested.
+func LabelDirs(labels []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, l := range labels {
+		if d := labelDir(l); d != "" && !seen[d] {
+			seen[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// FileDirs returns the distinct directories of repo-relative files, for
+// LoadNested.
+func FileDirs(files []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, f := range files {
+		if d := path.Dir(filepath.ToSlash(f)); !seen[d] {
+			seen[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
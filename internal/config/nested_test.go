@@ -0,0 +1,268 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeNestedTree writes config files keyed by repo-relative directory ("" is
+// the root) and returns the repository root.
+func writeNestedTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for dir, content := range files {
+		full := filepath.Join(root, filepath.FromSlash(dir))
+		if err := os.MkdirAll(full, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(full, ConfigFileName), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+var nestedTree = map[string]string{
+	"": `version: 1
+ignore_paths: ["docs/**"]
+exclude: ["//tools/format:*"]
+rules:
+  - patterns: ["**/*.go"]
+    targets: ["//tools/format:gofmt_test"]
+`,
+	"services/payment": `version: 1
+ignore_paths: ["*.md", "fixtures/**"]
+exclude: [":slow_test", "//services/payment/legacy/...:*"]
+rules:
+  - patterns: ["api/*.proto"]
+    targets: [":api_compat_test", "//tools/proto:lint_test"]
+`,
+	"services/payment/ledger": `rules:
+  - patterns: ["**/*.sql"]
+    targets: [":migration_test"]
+`,
+}
+
+func loadNestedTree(t *testing.T, dirs ...string) *Config {
+	t.Helper()
+	root := writeNestedTree(t, nestedTree)
+	cfg, err := LoadConfig(root)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if err := cfg.LoadNested(root, dirs); err != nil {
+		t.Fatalf("LoadNested() error = %v", err)
+	}
+	return cfg
+}
+
+func TestConfig_NestedIgnorePaths(t *testing.T) {
+	cfg := loadNestedTree(t, "docs", "services/payment", "services/payment/fixtures/a", "services/payment/api", "services/other")
+
+	files := []string{
+		"docs/guide.md",
+		"services/payment/README.md",
+		"services/payment/api/README.md",
+		"services/payment/fixtures/a/data.json",
+		"services/payment/api/pay.proto",
+		"services/other/README.md",
+	}
+	got := cfg.FilterIgnoredFiles(files)
+	want := []string{"services/payment/api/README.md", "services/payment/api/pay.proto", "services/other/README.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterIgnoredFiles() = %v, want %v", got, want)
+	}
+	if p := cfg.IgnorePattern("services/payment/README.md"); p != "services/payment/*.md" {
+		t.Errorf("IgnorePattern() = %q, want the rebased nested pattern", p)
+	}
+}
+
+func TestConfig_NestedExclude(t *testing.T) {
+	cfg := loadNestedTree(t, "services/payment", "services/payment/legacy/db", "services/other")
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"//tools/format:check", "//tools/format:*"},
+		{"//services/payment:slow_test", "//services/payment:slow_test"},
+		{"//services/payment:fast_test", ""},
+		{"//services/payment/legacy:legacy_test", "//services/payment/legacy/...:*"},
+		{"//services/payment/legacy/db:db_test", "//services/payment/legacy/...:*"},
+		{"//services/payment/legacyx:legacy_test", ""},
+		// Nested patterns only apply to targets under their directory.
+		{"//services/other:slow_test", ""},
+		{"@ext//services/payment:slow_test", ""},
+	}
+	for _, tt := range tests {
+		if got := cfg.ExcludePattern(tt.target); got != tt.want {
+			t.Errorf("ExcludePattern(%s) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+	got := cfg.FilterExcluded([]string{"//services/payment:slow_test", "//services/payment:fast_test", "//services/other:slow_test"})
+	if want := []string{"//services/payment:fast_test", "//services/other:slow_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterExcluded() = %v, want %v", got, want)
+	}
+}
+
+func TestConfig_NestedExcludeValidated(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude string
+		wantErr string
+	}{
+		{"bare name pattern", `"*_integration_test"`, "must be :name or a label pattern"},
+		{"label outside directory", `"//other/...:*"`, "only apply to targets under //services/payment"},
+		{"sibling with shared prefix", `"//services/paymentx:*"`, "only apply to targets under //services/payment"},
+		{"malformed glob", `"[:x"`, "invalid exclude pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := writeNestedTree(t, map[string]string{
+				"":                 "version: 1\n",
+				"services/payment": "exclude: [" + tt.exclude + "]\n",
+			})
+			cfg, err := LoadConfig(root)
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			err = cfg.LoadNested(root, []string{"services/payment"})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadNested() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_NestedRules(t *testing.T) {
+	cfg := loadNestedTree(t, "services/payment/api", "services/payment/ledger/sql", "api")
+
+	files := []string{"services/payment/api/pay.proto", "services/payment/ledger/sql/001.sql", "api/pay.proto", "main.go"}
+	matches := cfg.MatchRules(files)
+	if len(matches) != 3 {
+		t.Fatalf("MatchRules() = %+v, want root, payment and ledger rules", matches)
+	}
+	if want := []string{"services/payment/api/*.proto"}; !reflect.DeepEqual(matches[1].Rule.Patterns, want) {
+		t.Errorf("payment rule patterns = %v, want %v", matches[1].Rule.Patterns, want)
+	}
+	if want := []string{"services/payment/api/pay.proto"}; !reflect.DeepEqual(matches[1].Files, want) {
+		t.Errorf("payment rule files = %v, want %v (api/pay.proto is outside its directory)", matches[1].Files, want)
+	}
+
+	got := cfg.MatchTargets(files)
+	sort.Strings(got)
+	want := []string{
+		"//services/payment/ledger:migration_test",
+		"//services/payment:api_compat_test",
+		"//tools/format:gofmt_test",
+		"//tools/proto:lint_test",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchTargets() = %v, want %v", got, want)
+	}
+}
+
+func TestConfig_NestedNotLoaded(t *testing.T) {
+	cfg, err := LoadConfig(writeNestedTree(t, nestedTree))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.IgnorePattern("services/payment/README.md"); got != "" {
+		t.Errorf("IgnorePattern() = %q, want none before LoadNested", got)
+	}
+	var literal Config
+	if got := literal.FilterIgnoredFiles([]string{"a.md"}); len(got) != 1 {
+		t.Errorf("FilterIgnoredFiles() = %v on a config without nested files", got)
+	}
+}
+
+func TestConfig_ForFile(t *testing.T) {
+	root := writeNestedTree(t, nestedTree)
+	cfg, err := LoadConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cfg.ForFile(root, "services/payment/ledger/sql/001.sql")
+	if err != nil {
+		t.Fatalf("ForFile() error = %v", err)
+	}
+	if want := []string{"docs/**", "services/payment/*.md", "services/payment/fixtures/**"}; !reflect.DeepEqual(got.IgnorePaths, want) {
+		t.Errorf("IgnorePaths = %v, want %v", got.IgnorePaths, want)
+	}
+	if want := []string{"//tools/format:*", "//services/payment:slow_test", "//services/payment/legacy/...:*"}; !reflect.DeepEqual(got.Exclude, want) {
+		t.Errorf("Exclude = %v, want %v", got.Exclude, want)
+	}
+	if len(got.Rules) != 3 || got.Rules[2].Targets[0] != "//services/payment/ledger:migration_test" {
+		t.Errorf("Rules = %+v, want root, payment and ledger rules", got.Rules)
+	}
+	if len(cfg.Rules) != 1 {
+		t.Errorf("ForFile() modified the root config: %+v", cfg.Rules)
+	}
+	want := []string{"services/payment/" + ConfigFileName, "services/payment/ledger/" + ConfigFileName}
+	if files := cfg.NestedFiles("services/payment/ledger/sql"); !reflect.DeepEqual(files, want) {
+		t.Errorf("NestedFiles() = %v, want %v", files, want)
+	}
+}
+
+func TestConfig_LoadNestedErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"root-only field", "strict: true\n", "strict can only be set in the root config"},
+		{"unsupported version", "version: 2\n", "unsupported config version 2"},
+		{"malformed", "rules: [\n", "failed to parse config file services/payment/" + ConfigFileName},
+		{"not a mapping", "- rules\n", "must be a mapping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := writeNestedTree(t, map[string]string{"": "version: 1\n", "services/payment": tt.content})
+			cfg, err := LoadConfig(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cfg.LoadNested(root, []string{"services/payment/api"})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadNested() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			// A broken file is skipped by later lookups.
+			if got := cfg.FilterIgnoredFiles([]string{"services/payment/a.md"}); len(got) != 1 {
+				t.Errorf("FilterIgnoredFiles() = %v", got)
+			}
+		})
+	}
+}
+
+func TestAncestorDirs(t *testing.T) {
+	tests := []struct {
+		dir  string
+		want []string
+	}{
+		{".", nil},
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a/b/c", []string{"a", "a/b", "a/b/c"}},
+		{"a/b/", []string{"a", "a/b"}},
+		{"../a", nil},
+	}
+	for _, tt := range tests {
+		if got := ancestorDirs(tt.dir); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ancestorDirs(%q) = %v, want %v", tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestLabelAndFileDirs(t *testing.T) {
+	if got, want := LabelDirs([]string{"//a/b:c", "//a/b:d", "//:root", "@ext//x:y"}), []string{"a/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LabelDirs() = %v, want %v", got, want)
+	}
+	if got, want := FileDirs([]string{"a/b/c.go", "a/b/d.go", "top.go"}), []string{"a/b", "."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FileDirs() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProfileNames returns the names of the profiles defined in the config,
+// sorted.
+func (c *Config) ProfileNames() []string {
+	if c == nil {
+		return nil
+	}
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile overlays the named profile onto c. Only the fields the profile
+// sets change; a list in a profile replaces the base list rather than
+// extending it.
+func (c *Config) applyProfile(name string) error {
+	node, ok := c.Profiles[name]
+	if !ok {
+		if len(c.Profiles) == 0 {
+			return fmt.Errorf("unknown profile %q: the config file defines no profiles", name)
+		}
+		return fmt.Errorf("unknown profile %q (defined: %s)", name, strings.Join(c.ProfileNames(), ", "))
+	}
+	return decodeProfile(name, node, c)
+}
+
+// decodeProfile decodes a profile's fields into out, leaving fields the
+// profile does not set untouched.
+func decodeProfile(name string, node yaml.Node, out *Config) error {
+	if node.Kind == 0 || node.Tag == "!!null" {
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("profile %q must be a mapping of config fields", name)
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		switch key := node.Content[i].Value; key {
+		case "version", "profiles":
+			return fmt.Errorf("profile %q: %s cannot be set in a profile", name, key)
+		}
+	}
+	if err := node.Decode(out); err != nil {
+		return fmt.Errorf("failed to parse profile %q: %w", name, err)
+	}
+	return nil
+}
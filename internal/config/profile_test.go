@@ -0,0 +1,113 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const profileConfig = `version: 1
+strict: false
+query_timeout: 30s
+universe: ["//..."]
+exclude_tags: [manual]
+profiles:
+  ci:
+    strict: true
+    universe: ["//...", "-//third_party/..."]
+  precommit:
+    best_effort: true
+    test_sizes: [small]
+    query_timeout: 10s
+`
+
+func writeProfileConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ConfigFileName), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	dir := writeProfileConfig(t, profileConfig)
+
+	base, err := LoadConfigProfile(dir, "")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile(base) error = %v", err)
+	}
+	if base.Strict || base.BestEffort != nil || base.QueryTimeout != "30s" {
+		t.Errorf("base config = %+v, want top-level values only", base)
+	}
+	if got, want := base.ProfileNames(), []string{"ci", "precommit"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ProfileNames() = %v, want %v", got, want)
+	}
+
+	ci, err := LoadConfigProfile(dir, "ci")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile(ci) error = %v", err)
+	}
+	if !ci.Strict || ci.QueryTimeout != "30s" {
+		t.Errorf("ci Strict = %v, QueryTimeout = %q, want true and the inherited 30s", ci.Strict, ci.QueryTimeout)
+	}
+	if want := []string{"//...", "-//third_party/..."}; !reflect.DeepEqual(ci.Universe, want) {
+		t.Errorf("ci Universe = %v, want %v (replaced, not appended)", ci.Universe, want)
+	}
+
+	pre, err := LoadConfigProfile(dir, "precommit")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile(precommit) error = %v", err)
+	}
+	if pre.BestEffort == nil || !*pre.BestEffort || pre.QueryTimeout != "10s" || len(pre.TestSizes) != 1 {
+		t.Errorf("precommit config = %+v, want best_effort, 10s and small tests", pre)
+	}
+	if want := []string{"manual"}; !reflect.DeepEqual(pre.ExcludeTags, want) {
+		t.Errorf("precommit ExcludeTags = %v, want inherited %v", pre.ExcludeTags, want)
+	}
+}
+
+func TestLoadConfigProfile_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		profile string
+		wantErr string
+	}{
+		{"unknown profile", profileConfig, "nightly", `unknown profile "nightly" (defined: ci, precommit)`},
+		{"no profiles defined", "version: 1\n", "ci", "defines no profiles"},
+		{"invalid value in unselected profile", "version: 1\nprofiles:\n  ci:\n    granularity: file\n", "", `profile "ci": invalid granularity`},
+		{"version in profile", "version: 1\nprofiles:\n  ci:\n    version: 2\n", "", "version cannot be set in a profile"},
+		{"nested profiles", "version: 1\nprofiles:\n  ci:\n    profiles: {}\n", "ci", "profiles cannot be set in a profile"},
+		{"profile not a mapping", "version: 1\nprofiles:\n  ci: [strict]\n", "", "must be a mapping"},
+		{"wrong type in profile", "version: 1\nprofiles:\n  ci:\n    strict: [true]\n", "ci", `failed to parse profile "ci"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeProfileConfig(t, tt.content)
+			_, err := LoadConfigProfile(dir, tt.profile)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfigProfile() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigProfile_MissingFile(t *testing.T) {
+	if _, err := LoadConfigProfile(t.TempDir(), "ci"); err == nil {
+		t.Error("LoadConfigProfile() error = nil, want error for a profile without a config file")
+	}
+}
+
+func TestLoadConfigProfile_EmptyProfile(t *testing.T) {
+	dir := writeProfileConfig(t, "version: 1\nstrict: true\nprofiles:\n  local:\n")
+	cfg, err := LoadConfigProfile(dir, "local")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile() error = %v", err)
+	}
+	if !cfg.Strict {
+		t.Error("an empty profile should keep the top-level values")
+	}
+}
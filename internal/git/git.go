@@ -4,6 +4,7 @@ package git
 import (
 	"context"
 	"fmt"
+	"path"
 	"strings"
 
 	executor "github.com/jaeyeom/go-cmdexec"
@@ -19,36 +20,198 @@ func RepoRoot(ctx context.Context, exec executor.Executor) (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
-// GetStagedFiles returns the list of staged files (Added, Copied, Modified - not Deleted).
-func GetStagedFiles(ctx context.Context, exec executor.Executor) ([]string, error) {
-	return getDiffFiles(ctx, exec, "git", "diff", "--cached", "--name-only", "--diff-filter=ACM")
+// ChangeStatus is the single-letter status git reports for a changed path in
+// `git diff --name-status`.
+type ChangeStatus byte
+
+// Change statuses understood by the diff parser. Renames and copies carry a
+// similarity score in git's output (e.g. "R087"); only the letter is kept.
+const (
+	StatusAdded    ChangeStatus = 'A'
+	StatusCopied   ChangeStatus = 'C'
+	StatusModified ChangeStatus = 'M'
+	StatusDeleted  ChangeStatus = 'D'
+	StatusRenamed  ChangeStatus = 'R'
+)
+
+// FileChange is one entry of `git diff --name-status -M`. Path is the path
+// after the change (for deletions, the path that was removed). OldPath is the
+// source path of a rename or copy and empty otherwise.
+type FileChange struct {
+	Status  ChangeStatus
+	Path    string
+	OldPath string
 }
 
-// GetHeadFiles returns files that differ from HEAD (staged + unstaged changes).
-func GetHeadFiles(ctx context.Context, exec executor.Executor) ([]string, error) {
-	return getDiffFiles(ctx, exec, "git", "diff", "HEAD", "--name-only", "--diff-filter=ACM")
+// GetStagedChanges returns the staged changes, including deletions and
+// renames (git diff --cached --name-status -M).
+func GetStagedChanges(ctx context.Context, exec executor.Executor) ([]FileChange, error) {
+	return getDiffChanges(ctx, exec, "diff", "--cached", "--name-status", "-M", "--diff-filter=ACDMR")
 }
 
-// GetDiffFiles returns files that differ from the given ref.
-func GetDiffFiles(ctx context.Context, exec executor.Executor, ref string) ([]string, error) {
-	return getDiffFiles(ctx, exec, "git", "diff", ref, "--name-only", "--diff-filter=ACM")
+// GetHeadChanges returns changes relative to HEAD (staged + unstaged),
+// including deletions and renames.
+func GetHeadChanges(ctx context.Context, exec executor.Executor) ([]FileChange, error) {
+	return getDiffChanges(ctx, exec, "diff", "HEAD", "--name-status", "-M", "--diff-filter=ACDMR")
+}
+
+// GetDiffChanges returns changes relative to the given ref, including
+// deletions and renames.
+func GetDiffChanges(ctx context.Context, exec executor.Executor, ref string) ([]FileChange, error) {
+	return getDiffChanges(ctx, exec, "diff", ref, "--name-status", "-M", "--diff-filter=ACDMR")
+}
+
+// AffectedPaths flattens changes into the repo-relative paths whose packages
+// are affected: the new path of every change, plus the old path of a rename
+// since the package it left is affected too. A copy's source is unchanged and
+// is not included. Paths are deduplicated, preserving first-seen order.
+func AffectedPaths(changes []FileChange) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(p string) {
+		if p != "" && !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, c := range changes {
+		if c.Status == StatusRenamed {
+			add(c.OldPath)
+		}
+		add(c.Path)
+	}
+	return paths
 }
 
-func getDiffFiles(ctx context.Context, exec executor.Executor, name string, args ...string) ([]string, error) {
-	output, err := executor.Output(ctx, exec, name, args...)
+func getDiffChanges(ctx context.Context, exec executor.Executor, args ...string) ([]FileChange, error) {
+	output, err := executor.Output(ctx, exec, "git", args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get diff files: %w", err)
+		return nil, fmt.Errorf("failed to get diff changes: %w", err)
 	}
+	return parseNameStatus(string(output))
+}
 
-	if len(output) == 0 {
-		return []string{}, nil
+// parseNameStatus parses `git diff --name-status` output. Each line is a
+// status letter (renames and copies followed by a similarity score), then one
+// tab-separated path, or two for renames and copies.
+func parseNameStatus(output string) ([]FileChange, error) {
+	changes := []FileChange{}
+	for line := range strings.SplitSeq(output, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("unexpected name-status line %q", line)
+		}
+		status := ChangeStatus(fields[0][0])
+		switch status {
+		case StatusRenamed, StatusCopied:
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("unexpected name-status line %q", line)
+			}
+			changes = append(changes, FileChange{Status: status, OldPath: fields[1], Path: fields[2]})
+		case StatusAdded, StatusModified, StatusDeleted:
+			changes = append(changes, FileChange{Status: status, Path: fields[1]})
+		default:
+			return nil, fmt.Errorf("unsupported change status %q in line %q", fields[0], line)
+		}
 	}
+	return changes, nil
+}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+// BuildDirsAt returns the repo-relative directories that contain a BUILD or
+// BUILD.bazel file at ref in the repository at repoRoot, using "." for the
+// repository root. It reads the whole tree with `git ls-tree --full-tree`, so
+// it reflects the layout at ref even for packages that no longer exist in the
+// working tree, whatever the current directory.
+func BuildDirsAt(ctx context.Context, exec executor.Executor, repoRoot, ref string) (map[string]bool, error) {
+	output, err := executor.Output(ctx, exec, "git", "-C", repoRoot, "ls-tree", "--full-tree", "-r", "--name-only", ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree at %s: %w", ref, err)
+	}
+	dirs := make(map[string]bool)
+	for line := range strings.SplitSeq(string(output), "\n") {
+		switch path.Base(line) {
+		case "BUILD", "BUILD.bazel":
+			dirs[path.Dir(line)] = true
+		}
+	}
+	return dirs, nil
+}
+
+// AddWorktree checks out ref into dir as a detached worktree
+// (git worktree add --detach). dir must not exist or be empty.
+func AddWorktree(ctx context.Context, exec executor.Executor, dir, ref string) error {
+	if _, err := executor.Output(ctx, exec, "git", "worktree", "add", "--detach", dir, ref); err != nil {
+		return fmt.Errorf("failed to add worktree for %s: %w", ref, err)
+	}
+	return nil
+}
+
+// RemoveWorktree removes a worktree created by AddWorktree, discarding any
+// files written into it.
+func RemoveWorktree(ctx context.Context, exec executor.Executor, dir string) error {
+	if _, err := executor.Output(ctx, exec, "git", "worktree", "remove", "--force", dir); err != nil {
+		return fmt.Errorf("failed to remove worktree %s: %w", dir, err)
+	}
+	return nil
+}
+
+// buildFilePathspecs select the files that define the build graph. git
+// wildcards match across directories, so "*BUILD" also matches names such as
+// "foo/MYBUILD"; callers filter with IsBuildFile.
+var buildFilePathspecs = []string{"*BUILD", "*BUILD.bazel", "*.bzl"}
+
+// IsBuildFile reports whether the slash-separated path names a BUILD,
+// BUILD.bazel or .bzl file.
+func IsBuildFile(p string) bool {
+	name := path.Base(p)
+	return name == "BUILD" || name == "BUILD.bazel" || strings.HasSuffix(name, ".bzl")
+}
+
+// BuildFileBlobs returns the index blob id of every tracked BUILD, BUILD.bazel
+// and .bzl file in the repository at repoRoot, keyed by repo-relative path
+// (git ls-files -s). Reading the index is much cheaper than hashing the files,
+// but it misses edits that are not staged; see DirtyBuildFiles.
+func BuildFileBlobs(ctx context.Context, exec executor.Executor, repoRoot string) (map[string]string, error) {
+	args := append([]string{"-C", repoRoot, "ls-files", "-s", "-z", "--"}, buildFilePathspecs...)
+	output, err := executor.Output(ctx, exec, "git", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build files: %w", err)
+	}
+	blobs := make(map[string]string)
+	for entry := range strings.SplitSeq(string(output), "\x00") {
+		if entry == "" {
+			continue
+		}
+		// Each entry is "<mode> <object> <stage>\t<path>".
+		meta, p, ok := strings.Cut(entry, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected ls-files entry %q", entry)
+		}
+		if IsBuildFile(p) {
+			blobs[p] = fields[1]
+		}
+	}
+	return blobs, nil
+}
+
+// DirtyBuildFiles returns the repo-relative BUILD, BUILD.bazel and .bzl files
+// whose working-tree content is not what the index records: unstaged edits,
+// deletions, unmerged paths and untracked files that are not ignored
+// (git ls-files -m -o --exclude-standard).
+func DirtyBuildFiles(ctx context.Context, exec executor.Executor, repoRoot string) ([]string, error) {
+	args := append([]string{"-C", repoRoot, "ls-files", "-m", "-o", "--exclude-standard", "-z", "--"}, buildFilePathspecs...)
+	output, err := executor.Output(ctx, exec, "git", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dirty build files: %w", err)
+	}
 	var files []string
-	for _, line := range lines {
-		if line != "" {
-			files = append(files, line)
+	for p := range strings.SplitSeq(string(output), "\x00") {
+		if p != "" && IsBuildFile(p) {
+			files = append(files, p)
 		}
 	}
 	return files, nil
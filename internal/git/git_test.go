@@ -3,6 +3,10 @@ package git
 import (
 	"context"
 	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	executor "github.com/jaeyeom/go-cmdexec"
@@ -65,136 +69,102 @@ func TestRepoRoot(t *testing.T) {
 	}
 }
 
-func TestGetStagedFiles(t *testing.T) {
+func containsStr(s, substr string) bool {
+	if len(substr) == 0 {
+		return true
+	}
+	for i := 0; i <= len(s)-len(substr); i++ {
+		if s[i:i+len(substr)] == substr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGetChanges(t *testing.T) {
+	nameStatus := "M\tpkg/a/a.go\nD\tpkg/b/gone.go\nR087\tpkg/old/x.go\tpkg/new/x.go\nC100\tpkg/a/a.go\tpkg/c/a.go\nA\tpkg/d/new.go\n"
+	want := []FileChange{
+		{Status: StatusModified, Path: "pkg/a/a.go"},
+		{Status: StatusDeleted, Path: "pkg/b/gone.go"},
+		{Status: StatusRenamed, OldPath: "pkg/old/x.go", Path: "pkg/new/x.go"},
+		{Status: StatusCopied, OldPath: "pkg/a/a.go", Path: "pkg/c/a.go"},
+		{Status: StatusAdded, Path: "pkg/d/new.go"},
+	}
+
 	tests := []struct {
-		name        string
-		setupMock   func(m *executor.MockExecutor)
-		want        []string
-		wantErr     bool
-		errContains string
+		name string
+		args []string
+		call func(ctx context.Context, exec executor.Executor) ([]FileChange, error)
 	}{
 		{
-			name: "empty output returns empty slice",
-			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-only", "--diff-filter=ACM").
-					WillSucceed("", 0).
-					Build()
-			},
-			want:    []string{},
-			wantErr: false,
-		},
-		{
-			name: "single file staged",
-			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-only", "--diff-filter=ACM").
-					WillSucceed("internal/git/git.go", 0).
-					Build()
-			},
-			want:    []string{"internal/git/git.go"},
-			wantErr: false,
-		},
-		{
-			name: "multiple files staged",
-			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-only", "--diff-filter=ACM").
-					WillSucceed("internal/git/git.go\ncmd/main.go\ninternal/query/bazel.go", 0).
-					Build()
-			},
-			want:    []string{"internal/git/git.go", "cmd/main.go", "internal/query/bazel.go"},
-			wantErr: false,
-		},
-		{
-			name: "output with trailing newline",
-			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-only", "--diff-filter=ACM").
-					WillSucceed("internal/git/git.go\ncmd/main.go\n", 0).
-					Build()
-			},
-			want:    []string{"internal/git/git.go", "cmd/main.go"},
-			wantErr: false,
+			name: "staged",
+			args: []string{"diff", "--cached", "--name-status", "-M", "--diff-filter=ACDMR"},
+			call: GetStagedChanges,
 		},
 		{
-			name: "output with empty lines filters them out",
-			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-only", "--diff-filter=ACM").
-					WillSucceed("internal/git/git.go\n\ncmd/main.go\n\n", 0).
-					Build()
-			},
-			want:    []string{"internal/git/git.go", "cmd/main.go"},
-			wantErr: false,
+			name: "head",
+			args: []string{"diff", "HEAD", "--name-status", "-M", "--diff-filter=ACDMR"},
+			call: GetHeadChanges,
 		},
 		{
-			name: "executor error returns error",
-			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-only", "--diff-filter=ACM").
-					WillError(errors.New("connection refused")).
-					Build()
+			name: "base",
+			args: []string{"diff", "main", "--name-status", "-M", "--diff-filter=ACDMR"},
+			call: func(ctx context.Context, exec executor.Executor) ([]FileChange, error) {
+				return GetDiffChanges(ctx, exec, "main")
 			},
-			want:        nil,
-			wantErr:     true,
-			errContains: "failed to get diff files",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockExec := executor.NewMockExecutor()
-			tt.setupMock(mockExec)
-
-			got, err := GetStagedFiles(context.Background(), mockExec)
-
-			if tt.wantErr {
-				if err == nil {
-					t.Fatalf("GetStagedFiles() expected error, got nil")
-				}
-				if tt.errContains != "" && !containsStr(err.Error(), tt.errContains) {
-					t.Errorf("GetStagedFiles() error = %q, want it to contain %q", err.Error(), tt.errContains)
-				}
-				return
-			}
+			mockExec.ExpectCommandWithArgs("git", tt.args...).
+				WillSucceed(nameStatus, 0).
+				Build()
 
+			got, err := tt.call(context.Background(), mockExec)
 			if err != nil {
-				t.Fatalf("GetStagedFiles() unexpected error: %v", err)
+				t.Fatalf("unexpected error: %v", err)
 			}
-
-			if len(got) != len(tt.want) {
-				t.Fatalf("GetStagedFiles() returned %d files, want %d: got %v, want %v",
-					len(got), len(tt.want), got, tt.want)
-			}
-
-			for i, f := range got {
-				if f != tt.want[i] {
-					t.Errorf("GetStagedFiles()[%d] = %q, want %q", i, f, tt.want[i])
-				}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
 			}
 		})
 	}
 }
 
-func TestGetHeadFiles(t *testing.T) {
+func TestGetChanges_Errors(t *testing.T) {
 	tests := []struct {
-		name      string
-		setupMock func(m *executor.MockExecutor)
-		want      []string
-		wantErr   bool
+		name        string
+		setupMock   func(m *executor.MockExecutor)
+		errContains string
 	}{
 		{
-			name: "returns staged and unstaged files",
+			name: "executor error",
+			setupMock: func(m *executor.MockExecutor) {
+				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-status", "-M", "--diff-filter=ACDMR").
+					WillError(errors.New("connection refused")).
+					Build()
+			},
+			errContains: "failed to get diff changes",
+		},
+		{
+			name: "rename missing new path",
 			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "HEAD", "--name-only", "--diff-filter=ACM").
-					WillSucceed("file1.go\nfile2.go", 0).
+				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-status", "-M", "--diff-filter=ACDMR").
+					WillSucceed("R100\tonly/old.go\n", 0).
 					Build()
 			},
-			want: []string{"file1.go", "file2.go"},
+			errContains: "unexpected name-status line",
 		},
 		{
-			name: "empty output returns empty slice",
+			name: "unknown status",
 			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "HEAD", "--name-only", "--diff-filter=ACM").
-					WillSucceed("", 0).
+				m.ExpectCommandWithArgs("git", "diff", "--cached", "--name-status", "-M", "--diff-filter=ACDMR").
+					WillSucceed("X\tweird.go\n", 0).
 					Build()
 			},
-			want: []string{},
+			errContains: "unsupported change status",
 		},
 	}
 
@@ -203,93 +173,133 @@ func TestGetHeadFiles(t *testing.T) {
 			mockExec := executor.NewMockExecutor()
 			tt.setupMock(mockExec)
 
-			got, err := GetHeadFiles(context.Background(), mockExec)
-			if tt.wantErr {
-				if err == nil {
-					t.Fatal("expected error, got nil")
-				}
-				return
+			_, err := GetStagedChanges(context.Background(), mockExec)
+			if err == nil {
+				t.Fatal("expected error, got nil")
 			}
-			if err != nil {
-				t.Fatalf("unexpected error: %v", err)
-			}
-			if len(got) != len(tt.want) {
-				t.Fatalf("got %v, want %v", got, tt.want)
-			}
-			for i, f := range got {
-				if f != tt.want[i] {
-					t.Errorf("[%d] = %q, want %q", i, f, tt.want[i])
-				}
+			if !containsStr(err.Error(), tt.errContains) {
+				t.Errorf("error = %q, want it to contain %q", err.Error(), tt.errContains)
 			}
 		})
 	}
 }
 
-func TestGetDiffFiles(t *testing.T) {
-	tests := []struct {
-		name      string
-		ref       string
-		setupMock func(m *executor.MockExecutor)
-		want      []string
-		wantErr   bool
-	}{
-		{
-			name: "diff against main",
-			ref:  "main",
-			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "main", "--name-only", "--diff-filter=ACM").
-					WillSucceed("pkg/a.go\npkg/b.go", 0).
-					Build()
-			},
-			want: []string{"pkg/a.go", "pkg/b.go"},
-		},
-		{
-			name: "diff against commit SHA",
-			ref:  "abc123",
-			setupMock: func(m *executor.MockExecutor) {
-				m.ExpectCommandWithArgs("git", "diff", "abc123", "--name-only", "--diff-filter=ACM").
-					WillSucceed("changed.go", 0).
-					Build()
-			},
-			want: []string{"changed.go"},
-		},
+func TestAffectedPaths(t *testing.T) {
+	changes := []FileChange{
+		{Status: StatusModified, Path: "pkg/a/a.go"},
+		{Status: StatusDeleted, Path: "pkg/b/gone.go"},
+		{Status: StatusRenamed, OldPath: "pkg/old/x.go", Path: "pkg/new/x.go"},
+		{Status: StatusCopied, OldPath: "pkg/a/a.go", Path: "pkg/c/a.go"},
+		{Status: StatusModified, Path: "pkg/a/a.go"},
 	}
+	got := AffectedPaths(changes)
+	want := []string{"pkg/a/a.go", "pkg/b/gone.go", "pkg/old/x.go", "pkg/new/x.go", "pkg/c/a.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AffectedPaths() = %v, want %v", got, want)
+	}
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			mockExec := executor.NewMockExecutor()
-			tt.setupMock(mockExec)
+func TestBuildDirsAt(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("git", "-C", "/repo", "ls-tree", "--full-tree", "-r", "--name-only", "main").
+		WillSucceed("BUILD.bazel\nREADME.md\npkg/a/BUILD\npkg/a/a.go\npkg/b/BUILD.bazel\npkg/b/c/file.go\npkg/b/c/BUILD.tmpl\n", 0).
+		Build()
 
-			got, err := GetDiffFiles(context.Background(), mockExec, tt.ref)
-			if tt.wantErr {
-				if err == nil {
-					t.Fatal("expected error, got nil")
-				}
-				return
-			}
-			if err != nil {
-				t.Fatalf("unexpected error: %v", err)
-			}
-			if len(got) != len(tt.want) {
-				t.Fatalf("got %v, want %v", got, tt.want)
-			}
-			for i, f := range got {
-				if f != tt.want[i] {
-					t.Errorf("[%d] = %q, want %q", i, f, tt.want[i])
-				}
-			}
-		})
+	got, err := BuildDirsAt(context.Background(), mockExec, "/repo", "main")
+	if err != nil {
+		t.Fatalf("BuildDirsAt() unexpected error: %v", err)
+	}
+	want := map[string]bool{".": true, "pkg/a": true, "pkg/b": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildDirsAt() = %v, want %v", got, want)
 	}
 }
 
-func containsStr(s, substr string) bool {
-	if len(substr) == 0 {
-		return true
+func TestBuildDirsAt_FromSubdirectory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
 	}
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
+	root := t.TempDir()
+	for _, f := range []string{"BUILD", "pkg/a/BUILD.bazel", "pkg/a/a.go", "other/BUILD"} {
+		full := filepath.Join(root, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, nil, 0o600); err != nil {
+			t.Fatal(err)
 		}
 	}
-	return false
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = root
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	// Run from a subdirectory: the listing must still cover the whole
+	// repository with repo-relative paths.
+	t.Chdir(filepath.Join(root, "pkg", "a"))
+
+	got, err := BuildDirsAt(context.Background(), executor.NewBasicExecutor(), root, "HEAD")
+	if err != nil {
+		t.Fatalf("BuildDirsAt() unexpected error: %v", err)
+	}
+	want := map[string]bool{".": true, "pkg/a": true, "other": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildDirsAt() = %v, want %v", got, want)
+	}
+}
+
+func TestWorktree(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("git", "worktree", "add", "--detach", "/tmp/wt", "main").
+		WillSucceed("", 0).
+		Build()
+	mockExec.ExpectCommandWithArgs("git", "worktree", "remove", "--force", "/tmp/wt").
+		WillError(errors.New("locked")).
+		Build()
+
+	if err := AddWorktree(context.Background(), mockExec, "/tmp/wt", "main"); err != nil {
+		t.Fatalf("AddWorktree() unexpected error: %v", err)
+	}
+	err := RemoveWorktree(context.Background(), mockExec, "/tmp/wt")
+	if err == nil || !containsStr(err.Error(), "failed to remove worktree") {
+		t.Errorf("RemoveWorktree() error = %v, want it to contain %q", err, "failed to remove worktree")
+	}
+}
+
+func TestBuildFileBlobs(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("git", "-C", "/repo", "ls-files", "-s", "-z", "--", "*BUILD", "*BUILD.bazel", "*.bzl").
+		WillSucceed("100644 aaaa 0\tBUILD.bazel\x00100644 bbbb 0\tpkg/defs.bzl\x00100644 cccc 0\tpkg/MYBUILD\x00100644 dddd 0\tpkg/a b/BUILD\x00", 0).
+		Build()
+
+	got, err := BuildFileBlobs(context.Background(), mockExec, "/repo")
+	if err != nil {
+		t.Fatalf("BuildFileBlobs() unexpected error: %v", err)
+	}
+	want := map[string]string{"BUILD.bazel": "aaaa", "pkg/defs.bzl": "bbbb", "pkg/a b/BUILD": "dddd"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildFileBlobs() = %v, want %v", got, want)
+	}
+}
+
+func TestDirtyBuildFiles(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("git", "-C", "/repo", "ls-files", "-m", "-o", "--exclude-standard", "-z", "--", "*BUILD", "*BUILD.bazel", "*.bzl").
+		WillSucceed("pkg/BUILD\x00new/BUILD.bazel\x00pkg/NOTBUILD\x00", 0).
+		Build()
+
+	got, err := DirtyBuildFiles(context.Background(), mockExec, "/repo")
+	if err != nil {
+		t.Fatalf("DirtyBuildFiles() unexpected error: %v", err)
+	}
+	want := []string{"pkg/BUILD", "new/BUILD.bazel"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DirtyBuildFiles() = %v, want %v", got, want)
+	}
 }
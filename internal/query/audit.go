@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
+	"log/slog"
 	"strings"
 )
 
@@ -16,27 +17,107 @@ var SourceAttrs = []string{"srcs", "hdrs", "data", "resources"}
 var DepAttrs = []string{"deps", "runtime_deps", "exports", "implementation_deps"}
 
 // Rule is the structured form of a single Bazel rule extracted from
-// `bazel query --output=xml`. Sources and Deps are keyed by attribute name
-// and hold the labels Bazel reports for that attribute. Only attribute names
-// in SourceAttrs / DepAttrs are populated.
+// `bazel query --output=streamed_proto` (or --output=xml on Bazel versions
+// without it). Sources and Deps are keyed by attribute name and hold the
+// labels Bazel reports for that attribute. Only attribute names in
+// SourceAttrs / DepAttrs are populated; Attrs holds the string and label
+// values of every attribute. Inputs lists the rule's inputs, including
+// implicit ones, as reported by Bazel's rule-input entries.
 type Rule struct {
 	Kind    string
 	Label   string
 	Sources map[string][]string
 	Deps    map[string][]string
+	Attrs   map[string][]string
+	Inputs  []string
 }
 
-// QueryRules runs `bazel query <pattern> --output=xml` and returns parsed
-// rule metadata. Returns nil for an empty result.
-func (q *BazelQuerier) QueryRules(pattern string) ([]Rule, error) {
+// setAttr records the values of attribute name, and also files them under
+// Sources or Deps when the name is in the given sets.
+func (r *Rule) setAttr(name string, values []string, sources, deps map[string]bool) {
+	if r.Attrs == nil {
+		r.Attrs = make(map[string][]string)
+	}
+	r.Attrs[name] = values
+	switch {
+	case sources[name]:
+		if r.Sources == nil {
+			r.Sources = make(map[string][]string)
+		}
+		r.Sources[name] = values
+	case deps[name]:
+		if r.Deps == nil {
+			r.Deps = make(map[string][]string)
+		}
+		r.Deps[name] = values
+	}
+}
+
+// Target kinds, matching the discriminators of build.proto's Target.
+const (
+	TargetRule          = "rule"
+	TargetSourceFile    = "source file"
+	TargetGeneratedFile = "generated file"
+)
+
+// Target is a single target returned by queryTargets. Rule is set for rules;
+// GeneratingRule is set for generated files.
+type Target struct {
+	Kind           string
+	Label          string
+	Rule           *Rule
+	GeneratingRule string
+}
+
+// queryTargets runs `bazel query <pattern> --output=streamed_proto` and
+// returns every rule, source file and generated file it matched. If Bazel
+// does not support streamed_proto output, or its output cannot be decoded,
+// the query is repeated with --output=xml, and later queries by q use XML
+// directly. Returns nil for an empty result.
+func (q *BazelQuerier) queryTargets(pattern string) ([]Target, error) {
+	if !q.xmlOutput.Load() {
+		raw, err := q.queryRaw(pattern, "--output=streamed_proto")
+		switch {
+		case err == nil && raw == "":
+			return nil, nil
+		case err == nil:
+			targets, perr := parseStreamedTargets([]byte(raw))
+			if perr == nil {
+				return targets, nil
+			}
+			slog.Warn("Falling back to XML query output", "pattern", pattern, "error", perr)
+		case strings.Contains(err.Error(), "Invalid output format"):
+			slog.Debug("Bazel does not support streamed_proto output; using XML", "error", err)
+		default:
+			return nil, err
+		}
+		q.xmlOutput.Store(true)
+	}
+
 	raw, err := q.queryRaw(pattern, "--output=xml")
 	if err != nil {
-		return nil, fmt.Errorf("querying rules for %s: %w", pattern, err)
+		return nil, err
 	}
 	if raw == "" {
 		return nil, nil
 	}
-	return parseRulesXML([]byte(raw))
+	return parseTargetsXML([]byte(raw))
+}
+
+// QueryRules returns the rules matched by pattern, parsed by queryTargets.
+// Returns nil for an empty result.
+func (q *BazelQuerier) QueryRules(pattern string) ([]Rule, error) {
+	targets, err := q.queryTargets(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("querying rules for %s: %w", pattern, err)
+	}
+	var rules []Rule
+	for _, t := range targets {
+		if t.Rule != nil {
+			rules = append(rules, *t.Rule)
+		}
+	}
+	return rules, nil
 }
 
 // QueryPackages lists the unique workspace packages matched by pattern using
@@ -79,31 +160,68 @@ func (q *BazelQuerier) QueryDeps(targets []string) ([]string, error) {
 //
 //	<query>
 //	  <rule class="..." name="...">
+//	    <string name="..." value="..."/>
+//	    <label name="..." value="..."/>
 //	    <list name="srcs"><label value="..."/></list>
+//	    <rule-input name="..."/>
 //	    ...
 //	  </rule>
+//	  <source-file name="..."/>
+//	  <generated-file name="..." generating-rule="..."/>
 //	</query>
 type queryXML struct {
-	XMLName xml.Name  `xml:"query"`
-	Rules   []ruleXML `xml:"rule"`
+	XMLName        xml.Name           `xml:"query"`
+	Rules          []ruleXML          `xml:"rule"`
+	SourceFiles    []fileXML          `xml:"source-file"`
+	GeneratedFiles []generatedFileXML `xml:"generated-file"`
 }
 
 type ruleXML struct {
-	Class string    `xml:"class,attr"`
-	Name  string    `xml:"name,attr"`
-	Lists []listXML `xml:"list"`
+	Class   string     `xml:"class,attr"`
+	Name    string     `xml:"name,attr"`
+	Strings []valueXML `xml:"string"`
+	Labels  []valueXML `xml:"label"`
+	Lists   []listXML  `xml:"list"`
+	Inputs  []fileXML  `xml:"rule-input"`
 }
 
 type listXML struct {
-	Name   string     `xml:"name,attr"`
-	Labels []labelXML `xml:"label"`
+	Name    string     `xml:"name,attr"`
+	Labels  []valueXML `xml:"label"`
+	Strings []valueXML `xml:"string"`
 }
 
-type labelXML struct {
+type valueXML struct {
+	Name  string `xml:"name,attr"`
 	Value string `xml:"value,attr"`
 }
 
+type fileXML struct {
+	Name string `xml:"name,attr"`
+}
+
+type generatedFileXML struct {
+	Name           string `xml:"name,attr"`
+	GeneratingRule string `xml:"generating-rule,attr"`
+}
+
 func parseRulesXML(data []byte) ([]Rule, error) {
+	targets, err := parseTargetsXML(data)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, 0, len(targets))
+	for _, t := range targets {
+		if t.Rule != nil {
+			rules = append(rules, *t.Rule)
+		}
+	}
+	return rules, nil
+}
+
+// parseTargetsXML returns the rules of an XML query result followed by its
+// source and generated files.
+func parseTargetsXML(data []byte) ([]Target, error) {
 	// Bazel emits XML 1.1, which Go's encoding/xml rejects. The body is
 	// 1.0-compatible, so dropping the declaration is safe.
 	var doc queryXML
@@ -112,33 +230,36 @@ func parseRulesXML(data []byte) ([]Rule, error) {
 	}
 	sources := stringSet(SourceAttrs)
 	deps := stringSet(DepAttrs)
-	rules := make([]Rule, 0, len(doc.Rules))
+	targets := make([]Target, 0, len(doc.Rules)+len(doc.SourceFiles)+len(doc.GeneratedFiles))
 	for _, r := range doc.Rules {
 		rule := Rule{Kind: r.Class, Label: r.Name}
-		for _, l := range r.Lists {
-			switch {
-			case sources[l.Name]:
-				if rule.Sources == nil {
-					rule.Sources = make(map[string][]string)
-				}
-				rule.Sources[l.Name] = collectLabels(l.Labels)
-			case deps[l.Name]:
-				if rule.Deps == nil {
-					rule.Deps = make(map[string][]string)
-				}
-				rule.Deps[l.Name] = collectLabels(l.Labels)
+		for _, v := range append(append([]valueXML(nil), r.Strings...), r.Labels...) {
+			if v.Value != "" {
+				rule.setAttr(v.Name, []string{v.Value}, sources, deps)
 			}
 		}
-		rules = append(rules, rule)
+		for _, l := range r.Lists {
+			rule.setAttr(l.Name, append(collectValues(l.Labels), collectValues(l.Strings)...), sources, deps)
+		}
+		for _, in := range r.Inputs {
+			rule.Inputs = append(rule.Inputs, in.Name)
+		}
+		targets = append(targets, Target{Kind: TargetRule, Label: rule.Label, Rule: &rule})
 	}
-	return rules, nil
+	for _, f := range doc.SourceFiles {
+		targets = append(targets, Target{Kind: TargetSourceFile, Label: f.Name})
+	}
+	for _, f := range doc.GeneratedFiles {
+		targets = append(targets, Target{Kind: TargetGeneratedFile, Label: f.Name, GeneratingRule: f.GeneratingRule})
+	}
+	return targets, nil
 }
 
-func collectLabels(labels []labelXML) []string {
-	out := make([]string, 0, len(labels))
-	for _, l := range labels {
-		if l.Value != "" {
-			out = append(out, l.Value)
+func collectValues(values []valueXML) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v.Value != "" {
+			out = append(out, v.Value)
 		}
 	}
 	return out
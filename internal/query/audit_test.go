@@ -117,10 +117,106 @@ func TestParseRulesXML_Malformed(t *testing.T) {
 	}
 }
 
+func TestParseTargetsXML(t *testing.T) {
+	data := `<?xml version="1.1" encoding="UTF-8" standalone="no"?>
+<query version="2">
+    <rule class="genrule" name="//pkg/foo:gen_rule">
+        <string name="cmd" value="cp $&lt; $@"/>
+        <label name="tool" value="//tools:copier"/>
+        <list name="srcs"><label value="//pkg/foo:in.txt"/></list>
+        <list name="tags"><string value="manual"/></list>
+        <rule-input name="//pkg/foo:in.txt"/>
+        <rule-input name="//tools:copier"/>
+    </rule>
+    <source-file name="//pkg/foo:in.txt"/>
+    <generated-file generating-rule="//pkg/foo:gen_rule" name="//pkg/foo:out.txt"/>
+</query>
+`
+	got, err := parseTargetsXML([]byte(data))
+	if err != nil {
+		t.Fatalf("parseTargetsXML failed: %v", err)
+	}
+	want := []Target{
+		{
+			Kind:  TargetRule,
+			Label: "//pkg/foo:gen_rule",
+			Rule: &Rule{
+				Kind:    "genrule",
+				Label:   "//pkg/foo:gen_rule",
+				Sources: map[string][]string{"srcs": {"//pkg/foo:in.txt"}},
+				Attrs: map[string][]string{
+					"cmd":  {"cp $< $@"},
+					"tool": {"//tools:copier"},
+					"srcs": {"//pkg/foo:in.txt"},
+					"tags": {"manual"},
+				},
+				Inputs: []string{"//pkg/foo:in.txt", "//tools:copier"},
+			},
+		},
+		{Kind: TargetSourceFile, Label: "//pkg/foo:in.txt"},
+		{Kind: TargetGeneratedFile, Label: "//pkg/foo:out.txt", GeneratingRule: "//pkg/foo:gen_rule"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTargetsXML() = %+v, want %+v", got, want)
+	}
+}
+
 func TestQueryRules_Success(t *testing.T) {
 	mockExec := executor.NewMockExecutor()
 	q := NewBazelQuerierWithExecutor(mockExec)
 
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto", "//pkg/foo:*").
+		WillSucceed(string(streamed(sampleTargets...)), 0).
+		Once().
+		Build()
+
+	rules, err := q.QueryRules("//pkg/foo:*")
+	if err != nil {
+		t.Fatalf("QueryRules failed: %v", err)
+	}
+	if len(rules) != 1 || !reflect.DeepEqual(rules[0], *wantSampleTargets[0].Rule) {
+		t.Errorf("QueryRules() = %+v, want the sample rule", rules)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestQueryRules_FallsBackToXML(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto", "//pkg/foo:*").
+		WillFail("ERROR: Invalid output format 'streamed_proto'. Valid values are: label, xml, proto", 2).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=xml", "//pkg/foo:*").
+		WillSucceed(sampleXML, 0).
+		Build()
+
+	for range 2 {
+		rules, err := q.QueryRules("//pkg/foo:*")
+		if err != nil {
+			t.Fatalf("QueryRules failed: %v", err)
+		}
+		if len(rules) != 2 {
+			t.Errorf("expected 2 rules, got %d", len(rules))
+		}
+	}
+	// The second call goes straight to XML.
+	if n := len(mockExec.GetCallHistory()); n != 3 {
+		t.Errorf("bazel invoked %d times, want 3", n)
+	}
+}
+
+func TestQueryRules_UndecodableProtoFallsBackToXML(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto", "//pkg/foo:*").
+		WillSucceed("\xff\xff", 0).
+		Once().
+		Build()
 	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=xml", "//pkg/foo:*").
 		WillSucceed(sampleXML, 0).
 		Once().
@@ -133,8 +229,23 @@ func TestQueryRules_Success(t *testing.T) {
 	if len(rules) != 2 {
 		t.Errorf("expected 2 rules, got %d", len(rules))
 	}
-	if err := mockExec.AssertExpectationsMet(); err != nil {
-		t.Errorf("mock expectations not met: %v", err)
+}
+
+func TestQueryTargets_IncludesFiles(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto", "//pkg/foo:*").
+		WillSucceed(string(streamed(sampleTargets...)), 0).
+		Once().
+		Build()
+
+	targets, err := q.queryTargets("//pkg/foo:*")
+	if err != nil {
+		t.Fatalf("queryTargets failed: %v", err)
+	}
+	if !reflect.DeepEqual(targets, wantSampleTargets) {
+		t.Errorf("queryTargets() = %+v, want %+v", targets, wantSampleTargets)
 	}
 }
 
@@ -142,7 +253,7 @@ func TestQueryRules_EmptyResult(t *testing.T) {
 	mockExec := executor.NewMockExecutor()
 	q := NewBazelQuerierWithExecutor(mockExec)
 
-	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=xml", "//empty:*").
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto", "//empty:*").
 		WillSucceed("", 0).
 		Build()
 
@@ -159,7 +270,7 @@ func TestQueryRules_QueryError(t *testing.T) {
 	mockExec := executor.NewMockExecutor()
 	q := NewBazelQuerierWithExecutor(mockExec)
 
-	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=xml", "//bad:*").
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto", "//bad:*").
 		WillFail("ERROR: invalid pattern", 2).
 		Build()
 
@@ -170,6 +281,9 @@ func TestQueryRules_QueryError(t *testing.T) {
 	if !strings.Contains(err.Error(), "querying rules for //bad:*") {
 		t.Errorf("error should be wrapped with rule context, got: %v", err)
 	}
+	if len(mockExec.GetCallHistory()) != 1 {
+		t.Error("a failing query should not be retried with XML output")
+	}
 }
 
 func TestQueryDeps_SingleTarget(t *testing.T) {
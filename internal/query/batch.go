@@ -0,0 +1,242 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// graphEdgePattern matches one edge of `bazel query --output=graph
+// --nograph:factored`, e.g. `"//a:test" -> "//a:lib"`.
+var graphEdgePattern = regexp.MustCompile(`^\s*"([^"]+)"\s*->\s*"([^"]+)"`)
+
+// FindAffectedTestsBatched is the batched form of FindAffectedTests. Instead of
+// up to three queries per package it issues a fixed number of queries for the
+// whole package set:
+//
+//	kind('.*_test rule', set(//a:* //b:*))
+//	kind('.*_test rule', set(//a/... //b/...))
+//	rdeps(//..., set(//a:* //b:*)) intersect kind('.*_test rule', //...)
+//	rdeps(//..., set(//a:* //b:*))  (--output=graph, for attribution)
+//
+// The result maps every valid input package to the tests it alone would have
+// selected through FindAffectedTests, so callers can keep storing per-package
+// cache entries. Same-package and sub-package tests are attributed by label;
+// rdeps tests are attributed by walking the dependency graph back from each
+// package's targets.
+func (q *BazelQuerier) FindAffectedTestsBatched(packages []string) (map[string][]string, error) {
+	pkgs := uniqueValidPackages(packages)
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
+	if q.index != nil {
+		result := make(map[string][]string, len(pkgs))
+		for _, pkg := range pkgs {
+			result[pkg] = sortedSet(q.index.packageTests(pkg, q.enableSubpackageQuery))
+		}
+		return result, nil
+	}
+	label := fmt.Sprintf("%d packages", len(pkgs))
+	attributed := make(map[string]map[string]bool, len(pkgs))
+	for _, pkg := range pkgs {
+		attributed[pkg] = make(map[string]bool)
+	}
+
+	pkgTargets := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		pkgTargets[i] = pkg + ":*"
+	}
+	targetSet := strings.Join(pkgTargets, " ")
+
+	samePkg := make(map[string]bool)
+	if err := q.collectTests(context.Background(),
+		q.testsIn(fmt.Sprintf("set(%s)", targetSet)),
+		"same package tests", label, samePkg,
+	); err != nil {
+		return nil, err
+	}
+	for test := range samePkg {
+		if tests, ok := attributed[labelPackage(test)]; ok {
+			tests[test] = true
+		}
+	}
+
+	if err := q.collectSubpackageTestsBatched(pkgs, label, attributed); err != nil {
+		return nil, err
+	}
+
+	rdepsTests := make(map[string]bool)
+	if err := q.collectRdepsTests(context.Background(),
+		fmt.Sprintf("rdeps(%s, set(%s)) intersect %s", q.universe, targetSet, q.testsIn(q.universe)),
+		"external test deps", label, rdepsTests,
+	); err != nil {
+		return nil, err
+	}
+	if len(rdepsTests) > 0 {
+		if err := q.attributeRdepsTests(targetSet, label, rdepsTests, attributed); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make(map[string][]string, len(attributed))
+	for pkg, tests := range attributed {
+		result[pkg] = sortedSet(tests)
+	}
+	return result, nil
+}
+
+// collectSubpackageTestsBatched runs the sub-package test query for every
+// package except the root (see FindAffectedTests) and attributes each test to
+// all packages whose PKG/... pattern contains it.
+func (q *BazelQuerier) collectSubpackageTestsBatched(pkgs []string, label string, attributed map[string]map[string]bool) error {
+	if !q.enableSubpackageQuery {
+		slog.Debug("Skipping sub-package query (disabled by config)")
+		return nil
+	}
+	var patterns, subPkgs []string
+	for _, pkg := range pkgs {
+		if pkg == "//" {
+			slog.Debug("Skipping sub-package query for root package")
+			continue
+		}
+		patterns = append(patterns, pkg+"/...")
+		subPkgs = append(subPkgs, pkg)
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	subTests := make(map[string]bool)
+	if err := q.collectTests(context.Background(),
+		q.testsIn(fmt.Sprintf("set(%s)", strings.Join(patterns, " "))),
+		"sub-package tests", label, subTests,
+	); err != nil {
+		return err
+	}
+	for test := range subTests {
+		testPkg := labelPackage(test)
+		for _, pkg := range subPkgs {
+			if testPkg == pkg || strings.HasPrefix(testPkg, pkg+"/") {
+				attributed[pkg][test] = true
+			}
+		}
+	}
+	return nil
+}
+
+// attributeRdepsTests fetches the reverse-dependency graph of the package set
+// and records, for each package, the rdeps tests that reach one of its
+// targets. If the graph cannot be fetched and the failure is non-fatal, every
+// test is attributed to every package: over-attribution only widens future
+// cache hits, whereas dropping tests would silently under-select.
+func (q *BazelQuerier) attributeRdepsTests(targetSet, label string, rdepsTests map[string]bool, attributed map[string]map[string]bool) error {
+	graphArgs := []string{"--output=graph", "--nograph:factored", "--graph:node_limit=-1"}
+	command := "query"
+	if q.cquery {
+		command = "cquery"
+		graphArgs = append(graphArgs, q.buildFlags...)
+	}
+	raw, err := q.runQuery(context.Background(), command,
+		fmt.Sprintf("rdeps(%s, set(%s))", q.universe, targetSet),
+		rdepsArgs(graphArgs...)...,
+	)
+	if err != nil {
+		if !errors.Is(err, errBazelCrash) && q.failOnError {
+			return fmt.Errorf("failed to query dependency graph for %s: %w", label, err)
+		}
+		slog.Warn("Error querying dependency graph, attributing rdeps tests to every package", "packages", len(attributed), "error", err)
+		for _, tests := range attributed {
+			for test := range rdepsTests {
+				tests[test] = true
+			}
+		}
+		return nil
+	}
+
+	dependents := parseGraphDependents(raw)
+	for pkg, tests := range attributed {
+		for node := range reachableDependents(dependents, pkg) {
+			if rdepsTests[node] {
+				tests[node] = true
+			}
+		}
+	}
+	return nil
+}
+
+// parseGraphDependents parses unfactored `--output=graph` output into a map
+// from each target to the targets that depend on it directly.
+func parseGraphDependents(raw string) map[string][]string {
+	dependents := make(map[string][]string)
+	for line := range strings.SplitSeq(raw, "\n") {
+		m := graphEdgePattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		// cquery graphs label nodes with their configuration.
+		from, to := plainLabel(m[1]), plainLabel(m[2])
+		dependents[to] = append(dependents[to], from)
+		if _, ok := dependents[from]; !ok {
+			dependents[from] = nil
+		}
+	}
+	return dependents
+}
+
+// reachableDependents returns every node that transitively depends on a
+// target in pkg, including the package's own targets.
+func reachableDependents(dependents map[string][]string, pkg string) map[string]bool {
+	seen := make(map[string]bool)
+	var stack []string
+	for node := range dependents {
+		if labelPackage(node) == pkg {
+			seen[node] = true
+			stack = append(stack, node)
+		}
+	}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, d := range dependents[node] {
+			if !seen[d] {
+				seen[d] = true
+				stack = append(stack, d)
+			}
+		}
+	}
+	return seen
+}
+
+// uniqueValidPackages deduplicates and sorts packages, dropping labels that do
+// not match validPkgPattern.
+func uniqueValidPackages(packages []string) []string {
+	set := make(map[string]bool)
+	for _, pkg := range packages {
+		if !validPkgPattern.MatchString(pkg) {
+			slog.Warn("Skipping invalid package label", "package", pkg)
+			continue
+		}
+		set[pkg] = true
+	}
+	return sortedSet(set)
+}
+
+// labelPackage returns the package part of a label ("//a/b:c" -> "//a/b").
+// Labels without a target name are their own package.
+func labelPackage(label string) string {
+	pkg, _, _ := strings.Cut(label, ":")
+	return pkg
+}
+
+func sortedSet(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for v := range set {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
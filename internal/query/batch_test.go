@@ -0,0 +1,156 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+const batchGraph = `digraph mygraph {
+  node [shape=box];
+  "//pkg/a:lib"
+  "//pkg/a:a_test"
+  "//pkg/a:a_test" -> "//pkg/a:lib"
+  "//app:app_test"
+  "//app:app_test" -> "//app:lib"
+  "//app:lib"
+  "//app:lib" -> "//pkg/a:lib"
+  "//pkg/b:b_test"
+  "//pkg/b:b_test" -> "//pkg/b:lib"
+}
+`
+
+func expectBatchQueries(m *executor.MockExecutor, sub string) {
+	m.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', set(//pkg/a:* //pkg/b:*))").
+		WillSucceed("//pkg/a:a_test\n//pkg/b:b_test", 0).
+		Once().
+		Build()
+	if sub != "" {
+		m.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', set(//pkg/a/... //pkg/b/...))").
+			WillSucceed(sub, 0).
+			Once().
+			Build()
+	}
+	m.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., set(//pkg/a:* //pkg/b:*)) intersect kind('.*_test rule', //...)").
+		WillSucceed("//pkg/a:a_test\n//pkg/b:b_test\n//app:app_test", 0).
+		Once().
+		Build()
+}
+
+func TestFindAffectedTestsBatched_AttributesByPackage(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	expectBatchQueries(mockExec, "//pkg/a:a_test\n//pkg/a/golden:golden_test\n//pkg/b:b_test")
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"--output=graph", "--nograph:factored", "--graph:node_limit=-1",
+		"rdeps(//..., set(//pkg/a:* //pkg/b:*))").
+		WillSucceed(batchGraph, 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := q.FindAffectedTestsBatched([]string{"//pkg/b", "//pkg/a", "//pkg/a"})
+	if err != nil {
+		t.Fatalf("FindAffectedTestsBatched failed: %v", err)
+	}
+	want := map[string][]string{
+		"//pkg/a": {"//app:app_test", "//pkg/a/golden:golden_test", "//pkg/a:a_test"},
+		"//pkg/b": {"//pkg/b:b_test"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAffectedTestsBatched() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestFindAffectedTestsBatched_GraphFailureBestEffortAttributesToAll(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetFailOnError(false)
+	q.SetEnableSubpackageQuery(false)
+	expectBatchQueries(mockExec, "")
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"--output=graph", "--nograph:factored", "--graph:node_limit=-1",
+		"rdeps(//..., set(//pkg/a:* //pkg/b:*))").
+		WillFail("ERROR: graph failed", 1).
+		Once().
+		Build()
+
+	got, err := q.FindAffectedTestsBatched([]string{"//pkg/a", "//pkg/b"})
+	if err != nil {
+		t.Fatalf("FindAffectedTestsBatched failed: %v", err)
+	}
+	all := []string{"//app:app_test", "//pkg/a:a_test", "//pkg/b:b_test"}
+	want := map[string][]string{"//pkg/a": all, "//pkg/b": all}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAffectedTestsBatched() = %v, want %v", got, want)
+	}
+}
+
+func TestFindAffectedTestsBatched_GraphFailureIsFatalByDefault(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetFailOnError(true)
+	q.SetEnableSubpackageQuery(false)
+	expectBatchQueries(mockExec, "")
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"--output=graph", "--nograph:factored", "--graph:node_limit=-1",
+		"rdeps(//..., set(//pkg/a:* //pkg/b:*))").
+		WillFail("ERROR: graph failed", 1).
+		Once().
+		Build()
+
+	if _, err := q.FindAffectedTestsBatched([]string{"//pkg/a", "//pkg/b"}); err == nil {
+		t.Fatal("expected error when graph query fails with failOnError")
+	}
+}
+
+func TestFindAffectedTestsBatched_RootSkipsSubpackageQuery(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', set(//:*))").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., set(//:*)) intersect kind('.*_test rule', //...)").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := q.FindAffectedTestsBatched([]string{"//"})
+	if err != nil {
+		t.Fatalf("FindAffectedTestsBatched failed: %v", err)
+	}
+	if want := map[string][]string{"//": {}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAffectedTestsBatched() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestParseGraphDependents(t *testing.T) {
+	got := parseGraphDependents(batchGraph)
+	if !reflect.DeepEqual(got["//pkg/a:lib"], []string{"//pkg/a:a_test", "//app:lib"}) {
+		t.Errorf("dependents of //pkg/a:lib = %v", got["//pkg/a:lib"])
+	}
+	if _, ok := got["//app:app_test"]; !ok {
+		t.Error("expected //app:app_test to be recorded as a node")
+	}
+}
+
+func TestParseGraphDependents_CqueryConfigurations(t *testing.T) {
+	raw := `digraph mygraph {
+  "//app:app_test (a1b2c3)" -> "//pkg/a:lib (a1b2c3)"
+  "//tools:gen (d4e5f6)" -> "//pkg/a:lib (d4e5f6)"
+}
+`
+	got := parseGraphDependents(raw)
+	if want := []string{"//app:app_test", "//tools:gen"}; !reflect.DeepEqual(got["//pkg/a:lib"], want) {
+		t.Errorf("dependents of //pkg/a:lib = %v, want %v", got["//pkg/a:lib"], want)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	executor "github.com/jaeyeom/go-cmdexec"
@@ -17,6 +18,18 @@ import (
 // validPkgPattern validates Bazel package labels.
 var validPkgPattern = regexp.MustCompile(`^//[a-zA-Z0-9_./-]*$`)
 
+// validRulePattern validates Bazel target labels. Target names allow a wider
+// character set than package names, but anything that could be interpreted by
+// the shell or the query language (quotes, spaces, parentheses) is rejected.
+var validRulePattern = regexp.MustCompile(`^//[a-zA-Z0-9_./-]*:[a-zA-Z0-9_./+=,@~-]+$`)
+
+// ValidLabel reports whether l is a target label the querier accepts as a
+// query starting point. Labels it rejects are skipped by
+// FindAffectedTestsForRules, so callers check them first.
+func ValidLabel(l string) bool {
+	return validRulePattern.MatchString(l)
+}
+
 // DefaultQueryTimeout is the per-query wall-clock limit applied when no
 // timeout is configured. Large repositories whose rdeps queries traverse a
 // big graph may need to raise this via SetQueryTimeout.
@@ -48,12 +61,40 @@ func firstLine(s string) string {
 	return ""
 }
 
+// querySchemaVersion identifies how query answers are constructed. Bump it
+// whenever a change to the queries or to how their output is interpreted can
+// change the tests returned for the same inputs, so answers cached by older
+// versions are not reused. Version 2: proto output parsing, cquery, action
+// inputs, file precision, .bzl expansion, universe and test filters.
+const querySchemaVersion = 2
+
+// rdepsFlags are passed to every rdeps and somepath query: keep going past
+// broken targets and ignore host and implicit dependencies, which would
+// otherwise pull toolchain-only edges into the answer.
+var rdepsFlags = []string{"--keep_going", "--nohost_deps", "--noimplicit_deps"}
+
+// rdepsArgs returns rdepsFlags followed by extra, in a new slice.
+func rdepsArgs(extra ...string) []string {
+	return append(append([]string(nil), rdepsFlags...), extra...)
+}
+
 // BazelQuerier executes Bazel queries.
 type BazelQuerier struct {
 	executor              executor.Executor
 	failOnError           bool          // If true, return errors from query failures; if false, log and continue
 	enableSubpackageQuery bool          // If true, run sub-package test queries (PKG/...)
 	queryTimeout          time.Duration // Per-query wall-clock limit; defaults to DefaultQueryTimeout
+	startupArgs           []string      // Bazel startup options placed before the "query" command
+	workspaceDir          string        // Directory bazel runs in; empty means the current directory
+	index                 *TestIndex    // If set, answers FindAffectedTests without Bazel; see SetIndex
+	xmlOutput             atomic.Bool   // Set once Bazel rejects streamed_proto; see queryTargets
+	cquery                bool          // If true, the rdeps step runs as bazel cquery; see SetCquery
+	buildFlags            []string      // Build flags passed to cquery, e.g. --config=linux
+	universe              string        // Query expression rdeps ranges over; see SetUniverse
+	universeScope         string        // The universe as --universe_scope patterns
+	testKinds             []string      // kind() patterns selecting tests; see SetTestFilter
+	includeTags           []string      // Tests must carry one of these tags, if any
+	excludeTags           []string      // Tests must carry none of these tags
 }
 
 // NewBazelQuerier creates a new BazelQuerier.
@@ -67,6 +108,8 @@ func NewBazelQuerier() *BazelQuerier {
 		failOnError:           !bestEffort,
 		enableSubpackageQuery: true,
 		queryTimeout:          DefaultQueryTimeout,
+		universe:              DefaultUniverse,
+		universeScope:         DefaultUniverse,
 	}
 }
 
@@ -79,6 +122,8 @@ func NewBazelQuerierWithExecutor(exec executor.Executor) *BazelQuerier {
 		failOnError:           !bestEffort,
 		enableSubpackageQuery: true,
 		queryTimeout:          DefaultQueryTimeout,
+		universe:              DefaultUniverse,
+		universeScope:         DefaultUniverse,
 	}
 }
 
@@ -102,13 +147,96 @@ func (q *BazelQuerier) SetQueryTimeout(d time.Duration) {
 	}
 }
 
+// SetOutputBase points every query at the Bazel server for the given
+// --output_base instead of the workspace's default server. Queries against a
+// single server serialize on its lock, so concurrent callers give each worker
+// its own output base to get real parallelism. An empty dir restores the
+// default server.
+func (q *BazelQuerier) SetOutputBase(dir string) {
+	if dir == "" {
+		q.startupArgs = nil
+		return
+	}
+	q.startupArgs = []string{"--output_base=" + dir}
+}
+
+// SetCquery switches the rdeps step of the Find* methods to `bazel cquery`
+// with the given build flags (e.g. --config=linux), so select() branches are
+// resolved for that configuration instead of taking the union of all of
+// them. Same-package and sub-package test listings still use bazel query,
+// which sees every test regardless of configuration.
+func (q *BazelQuerier) SetCquery(enable bool, buildFlags []string) {
+	q.cquery = enable
+	q.buildFlags = append([]string(nil), buildFlags...)
+}
+
+// SetWorkspaceDir runs every query from dir instead of the current directory,
+// e.g. a checkout of another revision. An empty dir restores the current
+// directory.
+func (q *BazelQuerier) SetWorkspaceDir(dir string) {
+	q.workspaceDir = dir
+}
+
+// Shutdown stops the Bazel server the querier's queries ran against. It is
+// meant for throwaway workspaces (see SetWorkspaceDir) whose server would
+// otherwise idle in the background after the workspace is removed.
+func (q *BazelQuerier) Shutdown(ctx context.Context) error {
+	args := append([]string(nil), q.startupArgs...)
+	args = append(args, "shutdown")
+	result, err := q.executor.Execute(ctx, executor.ToolConfig{
+		Command:        "bazel",
+		Args:           args,
+		WorkingDir:     q.workspaceDir,
+		CommandBuilder: &executor.ShellCommandBuilder{},
+	})
+	if err != nil {
+		return fmt.Errorf("bazel shutdown failed: %w", err)
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("bazel shutdown failed with exit code %d: %s", result.ExitCode, result.Stderr)
+	}
+	return nil
+}
+
+// Fingerprint describes every querier setting that affects which tests the
+// Find* methods return, together with the query schema version. Callers that
+// cache answers include it in their cache key, so answers computed under
+// other settings, or by a version of the tool that built its queries
+// differently, are never reused.
+func (q *BazelQuerier) Fingerprint() string {
+	// Best-effort runs swallow query errors and may cache partial answers,
+	// which strict runs must not reuse.
+	fp := fmt.Sprintf("schema=%d fail_on_error=%t subpackages=%t rdeps_flags=%s universe=%s %s",
+		querySchemaVersion, q.failOnError, q.enableSubpackageQuery, strings.Join(rdepsFlags, ","), q.universe, q.testFilterFingerprint())
+	if q.cquery {
+		fp += " cquery_flags=" + strings.Join(q.buildFlags, ",")
+	}
+	return fp
+}
+
 // collectTests runs a Bazel query and adds the results to testsSet.
 // Returns an error only when failOnError is true and the query fails with a
 // non-crash error. Bazel internal crashes are always logged and skipped so
 // callers do not escalate a transient Bazel failure into a full test fallback.
 // Extra args are forwarded to the underlying bazel query invocation.
-func (q *BazelQuerier) collectTests(queryStr, label, pkg string, testsSet map[string]bool, extraArgs ...string) error {
-	tests, err := q.query(queryStr, extraArgs...)
+func (q *BazelQuerier) collectTests(ctx context.Context, queryStr, label, pkg string, testsSet map[string]bool, extraArgs ...string) error {
+	tests, err := q.queryContext(ctx, queryStr, extraArgs...)
+	return q.addTests(tests, err, label, pkg, testsSet)
+}
+
+// collectRdepsTests is collectTests for an rdeps query. In cquery mode (see
+// SetCquery) the query runs as bazel cquery under the configured build flags.
+func (q *BazelQuerier) collectRdepsTests(ctx context.Context, queryStr, label, pkg string, testsSet map[string]bool) error {
+	if !q.cquery {
+		return q.collectTests(ctx, queryStr, label, pkg, testsSet, rdepsArgs()...)
+	}
+	tests, err := q.cqueryContext(ctx, queryStr)
+	return q.addTests(tests, err, label, pkg, testsSet)
+}
+
+// addTests adds the result of a query to testsSet, applying the error policy
+// described on collectTests.
+func (q *BazelQuerier) addTests(tests []string, err error, label, pkg string, testsSet map[string]bool) error {
 	if err != nil {
 		if errors.Is(err, errBazelCrash) {
 			slog.Warn("Bazel crashed while querying "+label+", continuing with partial results", "package", pkg, "error", err)
@@ -129,9 +257,18 @@ func (q *BazelQuerier) collectTests(queryStr, label, pkg string, testsSet map[st
 
 // FindAffectedTests finds test targets affected by changes to the given packages.
 func (q *BazelQuerier) FindAffectedTests(packages []string) ([]string, error) {
+	return q.FindAffectedTestsContext(context.Background(), packages)
+}
+
+// FindAffectedTestsContext is FindAffectedTests with a context that, when
+// canceled, aborts the in-flight and remaining Bazel queries.
+func (q *BazelQuerier) FindAffectedTestsContext(ctx context.Context, packages []string) ([]string, error) {
 	if len(packages) == 0 {
 		return nil, nil
 	}
+	if q.index != nil {
+		return q.index.AffectedTests(packages, q.enableSubpackageQuery), nil
+	}
 
 	// Deduplicate packages
 	uniquePackages := make(map[string]bool)
@@ -152,8 +289,8 @@ func (q *BazelQuerier) FindAffectedTests(packages []string) ([]string, error) {
 		slog.Debug("Processing package", "package", pkg)
 
 		// Get tests in the same package
-		if err := q.collectTests(
-			fmt.Sprintf("kind('.*_test rule', %s:*)", pkg),
+		if err := q.collectTests(ctx,
+			q.testsIn(pkg+":*"),
 			"same package tests", pkg, testsSet,
 		); err != nil {
 			return nil, err
@@ -169,8 +306,8 @@ func (q *BazelQuerier) FindAffectedTests(packages []string) ([]string, error) {
 		case pkg == "//":
 			slog.Debug("Skipping sub-package query for root package")
 		default:
-			if err := q.collectTests(
-				fmt.Sprintf("kind('.*_test rule', %s/...)", pkg),
+			if err := q.collectTests(ctx,
+				q.testsIn(pkg+"/..."),
 				"sub-package tests", pkg, testsSet,
 			); err != nil {
 				return nil, err
@@ -178,10 +315,9 @@ func (q *BazelQuerier) FindAffectedTests(packages []string) ([]string, error) {
 		}
 
 		// Get external test dependencies
-		if err := q.collectTests(
-			fmt.Sprintf("rdeps(//..., %s:*) intersect kind('.*_test rule', //...)", pkg),
+		if err := q.collectRdepsTests(ctx,
+			fmt.Sprintf("rdeps(%s, %s:*) intersect %s", q.universe, pkg, q.testsIn(q.universe)),
 			"external test deps", pkg, testsSet,
-			"--keep_going", "--nohost_deps", "--noimplicit_deps",
 		); err != nil {
 			return nil, err
 		}
@@ -195,10 +331,240 @@ func (q *BazelQuerier) FindAffectedTests(packages []string) ([]string, error) {
 	return allTests, nil
 }
 
+// FindAffectedTestsForRules finds test targets affected by changes to the
+// given rule labels. Unlike FindAffectedTests, which starts from every target
+// in a package (//pkg:*), the rdeps query starts from exactly these rules, so
+// sibling rules in the same package do not widen the selection. Test rules in
+// the input are returned as well, since rdeps includes its starting set.
+// Labels that fail ValidLabel are skipped with a warning.
+func (q *BazelQuerier) FindAffectedTestsForRules(rules []string) ([]string, error) {
+	return q.findAffectedTestsForTargets(rules, "rule")
+}
+
+// FindAffectedTestsForFiles finds test targets affected by changes to the
+// given source-file labels (see SourceFileTargets). The rdeps query starts
+// from the files themselves, so only targets that actually consume a changed
+// file are traversed, not every target of its package.
+func (q *BazelQuerier) FindAffectedTestsForFiles(files []string) ([]string, error) {
+	return q.findAffectedTestsForTargets(files, "file")
+}
+
+// findAffectedTestsForTargets runs one rdeps query starting from the set of
+// labels. kind names the labels in warnings and errors.
+func (q *BazelQuerier) findAffectedTestsForTargets(labels []string, kind string) ([]string, error) {
+	unique := make(map[string]bool)
+	for _, l := range labels {
+		if !validRulePattern.MatchString(l) {
+			slog.Warn("Skipping invalid "+kind+" label", kind, l)
+			continue
+		}
+		unique[l] = true
+	}
+	if len(unique) == 0 {
+		return nil, nil
+	}
+
+	sorted := sortedSet(unique)
+	testsSet := make(map[string]bool)
+	if err := q.collectRdepsTests(context.Background(),
+		fmt.Sprintf("rdeps(%s, set(%s)) intersect %s", q.universe, strings.Join(sorted, " "), q.testsIn(q.universe)),
+		kind+" test deps", strings.Join(sorted, ","), testsSet,
+	); err != nil {
+		return nil, err
+	}
+
+	allTests := make([]string, 0, len(testsSet))
+	for test := range testsSet {
+		allTests = append(allTests, test)
+	}
+	return allTests, nil
+}
+
+// SourceFileTargets returns the labels among fileLabels that Bazel knows as
+// source-file targets, sorted. The source files of every package involved
+// are listed with a single query:
+//
+//	kind('source file', set(//a:* //b:*))
+//
+// so a file Bazel does not know, such as unlisted data, is simply absent from
+// the result instead of failing the query. Invalid labels are skipped.
+func (q *BazelQuerier) SourceFileTargets(fileLabels []string) ([]string, error) {
+	wanted := make(map[string]bool)
+	pkgSet := make(map[string]bool)
+	for _, l := range fileLabels {
+		if !validRulePattern.MatchString(l) {
+			slog.Warn("Skipping invalid file label", "file", l)
+			continue
+		}
+		wanted[l] = true
+		pkgSet[labelPackage(l)+":*"] = true
+	}
+	if len(wanted) == 0 {
+		return nil, nil
+	}
+
+	pkgs := sortedSet(pkgSet)
+	known, err := q.query(fmt.Sprintf("kind('source file', set(%s))", strings.Join(pkgs, " ")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list source files for %s: %w", strings.Join(pkgs, ","), err)
+	}
+	found := make(map[string]bool)
+	for _, l := range known {
+		if wanted[l] {
+			found[l] = true
+		}
+	}
+	return sortedSet(found), nil
+}
+
+// FindDependentTests finds test targets outside the given packages that
+// depend on any of their targets. It is the rdeps part of FindAffectedTests
+// alone, for packages whose own tests are not wanted, such as packages that
+// only exist in an older revision the querier's workspace is checked out at.
+func (q *BazelQuerier) FindDependentTests(packages []string) ([]string, error) {
+	pkgs := uniqueValidPackages(packages)
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
+	targets := make([]string, len(pkgs))
+	inputs := make(map[string]bool, len(pkgs))
+	for i, pkg := range pkgs {
+		targets[i] = pkg + ":*"
+		inputs[pkg] = true
+	}
+
+	testsSet := make(map[string]bool)
+	if err := q.collectRdepsTests(context.Background(),
+		fmt.Sprintf("rdeps(%s, set(%s)) intersect %s", q.universe, strings.Join(targets, " "), q.testsIn(q.universe)),
+		"dependent tests", strings.Join(pkgs, ","), testsSet,
+	); err != nil {
+		return nil, err
+	}
+	for test := range testsSet {
+		if inputs[labelPackage(test)] {
+			delete(testsSet, test)
+		}
+	}
+	return sortedSet(testsSet), nil
+}
+
+// ExistingTargets returns the sorted labels among targets that exist in the
+// querier's workspace. Their packages are listed in one query,
+//
+//	set(//app:* //lib:*)
+//
+// since a set() of the labels themselves fails on the first missing one. The
+// packages must exist; invalid labels are skipped.
+func (q *BazelQuerier) ExistingTargets(targets []string) ([]string, error) {
+	var pkgs []string
+	for _, t := range targets {
+		if !validRulePattern.MatchString(t) {
+			slog.Warn("Skipping invalid target label", "target", t)
+			continue
+		}
+		pkgs = append(pkgs, labelPackage(t))
+	}
+	pkgs = uniqueValidPackages(pkgs)
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
+	patterns := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		patterns[i] = pkg + ":*"
+	}
+	listed, err := q.query(fmt.Sprintf("set(%s)", strings.Join(patterns, " ")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list targets of %s: %w", strings.Join(pkgs, ", "), err)
+	}
+	exists := make(map[string]bool, len(listed))
+	for _, l := range listed {
+		exists[l] = true
+	}
+	found := make(map[string]bool)
+	for _, t := range targets {
+		if exists[t] {
+			found[t] = true
+		}
+	}
+	return sortedSet(found), nil
+}
+
+// ConsumingRules returns the rules anywhere in the repository that take the
+// source file label as a direct input, through any attribute:
+//
+//	kind(rule, rdeps(//..., //pkg:file, 1))
+//
+// It finds consumers that file ownership misses, such as a genrule in
+// another package reading an exported template.
+func (q *BazelQuerier) ConsumingRules(fileLabel string) ([]string, error) {
+	if !validRulePattern.MatchString(fileLabel) {
+		return nil, fmt.Errorf("invalid file label %q", fileLabel)
+	}
+	rules := make(map[string]bool)
+	if err := q.collectTests(context.Background(),
+		fmt.Sprintf("kind(rule, rdeps(%s, %s, 1))", q.universe, fileLabel),
+		"consuming rules", fileLabel, rules,
+		rdepsArgs()...,
+	); err != nil {
+		return nil, err
+	}
+	return sortedSet(rules), nil
+}
+
+// validBzlPathPattern validates repo-relative .bzl paths passed to
+// rbuildfiles, which takes path fragments rather than labels.
+var validBzlPathPattern = regexp.MustCompile(`^[a-zA-Z0-9_+=,@~-][a-zA-Z0-9_./+=,@~-]*\.bzl$`)
+
+// LoadingPackages returns the sorted packages whose BUILD file loads any of
+// the repo-relative .bzl paths, directly or through other .bzl files:
+//
+//	rbuildfiles(tools/defs.bzl,lib/rules.bzl)
+//
+// rbuildfiles is a Sky Query function, so the query runs with
+// the universe as --universe_scope (see SetUniverse) and --order_output=no. Invalid paths are skipped;
+// query errors follow the policy of collectTests.
+func (q *BazelQuerier) LoadingPackages(bzlFiles []string) ([]string, error) {
+	var paths []string
+	for _, f := range sortedUnique(bzlFiles) {
+		if !validBzlPathPattern.MatchString(f) || strings.Contains(f, "..") {
+			slog.Warn("Skipping invalid .bzl path", "file", f)
+			continue
+		}
+		paths = append(paths, f)
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]bool)
+	if err := q.collectTests(context.Background(),
+		fmt.Sprintf("rbuildfiles(%s)", strings.Join(paths, ",")),
+		"loading packages", strings.Join(paths, ","), labels,
+		"--universe_scope="+q.universeScope, "--order_output=no",
+	); err != nil {
+		return nil, err
+	}
+	pkgs := make(map[string]bool)
+	for l := range labels {
+		// The result also lists the .bzl files on the load path; only BUILD
+		// files name a package.
+		pkg, name, ok := strings.Cut(l, ":")
+		if ok && (name == "BUILD" || name == "BUILD.bazel") && validPkgPattern.MatchString(pkg) {
+			pkgs[pkg] = true
+		}
+	}
+	return sortedSet(pkgs), nil
+}
+
 // query executes a single bazel query and returns non-empty output lines.
 // Extra args are inserted between the standard flags and the query string.
 func (q *BazelQuerier) query(queryStr string, extraArgs ...string) ([]string, error) {
-	raw, err := q.queryRaw(queryStr, extraArgs...)
+	return q.queryContext(context.Background(), queryStr, extraArgs...)
+}
+
+// queryContext is query with a caller-supplied parent context.
+func (q *BazelQuerier) queryContext(ctx context.Context, queryStr string, extraArgs ...string) ([]string, error) {
+	raw, err := q.queryRawContext(ctx, queryStr, extraArgs...)
 	if err != nil {
 		return nil, err
 	}
@@ -219,21 +585,64 @@ func (q *BazelQuerier) query(queryStr string, extraArgs ...string) ([]string, er
 // queryRaw runs bazel query and returns raw stdout. Empty results return "".
 // Used for non-line-oriented outputs such as --output=xml.
 func (q *BazelQuerier) queryRaw(queryStr string, extraArgs ...string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), q.queryTimeout)
+	return q.queryRawContext(context.Background(), queryStr, extraArgs...)
+}
+
+// queryRawContext is queryRaw with a caller-supplied parent context; the
+// per-query timeout is applied on top of it.
+func (q *BazelQuerier) queryRawContext(parent context.Context, queryStr string, extraArgs ...string) (string, error) {
+	return q.runQuery(parent, "query", queryStr, extraArgs...)
+}
+
+// cqueryContext runs queryStr as `bazel cquery` with the rdeps flags and the
+// configured build flags, and returns the plain labels of the configured
+// targets it printed. A target configured more than once is returned once.
+func (q *BazelQuerier) cqueryContext(ctx context.Context, queryStr string) ([]string, error) {
+	raw, err := q.runQuery(ctx, "cquery", queryStr, rdepsArgs(q.buildFlags...)...)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	for line := range strings.SplitSeq(raw, "\n") {
+		if label := plainLabel(strings.TrimSpace(line)); label != "" {
+			set[label] = true
+		}
+	}
+	if len(set) == 0 {
+		return nil, nil
+	}
+	return sortedSet(set), nil
+}
+
+// plainLabel strips the configuration cquery appends to a target label, as
+// in "//pkg:test (a1b2c3d)" or "//pkg:file.txt (null)".
+func plainLabel(configured string) string {
+	if i := strings.Index(configured, " ("); i >= 0 && strings.HasSuffix(configured, ")") {
+		return configured[:i]
+	}
+	return configured
+}
+
+// runQuery runs a bazel query-like command (query or cquery) and returns raw
+// stdout. Empty results return "".
+func (q *BazelQuerier) runQuery(parent context.Context, command, queryStr string, extraArgs ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(parent, q.queryTimeout)
 	defer cancel()
 
-	args := []string{"query"}
+	args := append([]string(nil), q.startupArgs...)
+	args = append(args, command)
 	args = append(args, extraArgs...)
 	args = append(args, queryStr)
 
 	result, err := q.executor.Execute(ctx, executor.ToolConfig{
 		Command:        "bazel",
 		Args:           args,
+		WorkingDir:     q.workspaceDir,
 		Timeout:        q.queryTimeout,
 		CommandBuilder: &executor.ShellCommandBuilder{},
 	})
 	if err != nil {
-		return "", fmt.Errorf("bazel query failed: %w", err)
+		return "", fmt.Errorf("bazel %s failed: %w", command, err)
 	}
 
 	// Check for lock contention - bazel exits with code 45 when another command is running
@@ -241,16 +650,16 @@ func (q *BazelQuerier) queryRaw(queryStr string, extraArgs ...string) (string, e
 		return "", fmt.Errorf("another bazel command is running; wait for it to complete or run 'bazel shutdown'")
 	}
 
-	// Bazel query may return non-zero exit code for empty results
+	// Bazel may return non-zero exit code for empty results
 	if result.ExitCode != 0 && result.Stderr == "" {
 		return "", nil
 	}
 
 	if result.ExitCode != 0 {
 		if isBazelCrash(result.Stderr) {
-			return "", fmt.Errorf("bazel query crashed (exit code %d): %s: %w", result.ExitCode, firstLine(result.Stderr), errBazelCrash)
+			return "", fmt.Errorf("bazel %s crashed (exit code %d): %s: %w", command, result.ExitCode, firstLine(result.Stderr), errBazelCrash)
 		}
-		return "", fmt.Errorf("bazel query failed with exit code %d: %s", result.ExitCode, result.Stderr)
+		return "", fmt.Errorf("bazel %s failed with exit code %d: %s", command, result.ExitCode, result.Stderr)
 	}
 
 	return result.Output, nil
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"os"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -1017,3 +1018,317 @@ func TestQuery_LockContentionByStderr(t *testing.T) {
 		t.Errorf("Expected error message about bazel command running, got: %v", err)
 	}
 }
+
+func TestFindAffectedTestsForRules(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., set(//pkg/foo:lib_a //pkg/foo:lib_b)) intersect kind('.*_test rule', //...)").
+		WillSucceed("//pkg/foo:a_test\n//other:dep_test", 0).
+		Once().
+		Build()
+
+	tests, err := q.FindAffectedTestsForRules([]string{"//pkg/foo:lib_b", "//pkg/foo:lib_a", "//pkg/foo:lib_b"})
+	if err != nil {
+		t.Fatalf("FindAffectedTestsForRules failed: %v", err)
+	}
+	sort.Strings(tests)
+	want := []string{"//other:dep_test", "//pkg/foo:a_test"}
+	if strings.Join(tests, ",") != strings.Join(want, ",") {
+		t.Errorf("FindAffectedTestsForRules() = %v, want %v", tests, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestFindAffectedTestsForRules_SkipsInvalidLabels(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	tests, err := q.FindAffectedTestsForRules([]string{"//pkg/foo", "//pkg:a b", "//pkg:x) union //..."})
+	if err != nil {
+		t.Fatalf("FindAffectedTestsForRules failed: %v", err)
+	}
+	if len(tests) != 0 {
+		t.Errorf("Expected no tests, got %v", tests)
+	}
+	if n := len(mockExec.GetCallHistory()); n != 0 {
+		t.Errorf("Expected no command executions, got %d", n)
+	}
+}
+
+func TestFindAffectedTestsForFiles(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., set(//pkg/foo:a.go //pkg/foo:sub/b.go)) intersect kind('.*_test rule', //...)").
+		WillSucceed("//pkg/foo:a_test", 0).
+		Once().
+		Build()
+
+	tests, err := q.FindAffectedTestsForFiles([]string{"//pkg/foo:sub/b.go", "//pkg/foo:a.go", "//pkg:a b"})
+	if err != nil {
+		t.Fatalf("FindAffectedTestsForFiles failed: %v", err)
+	}
+	if want := []string{"//pkg/foo:a_test"}; strings.Join(tests, ",") != strings.Join(want, ",") {
+		t.Errorf("FindAffectedTestsForFiles() = %v, want %v", tests, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestSourceFileTargets(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('source file', set(//pkg/bar:* //pkg/foo:*))").
+		WillSucceed("//pkg/bar:BUILD\n//pkg/bar:c.go\n//pkg/foo:a.go\n//pkg/foo:other.go", 0).
+		Once().
+		Build()
+
+	got, err := q.SourceFileTargets([]string{"//pkg/foo:a.go", "//pkg/foo:data.json", "//pkg/bar:c.go", "//pkg:a b"})
+	if err != nil {
+		t.Fatalf("SourceFileTargets failed: %v", err)
+	}
+	if want := []string{"//pkg/bar:c.go", "//pkg/foo:a.go"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("SourceFileTargets() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestSourceFileTargets_QueryError(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('source file', set(//pkg/foo:*))").
+		WillFail("ERROR: no such package 'pkg/foo'", 7).
+		Once().
+		Build()
+
+	if _, err := q.SourceFileTargets([]string{"//pkg/foo:a.go"}); err == nil {
+		t.Error("SourceFileTargets() error = nil, want error")
+	}
+}
+
+func TestLoadingPackages(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--universe_scope=//...", "--order_output=no",
+		"rbuildfiles(lib/rules.bzl,tools/defs.bzl)").
+		WillSucceed("//app:BUILD.bazel\n//lib:rules.bzl\n//lib:BUILD\n//:BUILD\n//tools:defs.bzl", 0).
+		Once().
+		Build()
+
+	got, err := q.LoadingPackages([]string{"tools/defs.bzl", "lib/rules.bzl", "tools/defs.bzl", "../x.bzl", "a b.bzl"})
+	if err != nil {
+		t.Fatalf("LoadingPackages failed: %v", err)
+	}
+	if want := []string{"//", "//app", "//lib"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("LoadingPackages() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestFindDependentTests(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps(//..., set(//pkg/a:* //pkg/gone:*)) intersect kind('.*_test rule', //...)").
+		WillSucceed("//pkg/gone:gone_test\n//other:dep_test\n//pkg/a:a_test", 0).
+		Once().
+		Build()
+
+	tests, err := q.FindDependentTests([]string{"//pkg/gone", "//pkg/a", "//pkg/gone"})
+	if err != nil {
+		t.Fatalf("FindDependentTests failed: %v", err)
+	}
+	want := []string{"//other:dep_test"}
+	if strings.Join(tests, ",") != strings.Join(want, ",") {
+		t.Errorf("FindDependentTests() = %v, want %v", tests, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestSetOutputBase_PrependsStartupOption(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetOutputBase("/tmp/ob/worker-1")
+
+	mockExec.ExpectCommandWithArgs("bazel", "--output_base=/tmp/ob/worker-1", "query", "//...").
+		WillSucceed("//test:target", 0).
+		Once().
+		Build()
+
+	if _, err := q.query("//..."); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestFindAffectedTestsContext_Canceled(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetFailOnError(true)
+
+	var seen context.Context
+	mockExec.ExpectCustom(func(ctx context.Context, _ executor.ToolConfig) bool {
+		seen = ctx
+		return true
+	}).WillError(context.Canceled).Build()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.FindAffectedTestsContext(ctx, []string{"//pkg/foo"}); err == nil {
+		t.Fatal("expected error for canceled context")
+	}
+	if seen == nil || seen.Err() == nil {
+		t.Error("expected the executor to receive the canceled context")
+	}
+}
+
+func TestBazelQuerier_Fingerprint(t *testing.T) {
+	q := NewBazelQuerierWithExecutor(executor.NewMockExecutor())
+	base := q.Fingerprint()
+	if !strings.Contains(base, "--keep_going,--nohost_deps,--noimplicit_deps") {
+		t.Errorf("Fingerprint() = %q, want it to include the rdeps flags", base)
+	}
+
+	q.SetEnableSubpackageQuery(false)
+	if q.Fingerprint() == base {
+		t.Error("Fingerprint() should change when sub-package queries are disabled")
+	}
+
+	// Settings that only affect where or how long queries run do not change
+	// the answer, so they must not split the cache.
+	q.SetEnableSubpackageQuery(true)
+	q.SetQueryTimeout(time.Minute)
+	q.SetOutputBase("/tmp/ob")
+	if q.Fingerprint() != base {
+		t.Error("Fingerprint() should not depend on timeout or output base")
+	}
+
+	q.SetFailOnError(!q.failOnError)
+	if q.Fingerprint() == base {
+		t.Error("Fingerprint() should change with the query error policy")
+	}
+	q.SetFailOnError(!q.failOnError)
+
+	q.SetCquery(true, []string{"--config=linux"})
+	linux := q.Fingerprint()
+	if linux == base {
+		t.Error("Fingerprint() should change in cquery mode")
+	}
+	q.SetCquery(true, []string{"--config=macos"})
+	if q.Fingerprint() == linux {
+		t.Error("Fingerprint() should change with the cquery build flags")
+	}
+
+	q.SetCquery(false, nil)
+	q.SetUniverse(nil)
+	if q.Fingerprint() != base {
+		t.Error("Fingerprint() should not change with the default universe")
+	}
+	q.SetUniverse([]string{"//...", "-//third_party/..."})
+	if q.Fingerprint() == base {
+		t.Error("Fingerprint() should change with the universe")
+	}
+}
+
+func TestFindAffectedTests_Cquery(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', //pkg/foo:*)").
+		WillSucceed("//pkg/foo:foo_test", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "cquery", "--keep_going", "--nohost_deps", "--noimplicit_deps", "--config=linux",
+		"rdeps(//..., //pkg/foo:*) intersect kind('.*_test rule', //...)").
+		WillSucceed("//pkg/foo:foo_test (a1b2c3)\n//app:app_test (a1b2c3)\n//app:app_test (d4e5f6)", 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetEnableSubpackageQuery(false)
+	q.SetCquery(true, []string{"--config=linux"})
+
+	got, err := q.FindAffectedTests([]string{"//pkg/foo"})
+	if err != nil {
+		t.Fatalf("FindAffectedTests() error = %v", err)
+	}
+	sort.Strings(got)
+	want := []string{"//app:app_test", "//pkg/foo:foo_test"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAffectedTests() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestPlainLabel(t *testing.T) {
+	tests := map[string]string{
+		"//pkg:test (a1b2c3d)":   "//pkg:test",
+		"//pkg:file.txt (null)":  "//pkg:file.txt",
+		"@repo//pkg:lib (8f2e1)": "@repo//pkg:lib",
+		"//pkg:test":             "//pkg:test",
+		"":                       "",
+	}
+	for in, want := range tests {
+		if got := plainLabel(in); got != want {
+			t.Errorf("plainLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestExistingTargets(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "set(//app:* //lib:*)").
+		WillSucceed("//app:app_test\n//app:main.go\n//lib:lib_test", 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := q.ExistingTargets([]string{"//lib:lib_test", "//app:legacy_test", "//app:app_test", "//app:a b"})
+	if err != nil {
+		t.Fatalf("ExistingTargets() error = %v", err)
+	}
+	if want := []string{"//app:app_test", "//lib:lib_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExistingTargets() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestConsumingRules(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"kind(rule, rdeps(//..., //pkg/foo:api.tmpl, 1))").
+		WillSucceed("//pkg/foo:gen\n//other:gen", 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := q.ConsumingRules("//pkg/foo:api.tmpl")
+	if err != nil {
+		t.Fatalf("ConsumingRules() error = %v", err)
+	}
+	if want := []string{"//other:gen", "//pkg/foo:gen"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ConsumingRules() = %v, want %v", got, want)
+	}
+	if _, err := q.ConsumingRules("//pkg/foo:a b.tmpl"); err == nil {
+		t.Error("ConsumingRules() should reject labels with spaces")
+	}
+}
@@ -0,0 +1,219 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// TestIndex is a precomputed reverse-dependency index: for every package in
+// the repository, the tests that depend on one of its targets. It is built
+// from two queries over the whole repository and then answers
+// FindAffectedTests for any package set in-process, without further Bazel
+// invocations. An index is only valid for the BUILD files it was built from,
+// so callers store it under the same cache key as per-package results.
+type TestIndex struct {
+	// Tests lists every test label, sorted.
+	Tests []string `json:"tests"`
+	// Packages maps a package to the indices in Tests of the tests that
+	// depend on one of its targets, including the package's own tests.
+	Packages map[string][]int `json:"packages"`
+}
+
+// BuildTestIndex queries every test and the dependency graph of all tests,
+// with the same flags, universe and test filter (see SetUniverse and
+// SetTestFilter) as the rdeps query of FindAffectedTests, and inverts it into
+// a TestIndex:
+//
+//	kind('.*_test rule', //...)
+//	deps(kind('.*_test rule', //...))  (--output=graph)
+func (q *BazelQuerier) BuildTestIndex() (*TestIndex, error) {
+	if q.cquery {
+		return nil, errors.New("the reverse-dependency index cannot be built in cquery mode")
+	}
+	tests, err := q.query(q.testsIn(q.universe))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tests for index: %w", err)
+	}
+	raw, err := q.queryRaw(
+		fmt.Sprintf("deps(%s)", q.testsIn(q.universe)),
+		rdepsArgs("--output=graph", "--nograph:factored", "--graph:node_limit=-1")...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query test dependency graph for index: %w", err)
+	}
+	return buildTestIndex(tests, raw), nil
+}
+
+// buildTestIndex inverts the unfactored dependency graph of tests. Each node
+// is labeled with the set of tests that reach it, propagated from dependents
+// to dependencies in topological order; nodes on a cycle are settled by
+// iterating to a fixed point. External targets (@repo//...) are skipped: the
+// rdeps query only starts from packages in the main repository.
+func buildTestIndex(tests []string, raw string) *TestIndex {
+	tests = sortedUnique(tests)
+	testIdx := make(map[string]int, len(tests))
+	for i, t := range tests {
+		testIdx[t] = i
+	}
+	words := (len(tests) + 63) / 64
+
+	deps := make(map[string][]string)
+	indegree := make(map[string]int)
+	for line := range strings.SplitSeq(raw, "\n") {
+		m := graphEdgePattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		from, to := m[1], m[2]
+		deps[from] = append(deps[from], to)
+		indegree[to]++
+		if _, ok := indegree[from]; !ok {
+			indegree[from] = 0
+		}
+	}
+
+	reach := make(map[string][]uint64, len(indegree))
+	bitsFor := func(node string) []uint64 {
+		b, ok := reach[node]
+		if !ok {
+			b = make([]uint64, words)
+			reach[node] = b
+		}
+		return b
+	}
+	for t, i := range testIdx {
+		bitsFor(t)[i/64] |= 1 << (i % 64)
+	}
+
+	var queue []string
+	for node, n := range indegree {
+		if n == 0 {
+			queue = append(queue, node)
+		}
+	}
+	for len(queue) > 0 {
+		node := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		src := bitsFor(node)
+		for _, d := range deps[node] {
+			orInto(bitsFor(d), src)
+			indegree[d]--
+			if indegree[d] == 0 {
+				queue = append(queue, d)
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for node, n := range indegree {
+			if n <= 0 {
+				continue
+			}
+			for _, d := range deps[node] {
+				changed = orInto(bitsFor(d), bitsFor(node)) || changed
+			}
+		}
+	}
+
+	pkgBits := make(map[string][]uint64)
+	for node, b := range reach {
+		if strings.HasPrefix(node, "@") {
+			continue
+		}
+		pkg := labelPackage(node)
+		dst, ok := pkgBits[pkg]
+		if !ok {
+			dst = make([]uint64, words)
+			pkgBits[pkg] = dst
+		}
+		orInto(dst, b)
+	}
+
+	idx := &TestIndex{Tests: tests, Packages: make(map[string][]int, len(pkgBits))}
+	for pkg, b := range pkgBits {
+		var members []int
+		for w, word := range b {
+			for word != 0 {
+				members = append(members, w*64+bits.TrailingZeros64(word))
+				word &= word - 1
+			}
+		}
+		if len(members) > 0 {
+			idx.Packages[pkg] = members
+		}
+	}
+	return idx
+}
+
+// orInto sets dst |= src and reports whether dst changed.
+func orInto(dst, src []uint64) bool {
+	changed := false
+	for i, w := range src {
+		if dst[i]|w != dst[i] {
+			dst[i] |= w
+			changed = true
+		}
+	}
+	return changed
+}
+
+// AffectedTests answers FindAffectedTests for packages from the index: the
+// tests depending on each package (its own tests included) and, when
+// subpackages is set, the tests below each non-root package.
+func (idx *TestIndex) AffectedTests(packages []string, subpackages bool) []string {
+	set := make(map[string]bool)
+	for _, pkg := range uniqueValidPackages(packages) {
+		for test := range idx.packageTests(pkg, subpackages) {
+			set[test] = true
+		}
+	}
+	return sortedSet(set)
+}
+
+// packageTests returns the tests selected for a single package.
+func (idx *TestIndex) packageTests(pkg string, subpackages bool) map[string]bool {
+	set := make(map[string]bool)
+	for _, i := range idx.Packages[pkg] {
+		if i >= 0 && i < len(idx.Tests) {
+			set[idx.Tests[i]] = true
+		}
+	}
+	if subpackages && pkg != "//" {
+		// Tests is sorted, so the tests below pkg are one contiguous run.
+		prefix := pkg + "/"
+		for i := sort.SearchStrings(idx.Tests, prefix); i < len(idx.Tests) && strings.HasPrefix(idx.Tests[i], prefix); i++ {
+			set[idx.Tests[i]] = true
+		}
+	}
+	return set
+}
+
+// Encode serializes the index for storage in the cache.
+func (idx *TestIndex) Encode() ([]byte, error) {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode test index: %w", err)
+	}
+	return data, nil
+}
+
+// DecodeTestIndex parses an index serialized by Encode.
+func DecodeTestIndex(data []byte) (*TestIndex, error) {
+	var idx TestIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to decode test index: %w", err)
+	}
+	return &idx, nil
+}
+
+// SetIndex makes FindAffectedTests and FindAffectedTestsBatched answer from
+// idx instead of running Bazel queries. Rule-level and dependent-test queries
+// are not covered by the index and still run Bazel. A nil idx restores
+// querying.
+func (q *BazelQuerier) SetIndex(idx *TestIndex) {
+	q.index = idx
+}
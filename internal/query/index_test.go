@@ -0,0 +1,146 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+// indexGraph has a cycle between //lib/x and //lib/y and an external
+// dependency that must not appear in the index.
+const indexGraph = `digraph mygraph {
+  node [shape=box];
+  "//app:app_test"
+  "//app:app_test" -> "//app:lib"
+  "//app:lib"
+  "//app:lib" -> "//lib/x:x"
+  "//lib/x:x"
+  "//lib/x:x" -> "//lib/y:y"
+  "//lib/y:y"
+  "//lib/y:y" -> "//lib/x:x"
+  "//lib/y:y" -> "@ext//:dep"
+  "//lib/y:y_test"
+  "//lib/y:y_test" -> "//lib/y:y"
+  "//lib/y/sub:sub_test"
+  "//other:other_test"
+}
+`
+
+var indexTests = []string{"//app:app_test", "//lib/y/sub:sub_test", "//lib/y:y_test", "//other:other_test"}
+
+func TestBuildTestIndex(t *testing.T) {
+	idx := buildTestIndex(indexTests, indexGraph)
+
+	tests := []struct {
+		pkg  string
+		want []string
+	}{
+		{"//app", []string{"//app:app_test"}},
+		{"//lib/x", []string{"//app:app_test", "//lib/y:y_test"}},
+		{"//lib/y", []string{"//app:app_test", "//lib/y:y_test"}},
+		{"//other", []string{"//other:other_test"}},
+		{"//missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pkg, func(t *testing.T) {
+			got := idx.AffectedTests([]string{tt.pkg}, false)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AffectedTests(%s) = %v, want %v", tt.pkg, got, tt.want)
+			}
+		})
+	}
+	if _, ok := idx.Packages["@ext//"]; ok {
+		t.Error("index should not contain external packages")
+	}
+}
+
+func TestTestIndex_AffectedTestsSubpackages(t *testing.T) {
+	idx := buildTestIndex(indexTests, indexGraph)
+
+	got := idx.AffectedTests([]string{"//lib/y", "//other"}, true)
+	want := []string{"//app:app_test", "//lib/y/sub:sub_test", "//lib/y:y_test", "//other:other_test"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AffectedTests() = %v, want %v", got, want)
+	}
+
+	// The root package never selects every test through sub-packages.
+	if got := idx.AffectedTests([]string{"//"}, true); len(got) != 0 {
+		t.Errorf("AffectedTests(//) = %v, want none", got)
+	}
+}
+
+func TestTestIndex_EncodeRoundTrip(t *testing.T) {
+	idx := buildTestIndex(indexTests, indexGraph)
+	data, err := idx.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	decoded, err := DecodeTestIndex(data)
+	if err != nil {
+		t.Fatalf("DecodeTestIndex() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded, idx) {
+		t.Errorf("DecodeTestIndex() = %+v, want %+v", decoded, idx)
+	}
+	if _, err := DecodeTestIndex([]byte("{")); err == nil {
+		t.Error("DecodeTestIndex() of truncated data should fail")
+	}
+}
+
+func TestBuildTestIndex_Queries(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', //...)").
+		WillSucceed("//app:app_test\n//lib/y:y_test\n//lib/y/sub:sub_test\n//other:other_test", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"--output=graph", "--nograph:factored", "--graph:node_limit=-1",
+		"deps(kind('.*_test rule', //...))").
+		WillSucceed(indexGraph, 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	idx, err := q.BuildTestIndex()
+	if err != nil {
+		t.Fatalf("BuildTestIndex() error = %v", err)
+	}
+	if !reflect.DeepEqual(idx.Tests, indexTests) {
+		t.Errorf("Tests = %v, want %v", idx.Tests, indexTests)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestFindAffectedTests_AnswersFromIndex(t *testing.T) {
+	// No expectations: any Bazel invocation fails the lookup.
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetIndex(buildTestIndex(indexTests, indexGraph))
+
+	got, err := q.FindAffectedTests([]string{"//lib/x"})
+	if err != nil {
+		t.Fatalf("FindAffectedTests() error = %v", err)
+	}
+	want := []string{"//app:app_test", "//lib/y:y_test"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAffectedTests() = %v, want %v", got, want)
+	}
+
+	batched, err := q.FindAffectedTestsBatched([]string{"//lib/y", "//other"})
+	if err != nil {
+		t.Fatalf("FindAffectedTestsBatched() error = %v", err)
+	}
+	wantBatched := map[string][]string{
+		"//lib/y": {"//app:app_test", "//lib/y/sub:sub_test", "//lib/y:y_test"},
+		"//other": {"//other:other_test"},
+	}
+	if !reflect.DeepEqual(batched, wantBatched) {
+		t.Errorf("FindAffectedTestsBatched() = %v, want %v", batched, wantBatched)
+	}
+}
@@ -0,0 +1,100 @@
+package query
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// PackageBuildInputs returns the repo-relative BUILD and .bzl files that the
+// FindAffectedTests answer for pkg depends on: the build files of pkg, of its
+// sub-packages (when the sub-package query is enabled) and of every package
+// with a reverse dependency on it, plus the .bzl files they load. External
+// repository files are omitted.
+//
+// The set is what incremental cache entries are validated against. It cannot
+// see a BUILD file outside the set that gains a new dependency on pkg; such an
+// edit goes unnoticed until one of the recorded files changes.
+func (q *BazelQuerier) PackageBuildInputs(pkg string) ([]string, error) {
+	if !validPkgPattern.MatchString(pkg) {
+		return nil, fmt.Errorf("invalid package label %q", pkg)
+	}
+	expr := fmt.Sprintf("rdeps(%s, %s:*)", q.universe, pkg)
+	if q.enableSubpackageQuery && pkg != "//" {
+		expr += fmt.Sprintf(" union %s/...", pkg)
+	}
+	return q.buildFileInputs(expr, pkg)
+}
+
+// PackagesBuildInputs is PackageBuildInputs for several packages with one
+// query over the union of their answers, for FindAffectedTestsBatched:
+//
+//	buildfiles(rdeps(//..., set(//a:* //b:*)) union set(//a/... //b/...))
+//
+// The result is the union of the packages' input sets. Recorded for each of
+// them it is a superset of that package's own set, so an edit can invalidate
+// entries it does not concern, but none that it does.
+func (q *BazelQuerier) PackagesBuildInputs(pkgs []string) ([]string, error) {
+	var targets, subpackages []string
+	for _, pkg := range pkgs {
+		if !validPkgPattern.MatchString(pkg) {
+			return nil, fmt.Errorf("invalid package label %q", pkg)
+		}
+		targets = append(targets, pkg+":*")
+		if q.enableSubpackageQuery && pkg != "//" {
+			subpackages = append(subpackages, pkg+"/...")
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	expr := fmt.Sprintf("rdeps(%s, set(%s))", q.universe, strings.Join(targets, " "))
+	if len(subpackages) > 0 {
+		expr += fmt.Sprintf(" union set(%s)", strings.Join(subpackages, " "))
+	}
+	return q.buildFileInputs(expr, strings.Join(pkgs, ","))
+}
+
+// RuleBuildInputs is PackageBuildInputs for the rule-granularity answer of
+// FindAffectedTestsForRules: the build files of every reverse dependency of
+// rules. It accepts the source-file labels of FindAffectedTestsForFiles too.
+func (q *BazelQuerier) RuleBuildInputs(rules []string) ([]string, error) {
+	for _, r := range rules {
+		if !validRulePattern.MatchString(r) {
+			return nil, fmt.Errorf("invalid rule label %q", r)
+		}
+	}
+	return q.buildFileInputs(fmt.Sprintf("rdeps(%s, set(%s))", q.universe, strings.Join(rules, " ")), strings.Join(rules, ","))
+}
+
+func (q *BazelQuerier) buildFileInputs(expr, label string) ([]string, error) {
+	labels, err := q.query(fmt.Sprintf("buildfiles(%s)", expr), "--nohost_deps", "--noimplicit_deps")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query build file inputs for %s: %w", label, err)
+	}
+	inputs := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		p, ok := labelPath(l)
+		if !ok {
+			slog.Debug("Skipping non-workspace build file", "label", l)
+			continue
+		}
+		inputs[p] = true
+	}
+	return sortedSet(inputs), nil
+}
+
+// labelPath converts a main-repository file label to its repo-relative path
+// ("//a/b:defs.bzl" -> "a/b/defs.bzl", "//:BUILD" -> "BUILD"). Labels in
+// external repositories are reported as not ok.
+func labelPath(label string) (string, bool) {
+	if !strings.HasPrefix(label, "//") {
+		return "", false
+	}
+	pkg, name, ok := strings.Cut(strings.TrimPrefix(label, "//"), ":")
+	if !ok || name == "" {
+		return "", false
+	}
+	return path.Join(pkg, name), true
+}
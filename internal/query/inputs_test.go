@@ -0,0 +1,81 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+func TestPackageBuildInputs(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--nohost_deps", "--noimplicit_deps",
+		"buildfiles(rdeps(//..., //pkg/foo:*) union //pkg/foo/...)").
+		WillSucceed("//pkg/foo:BUILD.bazel\n//app:BUILD\n//tools:defs.bzl\n@bazel_tools//tools/build_defs:cc.bzl\n//:BUILD\n", 0).
+		Once().
+		Build()
+
+	got, err := q.PackageBuildInputs("//pkg/foo")
+	if err != nil {
+		t.Fatalf("PackageBuildInputs failed: %v", err)
+	}
+	want := []string{"BUILD", "app/BUILD", "pkg/foo/BUILD.bazel", "tools/defs.bzl"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PackageBuildInputs() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestPackageBuildInputs_RootAndNoSubpackages(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetEnableSubpackageQuery(false)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--nohost_deps", "--noimplicit_deps",
+		"buildfiles(rdeps(//..., //pkg:*))").
+		WillSucceed("//pkg:BUILD\n", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--nohost_deps", "--noimplicit_deps",
+		"buildfiles(rdeps(//..., //:*))").
+		WillSucceed("//:BUILD\n", 0).
+		Once().
+		Build()
+
+	if _, err := q.PackageBuildInputs("//pkg"); err != nil {
+		t.Fatalf("PackageBuildInputs failed: %v", err)
+	}
+	if _, err := q.PackageBuildInputs("//"); err != nil {
+		t.Fatalf("PackageBuildInputs failed: %v", err)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestRuleBuildInputs(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--nohost_deps", "--noimplicit_deps",
+		"buildfiles(rdeps(//..., set(//pkg:a //pkg:b)))").
+		WillSucceed("//pkg:BUILD\n", 0).
+		Once().
+		Build()
+
+	got, err := q.RuleBuildInputs([]string{"//pkg:a", "//pkg:b"})
+	if err != nil {
+		t.Fatalf("RuleBuildInputs failed: %v", err)
+	}
+	if want := []string{"pkg/BUILD"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RuleBuildInputs() = %v, want %v", got, want)
+	}
+
+	if _, err := q.RuleBuildInputs([]string{"//pkg:a) union //..."}); err == nil {
+		t.Error("expected error for invalid rule label")
+	}
+}
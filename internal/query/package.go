@@ -19,6 +19,51 @@ const UnlimitedParentDepth = -1
 // own directory is considered. maxDepth=UnlimitedParentDepth (-1) disables
 // the cap and walks all the way to the repo root.
 func FindBazelPackage(repoRoot, filePath string, maxDepth int) (string, bool) {
+	return findPackage(filePath, maxDepth, func(dir string) bool {
+		return hasBuildFile(filepath.Join(repoRoot, dir))
+	})
+}
+
+// FindBazelPackageAt is FindBazelPackage against a recorded BUILD layout
+// instead of the working tree. buildDirs holds the slash-separated,
+// repo-relative directories that contain a BUILD or BUILD.bazel file, with
+// "." for the repository root (see git.BuildDirsAt). It resolves files whose
+// package has since been removed from the working tree.
+func FindBazelPackageAt(buildDirs map[string]bool, filePath string, maxDepth int) (string, bool) {
+	return findPackage(filePath, maxDepth, func(dir string) bool {
+		return buildDirs[filepath.ToSlash(dir)]
+	})
+}
+
+// SourceFileLabel returns the label of the repo-relative file in package pkg,
+// e.g. ("//pkg/foo", "pkg/foo/sub/a.tmpl") -> "//pkg/foo:sub/a.tmpl". It
+// returns "" if the file does not lie below the package directory.
+func SourceFileLabel(pkg, file string) string {
+	dir := strings.TrimPrefix(pkg, "//")
+	name := file
+	if dir != "" {
+		var ok bool
+		if name, ok = strings.CutPrefix(file, dir+"/"); !ok {
+			return ""
+		}
+	}
+	if name == "" {
+		return ""
+	}
+	return pkg + ":" + name
+}
+
+// PackageExists reports whether the package label (e.g. "//foo/bar") has a
+// BUILD or BUILD.bazel file in the working tree under repoRoot.
+func PackageExists(repoRoot, pkg string) bool {
+	dir := strings.TrimPrefix(pkg, "//")
+	return hasBuildFile(filepath.Join(repoRoot, filepath.FromSlash(dir)))
+}
+
+// findPackage walks up from filePath's directory, asking hasBuild about each
+// repo-relative directory ("." for the root), and returns the first package
+// found within maxDepth hops.
+func findPackage(filePath string, maxDepth int, hasBuild func(dir string) bool) (string, bool) {
 	dir := filepath.Dir(filePath)
 	hops := 0
 
@@ -26,7 +71,7 @@ func FindBazelPackage(repoRoot, filePath string, maxDepth int) (string, bool) {
 		if maxDepth != UnlimitedParentDepth && hops > maxDepth {
 			return "", false
 		}
-		if hasBuildFile(filepath.Join(repoRoot, dir)) {
+		if hasBuild(dir) {
 			return "//" + strings.ReplaceAll(dir, string(filepath.Separator), "/"), true
 		}
 		dir = filepath.Dir(dir)
@@ -36,7 +81,7 @@ func FindBazelPackage(repoRoot, filePath string, maxDepth int) (string, bool) {
 	if maxDepth != UnlimitedParentDepth && hops > maxDepth {
 		return "", false
 	}
-	if hasBuildFile(repoRoot) {
+	if hasBuild(".") {
 		return "//", true
 	}
 
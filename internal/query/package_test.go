@@ -127,3 +127,75 @@ func TestFindBazelPackage(t *testing.T) {
 		})
 	}
 }
+
+func TestFindBazelPackageAt(t *testing.T) {
+	buildDirs := map[string]bool{
+		".":           true,
+		"src":         true,
+		"src/removed": true,
+	}
+
+	tests := []struct {
+		name      string
+		file      string
+		maxDepth  int
+		wantPkg   string
+		wantFound bool
+	}{
+		{name: "file in recorded package", file: "src/removed/file.go", maxDepth: 0, wantPkg: "//src/removed", wantFound: true},
+		{name: "deleted BUILD file", file: "src/removed/BUILD", maxDepth: 0, wantPkg: "//src/removed", wantFound: true},
+		{name: "walks up to parent", file: "src/other/file.go", maxDepth: 1, wantPkg: "//src", wantFound: true},
+		{name: "depth cap", file: "src/a/b/file.go", maxDepth: 1, wantFound: false},
+		{name: "root package", file: "main.go", maxDepth: 0, wantPkg: "//", wantFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPkg, gotFound := FindBazelPackageAt(buildDirs, tt.file, tt.maxDepth)
+			if gotPkg != tt.wantPkg || gotFound != tt.wantFound {
+				t.Errorf("FindBazelPackageAt(%q, %d) = (%q, %v), want (%q, %v)",
+					tt.file, tt.maxDepth, gotPkg, gotFound, tt.wantPkg, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestPackageExists(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpDir, "src", "lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, buildFile := range []string{"BUILD", filepath.Join("src", "lib", "BUILD.bazel")} {
+		if _, err := os.Create(filepath.Join(tmpDir, buildFile)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for pkg, want := range map[string]bool{
+		"//":        true,
+		"//src/lib": true,
+		"//src":     false,
+		"//gone":    false,
+	} {
+		if got := PackageExists(tmpDir, pkg); got != want {
+			t.Errorf("PackageExists(%q) = %v, want %v", pkg, got, want)
+		}
+	}
+}
+
+func TestSourceFileLabel(t *testing.T) {
+	tests := []struct {
+		pkg, file, want string
+	}{
+		{"//pkg/foo", "pkg/foo/a.go", "//pkg/foo:a.go"},
+		{"//pkg/foo", "pkg/foo/sub/a.tmpl", "//pkg/foo:sub/a.tmpl"},
+		{"//", "README.md", "//:README.md"},
+		{"//pkg/foo", "pkg/foobar/a.go", ""},
+		{"//pkg/foo", "pkg/foo", ""},
+	}
+	for _, tt := range tests {
+		if got := SourceFileLabel(tt.pkg, tt.file); got != tt.want {
+			t.Errorf("SourceFileLabel(%q, %q) = %q, want %q", tt.pkg, tt.file, got, tt.want)
+		}
+	}
+}
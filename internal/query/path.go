@@ -0,0 +1,83 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DependencyPath returns one dependency chain from test to a target in pkg,
+// starting with test and ending with the pkg target it reaches, using
+// somepath(test, pkg:*). The query follows dependency edges, so the test is
+// the start of the path and the changed package the end. It returns nil when
+// test does not depend on pkg. Host and implicit dependencies are ignored, as
+// in the rdeps query of FindAffectedTests.
+//
+// The rdeps query only returns tests inside the universe (see SetUniverse),
+// so with a universe other than DefaultUniverse the start of the path is
+// scoped to it, e.g. somepath(//app:app_test intersect (//... - //app/...),
+// //lib:*), and a test outside the universe has no path.
+func (q *BazelQuerier) DependencyPath(test, pkg string) ([]string, error) {
+	if !validRulePattern.MatchString(test) {
+		return nil, fmt.Errorf("invalid test label %q", test)
+	}
+	if !validPkgPattern.MatchString(pkg) {
+		return nil, fmt.Errorf("invalid package label %q", pkg)
+	}
+	from := test
+	if q.universe != DefaultUniverse {
+		from = fmt.Sprintf("%s intersect %s", test, q.universe)
+	}
+	raw, err := q.queryRaw(
+		fmt.Sprintf("somepath(%s, %s:*)", from, pkg),
+		rdepsArgs("--output=graph", "--nograph:factored")...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query path from %s to %s: %w", test, pkg, err)
+	}
+	return shortestGraphPath(raw, test, pkg), nil
+}
+
+// shortestGraphPath parses unfactored `--output=graph` output and returns the
+// shortest edge path from start to any node in pkg, or nil if there is none.
+// The somepath result is usually a single chain, but the graph output also
+// includes any edges between its nodes, so a breadth-first search keeps the
+// reported path minimal and deterministic.
+func shortestGraphPath(raw, start, pkg string) []string {
+	deps := make(map[string][]string)
+	for line := range strings.SplitSeq(raw, "\n") {
+		m := graphEdgePattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		deps[m[1]] = append(deps[m[1]], m[2])
+	}
+
+	prev := map[string]string{start: ""}
+	queue := []string{start}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if labelPackage(node) == pkg {
+			var path []string
+			for n := node; n != ""; n = prev[n] {
+				path = append([]string{n}, path...)
+			}
+			return path
+		}
+		for _, d := range sortedUnique(deps[node]) {
+			if _, seen := prev[d]; !seen {
+				prev[d] = node
+				queue = append(queue, d)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedUnique(values []string) []string {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return sortedSet(set)
+}
@@ -0,0 +1,104 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+func TestDependencyPath(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	graph := `digraph mygraph {
+  node [shape=box];
+  "//app:app_test"
+  "//app:app_test" -> "//app:lib"
+  "//app:app_test" -> "//pkg/foo:foo"
+  "//app:lib" -> "//pkg/foo:foo"
+  "//pkg/foo:foo"
+}
+`
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"--output=graph", "--nograph:factored", "somepath(//app:app_test, //pkg/foo:*)").
+		WillSucceed(graph, 0).
+		Once().
+		Build()
+
+	got, err := q.DependencyPath("//app:app_test", "//pkg/foo")
+	if err != nil {
+		t.Fatalf("DependencyPath failed: %v", err)
+	}
+	want := []string{"//app:app_test", "//pkg/foo:foo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DependencyPath() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestDependencyPath_NoPath(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"--output=graph", "--nograph:factored", "somepath(//app:app_test, //:*)").
+		WillSucceed("digraph mygraph {\n  node [shape=box];\n}\n", 0).
+		Once().
+		Build()
+
+	got, err := q.DependencyPath("//app:app_test", "//")
+	if err != nil {
+		t.Fatalf("DependencyPath failed: %v", err)
+	}
+	if got != nil {
+		t.Errorf("DependencyPath() = %v, want nil", got)
+	}
+}
+
+func TestDependencyPath_Universe(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetUniverse([]string{"//...", "-//app/..."})
+
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"--output=graph", "--nograph:factored", "somepath(//app:app_test intersect (//... - //app/...), //pkg/foo:*)").
+		WillSucceed("digraph mygraph {\n  node [shape=box];\n}\n", 0).
+		Once().
+		Build()
+
+	got, err := q.DependencyPath("//app:app_test", "//pkg/foo")
+	if err != nil {
+		t.Fatalf("DependencyPath failed: %v", err)
+	}
+	if got != nil {
+		t.Errorf("DependencyPath() = %v, want nil for a test outside the universe", got)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestDependencyPath_InvalidLabels(t *testing.T) {
+	q := NewBazelQuerierWithExecutor(executor.NewMockExecutor())
+	if _, err := q.DependencyPath("//app:t) union //...", "//pkg"); err == nil {
+		t.Error("expected error for invalid test label")
+	}
+	if _, err := q.DependencyPath("//app:t", "//pkg foo"); err == nil {
+		t.Error("expected error for invalid package label")
+	}
+}
+
+func TestShortestGraphPath_Chain(t *testing.T) {
+	raw := `"//t:t" -> "//a:a"
+"//a:a" -> "//b:b"
+"//b:b" -> "//pkg:lib"
+`
+	got := shortestGraphPath(raw, "//t:t", "//pkg")
+	want := []string{"//t:t", "//a:a", "//b:b", "//pkg:lib"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shortestGraphPath() = %v, want %v", got, want)
+	}
+}
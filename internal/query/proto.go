@@ -0,0 +1,222 @@
+package query
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// This file decodes the subset of Bazel's build.proto that the query layer
+// needs, directly from the protobuf wire format of
+// `--output=streamed_proto`, a sequence of length-delimited Target messages:
+//
+//	message Target {
+//	  required Discriminator type = 1;  // RULE=1 SOURCE_FILE=2 GENERATED_FILE=3
+//	  optional Rule rule = 2;
+//	  optional SourceFile source_file = 3;
+//	  optional GeneratedFile generated_file = 4;
+//	}
+//	message Rule {
+//	  required string name = 1;
+//	  required string rule_class = 2;
+//	  repeated Attribute attribute = 4;
+//	  repeated string rule_input = 5;
+//	}
+//	message Attribute {
+//	  required string name = 1;
+//	  optional string string_value = 5;       // STRING, LABEL, OUTPUT
+//	  repeated string string_list_value = 6;  // STRING_LIST, LABEL_LIST, ...
+//	}
+//	message SourceFile { required string name = 1; }
+//	message GeneratedFile { required string name = 1; required string generating_rule = 2; }
+//
+// Unknown fields are skipped, so newer Bazel versions that add fields still
+// decode. select() values are read as flattened by --proto:flatten_selects,
+// which Bazel enables by default.
+
+// Target discriminators from build.proto.
+const (
+	protoTargetRule          = 1
+	protoTargetSourceFile    = 2
+	protoTargetGeneratedFile = 3
+)
+
+// Protobuf wire types.
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+	wire32Bit  = 5
+)
+
+var errTruncatedProto = errors.New("truncated protobuf message")
+
+// protoField is a single decoded field. For wireBytes fields, bytes holds the
+// payload; for varints, num holds the value.
+type protoField struct {
+	number int
+	wire   int
+	num    uint64
+	bytes  []byte
+}
+
+// forEachField calls fn for each top-level field of the message in data.
+func forEachField(data []byte, fn func(f protoField) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncatedProto
+		}
+		data = data[n:]
+		f := protoField{number: int(tag >> 3), wire: int(tag & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.num, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncatedProto
+			}
+			data = data[n:]
+		case wire64Bit:
+			if len(data) < 8 {
+				return errTruncatedProto
+			}
+			data = data[8:]
+		case wire32Bit:
+			if len(data) < 4 {
+				return errTruncatedProto
+			}
+			data = data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errTruncatedProto
+			}
+			f.bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", f.wire)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseStreamedTargets decodes `--output=streamed_proto`: a sequence of
+// varint length-delimited Target messages.
+func parseStreamedTargets(data []byte) ([]Target, error) {
+	var targets []Target
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return nil, fmt.Errorf("parsing bazel streamed proto: %w", errTruncatedProto)
+		}
+		t, ok, err := parseTargetProto(data[n : n+int(size)])
+		if err != nil {
+			return nil, fmt.Errorf("parsing bazel streamed proto: %w", err)
+		}
+		if ok {
+			targets = append(targets, t)
+		}
+		data = data[n+int(size):]
+	}
+	return targets, nil
+}
+
+// parseTargetProto decodes a Target. ok is false for target kinds the query
+// layer does not model, such as package groups.
+func parseTargetProto(data []byte) (t Target, ok bool, err error) {
+	var kind uint64
+	var body []byte
+	err = forEachField(data, func(f protoField) error {
+		switch {
+		case f.number == 1 && f.wire == wireVarint:
+			kind = f.num
+		case f.number >= 2 && f.number <= 4 && f.wire == wireBytes:
+			body = f.bytes
+		}
+		return nil
+	})
+	if err != nil {
+		return Target{}, false, err
+	}
+
+	switch kind {
+	case protoTargetRule:
+		rule, err := parseRuleProto(body)
+		if err != nil {
+			return Target{}, false, err
+		}
+		return Target{Kind: TargetRule, Label: rule.Label, Rule: &rule}, true, nil
+	case protoTargetSourceFile:
+		t = Target{Kind: TargetSourceFile}
+	case protoTargetGeneratedFile:
+		t = Target{Kind: TargetGeneratedFile}
+	default:
+		return Target{}, false, nil
+	}
+	err = forEachField(body, func(f protoField) error {
+		switch {
+		case f.number == 1 && f.wire == wireBytes:
+			t.Label = string(f.bytes)
+		case f.number == 2 && f.wire == wireBytes && t.Kind == TargetGeneratedFile:
+			t.GeneratingRule = string(f.bytes)
+		}
+		return nil
+	})
+	return t, err == nil, err
+}
+
+func parseRuleProto(data []byte) (Rule, error) {
+	var rule Rule
+	sources := stringSet(SourceAttrs)
+	deps := stringSet(DepAttrs)
+	err := forEachField(data, func(f protoField) error {
+		if f.wire != wireBytes {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			rule.Label = string(f.bytes)
+		case 2:
+			rule.Kind = string(f.bytes)
+		case 4:
+			name, values, err := parseAttributeProto(f.bytes)
+			if err != nil {
+				return err
+			}
+			// Proto output lists every attribute of the rule class; only
+			// those with string or label values are recorded.
+			if len(values) > 0 {
+				rule.setAttr(name, values, sources, deps)
+			}
+		case 5:
+			rule.Inputs = append(rule.Inputs, string(f.bytes))
+		}
+		return nil
+	})
+	return rule, err
+}
+
+// parseAttributeProto returns an attribute's name and its string or label
+// values. Attributes of other types (integers, booleans, dicts) have none.
+func parseAttributeProto(data []byte) (name string, values []string, err error) {
+	err = forEachField(data, func(f protoField) error {
+		if f.wire != wireBytes {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			name = string(f.bytes)
+		case 5:
+			if len(f.bytes) > 0 {
+				values = append(values, string(f.bytes))
+			}
+		case 6:
+			values = append(values, string(f.bytes))
+		}
+		return nil
+	})
+	return name, values, err
+}
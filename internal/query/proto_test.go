@@ -0,0 +1,128 @@
+package query
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Minimal protobuf encoders for building build.proto fixtures.
+
+func protoTag(number, wire int) []byte {
+	return binary.AppendUvarint(nil, uint64(number<<3|wire))
+}
+
+func protoVarint(number int, v uint64) []byte {
+	return binary.AppendUvarint(protoTag(number, wireVarint), v)
+}
+
+func protoBytes(number int, payload []byte) []byte {
+	b := binary.AppendUvarint(protoTag(number, wireBytes), uint64(len(payload)))
+	return append(b, payload...)
+}
+
+func protoString(number int, s string) []byte {
+	return protoBytes(number, []byte(s))
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func protoAttr(name string, listValues ...string) []byte {
+	b := concat(protoString(1, name), protoVarint(2, 6)) // LABEL_LIST
+	for _, v := range listValues {
+		b = append(b, protoString(6, v)...)
+	}
+	return b
+}
+
+func protoRuleTarget(label, class string, attrs [][]byte, inputs ...string) []byte {
+	rule := concat(protoString(1, label), protoString(2, class))
+	for _, a := range attrs {
+		rule = append(rule, protoBytes(4, a)...)
+	}
+	// An integer attribute has no string values and must be ignored.
+	rule = append(rule, protoBytes(4, concat(protoString(1, "shard_count"), protoVarint(2, 1), protoVarint(3, 4)))...)
+	for _, in := range inputs {
+		rule = append(rule, protoString(5, in)...)
+	}
+	return concat(protoVarint(1, protoTargetRule), protoBytes(2, rule))
+}
+
+func protoSourceFileTarget(label string) []byte {
+	return concat(protoVarint(1, protoTargetSourceFile), protoBytes(3, protoString(1, label)))
+}
+
+func protoGeneratedFileTarget(label, generatingRule string) []byte {
+	return concat(protoVarint(1, protoTargetGeneratedFile),
+		protoBytes(4, concat(protoString(1, label), protoString(2, generatingRule))))
+}
+
+func streamed(targets ...[]byte) []byte {
+	var out []byte
+	for _, t := range targets {
+		out = binary.AppendUvarint(out, uint64(len(t)))
+		out = append(out, t...)
+	}
+	return out
+}
+
+var sampleTargets = [][]byte{
+	protoRuleTarget("//pkg/foo:foo_lib", "go_library",
+		[][]byte{
+			protoAttr("srcs", "//pkg/foo:foo.go", "//pkg/foo:gen.go"),
+			protoAttr("deps", "//pkg/dep:lib"),
+			concat(protoString(1, "importpath"), protoVarint(2, 2), protoString(5, "example.com/foo")),
+		},
+		"//pkg/foo:foo.go", "//pkg/foo:gen.go", "//pkg/dep:lib", "@rules_go//go:toolchain"),
+	protoSourceFileTarget("//pkg/foo:foo.go"),
+	protoGeneratedFileTarget("//pkg/foo:gen.go", "//pkg/foo:gen_rule"),
+	// Package groups are not modeled and are skipped.
+	concat(protoVarint(1, 4), protoBytes(5, protoString(1, "//pkg/foo:group"))),
+}
+
+var wantSampleTargets = []Target{
+	{
+		Kind:  TargetRule,
+		Label: "//pkg/foo:foo_lib",
+		Rule: &Rule{
+			Kind:    "go_library",
+			Label:   "//pkg/foo:foo_lib",
+			Sources: map[string][]string{"srcs": {"//pkg/foo:foo.go", "//pkg/foo:gen.go"}},
+			Deps:    map[string][]string{"deps": {"//pkg/dep:lib"}},
+			Attrs: map[string][]string{
+				"srcs":       {"//pkg/foo:foo.go", "//pkg/foo:gen.go"},
+				"deps":       {"//pkg/dep:lib"},
+				"importpath": {"example.com/foo"},
+			},
+			Inputs: []string{"//pkg/foo:foo.go", "//pkg/foo:gen.go", "//pkg/dep:lib", "@rules_go//go:toolchain"},
+		},
+	},
+	{Kind: TargetSourceFile, Label: "//pkg/foo:foo.go"},
+	{Kind: TargetGeneratedFile, Label: "//pkg/foo:gen.go", GeneratingRule: "//pkg/foo:gen_rule"},
+}
+
+func TestParseStreamedTargets(t *testing.T) {
+	got, err := parseStreamedTargets(streamed(sampleTargets...))
+	if err != nil {
+		t.Fatalf("parseStreamedTargets() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, wantSampleTargets) {
+		t.Errorf("parseStreamedTargets() = %+v, want %+v", got, wantSampleTargets)
+	}
+}
+
+func TestParseStreamedTargets_Truncated(t *testing.T) {
+	data := streamed(sampleTargets...)
+	for _, n := range []int{1, len(data) / 2, len(data) - 1} {
+		if _, err := parseStreamedTargets(data[:n]); !errors.Is(err, errTruncatedProto) {
+			t.Errorf("parseStreamedTargets(%d bytes) error = %v, want truncated", n, err)
+		}
+	}
+}
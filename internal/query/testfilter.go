@@ -0,0 +1,134 @@
+package query
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DefaultTestKind is the kind() pattern that selects test rules when no test
+// kinds are configured.
+const DefaultTestKind = ".*_test rule"
+
+// validTestKindPattern rejects kind patterns that could break out of the
+// single-quoted query string.
+var validTestKindPattern = regexp.MustCompile(`^[^'"\r\n]+$`)
+
+// validTagPattern validates tag names used in attr(tags, ...) filters.
+var validTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_.+=@~:/-]+$`)
+
+// ValidTestKind reports whether k is an accepted test kind: a regular
+// expression that cannot break out of the single-quoted kind() argument.
+func ValidTestKind(k string) bool {
+	if !validTestKindPattern.MatchString(k) {
+		return false
+	}
+	_, err := regexp.Compile(k)
+	return err == nil
+}
+
+// ValidTag reports whether t is an accepted include or exclude tag.
+func ValidTag(t string) bool {
+	return validTagPattern.MatchString(t)
+}
+
+// SetTestFilter replaces the kind('.*_test rule', ...) filter every query
+// uses to select tests. A target is a test if its kind matches one of kinds
+// (DefaultTestKind if empty), it carries at least one of includeTags (if
+// any), and none of excludeTags, mirroring Bazel's --test_tag_filters. The
+// tag filters translate to attr(tags, ...) queries, e.g. kinds
+// [".*_test rule", "sh_binary rule"] with excludeTags ["manual"] yield
+//
+//	((kind('.*_test rule', X) + kind('sh_binary rule', X)) except attr(tags, '[\[ ](manual)[,\]]', X))
+//
+// Invalid kinds and tags are skipped.
+func (q *BazelQuerier) SetTestFilter(kinds, includeTags, excludeTags []string) {
+	q.testKinds = nil
+	for _, k := range kinds {
+		if !ValidTestKind(k) {
+			slog.Warn("Skipping invalid test kind", "kind", k)
+			continue
+		}
+		q.testKinds = append(q.testKinds, k)
+	}
+	q.includeTags = validTags(includeTags)
+	q.excludeTags = validTags(excludeTags)
+}
+
+func validTags(tags []string) []string {
+	var valid []string
+	for _, t := range tags {
+		if !ValidTag(t) {
+			slog.Warn("Skipping invalid tag", "tag", t)
+			continue
+		}
+		valid = append(valid, t)
+	}
+	return valid
+}
+
+// PassesTestFilter reports whether test is a test under the configured kinds
+// and tag filters (see SetTestFilter), by applying them to the label alone:
+//
+//	kind('.*_test rule', //app:app_test)
+func (q *BazelQuerier) PassesTestFilter(test string) (bool, error) {
+	if !validRulePattern.MatchString(test) {
+		return false, fmt.Errorf("invalid test label %q", test)
+	}
+	tests, err := q.query(q.testsIn(test))
+	if err != nil {
+		return false, fmt.Errorf("failed to apply test filter to %s: %w", test, err)
+	}
+	return slices.Contains(tests, test), nil
+}
+
+// testsIn returns the query expression for the tests among the targets of
+// scope, applying the configured kinds and tag filters.
+func (q *BazelQuerier) testsIn(scope string) string {
+	kinds := q.testKinds
+	if len(kinds) == 0 {
+		kinds = []string{DefaultTestKind}
+	}
+	parts := make([]string, len(kinds))
+	for i, k := range kinds {
+		parts[i] = fmt.Sprintf("kind('%s', %s)", k, scope)
+	}
+	expr := parts[0]
+	if len(parts) > 1 {
+		expr = "(" + strings.Join(parts, " + ") + ")"
+	}
+	if len(q.includeTags) > 0 {
+		expr = fmt.Sprintf("attr(tags, '%s', %s)", tagsRegex(q.includeTags), expr)
+	}
+	if len(q.excludeTags) > 0 {
+		expr = fmt.Sprintf("(%s except attr(tags, '%s', %s))", expr, tagsRegex(q.excludeTags), scope)
+	}
+	return expr
+}
+
+// tagsRegex matches a tags attribute, rendered by Bazel as "[a, b]", that
+// contains any of tags as a whole element.
+func tagsRegex(tags []string) string {
+	quoted := make([]string, len(tags))
+	for i, t := range tags {
+		quoted[i] = regexp.QuoteMeta(t)
+	}
+	return `[\[ ](` + strings.Join(quoted, "|") + `)[,\]]`
+}
+
+// testFilterFingerprint describes the test filter for Fingerprint.
+func (q *BazelQuerier) testFilterFingerprint() string {
+	fp := "kind=" + DefaultTestKind
+	if len(q.testKinds) > 0 {
+		fp = "kind=" + strings.Join(q.testKinds, ",")
+	}
+	if len(q.includeTags) > 0 {
+		fp += " include_tags=" + strings.Join(q.includeTags, ",")
+	}
+	if len(q.excludeTags) > 0 {
+		fp += " exclude_tags=" + strings.Join(q.excludeTags, ",")
+	}
+	return fp
+}
@@ -0,0 +1,108 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+func TestTestsIn(t *testing.T) {
+	tests := []struct {
+		name                 string
+		kinds, include, excl []string
+		want                 string
+	}{
+		{"default", nil, nil, nil, "kind('.*_test rule', //a:*)"},
+		{"kinds", []string{".*_test rule", ".*_integration rule"}, nil, nil,
+			"(kind('.*_test rule', //a:*) + kind('.*_integration rule', //a:*))"},
+		{"include tags", nil, []string{"unit", "smoke"}, nil,
+			`attr(tags, '[\[ ](unit|smoke)[,\]]', kind('.*_test rule', //a:*))`},
+		{"exclude tags", nil, nil, []string{"manual", "flaky"},
+			`(kind('.*_test rule', //a:*) except attr(tags, '[\[ ](manual|flaky)[,\]]', //a:*))`},
+		{"invalid skipped", []string{"x') + //...", "sh_binary rule"}, []string{"a b"}, []string{"requires-network"},
+			`(kind('sh_binary rule', //a:*) except attr(tags, '[\[ ](requires-network)[,\]]', //a:*))`},
+		{"tag metacharacters quoted", nil, nil, []string{"cpu:4.x"},
+			`(kind('.*_test rule', //a:*) except attr(tags, '[\[ ](cpu:4\.x)[,\]]', //a:*))`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewBazelQuerierWithExecutor(executor.NewMockExecutor())
+			q.SetTestFilter(tt.kinds, tt.include, tt.excl)
+			if got := q.testsIn("//a:*"); got != tt.want {
+				t.Errorf("testsIn() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAffectedTests_TestFilter(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query",
+		`(kind('.*_test rule', //pkg/foo:*) except attr(tags, '[\[ ](manual)[,\]]', //pkg/foo:*))`).
+		WillSucceed("//pkg/foo:foo_test", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		`rdeps(//..., //pkg/foo:*) intersect (kind('.*_test rule', //...) except attr(tags, '[\[ ](manual)[,\]]', //...))`).
+		WillSucceed("//app:app_test", 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetEnableSubpackageQuery(false)
+	q.SetTestFilter(nil, nil, []string{"manual"})
+
+	got, err := q.FindAffectedTests([]string{"//pkg/foo"})
+	if err != nil {
+		t.Fatalf("FindAffectedTests() error = %v", err)
+	}
+	if want := []string{"//app:app_test", "//pkg/foo:foo_test"}; !reflect.DeepEqual(sortedUnique(got), want) {
+		t.Errorf("FindAffectedTests() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestFingerprint_TestFilter(t *testing.T) {
+	q := NewBazelQuerierWithExecutor(executor.NewMockExecutor())
+	base := q.Fingerprint()
+	q.SetTestFilter([]string{DefaultTestKind}, nil, nil)
+	if q.Fingerprint() != base {
+		t.Error("Fingerprint() should not change with the default test kind")
+	}
+	q.SetTestFilter(nil, nil, []string{"manual"})
+	excluded := q.Fingerprint()
+	if excluded == base {
+		t.Error("Fingerprint() should change with exclude tags")
+	}
+	q.SetTestFilter(nil, []string{"manual"}, nil)
+	if q.Fingerprint() == excluded {
+		t.Error("Fingerprint() should distinguish include from exclude tags")
+	}
+}
+
+func TestPassesTestFilter(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query",
+		`(kind('.*_test rule', //app:manual_test) except attr(tags, '[\[ ](manual)[,\]]', //app:manual_test))`).
+		WillSucceed("", 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetTestFilter(nil, nil, []string{"manual"})
+
+	ok, err := q.PassesTestFilter("//app:manual_test")
+	if err != nil {
+		t.Fatalf("PassesTestFilter() error = %v", err)
+	}
+	if ok {
+		t.Error("PassesTestFilter() = true for a test removed by exclude tags")
+	}
+	if _, err := q.PassesTestFilter("//app:a b"); err == nil {
+		t.Error("PassesTestFilter() should reject labels with spaces")
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package query
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Test sizes and timeouts in increasing order, as accepted by Bazel's size
+// and timeout test attributes. The timeout at an index is the default for the
+// size at the same index.
+var (
+	testSizes    = []string{"small", "medium", "large", "enormous"}
+	testTimeouts = []string{"short", "moderate", "long", "eternal"}
+)
+
+// defaultTestSize is the size Bazel assumes for a test without one.
+const defaultTestSize = "medium"
+
+// TestSize holds the size and effective timeout of a test.
+type TestSize struct {
+	Size    string
+	Timeout string
+}
+
+// QueryTestSizes returns the size and timeout of each test label, read from
+// the size and timeout attributes with QueryRules. A test without a size is
+// medium, and one without a timeout gets the default of its size (small ->
+// short, medium -> moderate, large -> long, enormous -> eternal), as in
+// Bazel. Invalid labels are skipped.
+func (q *BazelQuerier) QueryTestSizes(tests []string) (map[string]TestSize, error) {
+	var labels []string
+	for _, t := range sortedUnique(tests) {
+		if !validRulePattern.MatchString(t) {
+			slog.Warn("Skipping invalid test label", "test", t)
+			continue
+		}
+		labels = append(labels, t)
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	rules, err := q.QueryRules(fmt.Sprintf("set(%s)", strings.Join(labels, " ")))
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]TestSize, len(rules))
+	for _, r := range rules {
+		sizes[r.Label] = ruleTestSize(r)
+	}
+	return sizes, nil
+}
+
+func ruleTestSize(r Rule) TestSize {
+	ts := TestSize{Size: defaultTestSize}
+	if v := r.Attrs["size"]; len(v) > 0 && SizeRank(v[0]) >= 0 {
+		ts.Size = v[0]
+	}
+	if v := r.Attrs["timeout"]; len(v) > 0 && TimeoutRank(v[0]) >= 0 {
+		ts.Timeout = v[0]
+	} else {
+		ts.Timeout = testTimeouts[SizeRank(ts.Size)]
+	}
+	return ts
+}
+
+// TestSizes returns the test sizes in increasing order.
+func TestSizes() []string {
+	return slices.Clone(testSizes)
+}
+
+// TestTimeouts returns the test timeouts in increasing order.
+func TestTimeouts() []string {
+	return slices.Clone(testTimeouts)
+}
+
+// SizeRank returns the position of size in small < medium < large <
+// enormous, or -1 if it is not a test size.
+func SizeRank(size string) int {
+	return rank(testSizes, size)
+}
+
+// TimeoutRank returns the position of timeout in short < moderate < long <
+// eternal, or -1 if it is not a test timeout.
+func TimeoutRank(timeout string) int {
+	return rank(testTimeouts, timeout)
+}
+
+func rank(ordered []string, value string) int {
+	for i, v := range ordered {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
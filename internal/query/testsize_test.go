@@ -0,0 +1,54 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+func protoStringAttr(name, value string) []byte {
+	return concat(protoString(1, name), protoVarint(2, 3), protoString(5, value)) // STRING
+}
+
+func TestQueryTestSizes(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--output=streamed_proto",
+		"set(//a:default_test //a:large_test //a:small_long_test)").
+		WillSucceed(string(streamed(
+			protoRuleTarget("//a:default_test", "go_test", nil),
+			protoRuleTarget("//a:large_test", "go_test", [][]byte{protoStringAttr("size", "large")}),
+			protoRuleTarget("//a:small_long_test", "sh_test", [][]byte{
+				protoStringAttr("size", "small"),
+				protoStringAttr("timeout", "long"),
+			}),
+		)), 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+
+	got, err := q.QueryTestSizes([]string{"//a:small_long_test", "//a:large_test", "//a:default_test", "//a:bad label"})
+	if err != nil {
+		t.Fatalf("QueryTestSizes() error = %v", err)
+	}
+	want := map[string]TestSize{
+		"//a:default_test":    {Size: "medium", Timeout: "moderate"},
+		"//a:large_test":      {Size: "large", Timeout: "long"},
+		"//a:small_long_test": {Size: "small", Timeout: "long"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryTestSizes() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}
+
+func TestSizeAndTimeoutRank(t *testing.T) {
+	if SizeRank("small") >= SizeRank("enormous") || SizeRank("tiny") != -1 {
+		t.Error("SizeRank() does not order small before enormous or accepts unknown sizes")
+	}
+	if TimeoutRank("short") >= TimeoutRank("moderate") || TimeoutRank("") != -1 {
+		t.Error("TimeoutRank() does not order short before moderate or accepts unknown timeouts")
+	}
+}
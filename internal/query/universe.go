@@ -0,0 +1,60 @@
+package query
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// DefaultUniverse is the target pattern rdeps queries and the test-kind
+// filter range over when no universe is configured.
+const DefaultUniverse = "//..."
+
+// validUniversePattern validates universe entries: a main-repository target
+// pattern, optionally prefixed with - to exclude it.
+var validUniversePattern = regexp.MustCompile(`^-?//[a-zA-Z0-9_./-]*(:[a-zA-Z0-9_./+=,@~*-]+)?$`)
+
+// ValidUniversePattern reports whether p is an accepted universe entry.
+func ValidUniversePattern(p string) bool {
+	return validUniversePattern.MatchString(p)
+}
+
+// SetUniverse scopes the rdeps queries and their test-kind filter to
+// patterns instead of DefaultUniverse. Patterns prefixed with - are excluded,
+// e.g. ["//...", "-//third_party/..."] yields the query expression
+//
+//	(//... - //third_party/...)
+//
+// Invalid patterns are skipped. With no included pattern left, exclusions
+// apply to DefaultUniverse.
+func (q *BazelQuerier) SetUniverse(patterns []string) {
+	var include, exclude []string
+	for _, p := range patterns {
+		if !validUniversePattern.MatchString(p) {
+			slog.Warn("Skipping invalid universe pattern", "pattern", p)
+			continue
+		}
+		if excluded, ok := strings.CutPrefix(p, "-"); ok {
+			exclude = append(exclude, excluded)
+		} else {
+			include = append(include, p)
+		}
+	}
+	if len(include) == 0 {
+		include = []string{DefaultUniverse}
+	}
+
+	q.universeScope = strings.Join(include, ",")
+	for _, p := range exclude {
+		q.universeScope += ",-" + p
+	}
+	if len(include) == 1 && len(exclude) == 0 {
+		q.universe = include[0]
+		return
+	}
+	expr := strings.Join(include, " + ")
+	for _, p := range exclude {
+		expr += " - " + p
+	}
+	q.universe = "(" + expr + ")"
+}
@@ -0,0 +1,77 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	executor "github.com/jaeyeom/go-cmdexec"
+)
+
+func TestSetUniverse(t *testing.T) {
+	tests := []struct {
+		name      string
+		patterns  []string
+		wantExpr  string
+		wantScope string
+	}{
+		{"default", nil, "//...", "//..."},
+		{"single pattern", []string{"//src/..."}, "//src/...", "//src/..."},
+		{"exclusions", []string{"//...", "-//third_party/...", "-//experimental/..."},
+			"(//... - //third_party/... - //experimental/...)", "//...,-//third_party/...,-//experimental/..."},
+		{"several includes", []string{"//src/...", "//lib/..."}, "(//src/... + //lib/...)", "//src/...,//lib/..."},
+		{"only exclusions", []string{"-//third_party/..."}, "(//... - //third_party/...)", "//...,-//third_party/..."},
+		{"invalid skipped", []string{"//src/...", "//x) union (//y"}, "//src/...", "//src/..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewBazelQuerierWithExecutor(executor.NewMockExecutor())
+			q.SetUniverse(tt.patterns)
+			if q.universe != tt.wantExpr || q.universeScope != tt.wantScope {
+				t.Errorf("SetUniverse(%v) = %q, %q, want %q, %q", tt.patterns, q.universe, q.universeScope, tt.wantExpr, tt.wantScope)
+			}
+		})
+	}
+}
+
+func TestValidUniversePattern(t *testing.T) {
+	for _, p := range []string{"//...", "-//third_party/...", "//src:all", "//src:*", "//"} {
+		if !ValidUniversePattern(p) {
+			t.Errorf("ValidUniversePattern(%q) = false, want true", p)
+		}
+	}
+	for _, p := range []string{"", "src/...", "--//x", "//x y", "//x'", "@ext//..."} {
+		if ValidUniversePattern(p) {
+			t.Errorf("ValidUniversePattern(%q) = true, want false", p)
+		}
+	}
+}
+
+func TestFindAffectedTests_Universe(t *testing.T) {
+	mockExec := executor.NewMockExecutor()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', //pkg/foo:*)").
+		WillSucceed("//pkg/foo:foo_test", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "kind('.*_test rule', //pkg/foo/...)").
+		WillSucceed("", 0).
+		Once().
+		Build()
+	mockExec.ExpectCommandWithArgs("bazel", "query", "--keep_going", "--nohost_deps", "--noimplicit_deps",
+		"rdeps((//... - //third_party/...), //pkg/foo:*) intersect kind('.*_test rule', (//... - //third_party/...))").
+		WillSucceed("//app:app_test", 0).
+		Once().
+		Build()
+	q := NewBazelQuerierWithExecutor(mockExec)
+	q.SetUniverse([]string{"//...", "-//third_party/..."})
+
+	got, err := q.FindAffectedTests([]string{"//pkg/foo"})
+	if err != nil {
+		t.Fatalf("FindAffectedTests() error = %v", err)
+	}
+	if want := []string{"//app:app_test", "//pkg/foo:foo_test"}; !reflect.DeepEqual(sortedUnique(got), want) {
+		t.Errorf("FindAffectedTests() = %v, want %v", got, want)
+	}
+	if err := mockExec.AssertExpectationsMet(); err != nil {
+		t.Errorf("Mock expectations not met: %v", err)
+	}
+}